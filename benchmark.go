@@ -1,6 +1,7 @@
 package paxi
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
 	"sync"
@@ -12,11 +13,16 @@ import (
 // DB is general interface implemented by client to call client library
 type DB interface {
 	Init() error
-	Read(key int) ([]byte, error)
-	Write(key int, value []byte) error
+	Read(key Key) ([]byte, error)
+	Write(key Key, value []byte) error
 	Stop() error
 }
 
+// TxnDB is implemented by clients that run multi-key transactions, required by the transactional workload
+type TxnDB interface {
+	Txn(cmds []Command) ([]Value, error)
+}
+
 // Bconfig holds all benchmark configuration
 type Bconfig struct {
 	T                    int     // total number of running time in seconds
@@ -46,7 +52,9 @@ type Bconfig struct {
 	// exponential distribution
 	Lambda float64 // rate parameter
 
-	Size int // payload size
+	Size      int    // payload size
+	KeyFormat string // printf format of generated integer keys, decimal if empty
+	TxnSize   int    // number of keys of each transaction, single key operations if less than 2
 }
 
 // DefaultBConfig returns a default benchmark config
@@ -109,7 +117,7 @@ func (b *Benchmark) Load() {
 	b.Throttle = 0
 
 	b.db.Init()
-	keys := make(chan int, b.Concurrency)
+	keys := make(chan []int, b.Concurrency)
 	latencies := make(chan time.Duration, 1000)
 	defer close(latencies)
 	go b.collect(latencies)
@@ -120,7 +128,7 @@ func (b *Benchmark) Load() {
 	}
 	for i := b.Min; i < b.Min+b.K; i++ {
 		b.wait.Add(1)
-		keys <- i
+		keys <- []int{i}
 	}
 	t := time.Now().Sub(b.startTime)
 
@@ -143,8 +151,12 @@ func (b *Benchmark) Run() {
 		defer close(stop)
 	}
 
+	if _, ok := b.db.(TxnDB); b.TxnSize > 1 && !ok {
+		log.Fatal("transactional workload needs a client that supports transactions")
+	}
+
 	b.latency = make([]time.Duration, 0)
-	keys := make(chan int, b.Concurrency)
+	keys := make(chan []int, b.Concurrency)
 	latencies := make(chan time.Duration, 1000)
 	defer close(latencies)
 	go b.collect(latencies)
@@ -164,13 +176,13 @@ func (b *Benchmark) Run() {
 				break loop
 			default:
 				b.wait.Add(1)
-				keys <- b.next()
+				keys <- b.nextKeys()
 			}
 		}
 	} else {
 		for i := 0; i < b.N; i++ {
 			b.wait.Add(1)
-			keys <- b.next()
+			keys <- b.nextKeys()
 		}
 		b.wait.Wait()
 	}
@@ -201,6 +213,27 @@ func (b *Benchmark) Run() {
 	}
 }
 
+// nextKeys generates keys of the next operation, TxnSize different keys in transactional workload
+func (b *Benchmark) nextKeys() []int {
+	n := 1
+	if b.TxnSize > 1 {
+		n = b.TxnSize
+	}
+	if n > b.K {
+		n = b.K
+	}
+	keys := make([]int, 0, n)
+	exists := make(map[int]bool, n)
+	for len(keys) < n {
+		k := b.next()
+		if !exists[k] {
+			exists[k] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
 // generates key based on distribution
 func (b *Benchmark) next() int {
 	var key int
@@ -246,12 +279,25 @@ func (b *Benchmark) next() int {
 	return key
 }
 
-func (b *Benchmark) worker(keys <-chan int, result chan<- time.Duration) {
+// key formats generated integer key i with KeyFormat
+func (b *Benchmark) key(i int) Key {
+	if b.KeyFormat == "" {
+		return IntKey(i)
+	}
+	return Key(fmt.Sprintf(b.KeyFormat, i))
+}
+
+func (b *Benchmark) worker(keys <-chan []int, result chan<- time.Duration) {
 	var s time.Time
 	var e time.Time
 	var v []byte
 	var err error
-	for k := range keys {
+	for ks := range keys {
+		if len(ks) > 1 {
+			b.txn(ks, result)
+			continue
+		}
+		k := b.key(ks[0])
 		op := new(operation)
 		if rand.Float64() < b.W {
 			v = GenerateRandVal(b.Bconfig.Size)
@@ -281,6 +327,40 @@ func (b *Benchmark) worker(keys <-chan int, result chan<- time.Duration) {
 	}
 }
 
+// txn runs a transaction that reads or writes every key of ks by the write ratio
+func (b *Benchmark) txn(ks []int, result chan<- time.Duration) {
+	cmds := make([]Command, len(ks))
+	ops := make([]*operation, len(ks))
+	for i, k := range ks {
+		cmds[i] = Command{Key: b.key(k), Op: Get}
+		ops[i] = new(operation)
+		if rand.Float64() < b.W {
+			cmds[i].Op = Put
+			cmds[i].Value = GenerateRandVal(b.Bconfig.Size)
+			ops[i].input = cmds[i].Value
+		}
+	}
+	s := time.Now()
+	values, err := b.db.(TxnDB).Txn(cmds)
+	e := time.Now()
+	for i, op := range ops {
+		op.start = s.Sub(b.startTime).Nanoseconds()
+		op.end = math.MaxInt64
+		if err == nil {
+			op.end = e.Sub(b.startTime).Nanoseconds()
+			if cmds[i].Op == Get && i < len(values) && len(values[i]) > 0 {
+				op.output = values[i]
+			}
+		}
+		b.History.AddOperation(cmds[i].Key, op)
+	}
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	result <- e.Sub(s)
+}
+
 func (b *Benchmark) collect(latencies <-chan time.Duration) {
 	for t := range latencies {
 		b.latency = append(b.latency, t)
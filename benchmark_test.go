@@ -1,6 +1,7 @@
 package paxi
 
 import (
+	"strconv"
 	"sync"
 	"testing"
 
@@ -25,8 +26,9 @@ func (f *FakeDB) Stop() error {
 	return nil
 }
 
-func (f *FakeDB) Read(key int) ([]byte, error) {
+func (f *FakeDB) Read(k Key) ([]byte, error) {
 	//log.Debugf("Read %d", key)
+	key, _ := strconv.Atoi(string(k))
 	f.lock.Lock()
 	f.total++
 	if key >= f.start && key <= f.end {
@@ -38,8 +40,9 @@ func (f *FakeDB) Read(key int) ([]byte, error) {
 	return b, nil
 }
 
-func (f *FakeDB) Write(key int, value []byte) error {
+func (f *FakeDB) Write(k Key, value []byte) error {
 	//log.Debugf("Write %d", key)
+	key, _ := strconv.Atoi(string(k))
 	f.lock.Lock()
 	f.total++
 	if key >= f.start && key <= f.end {
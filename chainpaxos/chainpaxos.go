@@ -10,24 +10,14 @@ import (
 	"sync"
 )
 
-// entry in log
-type entry struct {
-	ballot    paxi.Ballot
-	command   paxi.Command
-	commit    bool
-	request   *paxi.Request
-	quorum    *paxi.Quorum
-	timestamp time.Time
-}
-
 // Paxos instance
 type ChainPaxos struct {
 	paxi.Node
 
 	// log management variables
-	log               map[int]*entry // log ordered by slot
-	slot              int            // highest slot number
-	execute           int            // next execute slot number
+	log               map[int]*paxi.Entry // log ordered by slot
+	slot              int                 // highest slot number
+	execute           int                 // next execute slot number
 	lastCleanupMarker int
 	globalExecute     int             // executed by all nodes. Need for log cleanup
 	executeByNode     map[paxi.ID]int // leader's knowledge of other nodes execute counter. Need for log cleanup
@@ -43,6 +33,10 @@ type ChainPaxos struct {
 	p3pendingSlots  []int
 	lastP3Time      int64
 
+	recovering bool // replaying write-ahead log, committed slots are already durable
+
+	handover *paxi.Handover // leadership transfer and placement
+
 	// Quorums
 	Q1              func(*paxi.Quorum) bool
 	Q2              func(*paxi.Quorum) bool
@@ -58,25 +52,53 @@ type ChainPaxos struct {
 func NewChainPaxos(n paxi.Node, options ...func(*ChainPaxos)) *ChainPaxos {
 	p := &ChainPaxos{
 		Node:            n,
-		log:             make(map[int]*entry, paxi.GetConfig().BufferSize),
+		log:             make(map[int]*paxi.Entry, paxi.GetConfig().BufferSize),
 		slot:            -1,
 		quorum:          paxi.NewQuorum(),
 		requests:        make([]*paxi.Request, 0),
 		p3pendingSlots:  make([]int, 0, 100),
 		executeByNode:   make(map[paxi.ID]int, 0),
 		lastP3Time:      0,
-		Q1:              func(q *paxi.Quorum) bool { return q.Majority() },
-		Q2:              func(q *paxi.Quorum) bool { return q.Majority() },
+		Q1:              func(q *paxi.Quorum) bool { return q.Q1() },
+		Q2:              func(q *paxi.Quorum) bool { return q.Q2() },
 		ReplyWhenCommit: false,
 	}
 
+	p.handover = paxi.NewHandover(n.ID())
+
 	for _, opt := range options {
 		opt(p)
 	}
 
+	p.recover()
+
 	return p
 }
 
+// recover restores the last snapshot, rebuilds promised ballot and accepted log from the
+// write-ahead log and re-executes all committed slots after the snapshot against the state machine
+func (p *ChainPaxos) recover() {
+	p.recovering = true
+	defer func() { p.recovering = false }()
+	p.logLck.Lock()
+	s, ballot, slot, err := paxi.ReplayWAL(p.WAL(), p.log)
+	if err != nil {
+		log.Fatalf("Replica %s cannot replay write-ahead log: %v", p.ID(), err)
+	}
+	p.ballot = ballot
+	p.slot = slot
+	if s != nil {
+		if err := p.Node.Restore(s.Data); err != nil {
+			log.Fatalf("Replica %s cannot restore %v: %v", p.ID(), s, err)
+		}
+		p.execute = s.Slot + 1
+		p.lastCleanupMarker = s.Slot + 1
+	}
+	p.logLck.Unlock()
+	log.Infof("Replica %s recovered ballot %v and log up to slot %d", p.ID(), p.ballot, p.slot)
+	p.exec()
+}
+
 // IsLeader indicates if this node is current leader
 func (p *ChainPaxos) IsLeader() bool {
 	return p.active || p.ballot.ID() == p.ID()
@@ -87,12 +109,15 @@ func (p *ChainPaxos) CheckTimeout(timeout int64) {
 	defer p.logLck.RUnlock()
 	execslot := p.execute
 	if p.active && execslot <= p.slot {
-		if e, ok := p.log[execslot]; ok && !e.commit {
-			if e.timestamp.UnixNano() < timeout {
-				log.Debugf("Retrying p2. entry_time = %d, retry time = %d", e.timestamp, timeout)
+		if e, ok := p.log[execslot]; ok && !e.Commit {
+			if e.Timestamp.UnixNano() < timeout {
+				log.Debugf("Retrying p2. entry_time = %d, retry time = %d", e.Timestamp, timeout)
 				p.RetryP2a(execslot, e)
 			}
 		}
+	} else if !p.active && p.handover.Pending() {
+		// this node handed leadership over and leads again if the target does not take over
+		p.CheckTransfer(time.Now())
 	} else if !p.active && p.p1aTime < timeout {
 		log.Debugf("Retrying p1. p1time = %d, retry time = %d", p.p1aTime, timeout)
 		p.RetryP1a()
@@ -172,6 +197,7 @@ func (p *ChainPaxos) HandleRequest(r paxi.Request) {
 			p.P1a()
 		}
 	} else {
+		p.handover.Hit(r.NodeID)
 		p.P2a(&r)
 	}
 }
@@ -182,7 +208,14 @@ func (p *ChainPaxos) P1a() {
 	if p.active {
 		return
 	}
-	p.ballot.Next(p.ID())
+	p.handover.Stop()
+	// the next ballot is used only once it is durable
+	b := p.ballot
+	b.Next(p.ID())
+	if !paxi.PersistPromise(p.WAL(), p.ID(), b) {
+		return
+	}
+	p.ballot = b
 	p.quorum.Reset()
 	p.quorum.ACK(p.ID())
 	p.p1aTime = time.Now().UnixNano()
@@ -206,14 +239,14 @@ func (p *ChainPaxos) P2a(r *paxi.Request) {
 	log.Debugf("Node %v etering P2a with slot %d", p.ID(), p.slot)
 	p.logLck.Lock()
 	p.slot++
-	p.log[p.slot] = &entry{
-		ballot:    p.ballot,
-		command:   r.Command,
-		request:   r,
-		quorum:    paxi.NewQuorum(),
-		timestamp: time.Now(),
-	}
-	p.log[p.slot].quorum.ACK(p.ID())
+	p.log[p.slot] = &paxi.Entry{
+		Ballot:    p.ballot,
+		Commands:  []paxi.Command{r.Command},
+		Requests:  []*paxi.Request{r},
+		Quorum:    paxi.NewQuorum(),
+		Timestamp: time.Now(),
+	}
+	p.log[p.slot].Quorum.ACK(p.ID())
 	m := P2a{
 		Ballot:        p.ballot,
 		Slot:          p.slot,
@@ -221,6 +254,9 @@ func (p *ChainPaxos) P2a(r *paxi.Request) {
 		GlobalExecute: p.globalExecute,
 	}
 	p.logLck.Unlock()
+	if !paxi.PersistAccept(p.WAL(), p.ID(), m.Slot, m.Ballot, m.Command) {
+		return
+	}
 	p.p3Lock.Lock()
 	if p.p3PendingBallot > 0 {
 		m.P3msg = P3{Ballot: p.p3PendingBallot, Slot: p.p3pendingSlots}
@@ -237,12 +273,12 @@ func (p *ChainPaxos) P2a(r *paxi.Request) {
 	log.Debugf("Leaving P2a with slot %d", p.slot)
 }
 
-func (p *ChainPaxos) RetryP2a(slot int, e *entry) {
+func (p *ChainPaxos) RetryP2a(slot int, e *paxi.Entry) {
 	log.Debugf("Entering RetryP2a with slot %d", slot)
 	m := P2a{
 		Ballot:        p.ballot,
 		Slot:          slot,
-		Command:       e.command,
+		Command:       e.Command(),
 		GlobalExecute: p.globalExecute,
 	}
 	if paxi.GetConfig().Thrifty {
@@ -259,6 +295,10 @@ func (p *ChainPaxos) HandleP1a(m P1a, reply paxi.ID) {
 
 	// new leader
 	if m.Ballot > p.ballot {
+		// the ballot is promised only once it is durable, so a retried P1a does not get a P1b on a lost promise
+		if !paxi.PersistPromise(p.WAL(), p.ID(), m.Ballot) {
+			return
+		}
 		p.ballot = m.Ballot
 		p.active = false
 		p.forward()
@@ -267,10 +307,10 @@ func (p *ChainPaxos) HandleP1a(m P1a, reply paxi.ID) {
 	l := make(map[int]CommandBallot)
 	p.logLck.RLock()
 	for s := p.execute; s <= p.slot; s++ {
-		if p.log[s] == nil || p.log[s].commit {
+		if p.log[s] == nil || p.log[s].Commit {
 			continue
 		}
-		l[s] = CommandBallot{p.log[s].command, p.log[s].ballot}
+		l[s] = CommandBallot{p.log[s].Command(), p.log[s].Ballot}
 	}
 	p.logLck.RUnlock()
 
@@ -288,15 +328,15 @@ func (p *ChainPaxos) update(scb map[int]CommandBallot) {
 	for s, cb := range scb {
 		p.slot = paxi.Max(p.slot, s)
 		if e, exists := p.log[s]; exists {
-			if !e.commit && cb.Ballot > e.ballot {
-				e.ballot = cb.Ballot
-				e.command = cb.Command
+			if !e.Commit && cb.Ballot > e.Ballot {
+				e.Ballot = cb.Ballot
+				e.Commands = []paxi.Command{cb.Command}
 			}
 		} else {
-			p.log[s] = &entry{
-				ballot:  cb.Ballot,
-				command: cb.Command,
-				commit:  false,
+			p.log[s] = &paxi.Entry{
+				Ballot:   cb.Ballot,
+				Commands: []paxi.Command{cb.Command},
+				Commit:   false,
 			}
 		}
 	}
@@ -304,6 +344,7 @@ func (p *ChainPaxos) update(scb map[int]CommandBallot) {
 
 // HandleP1b handles P1b message
 func (p *ChainPaxos) HandleP1b(m P1b) {
+	p.handover.Heard(m.ID)
 	// old message
 	if m.Ballot < p.ballot || p.active {
 		return
@@ -330,16 +371,19 @@ func (p *ChainPaxos) HandleP1b(m P1b) {
 			p.logLck.Lock()
 			for i := p.execute; i <= p.slot; i++ {
 				// TODO nil gap?
-				if p.log[i] == nil || p.log[i].commit {
+				if p.log[i] == nil || p.log[i].Commit {
+					continue
+				}
+				p.log[i].Ballot = p.ballot
+				p.log[i].Quorum = paxi.NewQuorum()
+				p.log[i].Quorum.ACK(p.ID())
+				if !paxi.PersistAccept(p.WAL(), p.ID(), i, p.ballot, p.log[i].Command()) {
 					continue
 				}
-				p.log[i].ballot = p.ballot
-				p.log[i].quorum = paxi.NewQuorum()
-				p.log[i].quorum.ACK(p.ID())
 				p.Broadcast(P2a{
 					Ballot:        p.ballot,
 					Slot:          i,
-					Command:       p.log[i].command,
+					Command:       p.log[i].Command(),
 					GlobalExecute: p.globalExecute,
 				})
 			}
@@ -366,28 +410,32 @@ func (p *ChainPaxos) HandleP2a(m P2a, reply paxi.ID) {
 		p.slot = paxi.Max(p.slot, m.Slot)
 		// update entry
 		if e, exists := p.log[m.Slot]; exists {
-			if !e.commit && m.Ballot > e.ballot {
+			if !e.Commit && m.Ballot > e.Ballot {
 				// different command and request is not nil
-				if !e.command.Equal(m.Command) && e.request != nil {
-					p.Forward(m.Ballot.ID(), *e.request)
-					// p.Retry(*e.request)
-					e.request = nil
+				if !e.Command().Equal(m.Command) && e.Request() != nil {
+					p.Forward(m.Ballot.ID(), *e.Request())
+					// p.Retry(*e.Request())
+					e.Requests = nil
 				}
-				e.command = m.Command
-				e.ballot = m.Ballot
-			} else if e.commit && e.ballot == 0 {
+				e.Commands = []paxi.Command{m.Command}
+				e.Ballot = m.Ballot
+			} else if e.Commit && e.Ballot == 0 {
 				// we can have commit slot with no ballot when we received P3 before P2a
-				e.command = m.Command
-				e.ballot = m.Ballot
+				e.Commands = []paxi.Command{m.Command}
+				e.Ballot = m.Ballot
 			}
 		} else {
-			p.log[m.Slot] = &entry{
-				ballot:  m.Ballot,
-				command: m.Command,
-				commit:  false,
+			p.log[m.Slot] = &paxi.Entry{
+				Ballot:   m.Ballot,
+				Commands: []paxi.Command{m.Command},
+				Commit:   false,
 			}
 		}
 		p.logLck.Unlock()
+		// accepted value must be durable before it is acknowledged
+		if !paxi.PersistAccept(p.WAL(), p.ID(), m.Slot, m.Ballot, m.Command) {
+			return
+		}
 	}
 
 	idList := make([]paxi.ID, 1, 1)
@@ -421,28 +469,32 @@ func (p *ChainPaxos) HandleP2aChain(m P2aChain) {
 		p.slot = paxi.Max(p.slot, m.Slot)
 		// update entry
 		if e, exists := p.log[m.Slot]; exists {
-			if !e.commit && m.Ballot > e.ballot {
+			if !e.Commit && m.Ballot > e.Ballot {
 				// different command and request is not nil
-				if !e.command.Equal(m.Command) && e.request != nil {
-					p.Forward(m.Ballot.ID(), *e.request)
-					// p.Retry(*e.request)
-					e.request = nil
+				if !e.Command().Equal(m.Command) && e.Request() != nil {
+					p.Forward(m.Ballot.ID(), *e.Request())
+					// p.Retry(*e.Request())
+					e.Requests = nil
 				}
-				e.command = m.Command
-				e.ballot = m.Ballot
-			} else if e.commit && e.ballot == 0 {
+				e.Commands = []paxi.Command{m.Command}
+				e.Ballot = m.Ballot
+			} else if e.Commit && e.Ballot == 0 {
 				// we can have commit slot with no ballot when we received P3 before P2a
-				e.command = m.Command
-				e.ballot = m.Ballot
+				e.Commands = []paxi.Command{m.Command}
+				e.Ballot = m.Ballot
 			}
 		} else {
-			p.log[m.Slot] = &entry{
-				ballot:  m.Ballot,
-				command: m.Command,
-				commit:  false,
+			p.log[m.Slot] = &paxi.Entry{
+				Ballot:   m.Ballot,
+				Commands: []paxi.Command{m.Command},
+				Commit:   false,
 			}
 		}
 		p.logLck.Unlock()
+		// accepted value must be durable before it is acknowledged
+		if !paxi.PersistAccept(p.WAL(), p.ID(), m.Slot, m.Ballot, m.Command) {
+			return
+		}
 	}
 
 	if len(m.P3msg.Slot) > 0 {
@@ -465,28 +517,32 @@ func (p *ChainPaxos) HandleP2aChainTail(m P2aChain, next paxi.ID) {
 		p.slot = paxi.Max(p.slot, m.Slot)
 		// update entry
 		if e, exists := p.log[m.Slot]; exists {
-			if !e.commit && m.Ballot > e.ballot {
+			if !e.Commit && m.Ballot > e.Ballot {
 				// different command and request is not nil
-				if !e.command.Equal(m.Command) && e.request != nil {
-					p.Forward(m.Ballot.ID(), *e.request)
-					// p.Retry(*e.request)
-					e.request = nil
+				if !e.Command().Equal(m.Command) && e.Request() != nil {
+					p.Forward(m.Ballot.ID(), *e.Request())
+					// p.Retry(*e.Request())
+					e.Requests = nil
 				}
-				e.command = m.Command
-				e.ballot = m.Ballot
-			} else if e.commit && e.ballot == 0 {
+				e.Commands = []paxi.Command{m.Command}
+				e.Ballot = m.Ballot
+			} else if e.Commit && e.Ballot == 0 {
 				// we can have commit slot with no ballot when we received P3 before P2a
-				e.command = m.Command
-				e.ballot = m.Ballot
+				e.Commands = []paxi.Command{m.Command}
+				e.Ballot = m.Ballot
 			}
 		} else {
-			p.log[m.Slot] = &entry{
-				ballot:  m.Ballot,
-				command: m.Command,
-				commit:  false,
+			p.log[m.Slot] = &paxi.Entry{
+				Ballot:   m.Ballot,
+				Commands: []paxi.Command{m.Command},
+				Commit:   false,
 			}
 		}
 		p.logLck.Unlock()
+		// accepted value must be durable before it is acknowledged
+		if !paxi.PersistAccept(p.WAL(), p.ID(), m.Slot, m.Ballot, m.Command) {
+			return
+		}
 	}
 
 	idList := make([]paxi.ID, 1, 1)
@@ -515,11 +571,12 @@ func (p *ChainPaxos) HandleP2aChainTail(m P2aChain, next paxi.ID) {
 // HandleP2b handles P2b message
 func (p *ChainPaxos) HandleP2b(msgSlot int, msgBallot paxi.Ballot, votedIds []paxi.ID) {
 	log.Debugf("Entering HandleP2b: ===[bal: %v, slot: %d, votes: %v]===>>> %s", msgBallot, msgSlot, votedIds, p.ID())
+	p.handover.Heard(votedIds...)
 	// old message
 	p.logLck.RLock()
 	entry, exist := p.log[msgSlot]
 	p.logLck.RUnlock()
-	if !exist || msgBallot < entry.ballot || entry.commit {
+	if !exist || msgBallot < entry.Ballot || entry.Commit {
 		return
 	}
 	// reject message
@@ -542,15 +599,15 @@ func (p *ChainPaxos) HandleP2b(msgSlot int, msgBallot paxi.Ballot, votedIds []pa
 	// ack message
 	// the current slot might still be committed with q2
 	// if no q2 can be formed, this slot will be retried when received p2a or p3
-	if msgBallot.ID() == p.ID() && msgBallot == entry.ballot {
+	if msgBallot.ID() == p.ID() && msgBallot == entry.Ballot {
 		for _, id := range votedIds {
-			entry.quorum.ACK(id)
+			entry.Quorum.ACK(id)
 		}
 
-		if p.Q2(entry.quorum) {
-			entry.commit = true
+		if p.Q2(entry.Quorum) {
+			entry.Commit = true
 			if paxi.GetConfig().UseRetroLog {
-				slotStruct := retro_log.NewRqlStruct(nil).AddVarInt32("slot", msgSlot).AddVarStr("hash", entry.command.Hash())
+				slotStruct := retro_log.NewRqlStruct(nil).AddVarInt32("slot", msgSlot).AddVarStr("hash", entry.Command().Hash())
 				paxi.Retrolog.StartTx().AppendSetStruct("committed", slotStruct).AppendSetInt32("committed_slots", msgSlot).Commit()
 			}
 
@@ -560,7 +617,7 @@ func (p *ChainPaxos) HandleP2b(msgSlot int, msgBallot paxi.Ballot, votedIds []pa
 			p.p3Lock.Unlock()
 
 			if p.ReplyWhenCommit {
-				r := entry.request
+				r := entry.Request()
 				r.Reply(paxi.Reply{
 					Command:   r.Command,
 					Timestamp: r.Timestamp,
@@ -581,32 +638,32 @@ func (p *ChainPaxos) HandleP3(m P3) {
 		p.slot = paxi.Max(p.slot, slot)
 		e, exist := p.log[slot]
 		if exist {
-			if e.ballot == m.Ballot {
-				e.commit = true
-			} else if e.request != nil {
-				// p.Retry(*e.request)
-				p.Forward(m.Ballot.ID(), *e.request)
-				e.request = nil
+			if e.Ballot == m.Ballot {
+				e.Commit = true
+			} else if e.Request() != nil {
+				// p.Retry(*e.Request())
+				p.Forward(m.Ballot.ID(), *e.Request())
+				e.Requests = nil
 				// ask to recover the slot
-				log.Debugf("Replica %s needs to recover slot %d on ballot %v (we have cmd %v)", p.ID(), slot, m.Ballot, e.command)
+				log.Debugf("Replica %s needs to recover slot %d on ballot %v (we have cmd %v)", p.ID(), slot, m.Ballot, e.Command())
 				p.sendRecoverRequest(m.Ballot, slot)
 			}
 
 		} else {
-			e = &entry{commit: true, ballot: 0}
+			e = &paxi.Entry{Commit: true, Ballot: 0}
 			p.log[slot] = e
 		}
 		p.logLck.Unlock()
 
 		if paxi.GetConfig().UseRetroLog {
-			slotStruct := retro_log.NewRqlStruct(nil).AddVarInt32("slot", slot).AddVarStr("hash", e.command.Hash())
+			slotStruct := retro_log.NewRqlStruct(nil).AddVarInt32("slot", slot).AddVarStr("hash", e.Command().Hash())
 			paxi.Retrolog.StartTx().AppendSetStruct("committed", slotStruct).AppendSetInt32("committed_slots", slot).Commit()
 		}
 		if p.ReplyWhenCommit {
-			if e.request != nil {
-				e.request.Reply(paxi.Reply{
-					Command:   e.request.Command,
-					Timestamp: e.request.Timestamp,
+			if r := e.Request(); r != nil {
+				r.Reply(paxi.Reply{
+					Command:   r.Command,
+					Timestamp: r.Timestamp,
 				})
 			}
 		}
@@ -629,12 +686,12 @@ func (p *ChainPaxos) HandleP3RecoverRequest(m P3RecoverRequest) {
 	p.logLck.Lock()
 	e, exist := p.log[m.Slot]
 	p.logLck.Unlock()
-	if exist && e.commit {
+	if exist && e.Commit {
 		// ok to recover
 		p.Send(m.NodeId, P3RecoverReply{
-			Ballot:  e.ballot,
+			Ballot:  e.Ballot,
 			Slot:    m.Slot,
-			Command: e.command,
+			Command: e.Command(),
 		})
 	}
 
@@ -648,12 +705,19 @@ func (p *ChainPaxos) HandleP3RecoverReply(m P3RecoverReply) {
 	p.logLck.Lock()
 	p.slot = paxi.Max(p.slot, m.Slot)
 	e, exist := p.log[m.Slot]
+	if exist && (m.Slot < p.execute || e.Chosen()) {
+		// committed or executed already, a late reply must not overwrite it
+		exist = false
+	}
 	if exist {
-		e.command = m.Command
-		e.ballot = m.Ballot
-		e.commit = true
+		e.Commands = []paxi.Command{m.Command}
+		e.Ballot = m.Ballot
+		e.Commit = true
 	}
 	p.logLck.Unlock()
+	if exist {
+		paxi.PersistAccept(p.WAL(), p.ID(), m.Slot, m.Ballot, m.Command)
+	}
 
 	p.exec()
 	log.Debugf("Leaving HandleP3RecoverReply")
@@ -665,25 +729,28 @@ func (p *ChainPaxos) exec() {
 	defer p.logLck.Unlock()
 	for {
 		e, ok := p.log[p.execute]
-		if ok && p.execute+10 < p.slot && e.commit && e.ballot == 0 {
+		if ok && p.execute+10 < p.slot && e.Commit && e.Ballot == 0 {
 			// ask to recover the slot
 			log.Debugf("Replica %s tries to recover slot %d on ballot %v", p.ID(), p.execute, p.Ballot())
 			p.sendRecoverRequest(p.Ballot(), p.execute)
 		}
 
-		if !ok || !e.commit || (e.commit && e.ballot == 0) {
+		if !ok || !e.Commit || (e.Commit && e.Ballot == 0) {
 			break
 		}
-		log.Debugf("Replica %s execute [s=%d, cmd=%v]", p.ID(), p.execute, e.command)
-		value := p.Execute(e.command)
-		if e.request != nil {
+		log.Debugf("Replica %s execute [s=%d, cmd=%v]", p.ID(), p.execute, e.Command())
+		if !p.recovering {
+			p.WAL().Commit(p.execute)
+		}
+		value := p.Execute(e.Command())
+		if e.Request() != nil {
 			reply := paxi.Reply{
-				Command:    e.command,
+				Command:    e.Command(),
 				Value:      value,
 				Properties: make(map[string]string),
 			}
-			go e.request.Reply(reply)
-			e.request = nil
+			go e.Request().Reply(reply)
+			e.Requests = nil
 		}
 		p.execute++
 	}
@@ -44,7 +44,7 @@ func (c *checker) clear() {
 func (c *checker) match(read *operation) *operation {
 	//for _, v := range c.Graph.BFSReverse(read) {
 	for v := range c.Graph.Vertices() {
-		if read.output.Equals(v.(*operation).input) {
+		if v.(*operation) != read && read.output.Equals(v.(*operation).input) {
 			return v.(*operation)
 		}
 	}
@@ -66,24 +66,30 @@ func (c *checker) merge(read, write *operation) {
 	c.Graph.Remove(read)
 }
 
+// linearizable returns reads of history that cannot be linearized. Reads have no input, writes have no output
+// and deletes write an empty value, which matches reads of missing keys. Operations with both input and output,
+// like increments and successful compare-and-swaps, read their output and atomically write their input
 func (c *checker) linearizable(history []*operation) []*operation {
 	c.clear()
 	sort.Sort(byTime(history))
 	anomaly := make([]*operation, 0)
 	for i, o := range history {
 		c.add(o)
-		// o is read operation
-		if o.input == nil {
+		// o is read or read-modify-write operation
+		if o.input == nil || o.output != nil {
 			// look ahead for concurrent writes
 			for j := i + 1; j < len(history) && o.concurrent(*history[j]); j++ {
 				// next operation is write
-				if history[j].output == nil {
+				if history[j].output == nil || history[j].input != nil {
 					c.add(history[j])
 				}
 			}
 
 			match := c.match(o)
-			if match != nil {
+			if match != nil && o.input != nil {
+				// read-modify-write stays in graph as a write ordered after the write it read
+				c.AddEdge(match, o)
+			} else if match != nil {
 				c.merge(o, match)
 			}
 
@@ -160,3 +160,42 @@ func TestNonUniqueValue(t *testing.T) {
 		t.Errorf("expected no violation, detected %d", n)
 	}
 }
+
+func TestLinearizabilityCheckerReadModifyWrite(t *testing.T) {
+	c := newChecker()
+	n1 := []byte("1")
+	n2 := []byte("2")
+
+	// increment reads 1 and writes 2
+	// +--w1--+ +--inc--+ +--r2--+
+	ops := []*operation{
+		{n1, nil, 0, 5},
+		{n2, n1, 6, 10},
+		{nil, n2, 11, 15},
+	}
+	if n := len(c.linearizable(ops)); n != 0 {
+		t.Errorf("expected no violation, detected %d", n)
+	}
+
+	// read of the value before a completed increment
+	// +--w1--+ +--inc--+ +--r1--+
+	ops = []*operation{
+		{n1, nil, 0, 5},
+		{n2, n1, 6, 10},
+		{nil, n1, 11, 15},
+	}
+	if n := len(c.linearizable(ops)); n != 1 {
+		t.Errorf("expected 1 violation, detected %d", n)
+	}
+
+	// delete writes an empty value
+	// +--w1--+ +--del--+ +--r1--+
+	ops = []*operation{
+		{n1, nil, 0, 5},
+		{[]byte{}, nil, 6, 10},
+		{nil, n1, 11, 15},
+	}
+	if n := len(c.linearizable(ops)); n != 1 {
+		t.Errorf("expected 1 violation, detected %d", n)
+	}
+}
@@ -2,14 +2,19 @@ package paxi
 
 import (
 	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,12 +28,18 @@ type Client interface {
 	Put(Key, Value) error
 }
 
+// ErrCASFailed is returned by compare-and-swap if the current value does not match the expected value
+var ErrCASFailed = errors.New("compare-and-swap failed")
+
 // AdminClient interface provides fault injection opeartion
 type AdminClient interface {
 	Consensus(Key) bool
 	Crash(ID, int)
 	Drop(ID, ID, int)
 	Partition(int, ...ID)
+	AddNode(id ID, addr, httpAddr string) error
+	RemoveNode(id ID) error
+	TransferLeader(to ID) error
 }
 
 // HTTPClient inplements Client interface with REST API
@@ -41,7 +52,10 @@ type HTTPClient struct {
 	LocalN   int // number of nodes in local zone
 	localIDs []ID
 
-	CID int // command id
+	CID     int    // command id
+	Session uint64 // random id of the session, retries of a command are applied once within the session lease
+	Retries int    // number of times a failed write is retried with the same command id
+	mu      sync.Mutex
 	*http.Client
 }
 
@@ -55,6 +69,15 @@ func NewHTTPClient(id ID) *HTTPClient {
 		Client:   &http.Client{},
 		IDs:      config.IDs(),
 		localIDs: make([]ID, 0),
+		Session:  newSession(),
+		Retries:  3,
+	}
+	if config.TLS.Enabled() {
+		tlsConfig, err := config.TLS.ClientConfig()
+		if err != nil {
+			log.Fatalf("client cannot load TLS config: %v", err)
+		}
+		c.Client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
 	}
 	if id != 0 {
 		i := 0
@@ -72,11 +95,52 @@ func NewHTTPClient(id ID) *HTTPClient {
 	return c
 }
 
+// newSession returns a random non-zero 64-bit session id
+func newSession() uint64 {
+	b := make([]byte, 8)
+	for {
+		if _, err := crand.Read(b); err != nil {
+			log.Fatalf("client cannot create session: %v", err)
+		}
+		if id := binary.BigEndian.Uint64(b); id != 0 {
+			return id
+		}
+	}
+}
+
+// nextCommandID returns id of a new command of the client
+func (c *HTTPClient) nextCommandID() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.CID++
+	return c.CID
+}
+
+// retry calls write f until it succeeds, fails with an error that cannot be retried, or fails Retries times.
+// The retries send the same command id, so they stop before the session lease would run out
+func (c *HTTPClient) retry(f func() error) error {
+	start := time.Now()
+	lease := time.Duration(config.SessionTimeout) * time.Second
+	err := f()
+	for i := 0; i < c.Retries && err != nil; i++ {
+		if errors.Is(err, ErrCASFailed) || errors.Is(err, ErrNotInteger) || errors.Is(err, ErrTxnAborted) || errors.Is(err, ErrSessionInUse) || (lease > 0 && time.Since(start) >= lease) {
+			return err
+		}
+		log.Debugf("client %x retries failed command: %v", c.Session, err)
+		// change to talk to a different node
+		if c.ID != 0 {
+			c.ID = c.getRandomId()
+		}
+		err = f()
+	}
+	return err
+}
+
 // Get gets value of given key (use REST)
 // Default implementation of Client interface
 func (c *HTTPClient) Get(key Key) (Value, error) {
-	c.CID++
-	v, _, err := c.RESTGet(c.ID, key)
+	cid := c.nextCommandID()
+	v, _, err := c.restMethod(c.ID, cid, http.MethodGet, key, nil, nil)
 	if err != nil {
 		// change to talk to a different node
 		if c.ID != 0 {
@@ -89,9 +153,130 @@ func (c *HTTPClient) Get(key Key) (Value, error) {
 // Put puts new key value pair and return previous value (use REST)
 // Default implementation of Client interface
 func (c *HTTPClient) Put(key Key, value Value) error {
-	c.CID++
-	_, _, err := c.RESTPut(c.ID, key, value)
-	return err
+	cid := c.nextCommandID()
+	return c.retry(func() error {
+		_, _, err := c.restMethod(c.ID, cid, http.MethodPut, key, value, nil)
+		return err
+	})
+}
+
+// Delete removes key (use REST)
+func (c *HTTPClient) Delete(key Key) error {
+	cid := c.nextCommandID()
+	return c.retry(func() error {
+		_, _, err := c.restMethod(c.ID, cid, http.MethodDelete, key, nil, nil)
+		return err
+	})
+}
+
+// CAS writes value of key if its current value is expect and returns the value before the operation (use REST).
+// It returns ErrCASFailed if the current value does not match
+func (c *HTTPClient) CAS(key Key, expect, value Value) (Value, error) {
+	cid := c.nextCommandID()
+	var v Value
+	err := c.retry(func() (err error) {
+		v, _, err = c.restMethod(c.ID, cid, http.MethodPatch, key, value, map[string]string{HTTPIfMatch: string(expect)})
+		return err
+	})
+	return v, err
+}
+
+// Increment adds delta to integer value of key and returns the value before the increment (use REST).
+// It returns ErrNotInteger if the current value is not an integer
+func (c *HTTPClient) Increment(key Key, delta int) (Value, error) {
+	cid := c.nextCommandID()
+	var v Value
+	err := c.retry(func() (err error) {
+		v, _, err = c.restMethod(c.ID, cid, http.MethodPatch, key, Value(strconv.Itoa(delta)), nil)
+		return err
+	})
+	return v, err
+}
+
+// Txn runs commands as one atomic transaction and returns the result of every command (use REST).
+// It returns ErrTxnAborted if the condition of a command does not hold
+func (c *HTTPClient) Txn(cmds []Command) ([]Value, error) {
+	cid := c.nextCommandID()
+	data, err := json.Marshal(Transaction{Commands: cmds})
+	if err != nil {
+		return nil, err
+	}
+	var values []Value
+	err = c.retry(func() (err error) {
+		values, err = c.txn(cid, data)
+		return err
+	})
+	return values, err
+}
+
+func (c *HTTPClient) txn(cid int, data []byte) ([]Value, error) {
+	id := c.ID
+	if id == 0 {
+		id = c.getRandomId()
+	}
+	req, err := http.NewRequest(http.MethodPost, c.HTTP[id]+"/txn", bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(HTTPClientID, strconv.Itoa(int(c.ID)))
+	req.Header.Set(HTTPSession, strconv.FormatUint(c.Session, 16))
+	req.Header.Set(HTTPCommandID, strconv.Itoa(cid))
+	res, err := c.Client.Do(req)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		var reply TransactionReply
+		err = json.Unmarshal(b, &reply)
+		return reply.Values, err
+	case http.StatusConflict:
+		if strings.TrimSpace(string(b)) == ErrSessionInUse.Error() {
+			return nil, ErrSessionInUse
+		}
+		reason := strings.TrimPrefix(strings.TrimSpace(string(b)), ErrTxnAborted.Error()+": ")
+		return nil, fmt.Errorf("%w: %s", ErrTxnAborted, reason)
+	}
+	return nil, errors.New(res.Status)
+}
+
+// Scan returns up to limit keys in [start, end) in key order with their values (use REST).
+// An empty end has no upper bound and limit 0 has no limit
+func (c *HTTPClient) Scan(start, end Key, limit int) ([]KeyValue, error) {
+	cid := c.nextCommandID()
+	id := c.ID
+	if id == 0 {
+		id = c.getRandomId()
+	}
+	q := url.Values{}
+	q.Set("start", string(start))
+	q.Set("end", string(end))
+	q.Set("limit", strconv.Itoa(limit))
+	req, err := http.NewRequest(http.MethodGet, c.HTTP[id]+"/scan?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(HTTPClientID, strconv.Itoa(int(c.ID)))
+	req.Header.Set(HTTPSession, strconv.FormatUint(c.Session, 16))
+	req.Header.Set(HTTPCommandID, strconv.Itoa(cid))
+	res, err := c.Client.Do(req)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+	kvs := make([]KeyValue, 0)
+	err = json.NewDecoder(res.Body).Decode(&kvs)
+	return kvs, err
 }
 
 func (c *HTTPClient) getRandomId() ID {
@@ -109,20 +294,27 @@ func (c *HTTPClient) GetURL(id ID, key Key) string {
 	} else if id == 0 {
 		id = c.getRandomId()
 	}
-	return c.HTTP[id] + "/" + strconv.Itoa(int(key))
+	return c.HTTP[id] + "/" + url.PathEscape(string(key))
 }
 
 // rest accesses server's REST API with url = http://ip:port/key
 // if value == nil, it's a read
 func (c *HTTPClient) rest(id ID, key Key, value Value) (Value, map[string]string, error) {
+	method := http.MethodGet
+	if value != nil {
+		method = http.MethodPut
+	}
+	return c.restMethod(id, c.CID, method, key, value, nil)
+}
+
+// restMethod sends value of key as command cid with http method and extra headers
+func (c *HTTPClient) restMethod(id ID, cid int, method string, key Key, value Value, header map[string]string) (Value, map[string]string, error) {
 	// get url
 	url := c.GetURL(id, key)
 	//log.Infof("New Op: node=%v type=%s key=%v", url, key)
 
-	method := http.MethodGet
 	var body io.Reader
 	if value != nil {
-		method = http.MethodPut
 		body = bytes.NewBuffer(value)
 	}
 	req, err := http.NewRequest(method, url, body)
@@ -131,7 +323,11 @@ func (c *HTTPClient) rest(id ID, key Key, value Value) (Value, map[string]string
 		return nil, nil, err
 	}
 	req.Header.Set(HTTPClientID, strconv.Itoa(int(c.ID)))
-	req.Header.Set(HTTPCommandID, strconv.Itoa(c.CID))
+	req.Header.Set(HTTPSession, strconv.FormatUint(c.Session, 16))
+	req.Header.Set(HTTPCommandID, strconv.Itoa(cid))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
 	// r.Header.Set(HTTPTimestamp, strconv.FormatInt(time.Now().UnixNano(), 10))
 
 	rep, err := c.Client.Do(req)
@@ -161,6 +357,21 @@ func (c *HTTPClient) rest(id ID, key Key, value Value) (Value, map[string]string
 		return Value(b), metadata, nil
 	}
 
+	if rep.StatusCode == http.StatusConflict {
+		return nil, metadata, ErrSessionInUse
+	}
+
+	if rep.StatusCode == http.StatusPreconditionFailed || rep.StatusCode == http.StatusUnprocessableEntity {
+		b, err := ioutil.ReadAll(rep.Body)
+		if err != nil {
+			return nil, metadata, err
+		}
+		if rep.StatusCode == http.StatusUnprocessableEntity {
+			return Value(b), metadata, ErrNotInteger
+		}
+		return Value(b), metadata, ErrCASFailed
+	}
+
 	// http call failed
 	dump, _ := httputil.DumpResponse(rep, true)
 	log.Debugf("%q", dump)
@@ -183,6 +394,7 @@ func (c *HTTPClient) json(id ID, key Key, value Value) (Value, error) {
 		Key:       key,
 		Value:     value,
 		ClientID:  c.ID,
+		Session:   c.Session,
 		CommandID: c.CID,
 	}
 	data, err := json.Marshal(cmd)
@@ -301,9 +513,9 @@ func (c *HTTPClient) QuorumPut(key Key, value Value) {
 // Consensus collects /history/key from every node and compare their values
 func (c *HTTPClient) Consensus(k Key) bool {
 	h := make(map[ID][]Value)
-	for id, url := range c.HTTP {
+	for id, addr := range c.HTTP {
 		h[id] = make([]Value, 0)
-		r, err := c.Client.Get(url + "/history?key=" + strconv.Itoa(int(k)))
+		r, err := c.Client.Get(addr + "/history?key=" + url.QueryEscape(string(k)))
 		if err != nil {
 			log.Error(err)
 			continue
@@ -365,6 +577,59 @@ func (c *HTTPClient) Drop(from, to ID, t int) {
 	r.Body.Close()
 }
 
+// AddNode asks the cluster to add node id with given addresses and waits for the change to commit
+func (c *HTTPClient) AddNode(id ID, addr, httpAddr string) error {
+	q := url.Values{}
+	q.Set("op", "add")
+	q.Set("id", id.String())
+	q.Set("addr", addr)
+	q.Set("http", httpAddr)
+	return c.reconfig(q)
+}
+
+// RemoveNode asks the cluster to remove node id and waits for the change to commit
+func (c *HTTPClient) RemoveNode(id ID) error {
+	q := url.Values{}
+	q.Set("op", "remove")
+	q.Set("id", id.String())
+	return c.reconfig(q)
+}
+
+// TransferLeader asks the current leader to hand leadership over to node to
+func (c *HTTPClient) TransferLeader(to ID) error {
+	id := c.ID
+	if id == 0 {
+		id = c.getRandomId()
+	}
+	r, err := c.Client.Post(c.HTTP[id]+"/leader/transfer?to="+to.String(), "", nil)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return errors.New(r.Status)
+	}
+	return nil
+}
+
+func (c *HTTPClient) reconfig(q url.Values) error {
+	id := c.ID
+	if id == 0 {
+		id = c.getRandomId()
+	}
+	r, err := c.Client.Post(c.HTTP[id]+"/reconfig?"+q.Encode(), "", nil)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return errors.New(r.Status)
+	}
+	return nil
+}
+
 // Partition cuts the network between nodes for t seconds
 func (c *HTTPClient) Partition(t int, nodes ...ID) {
 	s := lib.NewSet()
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"pigpaxos"
 	"pigpaxos/epaxos"
@@ -25,8 +26,7 @@ func (d *db) Stop() error {
 	return nil
 }
 
-func (d *db) Read(k int) ([]byte, error) {
-	key := paxi.Key(k)
+func (d *db) Read(key paxi.Key) ([]byte, error) {
 	v, err := d.Get(key)
 	if len(v) == 0 {
 		return nil, nil
@@ -34,12 +34,19 @@ func (d *db) Read(k int) ([]byte, error) {
 	return v, err
 }
 
-func (d *db) Write(k int, v []byte) error {
-	key := paxi.Key(k)
+func (d *db) Write(key paxi.Key, v []byte) error {
 	err := d.Put(key, v)
 	return err
 }
 
+func (d *db) Txn(cmds []paxi.Command) ([]paxi.Value, error) {
+	t, ok := d.Client.(paxi.TxnDB)
+	if !ok {
+		return nil, errors.New("client does not support transactions")
+	}
+	return t.Txn(cmds)
+}
+
 func main() {
 	paxi.Init()
 
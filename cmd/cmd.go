@@ -39,8 +39,7 @@ func run(cmd string, args []string) {
 			fmt.Println("get KEY")
 			return
 		}
-		k, _ := strconv.Atoi(args[0])
-		v, _ := client.Get(paxi.Key(k))
+		v, _ := client.Get(paxi.Key(args[0]))
 		fmt.Println(string(v))
 
 	case "put":
@@ -48,8 +47,7 @@ func run(cmd string, args []string) {
 			fmt.Println("put KEY VALUE")
 			return
 		}
-		k, _ := strconv.Atoi(args[0])
-		client.Put(paxi.Key(k), []byte(args[1]))
+		client.Put(paxi.Key(args[0]), []byte(args[1]))
 		//fmt.Println(string(v))
 
 	case "consensus":
@@ -57,8 +55,7 @@ func run(cmd string, args []string) {
 			fmt.Println("consensus KEY")
 			return
 		}
-		k, _ := strconv.Atoi(args[0])
-		v := admin.Consensus(paxi.Key(k))
+		v := admin.Consensus(paxi.Key(args[0]))
 		fmt.Println(v)
 
 	case "crash":
@@ -1,22 +1,27 @@
 package paxi
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-
-	"pigpaxos/log"
+	"reflect"
+	"sync"
 )
 
 // Codec interface provide methods for serialization and deserialization
 // combines json and gob encoder decoder interface
 type Codec interface {
 	Scheme() string
-	Encode(interface{})
-	Decode(interface{})
+	Encode(interface{}) error
+	Decode(interface{}) error
 }
 
-// NewCodec creates new codec object based on scheme, i.e. json and gob
+// NewCodec creates new codec object based on scheme, i.e. json, gob and binary
 func NewCodec(scheme string, rw io.ReadWriter) Codec {
 	switch scheme {
 	case "json":
@@ -29,10 +34,87 @@ func NewCodec(scheme string, rw io.ReadWriter) Codec {
 			encoder: gob.NewEncoder(rw),
 			decoder: gob.NewDecoder(rw),
 		}
+	case "binary":
+		return &codecBinary{
+			w: rw,
+			r: bufio.NewReader(rw),
+		}
 	}
 	return nil
 }
 
+// messageTypes maps names of registered message types to their types, so codecs without
+// type information on the wire can restore concrete messages behind interface{}
+var messageTypes = struct {
+	sync.RWMutex
+	byName map[string]reflect.Type
+}{byName: make(map[string]reflect.Type)}
+
+// RegisterMessage registers message type of m with all codecs.
+// Protocols register every message they send between nodes
+func RegisterMessage(m interface{}) {
+	gob.Register(m)
+	t := reflect.TypeOf(m)
+	messageTypes.Lock()
+	defer messageTypes.Unlock()
+	messageTypes.byName[t.String()] = t
+}
+
+// deref returns the value pointed to by m if m is a pointer to interface{}, as used by gob
+func deref(m interface{}) interface{} {
+	if p, ok := m.(*interface{}); ok {
+		return *p
+	}
+	return m
+}
+
+/******************************
+/*          JSON              *
+/******************************/
+
+// jsonMessage carries message type name along with the message
+type jsonMessage struct {
+	Type string          `json:"type"`
+	Msg  json.RawMessage `json:"msg"`
+}
+
+// EncodeJSONMessage encodes registered message m together with its type name.
+// Messages with interface{} fields use it to encode those fields
+func EncodeJSONMessage(m interface{}) (json.RawMessage, error) {
+	if m == nil {
+		return json.RawMessage("null"), nil
+	}
+	msg, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonMessage{Type: reflect.TypeOf(m).String(), Msg: msg})
+}
+
+// DecodeJSONMessage decodes message encoded by EncodeJSONMessage
+func DecodeJSONMessage(b json.RawMessage) (interface{}, error) {
+	if string(b) == "null" {
+		return nil, nil
+	}
+	var env jsonMessage
+	err := json.Unmarshal(b, &env)
+	if err != nil {
+		return nil, err
+	}
+	messageTypes.RLock()
+	t, exists := messageTypes.byName[env.Type]
+	messageTypes.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("json codec: message type %s is not registered", env.Type)
+	}
+	v := reflect.New(t)
+	err = json.Unmarshal(env.Msg, v.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
 type codecJSON struct {
 	encoder *json.Encoder
 	decoder *json.Decoder
@@ -42,20 +124,36 @@ func (j *codecJSON) Scheme() string {
 	return "json"
 }
 
-func (j *codecJSON) Encode(m interface{}) {
-	err := j.encoder.Encode(m)
+func (j *codecJSON) Encode(m interface{}) error {
+	b, err := EncodeJSONMessage(deref(m))
 	if err != nil {
-		log.Error(err)
+		return err
 	}
+	return j.encoder.Encode(b)
 }
 
-func (j *codecJSON) Decode(m interface{}) {
-	err := j.decoder.Decode(m)
+func (j *codecJSON) Decode(m interface{}) error {
+	var b json.RawMessage
+	err := j.decoder.Decode(&b)
+	if err != nil {
+		return err
+	}
+	v, err := DecodeJSONMessage(b)
 	if err != nil {
-		log.Error(err)
+		return err
 	}
+	p, ok := m.(*interface{})
+	if !ok {
+		return errors.New("json codec: decode target must be *interface{}")
+	}
+	*p = v
+	return nil
 }
 
+/******************************
+/*           GOB              *
+/******************************/
+
 type codecGOB struct {
 	encoder *gob.Encoder
 	decoder *gob.Decoder
@@ -65,16 +163,434 @@ func (g *codecGOB) Scheme() string {
 	return "gob"
 }
 
-func (g *codecGOB) Encode(m interface{}) {
-	err := g.encoder.Encode(m)
-	if err != nil {
-		log.Error(err)
+func (g *codecGOB) Encode(m interface{}) error {
+	return g.encoder.Encode(m)
+}
+
+func (g *codecGOB) Decode(m interface{}) error {
+	return g.decoder.Decode(m)
+}
+
+/******************************
+/*          Binary            *
+/******************************/
+
+// binaryType is a message type with hand-written binary encoding
+type binaryType struct {
+	id     uint64
+	encode func(*BinaryWriter, interface{})
+	decode func(*BinaryReader) interface{}
+}
+
+// binaryTypes is the registry of messages with binary encoding. Id 0 is reserved for messages
+// without one, they are encoded with gob inside the binary frame
+var binaryTypes = struct {
+	sync.RWMutex
+	byID   map[uint64]*binaryType
+	byType map[reflect.Type]*binaryType
+}{
+	byID:   make(map[uint64]*binaryType),
+	byType: make(map[reflect.Type]*binaryType),
+}
+
+// RegisterBinary registers compact binary encoding of message type of m under id.
+// Ids must be unique across all protocols linked into a binary, the paxi package uses ids below 100
+func RegisterBinary(m interface{}, id uint64, encode func(w *BinaryWriter, m interface{}), decode func(r *BinaryReader) interface{}) {
+	if id == 0 {
+		panic("binary codec: message id 0 is reserved")
 	}
+	RegisterMessage(m)
+	t := reflect.TypeOf(m)
+	binaryTypes.Lock()
+	defer binaryTypes.Unlock()
+	if other, exists := binaryTypes.byID[id]; exists && binaryTypes.byType[t] != other {
+		panic(fmt.Sprintf("binary codec: message id %d of %v is already registered", id, t))
+	}
+	bt := &binaryType{id: id, encode: encode, decode: decode}
+	binaryTypes.byID[id] = bt
+	binaryTypes.byType[t] = bt
 }
 
-func (g *codecGOB) Decode(m interface{}) {
-	err := g.decoder.Decode(m)
+// MaxFrameSize is the largest binary frame a node sends or accepts, it leaves room for snapshots of the state
+const MaxFrameSize = 256 << 20
+
+// ErrFrameTooLarge is returned for a binary frame longer than MaxFrameSize
+var ErrFrameTooLarge = errors.New("binary codec: frame too large")
+
+// codecBinary writes every message as a frame of [length uvarint][message]
+type codecBinary struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+func (c *codecBinary) Scheme() string {
+	return "binary"
+}
+
+func (c *codecBinary) Encode(m interface{}) error {
+	w := new(BinaryWriter)
+	w.Message(deref(m))
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buf) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	frame := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(w.buf))
+	frame = append(frame[:binary.PutUvarint(frame, uint64(len(w.buf)))], w.buf...)
+	_, err := c.w.Write(frame)
+	return err
+}
+
+func (c *codecBinary) Decode(m interface{}) error {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return err
+	}
+	// the length comes from the network, a corrupt one must not be allocated
+	if n > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(c.r, buf)
 	if err != nil {
-		log.Error(err)
+		return err
+	}
+	r := NewBinaryReader(buf)
+	v := r.Message()
+	if r.Err() != nil {
+		return r.Err()
+	}
+	p, ok := m.(*interface{})
+	if !ok {
+		return errors.New("binary codec: decode target must be *interface{}")
+	}
+	*p = v
+	return nil
+}
+
+// BinaryWriter appends values in compact binary form. Integers are varint encoded,
+// slices are prefixed with length+1 so that nil and empty slices are told apart
+type BinaryWriter struct {
+	buf []byte
+	err error
+}
+
+func (w *BinaryWriter) Uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (w *BinaryWriter) Varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func (w *BinaryWriter) Int(v int) {
+	w.Varint(int64(v))
+}
+
+func (w *BinaryWriter) Bool(v bool) {
+	if v {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *BinaryWriter) Bytes(b []byte) {
+	if b == nil {
+		w.Uvarint(0)
+		return
+	}
+	w.Uvarint(uint64(len(b)) + 1)
+	w.buf = append(w.buf, b...)
+}
+
+func (w *BinaryWriter) Text(s string) {
+	w.Uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *BinaryWriter) Ints(v []int) {
+	if v == nil {
+		w.Uvarint(0)
+		return
+	}
+	w.Uvarint(uint64(len(v)) + 1)
+	for _, i := range v {
+		w.Int(i)
+	}
+}
+
+func (w *BinaryWriter) ID(id ID) {
+	w.Uvarint(uint64(id))
+}
+
+func (w *BinaryWriter) IDs(ids []ID) {
+	if ids == nil {
+		w.Uvarint(0)
+		return
+	}
+	w.Uvarint(uint64(len(ids)) + 1)
+	for _, id := range ids {
+		w.ID(id)
+	}
+}
+
+func (w *BinaryWriter) Ballot(b Ballot) {
+	w.Uvarint(uint64(b))
+}
+
+func (w *BinaryWriter) Command(c Command) {
+	w.Text(string(c.Key))
+	w.Bytes(c.Value)
+	w.ID(c.ClientID)
+	w.Int(c.CommandID)
+	w.Uvarint(c.Session)
+	w.Uvarint(uint64(c.Op))
+	w.Bytes(c.Expect)
+	w.Varint(c.Timestamp)
+}
+
+func (w *BinaryWriter) Commands(cmds []Command) {
+	if cmds == nil {
+		w.Uvarint(0)
+		return
+	}
+	w.Uvarint(uint64(len(cmds)) + 1)
+	for _, c := range cmds {
+		w.Command(c)
+	}
+}
+
+// Message writes message m with its registered binary encoding, or with gob if it has none
+func (w *BinaryWriter) Message(m interface{}) {
+	binaryTypes.RLock()
+	bt, exists := binaryTypes.byType[reflect.TypeOf(m)]
+	binaryTypes.RUnlock()
+	if exists {
+		w.Uvarint(bt.id)
+		bt.encode(w, m)
+		return
+	}
+	w.Uvarint(0)
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(&m)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	w.Bytes(b.Bytes())
+}
+
+// BinaryReader reads values written by BinaryWriter. The first error is kept and
+// every later read returns zero values, so decoders check Err once at the end
+type BinaryReader struct {
+	buf []byte
+	off int
+	err error
+}
+
+func NewBinaryReader(b []byte) *BinaryReader {
+	return &BinaryReader{buf: b}
+}
+
+// Err returns the first error encountered while reading
+func (r *BinaryReader) Err() error {
+	return r.err
+}
+
+func (r *BinaryReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *BinaryReader) Uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf[r.off:])
+	if n <= 0 {
+		r.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	r.off += n
+	return v
+}
+
+func (r *BinaryReader) Varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf[r.off:])
+	if n <= 0 {
+		r.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	r.off += n
+	return v
+}
+
+func (r *BinaryReader) Int() int {
+	return int(r.Varint())
+}
+
+func (r *BinaryReader) Bool() bool {
+	if r.err != nil {
+		return false
+	}
+	if r.off >= len(r.buf) {
+		r.fail(io.ErrUnexpectedEOF)
+		return false
+	}
+	r.off++
+	return r.buf[r.off-1] != 0
+}
+
+// length reads slice length written with length+1, it returns -1 for nil slices
+func (r *BinaryReader) length() int {
+	n := r.Uvarint()
+	if r.err != nil || n == 0 {
+		return -1
+	}
+	if n-1 > uint64(len(r.buf)-r.off) {
+		// every element takes at least one byte
+		r.fail(io.ErrUnexpectedEOF)
+		return -1
+	}
+	return int(n - 1)
+}
+
+// Count reads number of elements written with Uvarint. A count larger than the remaining bytes
+// fails the reader and returns 0, so a corrupt frame cannot force a large allocation
+func (r *BinaryReader) Count() int {
+	n := r.Uvarint()
+	if r.err != nil {
+		return 0
+	}
+	if n > uint64(len(r.buf)-r.off) {
+		// every element takes at least one byte
+		r.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	return int(n)
+}
+
+func (r *BinaryReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.buf)-r.off {
+		r.fail(io.ErrUnexpectedEOF)
+		return nil
+	}
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *BinaryReader) Bytes() []byte {
+	n := r.length()
+	if n < 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, r.next(n))
+	return b
+}
+
+func (r *BinaryReader) Text() string {
+	n := r.Uvarint()
+	if n > uint64(len(r.buf)-r.off) {
+		r.fail(io.ErrUnexpectedEOF)
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func (r *BinaryReader) Ints() []int {
+	n := r.length()
+	if n < 0 {
+		return nil
+	}
+	v := make([]int, n)
+	for i := range v {
+		v[i] = r.Int()
+	}
+	return v
+}
+
+func (r *BinaryReader) ID() ID {
+	return ID(r.Uvarint())
+}
+
+func (r *BinaryReader) IDs() []ID {
+	n := r.length()
+	if n < 0 {
+		return nil
+	}
+	ids := make([]ID, n)
+	for i := range ids {
+		ids[i] = r.ID()
+	}
+	return ids
+}
+
+func (r *BinaryReader) Ballot() Ballot {
+	return Ballot(r.Uvarint())
+}
+
+func (r *BinaryReader) Command() Command {
+	return Command{
+		Key:       Key(r.Text()),
+		Value:     r.Bytes(),
+		ClientID:  r.ID(),
+		CommandID: r.Int(),
+		Session:   r.Uvarint(),
+		Op:        Op(r.Uvarint()),
+		Expect:    r.Bytes(),
+		Timestamp: r.Varint(),
+	}
+}
+
+func (r *BinaryReader) Commands() []Command {
+	n := r.length()
+	if n < 0 {
+		return nil
+	}
+	cmds := make([]Command, n)
+	for i := range cmds {
+		cmds[i] = r.Command()
+	}
+	return cmds
+}
+
+// Message reads a message written by BinaryWriter.Message
+func (r *BinaryReader) Message() interface{} {
+	id := r.Uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if id == 0 {
+		b := r.Bytes()
+		if r.err != nil {
+			return nil
+		}
+		var m interface{}
+		err := gob.NewDecoder(bytes.NewReader(b)).Decode(&m)
+		if err != nil {
+			r.fail(err)
+			return nil
+		}
+		return m
+	}
+	binaryTypes.RLock()
+	bt, exists := binaryTypes.byID[id]
+	binaryTypes.RUnlock()
+	if !exists {
+		r.fail(fmt.Errorf("binary codec: unknown message id %d", id))
+		return nil
 	}
+	return bt.decode(r)
 }
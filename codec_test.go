@@ -2,6 +2,7 @@ package paxi
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"strconv"
 	"testing"
@@ -78,6 +79,119 @@ func TestCodecGob(t *testing.T) {
 	}
 }
 
+func TestCodecJSON(t *testing.T) {
+	RegisterMessage(A{})
+	var send interface{}
+	var recv interface{}
+
+	buf := new(bytes.Buffer)
+	c := NewCodec("json", buf)
+
+	send = ProtocolMsg{HlcTime: 42, MsgId: 7, Msg: A{1, "a", true}}
+	if err := c.Encode(&send); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Decode(&recv); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := recv.(ProtocolMsg)
+	if !ok || m.HlcTime != 42 || m.MsgId != 7 || m.Msg.(A) != send.(ProtocolMsg).Msg.(A) {
+		t.Errorf("expect send %v and recv %v to be euqal", send, recv)
+	}
+}
+
+func encodeTestP2a(w *BinaryWriter, m interface{}) {
+	p2a := m.(testP2a)
+	w.Ballot(p2a.Ballot)
+	w.Int(p2a.Slot)
+	w.Command(p2a.Command)
+}
+
+func decodeTestP2a(r *BinaryReader) interface{} {
+	return testP2a{
+		Ballot:  r.Ballot(),
+		Slot:    r.Int(),
+		Command: r.Command(),
+	}
+}
+
+func TestCodecBinary(t *testing.T) {
+	RegisterBinary(testP2a{}, 99, encodeTestP2a, decodeTestP2a)
+	RegisterMessage(B{})
+	var send interface{}
+	var recv interface{}
+
+	buf := new(bytes.Buffer)
+	c := NewCodec("binary", buf)
+
+	read := Command{Key: "1", ClientID: NewIDFromString("1.2"), CommandID: 3}
+	write := Command{Key: "\xff\x00key", Value: []byte{}, ClientID: NewIDFromString("2.1"), CommandID: 4, Session: 1 << 40}
+	cas := Command{Key: "k", Value: []byte("new"), Expect: []byte("old"), Op: CAS, ClientID: NewIDFromString("1.1"), CommandID: 5}
+	for _, cmd := range []Command{read, write, cas} {
+		send = ProtocolMsg{HlcTime: 42, MsgId: 7, Msg: testP2a{NewBallot(3, NewIDFromString("1.1")), 12, cmd}}
+		if err := c.Encode(&send); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Decode(&recv); err != nil {
+			t.Fatal(err)
+		}
+		p2a := recv.(ProtocolMsg).Msg.(testP2a)
+		if p2a.Ballot != send.(ProtocolMsg).Msg.(testP2a).Ballot || p2a.Slot != 12 || !p2a.Command.Equal(cmd) {
+			t.Errorf("expect send %v and recv %v to be euqal", send, recv)
+		}
+		if p2a.Command.IsRead() != cmd.IsRead() {
+			t.Errorf("expect nil and empty values to be preserved, got %v", p2a.Command)
+		}
+	}
+
+	// messages without binary encoding fall back to gob
+	send = ProtocolMsg{Msg: B{"test"}}
+	c.Encode(&send)
+	c.Decode(&recv)
+	if recv.(ProtocolMsg).Msg.(B) != send.(ProtocolMsg).Msg.(B) {
+		t.Errorf("expect send %v and recv %v to be euqal", send, recv)
+	}
+
+	// truncated frame
+	send = ProtocolMsg{Msg: testP2a{Slot: 1, Command: write}}
+	c.Encode(&send)
+	buf.Truncate(buf.Len() - 1)
+	if err := c.Decode(&recv); err == nil {
+		t.Error("expect error decoding truncated message")
+	}
+}
+
+func TestBinaryReaderCount(t *testing.T) {
+	w := new(BinaryWriter)
+	w.Uvarint(2)
+	w.ID(NewIDFromString("1.1"))
+	w.ID(NewIDFromString("1.2"))
+	r := NewBinaryReader(w.buf)
+	if n := r.Count(); n != 2 || r.Err() != nil {
+		t.Errorf("expect count 2, got %d, %v", n, r.Err())
+	}
+
+	// a corrupt count larger than the frame fails instead of being allocated
+	w = new(BinaryWriter)
+	w.Uvarint(1 << 62)
+	w.ID(NewIDFromString("1.1"))
+	r = NewBinaryReader(w.buf)
+	if n := r.Count(); n != 0 || r.Err() == nil {
+		t.Errorf("expect corrupt count to fail, got %d, %v", n, r.Err())
+	}
+}
+
+func TestCodecBinaryFrameTooLarge(t *testing.T) {
+	for _, n := range []uint64{MaxFrameSize + 1, 1 << 63} {
+		var frame [binary.MaxVarintLen64]byte
+		buf := bytes.NewBuffer(frame[:binary.PutUvarint(frame[:], n)])
+		var m interface{}
+		if err := NewCodec("binary", buf).Decode(&m); err != ErrFrameTooLarge {
+			t.Errorf("expect frame of %d bytes to be refused, got %v", n, err)
+		}
+	}
+}
+
 func BenchmarkCodecGob(b *testing.B) {
 	gob.Register(A{})
 	var send interface{}
@@ -239,7 +353,7 @@ func BenchmarkCodecGobSerializeP2a(b *testing.B) {
 
 	v1 := GenerateRandVal(1)
 
-	Cmd := Command{ClientID: NewIDFromString("1.1"), CommandID: 1, Key: 1, Value: v1}
+	Cmd := Command{ClientID: NewIDFromString("1.1"), CommandID: 1, Key: "1", Value: v1}
 
 	send = testP2a{bal, 1, Cmd}
 
@@ -260,7 +374,7 @@ func BenchmarkCodecGobSerializePreAccept(b *testing.B) {
 	bal := NewBallot(0, NewIDFromString("1.1"))
 	v1 := GenerateRandVal(1)
 
-	Cmd := Command{ClientID: NewIDFromString("1.1"), CommandID: 1, Key: 1, Value: v1}
+	Cmd := Command{ClientID: NewIDFromString("1.1"), CommandID: 1, Key: "1", Value: v1}
 
 	deps := make(map[ID]int, 0)
 	for i := 1; i <= 25; i++ {
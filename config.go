@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"flag"
 	"os"
+	"sync"
 
 	"pigpaxos/log"
 )
@@ -22,31 +23,65 @@ type Config struct {
 	Policy    string  `json:"policy"`    // leader change policy {consecutive, majority}
 	Threshold float64 `json:"threshold"` // threshold for policy in WPaxos {n consecutive or time interval in ms}
 
-	Thrifty        bool    `json:"thrifty"`          // only send messages to a quorum
-	BufferSize     int     `json:"buffer_size"`      // buffer size for maps
-	ChanBufferSize int     `json:"chan_buffer_size"` // buffer size for channels
-	MultiVersion   bool    `json:"multiversion"`     // create multi-version database
-	Benchmark      Bconfig `json:"benchmark"`        // benchmark configuration
+	LeaderPreference []string `json:"leader_preference"` // node ids in the order they should lead, the first healthy one leads
+	LeaderAffinity   bool     `json:"leader_affinity"`   // move leadership to the zone policy finds issuing most requests
+	Learners         []string `json:"learners"`          // node ids of read-only replicas that receive the committed log but do not vote
+	Witnesses        []string `json:"witnesses"`         // node ids of acceptors that vote but keep no state machine and never lead
+
+	Quorum         QuorumConfig   `json:"quorum"`           // phase-1 and phase-2 quorums, majority if empty
+	Weights        map[string]int `json:"weights"`          // vote weight of node ids in weighted quorums, 1 if not set
+	Thrifty        bool           `json:"thrifty"`          // only send messages to a quorum
+	ThriftyTimeout int            `json:"thrifty_timeout"`  // ms a thrifty message waits for its quorum before it is sent to every node
+	BufferSize     int            `json:"buffer_size"`      // buffer size for maps
+	ChanBufferSize int            `json:"chan_buffer_size"` // buffer size for channels
+	MultiVersion   bool           `json:"multiversion"`     // create multi-version database
+	Benchmark      Bconfig        `json:"benchmark"`        // benchmark configuration
+
+	WALDir         string `json:"wal_dir"`          // directory for acceptor write-ahead logs, no persistence if empty
+	WALSync        bool   `json:"wal_sync"`         // fsync write-ahead log before replying to P1a/P2a
+	WALSegmentSize int64  `json:"wal_segment_size"` // size of write-ahead log segment files in bytes
+
+	SnapshotInterval  int `json:"snapshot_interval"`   // take a snapshot every n executed slots, 0 disables snapshots
+	SnapshotChunkSize int `json:"snapshot_chunk_size"` // max bytes of snapshot data in one InstallSnapshot message
+
+	Codec string `json:"codec"` // codec for message serialization between nodes (gob, json, binary)
+
+	TLS TLSConfig `json:"tls"` // mutual TLS between nodes and HTTPS for clients, plaintext if empty
+
+	Storage      string `json:"storage"`       // storage of the database (memory, disk)
+	StorageDir   string `json:"storage_dir"`   // directory of disk databases
+	MemtableSize int    `json:"memtable_size"` // bytes of writes a disk database buffers in memory
+
+	SessionTimeout int `json:"session_timeout"` // client sessions expire after n seconds without command, 0 never expires
 
 	// for future implementation
 	// Batching bool `json:"batching"`
 	// Consistency string `json:"consistency"`
-	// Codec string `json:"codec"` // codec for message serialization between nodes
 
-	n   int         // total number of nodes
-	z   int         // total number of zones
-	npz map[int]int // nodes per zone
+	n   int         // total number of voting nodes
+	z   int         // total number of zones with voting nodes
+	npz map[int]int // voting nodes per zone
+	w   int         // total weight of nodes
+	wpn map[ID]int  // weight per node
+	lp  []ID        // known nodes of leader preference that can lead
+	ln  map[ID]bool // known learners
+	wn  map[ID]bool // known witnesses
 }
 
 // Config is global configuration singleton generated by init() func below
 var config Config
 
+// configLock guards membership changes of the global configuration
+var configLock sync.RWMutex
+
 func init() {
 	config = MakeDefaultConfig()
 }
 
 // GetConfig returns paxi package configuration
 func GetConfig() Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
 	return config
 }
 
@@ -68,6 +103,16 @@ func MakeDefaultConfig() Config {
 		MultiVersion:   false,
 		UseRetroLog:    false,
 		Benchmark:      DefaultBConfig(),
+		WALSync:        true,
+		WALSegmentSize: 64 << 20,
+
+		SnapshotChunkSize: 64 << 10,
+		Codec:             "gob",
+		SessionTimeout:    60,
+		ThriftyTimeout:    50,
+		Storage:           "memory",
+		StorageDir:        "db",
+		MemtableSize:      4 << 20,
 	}
 }
 
@@ -80,12 +125,42 @@ func (c Config) IDs() []ID {
 	return ids
 }
 
-// N returns total number of nodes
+// Voters returns ids of all nodes that are not learners
+func (c Config) Voters() []ID {
+	ids := make([]ID, 0, c.n)
+	for id := range c.Addrs {
+		if !c.ln[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// LearnerIDs returns ids of all learners
+func (c Config) LearnerIDs() []ID {
+	ids := make([]ID, 0, len(c.ln))
+	for id := range c.ln {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// IsLearner returns true if node id is a learner that does not vote
+func (c Config) IsLearner(id ID) bool {
+	return c.ln[id]
+}
+
+// IsWitness returns true if node id is a witness that votes but does not execute commands
+func (c Config) IsWitness(id ID) bool {
+	return c.wn[id]
+}
+
+// N returns total number of voting nodes
 func (c Config) N() int {
 	return c.n
 }
 
-// Z returns total number of zones
+// Z returns total number of zones with voting nodes
 func (c Config) Z() int {
 	return c.z
 }
@@ -122,12 +197,82 @@ func (c *Config) Load() {
 		c.HTTPAddrs[NewIDFromString(idStr)] = httpaddress
 	}
 
+	c.count()
+	if err := c.validateQuorum(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// count computes number of nodes and zones from addresses
+func (c *Config) count() {
+	c.n = 0
+	c.w = 0
 	c.npz = make(map[int]int)
+	c.wpn = make(map[ID]int)
+	c.ln = make(map[ID]bool)
+	for _, s := range c.Learners {
+		id := NewIDFromString(s)
+		if _, exists := c.Addrs[id]; !exists {
+			log.Warningf("learners have unknown node %s", s)
+			continue
+		}
+		c.ln[id] = true
+	}
+	c.wn = make(map[ID]bool)
+	for _, s := range c.Witnesses {
+		id := NewIDFromString(s)
+		if _, exists := c.Addrs[id]; !exists {
+			log.Warningf("witnesses have unknown node %s", s)
+			continue
+		}
+		if c.ln[id] {
+			log.Warningf("learner %s cannot be a witness", s)
+			continue
+		}
+		c.wn[id] = true
+	}
 	for id := range c.Addrs {
+		if c.ln[id] {
+			// learners do not count in quorums
+			continue
+		}
 		c.n++
 		c.npz[id.Zone()]++
+		w, exists := c.Weights[id.String()]
+		if !exists {
+			w = 1
+		}
+		c.w += w
+		c.wpn[id] = w
 	}
 	c.z = len(c.npz)
+	c.lp = make([]ID, 0, len(c.LeaderPreference))
+	for _, s := range c.LeaderPreference {
+		id := NewIDFromString(s)
+		if _, exists := c.Addrs[id]; !exists {
+			log.Warningf("leader preference has unknown node %s", s)
+			continue
+		}
+		if c.ln[id] || c.wn[id] {
+			log.Warningf("leader preference has learner or witness %s that cannot lead", s)
+			continue
+		}
+		c.lp = append(c.lp, id)
+	}
+}
+
+// Weight returns total vote weight of nodes ids
+func (c Config) Weight(ids ...ID) int {
+	w := 0
+	for _, id := range ids {
+		w += c.wpn[id]
+	}
+	return w
+}
+
+// TotalWeight returns vote weight of all nodes
+func (c Config) TotalWeight() int {
+	return c.w
 }
 
 // Save saves configuration to file in JSON format
@@ -5,14 +5,35 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"strconv"
 	"sync"
+
+	"pigpaxos/lib"
+	"pigpaxos/log"
 )
 
-// Key type of the key-value database
-// TODO key should be general too
-type Key int
+// Key type of the key-value database. Keys are opaque byte strings
+type Key string
+
+// IntKey formats integer i as a key, so integer workloads keep their keys
+func IntKey(i int) Key {
+	return Key(strconv.Itoa(i))
+}
+
+// Reserved returns true if k belongs to commands only the replicas create, such as membership changes and transactions.
+// Such keys start with a zero byte and clients cannot read or write them directly
+func (k Key) Reserved() bool {
+	return len(k) > 0 && k[0] == 0
+}
+
+func (k Key) String() string {
+	return strconv.Quote(string(k))
+}
 
 // Value type of key-value database
 type Value []byte
@@ -21,79 +42,239 @@ func (v Value) Equals(v2 Value) bool {
 	return bytes.Equal(v, v2)
 }
 
+// Op is the operation of a command on the key-value database
+type Op uint8
+
+const (
+	Get       Op = iota + 1 // read value of key
+	Put                     // write value of key
+	Delete                  // remove key
+	CAS                     // write value if the current value equals Expect
+	Increment               // add integer delta in Value to integer value of key, 1 if Value is empty
+	Scan                    // read keys in range, see ScanCommand
+)
+
+var opNames = map[Op]string{
+	Get:       "get",
+	Put:       "put",
+	Delete:    "delete",
+	CAS:       "cas",
+	Increment: "increment",
+	Scan:      "scan",
+}
+
+func (op Op) String() string {
+	return opNames[op]
+}
+
+func (op Op) MarshalJSON() ([]byte, error) {
+	return json.Marshal(op.String())
+}
+
+func (op *Op) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	*op = 0
+	for o, n := range opNames {
+		if n == name {
+			*op = o
+		}
+	}
+	if *op == 0 && name != "" {
+		return fmt.Errorf("unknown operation %q", name)
+	}
+	return nil
+}
+
 // Command of key-value database
 type Command struct {
 	Key       Key
 	Value     Value
 	ClientID  ID
 	CommandID int
+	Session   uint64 // random id of the client session, a write is applied once per session and command id
+	Op        Op     // operation, Get or Put from Value if not set
+	Expect    Value  // expected current value of CAS
+	Timestamp int64  // time the command was received in unix nanoseconds, the clock of client sessions
+}
+
+// Operation returns operation of the command. Commands without Op are reads if they have no value
+func (c Command) Operation() Op {
+	if c.Op != 0 {
+		return c.Op
+	}
+	if c.Value == nil {
+		return Get
+	}
+	return Put
 }
 
 func (c Command) Empty() bool {
-	if c.Key == 0 && c.Value == nil && c.ClientID == 0 && c.CommandID == 0 {
+	if c.Key == "" && c.Value == nil && c.ClientID == 0 && c.CommandID == 0 && c.Session == 0 && c.Op == 0 && c.Expect == nil {
 		return true
 	}
 	return false
 }
 
 func (c Command) IsRead() bool {
-	return c.Value == nil
+	op := c.Operation()
+	return op == Get || op == Scan
 }
 
 func (c Command) IsWrite() bool {
-	return c.Value != nil
+	return !c.IsRead()
 }
 
 func (c Command) Equal(a Command) bool {
-	return c.Key == a.Key && bytes.Equal(c.Value, a.Value) && c.ClientID == a.ClientID && c.CommandID == a.CommandID
+	return c.Key == a.Key && bytes.Equal(c.Value, a.Value) && c.ClientID == a.ClientID && c.CommandID == a.CommandID && c.Session == a.Session &&
+		c.Operation() == a.Operation() && bytes.Equal(c.Expect, a.Expect)
 }
 
 func (c Command) String() string {
-	if c.Value == nil {
+	switch c.Operation() {
+	case Get:
 		return fmt.Sprintf("Get{key=%v id=%s cid=%d}", c.Key, c.ClientID, c.CommandID)
+	case Delete:
+		return fmt.Sprintf("Delete{key=%v id=%s cid=%d}", c.Key, c.ClientID, c.CommandID)
+	case CAS:
+		return fmt.Sprintf("CAS{key=%v expect=%x value=%x id=%s cid=%d}", c.Key, c.Expect, c.Value, c.ClientID, c.CommandID)
+	case Increment:
+		return fmt.Sprintf("Increment{key=%v delta=%s id=%s cid=%d}", c.Key, c.Value, c.ClientID, c.CommandID)
+	case Scan:
+		start, end, limit := c.ScanRange()
+		return fmt.Sprintf("Scan{start=%v end=%v limit=%d id=%s cid=%d}", start, end, limit, c.ClientID, c.CommandID)
 	}
 	return fmt.Sprintf("Put{key=%v value=%x id=%s cid=%d", c.Key, c.Value, c.ClientID, c.CommandID)
 }
 
 func (c Command) Hash() string {
 	h := sha1.New()
-	bs := make([]byte, 4)
-	binary.LittleEndian.PutUint32(bs, uint32(c.Key))
-	h.Write(bs)
+	bs := make([]byte, binary.MaxVarintLen64)
+	h.Write(bs[:binary.PutUvarint(bs, uint64(len(c.Key)))])
+	h.Write([]byte(c.Key))
 	h.Write(c.Value)
+	if op := c.Operation(); op != Get && op != Put {
+		// legacy commands keep their hashes
+		h.Write([]byte{byte(op)})
+		h.Write(c.Expect)
+	}
 	hashBytes := h.Sum(nil)
 	hashb64 := base64.StdEncoding.EncodeToString(hashBytes)
 	return hashb64
 }
 
-// Database defines a database interface
-// TODO replace with more general StateMachine interface
+// Database defines a key-value database interface, the default state machine of nodes
 type Database interface {
-	Execute(Command) Value
+	StateMachine
 	History(Key) []Value
 	Get(Key) Value
 	Put(Key, Value)
+	Scan(start, end Key, limit int) []KeyValue
 }
 
-// Database implements a multi-version key-value datastore as the StateMachine
+// KeyValue is a key with its value returned by scans
+type KeyValue struct {
+	Key   Key
+	Value Value
+}
+
+// Database implements a multi-version key-value datastore as the StateMachine.
+// Keys are kept in order, so they can be scanned by range
 type database struct {
 	sync.RWMutex
-	data         map[Key]Value
+	data         storage
 	version      int
 	multiversion bool
-	history      map[Key][]Value
 }
 
 // NewDatabase returns database that impelements Database interface
 func NewDatabase() Database {
 	return &database{
-		data:         make(map[Key]Value),
+		data:         newMemStorage(),
 		version:      0,
 		multiversion: config.MultiVersion,
-		history:      make(map[Key][]Value),
 	}
 }
 
+// storage keeps keys in order with their values and history for database
+type storage interface {
+	get(k Key) (Value, bool)
+	put(k Key, v Value)
+	delete(k Key) bool
+	// scan calls f in key order for every key in [start, end) until f returns false, an empty end has no upper bound
+	scan(start, end Key, f func(Key, Value) bool)
+	history(k Key) []Value
+	appendHistory(k Key, v Value)
+	// histories calls f with history of every key
+	histories(f func(Key, []Value))
+	// checkpoint makes the current state durable and returns its id, or empty if the storage is not durable
+	checkpoint() (string, error)
+	// release keeps checkpoint id instead of the previous one once a durable snapshot refers to it
+	release(id string)
+	// restore returns the storage to the state of checkpoint id, it returns false if the storage does not have it
+	restore(id string) bool
+	// clear removes every key
+	clear()
+}
+
+// memStorage is the in-memory storage
+type memStorage struct {
+	data     *lib.SkipList   // Key to Value
+	versions map[Key][]Value // history of values of every key
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		data:     lib.NewSkipList(),
+		versions: make(map[Key][]Value),
+	}
+}
+
+func (s *memStorage) get(k Key) (Value, bool) {
+	v, exists := s.data.Get(string(k))
+	if !exists {
+		return nil, false
+	}
+	return v.(Value), true
+}
+
+func (s *memStorage) put(k Key, v Value)    { s.data.Put(string(k), v) }
+func (s *memStorage) delete(k Key) bool     { return s.data.Delete(string(k)) }
+func (s *memStorage) history(k Key) []Value { return s.versions[k] }
+
+func (s *memStorage) scan(start, end Key, f func(Key, Value) bool) {
+	s.data.Range(string(start), string(end), func(k string, v interface{}) bool {
+		return f(Key(k), v.(Value))
+	})
+}
+
+func (s *memStorage) appendHistory(k Key, v Value) {
+	s.versions[k] = append(s.versions[k], v)
+}
+
+func (s *memStorage) histories(f func(Key, []Value)) {
+	for k, h := range s.versions {
+		f(k, h)
+	}
+}
+
+func (s *memStorage) checkpoint() (string, error) {
+	return "", nil
+}
+
+func (s *memStorage) release(id string) {}
+
+func (s *memStorage) restore(id string) bool {
+	return false
+}
+
+func (s *memStorage) clear() {
+	s.data = lib.NewSkipList()
+	s.versions = make(map[Key][]Value)
+}
+
 /*
 // Execute implements StateMachine interface
 func (d *database) Execute(c interface{}) interface{} {
@@ -122,35 +303,169 @@ func (d *database) Execute(c Command) Value {
 	d.Lock()
 	defer d.Unlock()
 
+	if c.Operation() == Scan {
+		return encodeKeyValues(d.scan(c.ScanRange()))
+	}
+
 	// get previous value
-	v := d.data[c.Key]
+	v := d.get(c.Key)
 
-	// writes new value
-	d.put(c.Key, c.Value)
+	if next, changed, _ := apply(c, v); changed {
+		d.set(c.Key, next)
+	}
 
 	return v
 }
 
+// ExecuteTransaction implements Transactional interface. Commands are checked against the current state
+// and the writes of earlier commands of the transaction before any of them is applied
+func (d *database) ExecuteTransaction(cmds []Command) ([]Value, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	type write struct {
+		key   Key
+		value Value
+	}
+	values := make([]Value, len(cmds))
+	writes := make([]write, 0, len(cmds))
+	state := make(map[Key]Value)
+	for i, c := range cmds {
+		if c.Operation() == Scan {
+			return nil, errors.New("scans are not supported in transactions")
+		}
+		v, exists := state[c.Key]
+		if !exists {
+			v = d.get(c.Key)
+		}
+		values[i] = v
+		next, changed, err := apply(c, v)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", c, err)
+		}
+		if changed {
+			state[c.Key] = next
+			writes = append(writes, write{c.Key, next})
+		}
+	}
+	for _, w := range writes {
+		d.set(w.key, w.value)
+	}
+	return values, nil
+}
+
+// ErrNotInteger is the error of increments on values that are not integers
+var ErrNotInteger = errors.New("value is not an integer")
+
+// Error returns the error of command c that returned prev, the value of its key before it was executed,
+// or nil if c was applied. Conditional commands that fail leave the value unchanged, so replies tell them apart
+func (c Command) Error(prev Value) error {
+	_, _, err := apply(c, prev)
+	return err
+}
+
+// apply returns value of key after command c is applied to its current value v and whether c changes the value.
+// It returns an error if the condition of c does not hold
+func apply(c Command, v Value) (Value, bool, error) {
+	switch c.Operation() {
+	case Put:
+		return c.Value, c.Value != nil, nil
+	case Delete:
+		return nil, true, nil
+	case CAS:
+		if !v.Equals(c.Expect) {
+			return v, false, ErrCASFailed
+		}
+		return c.Value, true, nil
+	case Increment:
+		n, ok := increment(v, c.Value)
+		if !ok {
+			return v, false, ErrNotInteger
+		}
+		return n, true, nil
+	}
+	return v, false, nil
+}
+
+// increment adds integer delta to integer value v, a missing value counts as 0 and an empty delta as 1.
+// It returns false if either of them is not an integer
+func increment(v, delta Value) (Value, bool) {
+	var n, d int64 = 0, 1
+	var err error
+	if len(v) > 0 {
+		n, err = strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return nil, false
+		}
+	}
+	if len(delta) > 0 {
+		d, err = strconv.ParseInt(string(delta), 10, 64)
+		if err != nil {
+			return nil, false
+		}
+	}
+	return Value(strconv.FormatInt(n+d, 10)), true
+}
+
 // Get gets the current value and version of given key
 func (d *database) Get(k Key) Value {
 	d.RLock()
 	defer d.RUnlock()
-	return d.data[k]
+	return d.get(k)
+}
+
+func (d *database) get(k Key) Value {
+	v, _ := d.data.get(k)
+	return v
+}
+
+// Scan returns up to limit keys in [start, end) in key order with their values.
+// An empty end has no upper bound and limit 0 has no limit
+func (d *database) Scan(start, end Key, limit int) []KeyValue {
+	d.RLock()
+	defer d.RUnlock()
+	return d.scan(start, end, limit)
+}
+
+func (d *database) scan(start, end Key, limit int) []KeyValue {
+	kvs := make([]KeyValue, 0)
+	d.data.scan(start, end, func(k Key, v Value) bool {
+		kvs = append(kvs, KeyValue{k, v})
+		return limit <= 0 || len(kvs) < limit
+	})
+	return kvs
 }
 
 func (d *database) put(k Key, v Value) {
 	if v != nil {
-		d.data[k] = v
+		d.data.put(k, v)
 		d.version++
 		if d.multiversion {
-			if d.history[k] == nil {
-				d.history[k] = make([]Value, 0)
-			}
-			d.history[k] = append(d.history[k], v)
+			d.data.appendHistory(k, v)
 		}
 	}
 }
 
+// delete removes key k, the removal is recorded in history as a nil value
+func (d *database) delete(k Key) {
+	if !d.data.delete(k) {
+		return
+	}
+	d.version++
+	if d.multiversion {
+		d.data.appendHistory(k, nil)
+	}
+}
+
+// set writes value v of key k, a nil value removes the key
+func (d *database) set(k Key, v Value) {
+	if v == nil {
+		d.delete(k)
+	} else {
+		d.put(k, v)
+	}
+}
+
 // Put puts a new value of given key
 func (d *database) Put(k Key, v Value) {
 	d.Lock()
@@ -169,24 +484,169 @@ func (d *database) Version(k Key) int {
 func (d *database) History(k Key) []Value {
 	d.RLock()
 	defer d.RUnlock()
-	return d.history[k]
+	return d.data.history(k)
+}
+
+// databaseImage is the serialized form of database used by snapshots
+type databaseImage struct {
+	Data       map[Key]Value
+	Version    int
+	History    map[Key][]Value
+	Checkpoint string // id of the durable checkpoint of the state on the local disk, Data and History are empty then
+}
+
+// Snapshot serializes the current state of database. Durable storage takes a checkpoint of the state
+// and the snapshot only refers to it, so its size does not grow with the database
+func (d *database) Snapshot() ([]byte, error) {
+	d.Lock()
+	defer d.Unlock()
+	checkpoint, err := d.data.checkpoint()
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint == "" {
+		return d.image()
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(&databaseImage{
+		Version:    d.version,
+		Checkpoint: checkpoint,
+	})
+	return buf.Bytes(), err
+}
+
+// Export implements Exporter interface with every key, value and history of the database
+func (d *database) Export() ([]byte, error) {
+	d.RLock()
+	defer d.RUnlock()
+	return d.image()
+}
+
+// image serializes every key, value and history of the database
+func (d *database) image() ([]byte, error) {
+	history := make(map[Key][]Value)
+	d.data.histories(func(k Key, h []Value) {
+		history[k] = h
+	})
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&databaseImage{
+		Data:    d.dataMap(),
+		Version: d.version,
+		History: history,
+	})
+	return buf.Bytes(), err
+}
+
+// Restore replaces the state of database with a snapshot image
+func (d *database) Restore(b []byte) error {
+	image := new(databaseImage)
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(image)
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+	if image.Checkpoint != "" {
+		// the state on disk is kept as it is if the checkpoint is gone, a full snapshot replaces it later
+		if !d.data.restore(image.Checkpoint) {
+			return fmt.Errorf("checkpoint %s is not on local disk", image.Checkpoint)
+		}
+		d.version = image.Version
+		log.Debugf("database restored from checkpoint %s on disk", image.Checkpoint)
+		return nil
+	}
+	d.version = image.Version
+	d.data.clear()
+	for k, v := range image.Data {
+		d.data.put(k, v)
+	}
+	for k, h := range image.History {
+		for _, v := range h {
+			d.data.appendHistory(k, v)
+		}
+	}
+	return nil
+}
+
+// Release implements Checkpointer interface. The checkpoint snapshot b refers to is kept on disk
+// instead of the checkpoint of the previous snapshot
+func (d *database) Release(b []byte) error {
+	image := new(databaseImage)
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(image)
+	if err != nil {
+		return err
+	}
+	if image.Checkpoint != "" {
+		d.Lock()
+		defer d.Unlock()
+		d.data.release(image.Checkpoint)
+	}
+	return nil
+}
+
+// Hash implements State interface with a hash of every key and value in key order
+func (d *database) Hash() uint64 {
+	d.RLock()
+	defer d.RUnlock()
+	h := fnv.New64a()
+	bs := make([]byte, binary.MaxVarintLen64)
+	d.data.scan("", "", func(k Key, v Value) bool {
+		h.Write(bs[:binary.PutUvarint(bs, uint64(len(k)))])
+		h.Write([]byte(k))
+		h.Write(bs[:binary.PutUvarint(bs, uint64(len(v)))])
+		h.Write(v)
+		return true
+	})
+	return h.Sum64()
 }
 
 func (d *database) String() string {
 	d.RLock()
 	defer d.RUnlock()
-	b, _ := json.Marshal(d.data)
+	b, _ := json.Marshal(d.dataMap())
 	return string(b)
 }
 
-// Conflict checks if two commands are conflicting as reorder them will end in different states
+// dataMap copies every key and value to a map
+func (d *database) dataMap() map[Key]Value {
+	m := make(map[Key]Value)
+	d.data.scan("", "", func(k Key, v Value) bool {
+		m[k] = v
+		return true
+	})
+	return m
+}
+
+// Conflict checks if two commands are conflicting as reorder them will end in different states or results.
+// Only reads of the same key commute. Increments conflict with each other too, because they return the
+// value before the increment, and a CAS conflicts with every write as its outcome depends on their order.
+// Scans conflict with writes of keys in their range
 func Conflict(gamma *Command, delta *Command) bool {
-	if gamma.Key == delta.Key {
-		if !gamma.IsRead() || !delta.IsRead() {
-			return true
-		}
+	if gamma.IsTransaction() || delta.IsTransaction() {
+		return ConflictBatch(commands(gamma), commands(delta))
 	}
-	return false
+	if gamma.IsRead() && delta.IsRead() {
+		return false
+	}
+	if gamma.Operation() == Scan {
+		return inRange(delta.Key, gamma)
+	}
+	if delta.Operation() == Scan {
+		return inRange(gamma.Key, delta)
+	}
+	return gamma.Key == delta.Key
+}
+
+// commands returns commands of transaction c or c itself
+func commands(c *Command) []Command {
+	if !c.IsTransaction() {
+		return []Command{*c}
+	}
+	t, err := c.Transaction()
+	if err != nil {
+		log.Error(err)
+	}
+	return t.Commands
 }
 
 // ConflictBatch checks if two batchs of commands are conflict
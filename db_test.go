@@ -0,0 +1,117 @@
+package paxi
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDatabaseOperations(t *testing.T) {
+	db := NewDatabase()
+	db.Execute(Command{Key: "k", Value: []byte("a")})
+
+	if v := db.Execute(Command{Key: "k", Op: CAS, Expect: []byte("b"), Value: []byte("c")}); !v.Equals([]byte("a")) {
+		t.Errorf("expect failed CAS to return current value, got %q", v)
+	}
+	if v := db.Get("k"); !v.Equals([]byte("a")) {
+		t.Errorf("expect failed CAS to keep value, got %q", v)
+	}
+	db.Execute(Command{Key: "k", Op: CAS, Expect: []byte("a"), Value: []byte("b")})
+	if v := db.Get("k"); !v.Equals([]byte("b")) {
+		t.Errorf("expect CAS to swap value, got %q", v)
+	}
+
+	db.Execute(Command{Key: "k", Op: Delete})
+	if v := db.Get("k"); v != nil {
+		t.Errorf("expect deleted key to have no value, got %q", v)
+	}
+
+	db.Execute(Command{Key: "n", Op: Increment})
+	db.Execute(Command{Key: "n", Op: Increment, Value: []byte("41")})
+	if v := db.Get("n"); !v.Equals([]byte("42")) {
+		t.Errorf("expect counter 42, got %q", v)
+	}
+	if err := (Command{Key: "n", Op: Increment}).Error([]byte("41")); err != nil {
+		t.Errorf("expect increment of integer to succeed, got %v", err)
+	}
+
+	db.Execute(Command{Key: "k", Value: []byte("x")})
+	inc := Command{Key: "k", Op: Increment}
+	if err := inc.Error(db.Execute(inc)); err != ErrNotInteger {
+		t.Errorf("expect increment of non-integer to fail with %v, got %v", ErrNotInteger, err)
+	}
+	if v := db.Get("k"); !v.Equals([]byte("x")) {
+		t.Errorf("expect failed increment to keep value, got %q", v)
+	}
+	cas := Command{Key: "k", Op: CAS, Expect: []byte("y"), Value: []byte("z")}
+	if err := cas.Error(db.Execute(cas)); err != ErrCASFailed {
+		t.Errorf("expect failed CAS to fail with %v, got %v", ErrCASFailed, err)
+	}
+}
+
+func TestConflict(t *testing.T) {
+	get := Command{Key: "k"}
+	put := Command{Key: "k", Value: []byte("v")}
+	inc := Command{Key: "k", Op: Increment}
+	other := Command{Key: "o", Op: Delete}
+
+	cases := []struct {
+		a, b     Command
+		conflict bool
+	}{
+		{get, get, false},
+		{get, put, true},
+		{inc, inc, true},
+		{get, inc, true},
+		{put, other, false},
+		{ScanCommand("a", "l", 0), put, true},
+		{ScanCommand("l", "", 0), put, false},
+		{ScanCommand("a", "", 0), get, false},
+	}
+	for _, c := range cases {
+		if Conflict(&c.a, &c.b) != c.conflict {
+			t.Errorf("expect conflict of %v and %v to be %v", c.a, c.b, c.conflict)
+		}
+	}
+}
+
+func TestOpJSON(t *testing.T) {
+	var cmd Command
+	err := json.Unmarshal([]byte(`{"Key":"k","Op":"cas","Expect":"YQ==","Value":"Yg=="}`), &cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Operation() != CAS || !cmd.Expect.Equals([]byte("a")) {
+		t.Errorf("unexpected command %v", cmd)
+	}
+	if err := json.Unmarshal([]byte(`"swap"`), &cmd.Op); err == nil {
+		t.Error("expect error for unknown operation")
+	}
+}
+
+func TestDatabaseScan(t *testing.T) {
+	db := NewDatabase()
+	for _, k := range []Key{"d", "a", "c", "b", "e"} {
+		db.Put(k, Value(k))
+	}
+	db.Execute(Command{Key: "c", Op: Delete})
+
+	kvs := db.Scan("b", "e", 0)
+	if len(kvs) != 2 || kvs[0].Key != "b" || kvs[1].Key != "d" || !kvs[1].Value.Equals([]byte("d")) {
+		t.Errorf("unexpected scan result %v", kvs)
+	}
+
+	cmd := ScanCommand("a", "", 3)
+	kvs, err := Reply{Command: cmd, Value: db.Execute(cmd)}.KeyValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 3 || kvs[0].Key != "a" || kvs[2].Key != "d" {
+		t.Errorf("unexpected scan result %v", kvs)
+	}
+
+	cmd = ScanCommand("x", "", 0)
+	kvs, err = Reply{Command: cmd, Value: db.Execute(cmd)}.KeyValues()
+	if err != nil || len(kvs) != 0 {
+		t.Errorf("expect empty scan result, got %v, %v", kvs, err)
+	}
+}
@@ -0,0 +1,182 @@
+package paxi
+
+import (
+	"encoding/binary"
+	"path/filepath"
+
+	"pigpaxos/lib"
+	"pigpaxos/log"
+)
+
+// prefixes of the key spaces of disk storage
+const (
+	diskDataPrefix    = "d" // "d" key -> value
+	diskHistoryPrefix = "h" // "h" len(key) key seq -> flag value, flag 0 for a removed key
+	diskCountPrefix   = "n" // "n" key -> number of values in history
+)
+
+// NewDiskDatabase returns database that keeps its keys, values and history in an LSM tree in dir.
+// The database opens at the state of its last snapshot, later commands are applied again from the log
+func NewDiskDatabase(dir string, memtableSize int) (Database, error) {
+	s, err := lib.OpenLSM(dir, memtableSize)
+	if err != nil {
+		return nil, err
+	}
+	return &database{
+		data:         &diskStorage{lsm: s},
+		multiversion: config.MultiVersion,
+	}, nil
+}
+
+// newStateMachine returns the database of node id selected by the storage configuration
+func newStateMachine(id ID) StateMachine {
+	if config.Storage != "disk" {
+		return NewDatabase()
+	}
+	db, err := NewDiskDatabase(filepath.Join(config.StorageDir, id.String()), config.MemtableSize)
+	if err != nil {
+		log.Fatalf("node %v cannot open database: %v", id, err)
+	}
+	if config.WALDir == "" {
+		// without write-ahead log the replica restarts from an empty log, so it must start from an empty state too
+		log.Warningf("node %v clears disk database as no write-ahead log is configured", id)
+		db.(*database).data.clear()
+	}
+	return db
+}
+
+// diskStorage is the storage of database in an LSM tree on local disk.
+// Failed disk operations are fatal as the replica cannot go on with a partially applied command
+type diskStorage struct {
+	lsm   *lib.LSM
+	dirty bool // changed after the last checkpoint
+}
+
+func historyKey(k Key, seq uint64) string {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, uint64(len(k)))
+	s := make([]byte, 8)
+	binary.BigEndian.PutUint64(s, seq)
+	return diskHistoryPrefix + string(b[:n]) + string(k) + string(s)
+}
+
+// prefixEnd returns the first key after every key with prefix p
+func prefixEnd(p string) string {
+	return p[:len(p)-1] + string(p[len(p)-1]+1)
+}
+
+func (s *diskStorage) fatal(err error) {
+	if err != nil {
+		log.Fatalf("disk storage failed: %v", err)
+	}
+}
+
+func (s *diskStorage) get(k Key) (Value, bool) {
+	v, exists, err := s.lsm.Get(diskDataPrefix + string(k))
+	s.fatal(err)
+	return v, exists
+}
+
+func (s *diskStorage) put(k Key, v Value) {
+	s.dirty = true
+	s.fatal(s.lsm.Put(diskDataPrefix+string(k), v))
+}
+
+func (s *diskStorage) delete(k Key) bool {
+	if _, exists := s.get(k); !exists {
+		return false
+	}
+	s.dirty = true
+	s.fatal(s.lsm.Delete(diskDataPrefix + string(k)))
+	return true
+}
+
+func (s *diskStorage) scan(start, end Key, f func(Key, Value) bool) {
+	e := diskDataPrefix + string(end)
+	if end == "" {
+		e = prefixEnd(diskDataPrefix)
+	}
+	s.fatal(s.lsm.Range(diskDataPrefix+string(start), e, func(k string, v []byte) bool {
+		return f(Key(k[len(diskDataPrefix):]), v)
+	}))
+}
+
+func (s *diskStorage) count(k Key) uint64 {
+	b, _, err := s.lsm.Get(diskCountPrefix + string(k))
+	s.fatal(err)
+	n, _ := binary.Uvarint(b)
+	return n
+}
+
+func (s *diskStorage) history(k Key) []Value {
+	n := s.count(k)
+	if n == 0 {
+		return nil
+	}
+	h := make([]Value, 0, n)
+	s.fatal(s.lsm.Range(historyKey(k, 0), historyKey(k, n), func(_ string, v []byte) bool {
+		if v[0] == 0 {
+			h = append(h, nil)
+		} else {
+			h = append(h, v[1:])
+		}
+		return true
+	}))
+	return h
+}
+
+func (s *diskStorage) appendHistory(k Key, v Value) {
+	n := s.count(k)
+	flag := byte(0)
+	if v != nil {
+		flag = 1
+	}
+	s.dirty = true
+	s.fatal(s.lsm.Put(historyKey(k, n), append([]byte{flag}, v...)))
+	b := make([]byte, binary.MaxVarintLen64)
+	s.fatal(s.lsm.Put(diskCountPrefix+string(k), b[:binary.PutUvarint(b, n+1)]))
+}
+
+func (s *diskStorage) histories(f func(Key, []Value)) {
+	keys := make([]Key, 0)
+	s.fatal(s.lsm.Range(diskCountPrefix, prefixEnd(diskCountPrefix), func(k string, _ []byte) bool {
+		keys = append(keys, Key(k[len(diskCountPrefix):]))
+		return true
+	}))
+	for _, k := range keys {
+		f(k, s.history(k))
+	}
+}
+
+func (s *diskStorage) checkpoint() (string, error) {
+	id, err := s.lsm.TakeCheckpoint()
+	if err == nil {
+		s.dirty = false
+	}
+	return id, err
+}
+
+func (s *diskStorage) release(id string) {
+	s.fatal(s.lsm.Release(id))
+}
+
+// restore returns to the last checkpoint or the stable one. The last checkpoint may be newer than the snapshot
+// in the write-ahead log if the replica failed before the snapshot was durable
+func (s *diskStorage) restore(id string) bool {
+	if s.dirty || s.lsm.Checkpoint() != id {
+		ok, err := s.lsm.Rollback(id)
+		s.fatal(err)
+		if !ok {
+			return false
+		}
+		s.dirty = false
+	}
+	// the snapshot being restored is durable
+	s.release(id)
+	return true
+}
+
+func (s *diskStorage) clear() {
+	s.fatal(s.lsm.Clear())
+	s.dirty = true
+}
@@ -0,0 +1,122 @@
+package paxi
+
+import (
+	"testing"
+)
+
+func TestDiskDatabase(t *testing.T) {
+	config.MultiVersion = true
+	defer func() { config.MultiVersion = false }()
+	dir := t.TempDir()
+	db, err := NewDiskDatabase(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		db.Execute(Command{Key: IntKey(i % 10), Value: []byte{byte(i)}})
+	}
+	db.Execute(Command{Key: "3", Op: Delete})
+	if v := db.Get("1"); !v.Equals([]byte{91}) {
+		t.Errorf("expect 1 to be 91, got %v", v)
+	}
+	if h := db.History("3"); len(h) != 11 || h[10] != nil || !h[9].Equals([]byte{93}) {
+		t.Errorf("unexpected history of 3 %v", h)
+	}
+	if kvs := db.Scan("2", "5", 0); len(kvs) != 2 || kvs[0].Key != "2" || kvs[1].Key != "4" {
+		t.Errorf("unexpected scan %v", kvs)
+	}
+
+	s, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := db.(Exporter).Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) >= len(exported) {
+		t.Errorf("expect snapshot to refer to the checkpoint, got %d bytes for %d exported", len(s), len(exported))
+	}
+	hash := db.Hash()
+	db.Execute(Command{Key: "1", Value: []byte("after snapshot")})
+
+	// a restarted replica keeps its state on disk
+	reopened, err := NewDiskDatabase(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Hash() != hash || len(reopened.History("3")) != 11 {
+		t.Errorf("expect reopened database at snapshot, got %v", reopened)
+	}
+
+	// other replicas do not have the checkpoint and install the exported state
+	other, err := NewDiskDatabase(t.TempDir(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Restore(s); err == nil {
+		t.Error("expect snapshot of a checkpoint not to be restored on another disk")
+	}
+	other.Put("x", []byte("y"))
+	if err := other.Restore(exported); err != nil {
+		t.Fatal(err)
+	}
+	if other.Hash() != hash || len(other.History("3")) != 11 {
+		t.Errorf("expect installed snapshot, got %v", other)
+	}
+	memory := NewDatabase()
+	memory.Restore(exported)
+	if memory.Hash() != hash {
+		t.Errorf("expect snapshot to be restored in memory, got %v", memory)
+	}
+}
+
+func TestDiskDatabaseSnapshotNotDurable(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDiskDatabase(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Execute(Command{Key: "k", Value: []byte("durable")})
+	durable, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the write-ahead log stored the snapshot
+	if err := db.(Checkpointer).Release(durable); err != nil {
+		t.Fatal(err)
+	}
+	hash := db.Hash()
+
+	// the replica fails after the next checkpoint, before its snapshot is stored
+	db.Execute(Command{Key: "k", Value: []byte("lost")})
+	if _, err := db.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewDiskDatabase(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Restore(durable); err != nil {
+		t.Fatalf("expect snapshot stored in the write-ahead log to be restored, got %v", err)
+	}
+	if reopened.Hash() != hash {
+		t.Errorf("expect database at the durable snapshot, got %v", reopened)
+	}
+
+	// a missing checkpoint keeps the state on disk until a full snapshot is installed
+	other, err := NewDiskDatabase(t.TempDir(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Put("x", []byte("y"))
+	if err := other.Restore(durable); err == nil {
+		t.Error("expect snapshot of a checkpoint not to be restored on another disk")
+	}
+	if v := other.Get("x"); !v.Equals([]byte("y")) {
+		t.Errorf("expect failed restore to keep the state, got %q", v)
+	}
+}
@@ -0,0 +1,123 @@
+package paxi
+
+import (
+	"time"
+
+	"pigpaxos/log"
+)
+
+// Entry is a slot of the acceptor log shared by paxos, pigpaxos, layerpaxos and chainpaxos
+type Entry struct {
+	Ballot    Ballot
+	Commands  []Command // commands accepted in the slot, protocols without batching accept one
+	Commit    bool
+	Requests  []*Request // requests of commands proposed by this node, nil once replied or forwarded
+	Quorum    *Quorum
+	Timestamp time.Time
+	Hash      string // hash of commands a witness dropped after every node executed the slot
+}
+
+// Command returns the first command of the slot, the only one in protocols without batching
+func (e *Entry) Command() Command {
+	if len(e.Commands) == 0 {
+		return Command{}
+	}
+	return e.Commands[0]
+}
+
+// Request returns the request of the first command of the slot, nil if this node did not propose it
+func (e *Entry) Request() *Request {
+	if len(e.Requests) == 0 {
+		return nil
+	}
+	return e.Requests[0]
+}
+
+// Chosen reports if the slot is committed with known commands. A slot committed with no ballot
+// only heard of the commit and still has to be recovered
+func (e *Entry) Chosen() bool {
+	return e.Commit && e.Ballot != 0
+}
+
+// ReplayWAL loads the last snapshot of w and replays accepted slots after it into log.
+// It returns the snapshot, nil if there is none, the highest promised ballot and the highest accepted slot
+func ReplayWAL(w WAL, log map[int]*Entry) (*Snapshot, Ballot, int, error) {
+	s, err := w.LoadSnapshot()
+	if err != nil {
+		return nil, 0, -1, err
+	}
+	var ballot Ballot
+	slot, execute := -1, 0
+	if s != nil {
+		ballot = s.Ballot
+		slot = s.Slot
+		execute = s.Slot + 1
+	}
+	err = w.Replay(func(r WALRecord) {
+		if r.Type != WALPromise && r.Slot < execute {
+			// already part of the snapshot
+			return
+		}
+		switch r.Type {
+		case WALPromise:
+			if r.Ballot > ballot {
+				ballot = r.Ballot
+			}
+		case WALAccept:
+			if r.Ballot > ballot {
+				ballot = r.Ballot
+			}
+			slot = Max(slot, r.Slot)
+			e, exists := log[r.Slot]
+			if !exists {
+				e = &Entry{}
+				log[r.Slot] = e
+			}
+			if r.Ballot >= e.Ballot {
+				e.Ballot = r.Ballot
+				e.Commands = r.Commands
+			}
+		case WALCommit:
+			if e, exists := log[r.Slot]; exists {
+				e.Commit = true
+			}
+		}
+	})
+	return s, ballot, slot, err
+}
+
+// WALRecords returns accepted slots of log from slot from to slot to that must survive write-ahead log compaction
+func WALRecords(ballot Ballot, log map[int]*Entry, from, to int) []WALRecord {
+	records := []WALRecord{{Type: WALPromise, Ballot: ballot}}
+	for s := from; s <= to; s++ {
+		e, exists := log[s]
+		if !exists || e.Ballot == 0 {
+			continue
+		}
+		records = append(records, WALRecord{Type: WALAccept, Slot: s, Ballot: e.Ballot, Commands: e.Commands})
+		if e.Commit {
+			records = append(records, WALRecord{Type: WALCommit, Slot: s})
+		}
+	}
+	return records
+}
+
+// PersistPromise makes ballot b promised by node id durable. It logs the error and returns false
+// if the promise is not durable, P1b must not be sent then
+func PersistPromise(w WAL, id ID, b Ballot) bool {
+	if err := w.Promise(b); err != nil {
+		log.Errorf("Replica %s cannot persist ballot %v: %v", id, b, err)
+		return false
+	}
+	return true
+}
+
+// PersistAccept makes commands node id accepted in slot with ballot b durable. It logs the error and returns false
+// if the slot is not durable, P2b must not be sent then
+func PersistAccept(w WAL, id ID, slot int, b Ballot, cmds ...Command) bool {
+	if err := w.Accept(slot, b, cmds...); err != nil {
+		log.Errorf("Replica %s cannot persist slot %d: %v", id, slot, err)
+		return false
+	}
+	return true
+}
@@ -1,18 +1,17 @@
 package epaxos
 
 import (
-	"encoding/gob"
 	"fmt"
 
 	"pigpaxos"
 )
 
 func init() {
-	gob.Register(PreAccept{})
-	gob.Register(PreAcceptReply{})
-	gob.Register(Accept{})
-	gob.Register(AcceptReply{})
-	gob.Register(Commit{})
+	paxi.RegisterMessage(PreAccept{})
+	paxi.RegisterMessage(PreAcceptReply{})
+	paxi.RegisterMessage(Accept{})
+	paxi.RegisterMessage(AcceptReply{})
+	paxi.RegisterMessage(Commit{})
 }
 
 type PreAccept struct {
@@ -25,9 +25,9 @@ type Replica struct {
 }
 
 // NewReplica initialize replica and register all message types
-func NewReplica(id paxi.ID) *Replica {
+func NewReplica(id paxi.ID, options ...paxi.NodeOption) *Replica {
 	r := &Replica{
-		Node:         paxi.NewNode(id),
+		Node:         paxi.NewNode(id, options...),
 		log:          make(map[paxi.ID]map[int]*instance),
 		slot:         make(map[paxi.ID]int),
 		committed:    make(map[paxi.ID]int),
@@ -16,20 +16,20 @@ import (
 // History client operation history mapped by key
 type History struct {
 	sync.RWMutex
-	shard      map[int][]*operation
+	shard      map[Key][]*operation
 	operations []*operation
 }
 
 // NewHistory creates a History map
 func NewHistory() *History {
 	return &History{
-		shard:      make(map[int][]*operation),
+		shard:      make(map[Key][]*operation),
 		operations: make([]*operation, 0),
 	}
 }
 
 // Add puts an operation in History
-func (h *History) Add(key int, input, output Value, start, end int64) {
+func (h *History) Add(key Key, input, output Value, start, end int64) {
 	h.Lock()
 	defer h.Unlock()
 	if _, exists := h.shard[key]; !exists {
@@ -41,7 +41,7 @@ func (h *History) Add(key int, input, output Value, start, end int64) {
 }
 
 // AddOperation adds the operation
-func (h *History) AddOperation(key int, o *operation) {
+func (h *History) AddOperation(key Key, o *operation) {
 	h.Lock()
 	defer h.Unlock()
 	if _, exists := h.shard[key]; !exists {
@@ -134,11 +134,8 @@ func (h *History) ReadFile(path string) error {
 			return errors.New("operation history file format error")
 		}
 
-		// get id / key
-		id, err := strconv.Atoi(record[0])
-		if err != nil {
-			return err
-		}
+		// get key
+		key := Key(record[0])
 
 		operation := new(operation)
 
@@ -172,7 +169,7 @@ func (h *History) ReadFile(path string) error {
 		}
 		operation.end = end
 
-		h.AddOperation(id, operation)
+		h.AddOperation(key, operation)
 	}
 
 	return file.Close()
@@ -1,11 +1,13 @@
 package paxi
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strconv"
 	"time"
 
@@ -16,8 +18,10 @@ import (
 const (
 	HTTPClientID  = "Id"
 	HTTPCommandID = "Cid"
+	HTTPSession   = "Session" // random 64-bit session id of the client in hex
 	HTTPTimestamp = "Timestamp"
 	HTTPNodeID    = "Id"
+	HTTPIfMatch   = "If-Match" // expected value of compare-and-swap
 )
 
 // serve serves the http REST API request from clients
@@ -25,8 +29,13 @@ func (n *node) http() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", n.handleRoot)
 	mux.HandleFunc("/history", n.handleHistory)
-	mux.HandleFunc("/crash", n.handleCrash)
-	mux.HandleFunc("/drop", n.handleDrop)
+	mux.HandleFunc("/crash", admin(n.handleCrash))
+	mux.HandleFunc("/drop", admin(n.handleDrop))
+	mux.HandleFunc("/reconfig", admin(n.handleReconfig))
+	mux.HandleFunc("/leader/transfer", admin(n.handleLeaderTransfer))
+	mux.HandleFunc("/txn", n.handleTxn)
+	mux.HandleFunc("/scan", n.handleScan)
+	mux.HandleFunc("/stats", n.handleStats)
 	// http string should be in form of ":8080"
 	url, err := url.Parse(config.HTTPAddrs[n.id])
 	if err != nil {
@@ -37,8 +46,33 @@ func (n *node) http() {
 		Addr:    port,
 		Handler: mux,
 	}
-	log.Info("http server starting on ", port)
-	log.Fatal(n.server.ListenAndServe())
+	tlsConfig := GetConfig().TLS
+	if !tlsConfig.Enabled() {
+		log.Info("http server starting on ", port)
+		log.Fatal(n.server.ListenAndServe())
+	}
+	n.server.TLSConfig, err = tlsConfig.NodeConfig(n.id)
+	if err != nil {
+		log.Fatal("https config error: ", err)
+	}
+	// clients without certificate can only use the key-value API
+	n.server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	n.server.TLSConfig.VerifyPeerCertificate = nil
+	log.Info("https server starting on ", port)
+	log.Fatal(n.server.ListenAndServeTLS("", ""))
+}
+
+// admin allows only clients with a verified admin certificate to call handler h
+func admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := GetConfig().TLS.authorize(r)
+		if err != nil {
+			log.Errorf("reject %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
 }
 
 func (n *node) handleRoot(w http.ResponseWriter, r *http.Request) {
@@ -54,6 +88,17 @@ func (n *node) handleRoot(w http.ResponseWriter, r *http.Request) {
 			cmd.ClientID = ID(cid)
 			continue
 		}
+		if k == HTTPSession {
+			cmd.Session, err = strconv.ParseUint(r.Header.Get(HTTPSession), 16, 64)
+			if err != nil {
+				http.Error(w, "invalide session", http.StatusBadRequest)
+				return
+			}
+			continue
+		}
+		if k == HTTPIfMatch {
+			continue
+		}
 		if k == HTTPCommandID {
 			cmd.CommandID, err = strconv.Atoi(r.Header.Get(HTTPCommandID))
 			if err != nil {
@@ -66,14 +111,25 @@ func (n *node) handleRoot(w http.ResponseWriter, r *http.Request) {
 
 	// get command key and value
 	if len(r.URL.Path) > 1 {
-		i, err := strconv.Atoi(r.URL.Path[1:])
-		if err != nil {
-			http.Error(w, "invalid path", http.StatusBadRequest)
-			log.Error(err)
-			return
+		// path is unescaped, so keys can have any bytes
+		cmd.Key = Key(r.URL.Path[1:])
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+			cmd.Op = Put
+		case http.MethodDelete:
+			cmd.Op = Delete
+		case http.MethodPatch:
+			// PATCH swaps the value if it matches If-Match, otherwise increments the value by the body
+			if _, exists := r.Header[HTTPIfMatch]; exists {
+				cmd.Op = CAS
+				cmd.Expect = Value(r.Header.Get(HTTPIfMatch))
+			} else {
+				cmd.Op = Increment
+			}
+		default:
+			cmd.Op = Get
 		}
-		cmd.Key = Key(i)
-		if r.Method == http.MethodPut || r.Method == http.MethodPost {
+		if cmd.Op == Put || cmd.Op == CAS || cmd.Op == Increment {
 			body, err := ioutil.ReadAll(r.Body)
 			if err != nil {
 				log.Error("error reading body: ", err)
@@ -91,9 +147,18 @@ func (n *node) handleRoot(w http.ResponseWriter, r *http.Request) {
 		}
 		json.Unmarshal(body, &cmd)
 	}
+	if cmd.Key.Reserved() {
+		http.Error(w, "reserved key", http.StatusBadRequest)
+		return
+	}
+	if n.sessions.clash(cmd) {
+		http.Error(w, ErrSessionInUse.Error(), http.StatusConflict)
+		return
+	}
 
-	req.Command = cmd
 	req.Timestamp = time.Now().UnixNano()
+	cmd.Timestamp = req.Timestamp
+	req.Command = cmd
 	req.NodeID = n.id // TODO does this work when forward twice
 	req.c = make(chan Reply, 1)
 
@@ -112,6 +177,14 @@ func (n *node) handleRoot(w http.ResponseWriter, r *http.Request) {
 	for k, v := range reply.Properties {
 		w.Header().Set(k, v)
 	}
+	switch reply.Command.Error(reply.Value) {
+	case ErrCASFailed:
+		// the current value is returned with the failed swap
+		w.WriteHeader(http.StatusPreconditionFailed)
+	case ErrNotInteger:
+		// the current value is returned with the failed increment
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
 
 	_, err = io.WriteString(w, string(reply.Value))
 	if err != nil {
@@ -121,15 +194,18 @@ func (n *node) handleRoot(w http.ResponseWriter, r *http.Request) {
 
 func (n *node) handleHistory(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(HTTPNodeID, string(n.id))
-	k, err := strconv.Atoi(r.URL.Query().Get("key"))
-	if err != nil {
-		log.Error(err)
+	if !r.URL.Query().Has("key") {
 		http.Error(w, "invalide key", http.StatusBadRequest)
 		return
 	}
-	h := n.Database.History(Key(k))
+	db, ok := n.StateMachine.(Database)
+	if !ok {
+		http.Error(w, "state machine has no history", http.StatusNotImplemented)
+		return
+	}
+	h := db.History(Key(r.URL.Query().Get("key")))
 	b, _ := json.Marshal(h)
-	_, err = w.Write(b)
+	_, err := w.Write(b)
 	if err != nil {
 		log.Error(err)
 	}
@@ -151,6 +227,191 @@ func (n *node) handleCrash(w http.ResponseWriter, r *http.Request) {
 	// }()
 }
 
+// handleStats replies with JSON object of statistics registered by the protocol
+func (n *node) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats := make(map[string]interface{})
+	n.RLock()
+	for name, f := range n.stats {
+		stats[name] = f()
+	}
+	n.RUnlock()
+	b, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// handleScan reads keys in range through the log
+// /scan?start=a&end=b&limit=10 replies with JSON array of keys and values, end and limit are optional
+func (n *node) handleScan(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 0
+	if q.Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(q.Get("limit"))
+		if err != nil || limit < 0 {
+			http.Error(w, "invalide limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	req := Request{
+		Command:    ScanCommand(Key(q.Get("start")), Key(q.Get("end")), limit),
+		Properties: make(map[string]string),
+		Timestamp:  time.Now().UnixNano(),
+		NodeID:     n.id,
+		c:          make(chan Reply, 1),
+	}
+	cid, _ := strconv.Atoi(r.Header.Get(HTTPClientID))
+	req.Command.ClientID = ID(cid)
+	req.Command.CommandID, _ = strconv.Atoi(r.Header.Get(HTTPCommandID))
+	req.Command.Timestamp = req.Timestamp
+	n.MessageChan <- req
+	reply := <-req.c
+	if reply.Err != nil {
+		http.Error(w, reply.Err.Error(), http.StatusInternalServerError)
+		return
+	}
+	kvs, err := reply.KeyValues()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(kvs)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// handleTxn proposes multi-key transaction posted as JSON object {"Commands": [...]}.
+// It replies with the result of every command, or 409 Conflict if the transaction aborts
+func (n *node) handleTxn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "transactions must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	var t Transaction
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil || len(t.Commands) == 0 {
+		http.Error(w, "invalide transaction", http.StatusBadRequest)
+		return
+	}
+	for _, c := range t.Commands {
+		if c.Key.Reserved() {
+			http.Error(w, "reserved key", http.StatusBadRequest)
+			return
+		}
+	}
+
+	req := Request{
+		Command:    t.Command(),
+		Properties: make(map[string]string),
+		Timestamp:  time.Now().UnixNano(),
+		NodeID:     n.id,
+		c:          make(chan Reply, 1),
+	}
+	cid, _ := strconv.Atoi(r.Header.Get(HTTPClientID))
+	req.Command.ClientID = ID(cid)
+	req.Command.CommandID, _ = strconv.Atoi(r.Header.Get(HTTPCommandID))
+	req.Command.Session, err = strconv.ParseUint(r.Header.Get(HTTPSession), 16, 64)
+	if err != nil && r.Header.Get(HTTPSession) != "" {
+		http.Error(w, "invalide session", http.StatusBadRequest)
+		return
+	}
+	if n.sessions.clash(req.Command) {
+		http.Error(w, ErrSessionInUse.Error(), http.StatusConflict)
+		return
+	}
+	req.Command.Timestamp = req.Timestamp
+	n.MessageChan <- req
+	reply := <-req.c
+	if reply.Err != nil {
+		http.Error(w, reply.Err.Error(), http.StatusInternalServerError)
+		return
+	}
+	txnReply, err := reply.TransactionReply()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !txnReply.OK {
+		http.Error(w, txnReply.Err.Error(), http.StatusConflict)
+		return
+	}
+	b, _ := json.Marshal(txnReply)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// handleReconfig proposes membership change
+// POST /reconfig?op=add&id=1.4&addr=tcp://127.0.0.1:1738&http=http://127.0.0.1:8084 or POST /reconfig?op=remove&id=1.4
+func (n *node) handleReconfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "membership change must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var rc Reconfig
+	rc.ID = NewIDFromString(r.URL.Query().Get("id"))
+	switch r.URL.Query().Get("op") {
+	case "add":
+		rc.Op = AddNode
+		rc.Addr = r.URL.Query().Get("addr")
+		rc.HTTPAddr = r.URL.Query().Get("http")
+		if rc.Addr == "" || rc.HTTPAddr == "" {
+			http.Error(w, "missing node address", http.StatusBadRequest)
+			return
+		}
+	case "remove":
+		rc.Op = RemoveNode
+	default:
+		http.Error(w, "invalide operation", http.StatusBadRequest)
+		return
+	}
+
+	req := Request{
+		Command:    rc.Command(),
+		Properties: make(map[string]string),
+		Timestamp:  time.Now().UnixNano(),
+		NodeID:     n.id,
+		c:          make(chan Reply, 1),
+	}
+	n.MessageChan <- req
+	reply := <-req.c
+	if reply.Err != nil {
+		http.Error(w, reply.Err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("node %v committed %v", n.id, rc)
+}
+
+// handleLeaderTransfer asks the leader to hand leadership over to another node
+// POST /leader/transfer?to=1.3 returns once the request is passed to the protocol, the transfer itself is asynchronous
+func (n *node) handleLeaderTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "leader transfer must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	to := NewIDFromString(r.URL.Query().Get("to"))
+	if _, exists := GetConfig().Addrs[to]; !exists {
+		http.Error(w, "unknown node", http.StatusBadRequest)
+		return
+	}
+	if _, exists := n.handles[reflect.TypeOf(LeaderTransfer{}).String()]; !exists {
+		http.Error(w, "protocol does not support leader transfer", http.StatusNotImplemented)
+		return
+	}
+	log.Infof("node %v asked to transfer leadership to %v", n.id, to)
+	n.MessageChan <- LeaderTransfer{To: to}
+}
+
 func (n *node) handleDrop(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	t, err := strconv.Atoi(r.URL.Query().Get("t"))
@@ -6,7 +6,9 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -66,3 +68,50 @@ func TestHTTP(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestHTTPReservedKey(t *testing.T) {
+	n := &node{MessageChan: make(chan interface{}, 1)}
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodPut, "/%00reconfig", strings.NewReader("members")),
+		httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"Key":"\u0000txn","Value":"AA=="}`)),
+	}
+	for _, r := range requests {
+		w := httptest.NewRecorder()
+		n.handleRoot(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s returned %d, want %d", r.Method, r.URL, w.Code, http.StatusBadRequest)
+		}
+	}
+	if len(n.MessageChan) != 0 {
+		t.Error("request on reserved key reached the protocol")
+	}
+}
+
+func TestHTTPReconfigMethod(t *testing.T) {
+	n := &node{MessageChan: make(chan interface{}, 1)}
+	w := httptest.NewRecorder()
+	n.handleReconfig(w, httptest.NewRequest(http.MethodGet, "/reconfig?op=remove&id=1.3", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /reconfig returned %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if len(n.MessageChan) != 0 {
+		t.Error("membership change by GET reached the protocol")
+	}
+}
+
+func TestHTTPIncrementNotInteger(t *testing.T) {
+	n := &node{MessageChan: make(chan interface{}, 1)}
+	go func() {
+		req := (<-n.MessageChan).(Request)
+		// the value before the increment
+		req.Reply(Reply{Command: req.Command, Value: Value("x")})
+	}()
+	w := httptest.NewRecorder()
+	n.handleRoot(w, httptest.NewRequest(http.MethodPatch, "/k", strings.NewReader("1")))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("increment of non-integer returned %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	if w.Body.String() != "x" {
+		t.Errorf("expect failed increment to return current value, got %q", w.Body.String())
+	}
+}
@@ -1,24 +1,24 @@
 package layerpaxos
 
 import (
-	"encoding/gob"
 	"fmt"
 	"pigpaxos"
 	"sync"
 )
 
 func init() {
-	gob.Register(P1b{})
-	gob.Register(P2b{})
-	gob.Register(P2bAggregated{})
-	gob.Register([]P1b{})
-	gob.Register([]P2b{})
-	gob.Register(P1a{})
-	gob.Register(P2a{})
-	gob.Register(P3{})
-	gob.Register(P3RecoverRequest{})
-	gob.Register(P3RecoverReply{})
-	gob.Register(RoutedMsg{})
+	paxi.RegisterMessage(P1b{})
+	paxi.RegisterMessage(P2b{})
+	paxi.RegisterMessage(P2bAggregated{})
+	paxi.RegisterMessage([]P1b{})
+	paxi.RegisterMessage([]P2b{})
+	paxi.RegisterMessage(P1a{})
+	paxi.RegisterMessage(P2a{})
+	paxi.RegisterMessage(P3{})
+	paxi.RegisterMessage(P3RecoverRequest{})
+	paxi.RegisterMessage(P3RecoverReply{})
+	paxi.RegisterMessage(Transfer{})
+	paxi.RegisterMessage(RoutedMsg{})
 }
 
 // CommandBallot combines each command with its ballot number
@@ -138,3 +138,14 @@ type P3RecoverReply struct {
 func (m P3RecoverReply) String() string {
 	return fmt.Sprintf("P3RecoverReply {b=%v slots=%d, cmd=%v}", m.Ballot, m.Slot, m.Command)
 }
+
+// Transfer hands leadership of Ballot over to the receiver together with the slots the leader has not committed
+type Transfer struct {
+	Ballot paxi.Ballot
+	Log    map[int]CommandBallot
+	Zone   int // zone the new leader leads from, 0 if none
+}
+
+func (m Transfer) String() string {
+	return fmt.Sprintf("Transfer {b=%v zone=%d log=%v}", m.Ballot, m.Zone, m.Log)
+}
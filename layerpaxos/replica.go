@@ -77,10 +77,10 @@ type Replica struct {
 }
 
 // NewReplica generates new Paxos replica
-func NewReplica(id paxi.ID) *Replica {
+func NewReplica(id paxi.ID, options ...paxi.NodeOption) *Replica {
 	log.Debugf("LayerPaxos Starting replica %v", id)
 	r := new(Replica)
-	r.Node = paxi.NewNode(id)
+	r.Node = paxi.NewNode(id, options...)
 	r.LayerPaxos = NewLayerPaxos(r)
 	r.Register(paxi.Request{}, r.handleRequest)
 	r.Register(P1b{}, r.handleP1b)
@@ -91,6 +91,8 @@ func NewReplica(id paxi.ID) *Replica {
 	r.Register(P3RecoverRequest{}, r.HandleP3RecoverRequest)
 	r.Register(P3RecoverReply{}, r.HandleP3RecoverReply)
 	r.Register(RoutedMsg{}, r.handleRoutedMsg)
+	r.Register(paxi.LeaderTransfer{}, r.HandleLeaderTransfer)
+	r.Register(Transfer{}, r.HandleTransfer)
 
 	r.pendingP1bRelay = 0
 	r.p1bRelayDepth = 0
@@ -174,6 +176,14 @@ func (r *Replica) peersToGroups(numGroups int, nodeList []paxi.ID) []*PeerGroup
 	return peerGroups
 }
 
+// healthy returns true for connected nodes that are not on the gray list
+func (r *Replica) healthy(id paxi.ID) bool {
+	r.GrayLock.RLock()
+	_, gray := r.GrayNodes[id]
+	r.GrayLock.RUnlock()
+	return !gray && paxi.IsConnected(r, id)
+}
+
 //*********************************************************************************************************************
 // Timer for all timed events, such as timeouts and log clean ups
 //*********************************************************************************************************************
@@ -199,6 +209,10 @@ func (r *Replica) startTicker() {
 			log.Debugf("Ticker gray check done on tick %d", ticks)
 		}
 
+		if r.active {
+			r.CheckPlacement(now, r.healthy)
+		}
+
 		// handling timeouts
 		timeoutCutoffTime := now.Add(-time.Duration(*stdPigTimeout) * time.Millisecond).UnixNano() // everything older than this needs to timeout
 		//log.Debugf("Start TimeoutChecker (timeout_cutoff = %d)", timeoutCutoffTime)
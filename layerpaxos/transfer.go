@@ -0,0 +1,58 @@
+package layerpaxos
+
+import (
+	"time"
+
+	"pigpaxos"
+	"pigpaxos/log"
+)
+
+// HandleLeaderTransfer makes the leader stop proposing and hand its uncommitted slots over to m.To.
+// Other nodes pass the request on to the leader they know
+func (p *LayerPaxos) HandleLeaderTransfer(m paxi.LeaderTransfer) {
+	switch p.handover.Decide(m, p.ballot, p.active) {
+	case paxi.HandoverForward:
+		p.Send(p.ballot.ID(), m)
+	case paxi.HandoverElect:
+		p.P1a()
+	case paxi.HandoverStart:
+		p.active = false
+		l := make(map[int]CommandBallot)
+		p.logLck.RLock()
+		for s := p.execute; s <= p.slot; s++ {
+			if p.log[s] == nil || p.log[s].Commit {
+				continue
+			}
+			l[s] = CommandBallot{p.log[s].Command(), p.log[s].Ballot}
+		}
+		p.logLck.RUnlock()
+		log.Debugf("Node %v hands %d slots over to %v", p.ID(), len(l), m.To)
+		p.Send(m.To, Transfer{Ballot: p.ballot, Log: l, Zone: m.Zone})
+	}
+}
+
+// HandleTransfer takes over slots of the leader that gave up leadership and starts phase 1 with a higher ballot
+func (p *LayerPaxos) HandleTransfer(m Transfer) {
+	log.Debugf("Replica %s ===[%v]===>>> Replica %s\n", m.Ballot.ID(), m, p.ID())
+	if m.Ballot < p.ballot || p.active {
+		return
+	}
+	p.update(m.Log)
+	p.handover.TakeOver(m.Zone)
+	p.P1a()
+}
+
+// CheckTransfer runs phase 1 again if the target of a leadership transfer did not take over in time
+func (p *LayerPaxos) CheckTransfer(now time.Time) {
+	if p.handover.Expired(p.ballot, p.active, now) {
+		p.P1a()
+	}
+}
+
+// CheckPlacement hands leadership over to a healthy node that should lead instead of this leader.
+// It runs on the ticker, so the transfer is handled with other messages of this node
+func (p *LayerPaxos) CheckPlacement(now time.Time, healthy func(paxi.ID) bool) {
+	if m := p.handover.Next(p.active, now, healthy); m.To != 0 {
+		p.Enqueue(m)
+	}
+}
@@ -0,0 +1,674 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	lsmTableSuffix     = ".sst"
+	lsmCheckpointFile  = "CHECKPOINT"
+	lsmMaxTables       = 4  // tables are merged into one when there are more
+	lsmIndexInterval   = 16 // records between two index entries of a table
+	lsmRecordValue     = 1
+	lsmRecordTombstone = 0
+)
+
+// LSM is an embedded ordered key-value store on local disk organized as a log-structured merge tree.
+// Writes go to an in-memory table that is flushed to an immutable sorted table file when it grows over
+// memtableSize bytes, and the table files are merged into one when there are too many of them.
+// Checkpoint makes the current state durable. Opening the store returns it to the last checkpoint,
+// writes after the checkpoint are not kept. Tables of the stable checkpoint, the last one released by the
+// caller, are kept next to newer checkpoints, so the store can roll back to it. It is not safe for concurrent use
+type LSM struct {
+	dir        string
+	maxMem     int
+	memtable   *SkipList // key to []byte value, nil is a deleted key
+	memSize    int
+	tables     []*sstable // newest first
+	seq        int        // sequence number of the last table file
+	checkpoint lsmCheckpoint
+}
+
+// lsmCheckpoint is the content of the checkpoint file
+type lsmCheckpoint struct {
+	Store        string // random id of the store
+	Seq          int    // number of checkpoints taken
+	Tables       []int  // sequence numbers of tables holding the state, newest first
+	StableSeq    int    // sequence number of the stable checkpoint
+	StableTables []int  // tables of the stable checkpoint
+}
+
+// OpenLSM opens or creates a store in dir at its last checkpoint
+func OpenLSM(dir string, memtableSize int) (*LSM, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &LSM{dir: dir, maxMem: memtableSize, memtable: NewSkipList()}
+	b, err := os.ReadFile(filepath.Join(dir, lsmCheckpointFile))
+	if os.IsNotExist(err) {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		s.checkpoint.Store = hex.EncodeToString(id)
+	} else if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(b, &s.checkpoint); err != nil {
+		return nil, fmt.Errorf("corrupted checkpoint in %s: %v", dir, err)
+	}
+	for _, seq := range s.checkpoint.StableTables {
+		s.seq = max(s.seq, seq)
+	}
+	if err := s.openTables(s.checkpoint.Tables); err != nil {
+		return nil, err
+	}
+	// tables written after the checkpoint are dropped
+	return s, s.removeTables()
+}
+
+// openTables opens tables seqs as the current tables
+func (s *LSM) openTables(seqs []int) error {
+	s.tables = nil
+	for _, seq := range seqs {
+		t, err := openTable(s.tablePath(seq), seq)
+		if err != nil {
+			s.Close()
+			return err
+		}
+		s.tables = append(s.tables, t)
+		s.seq = max(s.seq, seq)
+	}
+	return nil
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Checkpoint returns id of the last checkpoint, it changes every time a checkpoint is taken
+func (s *LSM) Checkpoint() string {
+	return s.checkpointID(s.checkpoint.Seq)
+}
+
+// Stable returns id of the stable checkpoint
+func (s *LSM) Stable() string {
+	return s.checkpointID(s.checkpoint.StableSeq)
+}
+
+func (s *LSM) checkpointID(seq int) string {
+	return s.checkpoint.Store + "-" + strconv.Itoa(seq)
+}
+
+// TakeCheckpoint flushes the memtable and durably records the current tables as the state to open
+func (s *LSM) TakeCheckpoint() (string, error) {
+	if err := s.flush(); err != nil {
+		return "", err
+	}
+	c := s.checkpoint
+	c.Seq++
+	c.Tables = nil
+	for _, t := range s.tables {
+		c.Tables = append(c.Tables, t.seq)
+	}
+	if err := s.saveCheckpoint(c); err != nil {
+		return "", err
+	}
+	return s.Checkpoint(), s.removeTables()
+}
+
+// Release makes checkpoint id the stable checkpoint once the caller durably refers to it.
+// Tables only older checkpoints use are removed. Ids other than the last checkpoint are ignored
+func (s *LSM) Release(id string) error {
+	if id != s.Checkpoint() || s.checkpoint.StableSeq == s.checkpoint.Seq {
+		return nil
+	}
+	c := s.checkpoint
+	c.StableSeq = c.Seq
+	c.StableTables = c.Tables
+	if err := s.saveCheckpoint(c); err != nil {
+		return err
+	}
+	return s.removeTables()
+}
+
+// Rollback returns the store to checkpoint id, the last or the stable one, every later write is dropped.
+// It returns false if the store does not have the checkpoint
+func (s *LSM) Rollback(id string) (bool, error) {
+	c := s.checkpoint
+	switch id {
+	case s.Checkpoint():
+	case s.Stable():
+		c.Seq = c.StableSeq
+		c.Tables = c.StableTables
+		if err := s.saveCheckpoint(c); err != nil {
+			return false, err
+		}
+	default:
+		return false, nil
+	}
+	s.memtable = NewSkipList()
+	s.memSize = 0
+	s.closeTables()
+	if err := s.openTables(c.Tables); err != nil {
+		return false, err
+	}
+	return true, s.removeTables()
+}
+
+// saveCheckpoint durably replaces the checkpoint file with c
+func (s *LSM) saveCheckpoint(c lsmCheckpoint) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, lsmCheckpointFile+".tmp")
+	if err := writeFileSync(tmp, b); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, lsmCheckpointFile)); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	s.checkpoint = c
+	return nil
+}
+
+// Get returns value of key and whether the key exists
+func (s *LSM) Get(key string) ([]byte, bool, error) {
+	if v, exists := s.memtable.Get(key); exists {
+		return v.([]byte), v.([]byte) != nil, nil
+	}
+	for _, t := range s.tables {
+		v, found, err := t.get(key)
+		if err != nil || found {
+			return v, v != nil, err
+		}
+	}
+	return nil, false, nil
+}
+
+// Put sets value of key
+func (s *LSM) Put(key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	return s.set(key, value)
+}
+
+// Delete removes key
+func (s *LSM) Delete(key string) error {
+	return s.set(key, nil)
+}
+
+func (s *LSM) set(key string, value []byte) error {
+	s.memtable.Put(key, value)
+	s.memSize += len(key) + len(value)
+	if s.memSize < s.maxMem {
+		return nil
+	}
+	return s.flush()
+}
+
+// Range calls f in key order for every key in [start, end) until f returns false.
+// An empty end has no upper bound
+func (s *LSM) Range(start, end string, f func(key string, value []byte) bool) error {
+	// the memtable is small, so its part of the range is copied to iterate it next to the tables
+	mem := &sliceIterator{}
+	s.memtable.Range(start, end, func(k string, v interface{}) bool {
+		mem.records = append(mem.records, record{k, v.([]byte)})
+		return true
+	})
+	its := []iterator{mem}
+	for _, t := range s.tables {
+		it, err := t.iterator(start)
+		if err != nil {
+			return err
+		}
+		its = append(its, it)
+	}
+	return merge(its, func(r record) bool {
+		if end != "" && r.key >= end {
+			return false
+		}
+		return r.value == nil || f(r.key, r.value)
+	})
+}
+
+// Clear removes every key
+func (s *LSM) Clear() error {
+	s.memtable = NewSkipList()
+	s.memSize = 0
+	s.closeTables()
+	s.tables = nil
+	return s.removeTables()
+}
+
+// Close closes table files, writes after the last checkpoint are lost
+func (s *LSM) Close() error {
+	return s.closeTables()
+}
+
+func (s *LSM) closeTables() error {
+	var err error
+	for _, t := range s.tables {
+		if e := t.file.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *LSM) tablePath(seq int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, lsmTableSuffix))
+}
+
+// flush writes memtable to a new table and merges the tables if there are too many
+func (s *LSM) flush() error {
+	if s.memtable.Len() == 0 {
+		return nil
+	}
+	mem := &sliceIterator{}
+	s.memtable.Range("", "", func(k string, v interface{}) bool {
+		mem.records = append(mem.records, record{k, v.([]byte)})
+		return true
+	})
+	t, err := s.writeTable(mem, true)
+	if err != nil {
+		return err
+	}
+	s.tables = append([]*sstable{t}, s.tables...)
+	s.memtable = NewSkipList()
+	s.memSize = 0
+	if len(s.tables) <= lsmMaxTables {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact merges all tables into one, deleted keys are dropped as no older table is left
+func (s *LSM) compact() error {
+	its := make([]iterator, 0, len(s.tables))
+	for _, t := range s.tables {
+		it, err := t.iterator("")
+		if err != nil {
+			return err
+		}
+		its = append(its, it)
+	}
+	t, err := s.writeTable(&mergeIterator{its: its}, false)
+	if err != nil {
+		return err
+	}
+	s.closeTables()
+	s.tables = []*sstable{t}
+	return s.removeTables()
+}
+
+// removeTables deletes table files that are neither in use nor part of the last or the stable checkpoint
+func (s *LSM) removeTables() error {
+	keep := make(map[int]bool)
+	for _, t := range s.tables {
+		keep[t.seq] = true
+	}
+	for _, seq := range s.checkpoint.Tables {
+		keep[seq] = true
+	}
+	for _, seq := range s.checkpoint.StableTables {
+		keep[seq] = true
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, lsmTableSuffix) && !strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(name, lsmTableSuffix))
+		if err == nil && keep[seq] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTable writes records of it to a new table file, deleted keys are kept if tombstones is true
+func (s *LSM) writeTable(it iterator, tombstones bool) (*sstable, error) {
+	s.seq++
+	path := s.tablePath(s.seq)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	w := &countingWriter{w: bufio.NewWriter(f)}
+	var index []byte
+	n := 0
+	for {
+		r, ok, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		if r.value == nil && !tombstones {
+			continue
+		}
+		if n%lsmIndexInterval == 0 {
+			index = appendString(index, r.key)
+			index = appendUvarint(index, uint64(w.n))
+		}
+		n++
+		buf := []byte{lsmRecordTombstone}
+		if r.value != nil {
+			buf[0] = lsmRecordValue
+		}
+		buf = appendString(buf, r.key)
+		buf = appendString(buf, string(r.value))
+		w.Write(buf)
+	}
+	// the index follows the records and the footer is the offset of the index
+	offset := w.n
+	w.Write(index)
+	footer := make([]byte, 8)
+	binary.BigEndian.PutUint64(footer, uint64(offset))
+	w.Write(footer)
+	if w.err != nil {
+		return nil, w.err
+	}
+	if err := w.w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, err
+	}
+	return openTable(path, s.seq)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	w.err = err
+}
+
+func writeFileSync(path string, b []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// sstable is an immutable file of records sorted by key with a sparse index of keys
+type sstable struct {
+	seq     int
+	file    *os.File
+	size    int64 // size of the records
+	keys    []string
+	offsets []int64
+}
+
+func openTable(path string, seq int) (*sstable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &sstable{seq: seq, file: f}
+	err = t.readIndex()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("corrupted table %s: %v", path, err)
+	}
+	return t, nil
+}
+
+func (t *sstable) readIndex() error {
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < 8 {
+		return io.ErrUnexpectedEOF
+	}
+	footer := make([]byte, 8)
+	if _, err := t.file.ReadAt(footer, info.Size()-8); err != nil {
+		return err
+	}
+	t.size = int64(binary.BigEndian.Uint64(footer))
+	if t.size > info.Size()-8 {
+		return io.ErrUnexpectedEOF
+	}
+	r := bufio.NewReader(io.NewSectionReader(t.file, t.size, info.Size()-8-t.size))
+	for {
+		key, err := readString(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		t.keys = append(t.keys, key)
+		t.offsets = append(t.offsets, int64(offset))
+	}
+}
+
+// iterator returns iterator of records from the first key not less than start
+func (t *sstable) iterator(start string) (*tableIterator, error) {
+	// the last block whose first key is not greater than start
+	i := sort.Search(len(t.keys), func(i int) bool { return t.keys[i] > start }) - 1
+	offset := int64(0)
+	if i > 0 {
+		offset = t.offsets[i]
+	}
+	it := &tableIterator{r: bufio.NewReader(io.NewSectionReader(t.file, offset, t.size-offset))}
+	for {
+		r, ok, err := it.peek()
+		if err != nil || !ok || r.key >= start {
+			return it, err
+		}
+		it.head = nil
+	}
+}
+
+func (t *sstable) get(key string) ([]byte, bool, error) {
+	it, err := t.iterator(key)
+	if err != nil {
+		return nil, false, err
+	}
+	r, ok, err := it.next()
+	if err != nil || !ok || r.key != key {
+		return nil, false, err
+	}
+	return r.value, true, nil
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+// record is a key and its value, nil for a deleted key
+type record struct {
+	key   string
+	value []byte
+}
+
+type iterator interface {
+	// next returns the next record or false after the last one
+	next() (record, bool, error)
+}
+
+type sliceIterator struct {
+	records []record
+}
+
+func (it *sliceIterator) next() (record, bool, error) {
+	if len(it.records) == 0 {
+		return record{}, false, nil
+	}
+	r := it.records[0]
+	it.records = it.records[1:]
+	return r, true, nil
+}
+
+type tableIterator struct {
+	r    *bufio.Reader
+	head *record
+}
+
+func (it *tableIterator) peek() (record, bool, error) {
+	if it.head != nil {
+		return *it.head, true, nil
+	}
+	flag, err := it.r.ReadByte()
+	if err == io.EOF {
+		return record{}, false, nil
+	}
+	if err != nil {
+		return record{}, false, err
+	}
+	key, err := readString(it.r)
+	if err != nil {
+		return record{}, false, err
+	}
+	value, err := readString(it.r)
+	if err != nil {
+		return record{}, false, err
+	}
+	r := record{key: key}
+	if flag == lsmRecordValue {
+		r.value = []byte(value)
+	}
+	it.head = &r
+	return r, true, nil
+}
+
+func (it *tableIterator) next() (record, bool, error) {
+	r, ok, err := it.peek()
+	it.head = nil
+	return r, ok, err
+}
+
+// mergeIterator merges sorted iterators, the first iterator holding a key wins
+type mergeIterator struct {
+	its   []iterator
+	heads []*record
+}
+
+func (m *mergeIterator) next() (record, bool, error) {
+	if m.heads == nil {
+		m.heads = make([]*record, len(m.its))
+		for i := range m.its {
+			if err := m.advance(i); err != nil {
+				return record{}, false, err
+			}
+		}
+	}
+	min := -1
+	for i, h := range m.heads {
+		if h != nil && (min < 0 || h.key < m.heads[min].key) {
+			min = i
+		}
+	}
+	if min < 0 {
+		return record{}, false, nil
+	}
+	r := *m.heads[min]
+	for i, h := range m.heads {
+		if h != nil && h.key == r.key {
+			if err := m.advance(i); err != nil {
+				return record{}, false, err
+			}
+		}
+	}
+	return r, true, nil
+}
+
+func (m *mergeIterator) advance(i int) error {
+	r, ok, err := m.its[i].next()
+	if err != nil {
+		return err
+	}
+	m.heads[i] = nil
+	if ok {
+		m.heads[i] = &r
+	}
+	return nil
+}
+
+// merge calls f with records of iterators in key order until f returns false
+func merge(its []iterator, f func(record) bool) error {
+	m := &mergeIterator{its: its}
+	for {
+		r, ok, err := m.next()
+		if err != nil || !ok || !f(r) {
+			return err
+		}
+	}
+}
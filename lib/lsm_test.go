@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestLSM(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLSM(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		k := strconv.Itoa(rand.Intn(300))
+		if rand.Intn(4) == 0 {
+			err = s.Delete(k)
+			delete(m, k)
+		} else {
+			err = s.Put(k, []byte(strconv.Itoa(i)))
+			m[k] = strconv.Itoa(i)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put("empty", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	m["empty"] = ""
+
+	check := func(s *LSM) {
+		for k, v := range m {
+			got, exists, err := s.Get(k)
+			if err != nil || !exists || string(got) != v {
+				t.Errorf("Get(%s) should return %q, got %q %v %v", k, v, got, exists, err)
+			}
+		}
+		if _, exists, _ := s.Get("missing"); exists {
+			t.Error("Get(missing) should not find key")
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			if k >= "2" && k < "4" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		i := 0
+		err := s.Range("2", "4", func(key string, value []byte) bool {
+			if i >= len(keys) || key != keys[i] || string(value) != m[key] {
+				t.Fatalf("Range should return %v, got %s at %d", keys, key, i)
+			}
+			i++
+			return true
+		})
+		if err != nil || i != len(keys) {
+			t.Errorf("Range should return %d keys, got %d: %v", len(keys), i, err)
+		}
+	}
+	check(s)
+
+	// writes after the checkpoint are lost on reopen
+	if _, err := s.TakeCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	s.Put("after", []byte("checkpoint"))
+	s.Delete("empty")
+	checkpoint := s.Checkpoint()
+	s.Close()
+
+	s, err = OpenLSM(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Checkpoint() != checkpoint {
+		t.Errorf("expect checkpoint %s after reopen, got %s", checkpoint, s.Checkpoint())
+	}
+	if _, exists, _ := s.Get("after"); exists {
+		t.Error("expect write after checkpoint to be lost")
+	}
+	check(s)
+}
+
+func TestLSMStableCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLSM(dir, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("k", []byte("stable"))
+	stable, err := s.TakeCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Release(stable); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		s.Put(strconv.Itoa(i), []byte("after"))
+	}
+	s.Put("k", []byte("last"))
+	last, err := s.TakeCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// the last checkpoint was never released, both it and the stable one can be opened
+	s, err = OpenLSM(dir, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Checkpoint() != last || s.Stable() != stable {
+		t.Fatalf("expect checkpoints %s and stable %s, got %s and %s", last, stable, s.Checkpoint(), s.Stable())
+	}
+	if ok, err := s.Rollback("missing"); ok || err != nil {
+		t.Errorf("expect no rollback to unknown checkpoint, got %v %v", ok, err)
+	}
+	if ok, err := s.Rollback(stable); !ok || err != nil {
+		t.Fatalf("expect rollback to stable checkpoint, got %v %v", ok, err)
+	}
+	if v, _, _ := s.Get("k"); string(v) != "stable" {
+		t.Errorf("expect value of stable checkpoint, got %q", v)
+	}
+	if _, exists, _ := s.Get("0"); exists {
+		t.Error("expect writes after stable checkpoint to be dropped")
+	}
+	s.Close()
+
+	// the rollback is durable
+	s, err = OpenLSM(dir, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Checkpoint() != stable {
+		t.Errorf("expect checkpoint %s after rollback, got %s", stable, s.Checkpoint())
+	}
+
+	// a released checkpoint drops the tables of the previous stable one
+	s.Put("k", []byte("next"))
+	next, err := s.TakeCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Release(next); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.Rollback(stable); ok {
+		t.Error("expect released checkpoint to replace the stable one")
+	}
+}
@@ -0,0 +1,122 @@
+package lib
+
+import "math/rand"
+
+const (
+	skipListMaxLevel = 32
+	skipListP        = 0.25
+)
+
+// SkipList is an ordered map from string keys to values backed by a skip list.
+// It is not safe for concurrent use
+type SkipList struct {
+	head   *skipListNode
+	level  int
+	length int
+	rand   *rand.Rand
+}
+
+type skipListNode struct {
+	key   string
+	value interface{}
+	next  []*skipListNode
+}
+
+// NewSkipList creates a new SkipList
+func NewSkipList() *SkipList {
+	return &SkipList{
+		head:  &skipListNode{next: make([]*skipListNode, skipListMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// Len returns the number of keys in the skip list
+func (s *SkipList) Len() int {
+	return s.length
+}
+
+// find returns the last node before key on every level
+func (s *SkipList) find(key string) []*skipListNode {
+	prev := make([]*skipListNode, skipListMaxLevel)
+	n := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+		prev[i] = n
+	}
+	return prev
+}
+
+// seek returns the first node with key not less than key
+func (s *SkipList) seek(key string) *skipListNode {
+	n := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+	}
+	return n.next[0]
+}
+
+// Get returns value of key and whether the key exists
+func (s *SkipList) Get(key string) (interface{}, bool) {
+	n := s.seek(key)
+	if n == nil || n.key != key {
+		return nil, false
+	}
+	return n.value, true
+}
+
+// Put sets value of key
+func (s *SkipList) Put(key string, value interface{}) {
+	prev := s.find(key)
+	if n := prev[0].next[0]; n != nil && n.key == key {
+		n.value = value
+		return
+	}
+	level := 1
+	for level < skipListMaxLevel && s.rand.Float64() < skipListP {
+		level++
+	}
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			prev[i] = s.head
+		}
+		s.level = level
+	}
+	n := &skipListNode{key: key, value: value, next: make([]*skipListNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+	s.length++
+}
+
+// Delete removes key and returns whether it existed
+func (s *SkipList) Delete(key string) bool {
+	prev := s.find(key)
+	n := prev[0].next[0]
+	if n == nil || n.key != key {
+		return false
+	}
+	for i := 0; i < len(n.next); i++ {
+		prev[i].next[i] = n.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.length--
+	return true
+}
+
+// Range calls f in key order for every key in [start, end) until f returns false.
+// An empty end has no upper bound
+func (s *SkipList) Range(start, end string, f func(key string, value interface{}) bool) {
+	for n := s.seek(start); n != nil && (end == "" || n.key < end); n = n.next[0] {
+		if !f(n.key, n.value) {
+			return
+		}
+	}
+}
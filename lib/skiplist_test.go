@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSkipList(t *testing.T) {
+	s := NewSkipList()
+	m := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		k := strconv.Itoa(rand.Intn(500))
+		if rand.Intn(4) == 0 {
+			_, exists := m[k]
+			if s.Delete(k) != exists {
+				t.Fatalf("Delete(%s) should return %v", k, exists)
+			}
+			delete(m, k)
+		} else {
+			s.Put(k, i)
+			m[k] = i
+		}
+	}
+
+	if s.Len() != len(m) {
+		t.Errorf("Length should be %d, got %d", len(m), s.Len())
+	}
+	for k, v := range m {
+		if got, ok := s.Get(k); !ok || got.(int) != v {
+			t.Errorf("Get(%s) should return %d, got %v", k, v, got)
+		}
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if k >= "2" && k < "4" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	i := 0
+	s.Range("2", "4", func(key string, value interface{}) bool {
+		if i >= len(keys) || key != keys[i] {
+			t.Fatalf("Range should return %v, got %s at %d", keys, key, i)
+		}
+		i++
+		return true
+	})
+	if i != len(keys) {
+		t.Errorf("Range should return %d keys, got %d", len(keys), i)
+	}
+}
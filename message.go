@@ -1,20 +1,23 @@
 package paxi
 
 import (
-	"encoding/gob"
+	"encoding/json"
 	"fmt"
+	"time"
 )
 
 func init() {
-	gob.Register(Request{})
-	gob.Register(Reply{})
-	gob.Register(Read{})
-	gob.Register(ReadReply{})
-	gob.Register(Transaction{})
-	gob.Register(TransactionReply{})
-	gob.Register(Register{})
-	gob.Register(Config{})
-	gob.Register(ProtocolMsg{})
+	RegisterMessage(Request{})
+	RegisterMessage(Reply{})
+	RegisterMessage(Read{})
+	RegisterMessage(ReadReply{})
+	RegisterMessage(Transaction{})
+	RegisterMessage(TransactionReply{})
+	RegisterMessage(Register{})
+	RegisterMessage(Config{})
+	RegisterMessage(InstallSnapshot{})
+	RegisterMessage(LeaderTransfer{})
+	RegisterBinary(ProtocolMsg{}, 1, encodeProtocolMsg, decodeProtocolMsg)
 }
 
 /***************************
@@ -31,6 +34,50 @@ func (p ProtocolMsg) String() string {
 	return fmt.Sprintf("ProtocolMsg {msgid=%d, hlc=%d msg=%v}",p.MsgId, p.HlcTime, p.Msg)
 }
 
+func (p ProtocolMsg) MarshalJSON() ([]byte, error) {
+	msg, err := EncodeJSONMessage(p.Msg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		HlcTime int64
+		MsgId   int64
+		Msg     json.RawMessage
+	}{p.HlcTime, p.MsgId, msg})
+}
+
+func (p *ProtocolMsg) UnmarshalJSON(b []byte) error {
+	var m struct {
+		HlcTime int64
+		MsgId   int64
+		Msg     json.RawMessage
+	}
+	err := json.Unmarshal(b, &m)
+	if err != nil {
+		return err
+	}
+	p.HlcTime = m.HlcTime
+	p.MsgId = m.MsgId
+	p.Msg, err = DecodeJSONMessage(m.Msg)
+	return err
+}
+
+// every message between nodes is wrapped into ProtocolMsg, so it always has binary encoding
+func encodeProtocolMsg(w *BinaryWriter, m interface{}) {
+	p := m.(ProtocolMsg)
+	w.Varint(p.HlcTime)
+	w.Varint(p.MsgId)
+	w.Message(p.Msg)
+}
+
+func decodeProtocolMsg(r *BinaryReader) interface{} {
+	return ProtocolMsg{
+		HlcTime: r.Varint(),
+		MsgId:   r.Varint(),
+		Msg:     r.Message(),
+	}
+}
+
 /***************************
  * Client-Replica Messages *
  ***************************/
@@ -72,7 +119,7 @@ type Read struct {
 }
 
 func (r Read) String() string {
-	return fmt.Sprintf("Read {cid=%d, key=%d}", r.CommandID, r.Key)
+	return fmt.Sprintf("Read {cid=%d, key=%v}", r.CommandID, r.Key)
 }
 
 // ReadReply cid and value of reading key
@@ -107,6 +154,7 @@ func (t Transaction) String() string {
 type TransactionReply struct {
 	OK        bool
 	Commands  []Command
+	Values    []Value // result of every command if the transaction committed
 	Timestamp int64
 	Err       error
 }
@@ -115,6 +163,24 @@ type TransactionReply struct {
  Fault Simulation
  ***/
 
+/**************************
+ *     Admin Related      *
+ **************************/
+
+// LeaderTransferTimeout is how long the leader waits for the target of a leadership transfer to take over
+// before it runs phase 1 again itself
+const LeaderTransferTimeout = time.Second
+
+// LeaderTransfer asks the leader to stop proposing and hand leadership over to node To
+type LeaderTransfer struct {
+	To   ID
+	Zone int // zone leader affinity moves leadership to, 0 if none
+}
+
+func (m LeaderTransfer) String() string {
+	return fmt.Sprintf("LeaderTransfer {to=%v zone=%d}", m.To, m.Zone)
+}
+
 
 /**************************
  *     Config Related     *
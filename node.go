@@ -6,6 +6,7 @@ import (
 	"pigpaxos/retro_log"
 	"reflect"
 	"sync"
+	"time"
 
 	"pigpaxos/log"
 )
@@ -16,13 +17,18 @@ var Retrolog *retro_log.RetroLog
 // it includes networking, state machine and RESTful API server
 type Node interface {
 	Socket
-	Database
+	StateMachine
 	ID() ID
+	WAL() WAL
+	Export() ([]byte, error)
 	Run()
 	Retry(r Request)
+	Enqueue(m interface{})
 	Forward(id ID, r Request)
 	Register(m interface{}, f interface{})
 	HandleMsg(m interface{})
+	Reconfigure(r Reconfig) error
+	RegisterStat(name string, f func() interface{})
 }
 
 // node implements Node interface
@@ -30,7 +36,9 @@ type node struct {
 	id ID
 
 	Socket
-	Database
+	StateMachine
+	sessions    sessionTable
+	wal         WAL
 	MessageChan chan interface{}
 	handles     map[string]reflect.Value
 	server      *http.Server
@@ -39,35 +47,89 @@ type node struct {
 
 	sync.RWMutex
 	forwards map[string]*Request
+	stats    map[string]func() interface{}
+}
+
+// NodeOption changes a node created by NewNode
+type NodeOption func(*node)
+
+// WithStateMachine replicates state machine sm instead of the key-value database
+func WithStateMachine(sm StateMachine) NodeOption {
+	return func(n *node) {
+		n.StateMachine = sm
+	}
 }
 
 // NewNode creates a new Node object from configuration
-func NewNode(id ID) Node {
+func NewNode(id ID, options ...NodeOption) Node {
 	if config.UseRetroLog {
 		Retrolog = retro_log.NewRetroLog("paxi", int(id), "logs/", 100, false)
 		Retrolog.CreateTimerSet("sentM", 5)
 		Retrolog.CreateTimerSet("recvM", 5)
 	}
-	return &node{
+	n := &node{
 		id:          id,
 		Socket:      NewSocket(id, config.Addrs),
-		Database:    NewDatabase(),
 		MessageChan: make(chan interface{}, config.ChanBufferSize),
 		handles:     make(map[string]reflect.Value),
 		forwards:    make(map[string]*Request),
+		stats:       make(map[string]func() interface{}),
 		recvCount:   0,
 	}
+	n.wal = snapshotWAL{WAL: NewWAL(id), n: n}
+	n.sessions.timeout = time.Duration(config.SessionTimeout) * time.Second
+	n.stats["dropped"] = func() interface{} { return n.Socket.Dropped() }
+	for _, opt := range options {
+		opt(n)
+	}
+	if n.StateMachine == nil {
+		n.StateMachine = newStateMachine(id)
+	}
+	return n
 }
 
 func (n *node) ID() ID {
 	return n.id
 }
 
+// WAL returns write-ahead log of this node
+func (n *node) WAL() WAL {
+	return n.wal
+}
+
+// Reconfigure applies committed membership change to the configuration and the socket of this node
+func (n *node) Reconfigure(r Reconfig) error {
+	err := Reconfigure(r)
+	if err != nil {
+		return err
+	}
+	if r.Op == AddNode {
+		n.Socket.SetAddress(r.ID, r.Addr)
+	} else {
+		n.Socket.SetAddress(r.ID, "")
+	}
+	log.Infof("node %v applied %v", n.id, r)
+	return nil
+}
+
+// RegisterStat reports the value returned by f as statistic name of GET /stats
+func (n *node) RegisterStat(name string, f func() interface{}) {
+	n.Lock()
+	defer n.Unlock()
+	n.stats[name] = f
+}
+
 func (n *node) Retry(r Request) {
 	log.Debugf("node %v retry request %v", n.id, r)
 	n.MessageChan <- r
 }
 
+// Enqueue passes message m to the handler of this node as if it was received, so timers change protocol state
+// on the handler goroutine
+func (n *node) Enqueue(m interface{}) {
+	n.MessageChan <- m
+}
+
 // Register a handle function for each message type
 func (n *node) Register(m interface{}, f interface{}) {
 	t := reflect.TypeOf(m)
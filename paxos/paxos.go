@@ -15,27 +15,17 @@ import (
 // as this is likely the case of state machine getting stuck because of network/communication failures
 const ExecuteSlack = 10
 
-// entry in log
-type entry struct {
-	ballot    paxi.Ballot
-	command   paxi.Command
-	commit    bool
-	request   *paxi.Request
-	quorum    *paxi.Quorum
-	timestamp time.Time
-}
-
 // Paxos instance
 type Paxos struct {
 	paxi.Node
 
 	config []paxi.ID
 
-	log     map[int]*entry // log ordered by slot
-	execute int            // next execute slot number
-	active  bool           // active leader
-	ballot  paxi.Ballot    // highest ballot number
-	slot    int            // highest slot number
+	log     map[int]*paxi.Entry // log ordered by slot
+	execute int                 // next execute slot number
+	active  bool                // active leader
+	ballot  paxi.Ballot         // highest ballot number
+	slot    int                 // highest slot number
 
 	p3PendingBallot   paxi.Ballot
 	p3pendingSlots    []int
@@ -47,6 +37,18 @@ type Paxos struct {
 	quorum   *paxi.Quorum    // phase 1 quorum
 	requests []*paxi.Request // phase 1 pending requests
 
+	recovering bool // replaying write-ahead log, committed slots are already durable
+	witness    bool // witnesses vote but keep no state machine, only ballots and hashes of executed slots
+
+	handover *paxi.Handover // leadership transfer and placement
+
+	snapshot     *paxi.Snapshot         // last snapshot taken or installed
+	snapshotSent map[paxi.ID]time.Time  // last time a snapshot was sent to a lagging node
+	assembler    paxi.SnapshotAssembler // snapshot being received from the leader
+
+	latency *paxi.LatencyTracker // round trip of P2a to every acceptor
+	thrifty paxi.Thrifty
+
 	Q1              func(*paxi.Quorum) bool
 	Q2              func(*paxi.Quorum) bool
 	ReplyWhenCommit bool
@@ -61,27 +63,65 @@ type Paxos struct {
 func NewPaxos(n paxi.Node, options ...func(*Paxos)) *Paxos {
 	p := &Paxos{
 		Node:            n,
-		log:             make(map[int]*entry, paxi.GetConfig().BufferSize),
+		log:             make(map[int]*paxi.Entry, paxi.GetConfig().BufferSize),
 		slot:            -1,
 		quorum:          paxi.NewQuorum(),
 		requests:        make([]*paxi.Request, 0),
-		Q1:              func(q *paxi.Quorum) bool { return q.Majority() },
-		Q2:              func(q *paxi.Quorum) bool { return q.Majority() },
+		Q1:              func(q *paxi.Quorum) bool { return q.Q1() },
+		Q2:              func(q *paxi.Quorum) bool { return q.Q2() },
 		ReplyWhenCommit: false,
+		witness:         paxi.GetConfig().IsWitness(n.ID()),
 	}
 
 	p.executeByNode = make(map[paxi.ID]int)
+	p.snapshotSent = make(map[paxi.ID]time.Time)
+	p.latency = paxi.NewLatencyTracker()
+	p.RegisterStat("thrifty", func() interface{} { return p.thrifty.Stats() })
 	for _, id := range paxi.GetConfig().IDs() {
 		p.executeByNode[id] = 0
 	}
 
+	p.handover = paxi.NewHandover(n.ID())
+
 	for _, opt := range options {
 		opt(p)
 	}
 
+	p.recover()
+
 	return p
 }
 
+// recover restores the last snapshot, rebuilds promised ballot and accepted log from the
+// write-ahead log and re-executes all committed slots after the snapshot against the state machine
+func (p *Paxos) recover() {
+	p.recovering = true
+	defer func() { p.recovering = false }()
+	p.logLck.Lock()
+	s, ballot, slot, err := paxi.ReplayWAL(p.WAL(), p.log)
+	if err != nil {
+		log.Fatalf("Replica %s cannot replay write-ahead log: %v", p.ID(), err)
+	}
+	p.ballot = ballot
+	p.slot = slot
+	// snapshots of witnesses have no state machine
+	if s != nil && !p.witness {
+		if err := p.Node.Restore(s.Data); err != nil {
+			// slots of the snapshot are compacted, the leader sends its snapshot when this node asks to recover them
+			log.Errorf("Replica %s cannot restore %v, waits for a snapshot from the leader: %v", p.ID(), s, err)
+			s = nil
+		}
+	}
+	if s != nil {
+		p.snapshot = s
+		p.execute = s.Slot + 1
+		p.lastCleanupMarker = s.Slot + 1
+	}
+	p.logLck.Unlock()
+	log.Infof("Replica %s recovered ballot %v and log up to slot %d", p.ID(), p.ballot, p.slot)
+	p.exec()
+}
+
 // IsLeader indecates if this node is current leader
 func (p *Paxos) IsLeader() bool {
 	return p.active || p.ballot.ID() == p.ID()
@@ -132,7 +172,7 @@ func (p *Paxos) CheckNeedForRecovery() {
 		recoverSlots := make([]int, 0)
 		for slot := p.execute; slot < p.slot-ExecuteSlack; slot++ {
 			e, exists := p.log[slot]
-			if !exists || !e.commit {
+			if !exists || !e.Commit {
 				recoverSlots = append(recoverSlots, slot)
 			}
 		}
@@ -167,10 +207,66 @@ func (p *Paxos) CleanupLog() {
 
 	p.logLck.Lock()
 	defer p.logLck.Unlock()
+	if p.witness {
+		if p.execute < marker {
+			marker = p.execute
+		}
+		p.compact(marker)
+		return
+	}
+	// slots covered by a snapshot can go even if some node is behind, it will install the snapshot
+	if p.snapshot != nil && p.snapshot.Slot+1 > marker {
+		marker = p.snapshot.Slot + 1
+	}
 	for i := p.lastCleanupMarker; i < marker; i++ {
 		delete(p.log, i)
 	}
-	p.lastCleanupMarker = marker
+	p.lastCleanupMarker = paxi.Max(p.lastCleanupMarker, marker)
+}
+
+// takeSnapshot snapshots the state machine at the last executed slot and compacts the write-ahead log.
+// Should be called with logLck held
+func (p *Paxos) takeSnapshot() (*paxi.Snapshot, error) {
+	data, err := p.Node.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	s := &paxi.Snapshot{
+		Slot:   p.execute - 1,
+		Ballot: p.ballot,
+		Data:   data,
+	}
+	err = p.WAL().SaveSnapshot(*s, paxi.WALRecords(p.ballot, p.log, s.Slot+1, p.slot)...)
+	if err != nil {
+		return nil, err
+	}
+	p.snapshot = s
+	log.Debugf("Replica %s took %v", p.ID(), s)
+	return s, nil
+}
+
+// snapshotFor returns a snapshot of the executed state for node that asked to recover compacted slots,
+// or nil if one was sent to it recently. Local snapshots may only refer to a checkpoint on the local disk,
+// so the state is exported in full. Should be called with logLck held
+func (p *Paxos) snapshotFor(id paxi.ID) *paxi.Snapshot {
+	if t, sent := p.snapshotSent[id]; sent && time.Since(t) < paxi.SnapshotResendInterval {
+		return nil
+	}
+	if p.witness {
+		// witnesses have no state machine to export
+		return nil
+	}
+	data, err := p.Node.Export()
+	if err != nil {
+		log.Errorf("Replica %s cannot export snapshot: %v", p.ID(), err)
+		return nil
+	}
+	p.snapshotSent[id] = time.Now()
+	return &paxi.Snapshot{
+		Slot:   p.execute - 1,
+		Ballot: p.ballot,
+		Data:   data,
+	}
 }
 
 // HandleRequest handles request and start phase 1 or phase 2
@@ -183,16 +279,25 @@ func (p *Paxos) HandleRequest(r paxi.Request) {
 			p.P1a()
 		}
 	} else {
+		p.handover.Hit(r.NodeID)
 		p.P2a(&r)
 	}
 }
 
 // P1a starts phase 1 prepare
 func (p *Paxos) P1a() {
-	if p.active {
+	if p.active || p.witness {
+		// witnesses never lead
 		return
 	}
-	p.ballot.Next(p.ID())
+	p.handover.Stop()
+	// the next ballot is used only once it is durable
+	b := p.ballot
+	b.Next(p.ID())
+	if !paxi.PersistPromise(p.WAL(), p.ID(), b) {
+		return
+	}
+	p.ballot = b
 	p.quorum.Reset()
 	p.quorum.ACK(p.ID())
 	p.Broadcast(P1a{Ballot: p.ballot})
@@ -204,20 +309,23 @@ func (p *Paxos) P2a(r *paxi.Request) {
 	defer p.logLck.Unlock()
 
 	p.slot++
-	p.log[p.slot] = &entry{
-		ballot:    p.ballot,
-		command:   r.Command,
-		request:   r,
-		quorum:    paxi.NewQuorum(),
-		timestamp: time.Now(),
-	}
-	p.log[p.slot].quorum.ACK(p.ID())
+	p.log[p.slot] = &paxi.Entry{
+		Ballot:    p.ballot,
+		Commands:  []paxi.Command{r.Command},
+		Requests:  []*paxi.Request{r},
+		Quorum:    paxi.NewQuorum(),
+		Timestamp: time.Now(),
+	}
+	p.log[p.slot].Quorum.ACK(p.ID())
 	m := P2a{
 		Ballot:             p.ballot,
 		Slot:               p.slot,
 		GlobalExecutedSlot: p.globalExecuted,
 		Command:            r.Command,
 	}
+	if !paxi.PersistAccept(p.WAL(), p.ID(), m.Slot, m.Ballot, m.Command) {
+		return
+	}
 
 	p.p3Lock.Lock()
 	if p.p3PendingBallot > 0 {
@@ -228,18 +336,57 @@ func (p *Paxos) P2a(r *paxi.Request) {
 	p.p3Lock.Unlock()
 
 	if paxi.GetConfig().Thrifty {
-		p.MulticastQuorum(paxi.GetConfig().N()/2+1, m)
+		p.sendThrifty(m)
 	} else {
 		p.Broadcast(m)
 	}
 }
 
+// sendThrifty sends P2a only to the fastest acceptors that make a phase-2 quorum with the leader.
+// If the slot is not committed within the thrifty timeout, P2a is sent to every node and
+// the acceptors that did not answer are penalized, so the next quorum avoids them
+func (p *Paxos) sendThrifty(m P2a) {
+	peers := make([]paxi.ID, 0)
+	for _, id := range paxi.GetConfig().IDs() {
+		if id != p.ID() {
+			peers = append(peers, id)
+		}
+	}
+	ids := p.latency.Fastest(p.ID(), peers, p.Q2)
+	if len(ids) == len(peers) {
+		p.Broadcast(m)
+		return
+	}
+	p.thrifty.Sent()
+	for _, id := range ids {
+		p.Send(id, m)
+	}
+	sent := time.Now()
+	time.AfterFunc(paxi.ThriftyTimeout(), func() {
+		p.logLck.RLock()
+		e, exists := p.log[m.Slot]
+		done := !exists || e.Commit || e.Ballot != m.Ballot
+		p.logLck.RUnlock()
+		if done {
+			return
+		}
+		log.Debugf("Replica %s sends P2a of slot %d to every node after thrifty quorum %v timed out", p.ID(), m.Slot, ids)
+		p.thrifty.Fallback()
+		p.latency.Penalize(ids, sent, paxi.ThriftyTimeout())
+		p.Broadcast(m)
+	})
+}
+
 // HandleP1a handles P1a message
 func (p *Paxos) HandleP1a(m P1a) {
 	log.Debugf("Replica %s ===[%v]===>>> Replica %s\n", m.Ballot.ID(), m, p.ID())
 
 	// new leader
 	if m.Ballot > p.ballot {
+		// the ballot is promised only once it is durable, so a retried P1a does not get a P1b on a lost promise
+		if !paxi.PersistPromise(p.WAL(), p.ID(), m.Ballot) {
+			return
+		}
 		p.ballot = m.Ballot
 		p.active = false
 		// TODO use BackOff time or forward
@@ -253,10 +400,13 @@ func (p *Paxos) HandleP1a(m P1a) {
 	defer p.logLck.RUnlock()
 	l := make(map[int]CommandBallot)
 	for s := p.execute; s <= p.slot; s++ {
-		if p.log[s] == nil || p.log[s].commit {
+		if p.log[s] == nil || p.log[s].Commit {
 			continue
 		}
-		l[s] = CommandBallot{p.log[s].command, p.log[s].ballot}
+		l[s] = CommandBallot{p.log[s].Command(), p.log[s].Ballot}
+	}
+	if p.witness {
+		p.handOff(l)
 	}
 
 	p.Send(m.Ballot.ID(), P1b{
@@ -271,16 +421,21 @@ func (p *Paxos) update(scb map[int]CommandBallot) {
 	defer p.logLck.Unlock()
 	for s, cb := range scb {
 		p.slot = paxi.Max(p.slot, s)
+		if s < p.execute {
+			// executed already, witnesses hand over slots that other nodes may have missed
+			continue
+		}
 		if e, exists := p.log[s]; exists {
-			if !e.commit && cb.Ballot > e.ballot {
-				e.ballot = cb.Ballot
-				e.command = cb.Command
+			// a slot committed with no ballot is missing its P2a
+			if (!e.Commit || e.Ballot == 0) && cb.Ballot > e.Ballot {
+				e.Ballot = cb.Ballot
+				e.Commands = []paxi.Command{cb.Command}
 			}
 		} else {
-			p.log[s] = &entry{
-				ballot:  cb.Ballot,
-				command: cb.Command,
-				commit:  false,
+			p.log[s] = &paxi.Entry{
+				Ballot:   cb.Ballot,
+				Commands: []paxi.Command{cb.Command},
+				Commit:   false,
 			}
 		}
 	}
@@ -288,6 +443,7 @@ func (p *Paxos) update(scb map[int]CommandBallot) {
 
 // HandleP1b handles P1b message
 func (p *Paxos) HandleP1b(m P1b) {
+	p.handover.Heard(m.ID)
 	// old message
 	if m.Ballot < p.ballot || p.active {
 		// log.Debugf("Replica %s ignores old message [%v]\n", p.ID(), m)
@@ -319,17 +475,20 @@ func (p *Paxos) HandleP1b(m P1b) {
 				p.logLck.RLock()
 				logEntry := p.log[i]
 				p.logLck.RUnlock()
-				if logEntry == nil || logEntry.commit {
+				if logEntry == nil || logEntry.Commit {
+					continue
+				}
+				logEntry.Ballot = p.ballot
+				logEntry.Quorum = paxi.NewQuorum()
+				logEntry.Quorum.ACK(p.ID())
+				if !paxi.PersistAccept(p.WAL(), p.ID(), i, p.ballot, logEntry.Command()) {
 					continue
 				}
-				logEntry.ballot = p.ballot
-				logEntry.quorum = paxi.NewQuorum()
-				logEntry.quorum.ACK(p.ID())
 				p.Broadcast(P2a{
 					Ballot:             p.ballot,
 					Slot:               i,
 					GlobalExecutedSlot: p.globalExecuted,
-					Command:            logEntry.command,
+					Command:            logEntry.Command(),
 				})
 			}
 			// propose new commands
@@ -354,29 +513,39 @@ func (p *Paxos) HandleP2a(m P2a) {
 		// update entry
 		p.logLck.Lock()
 		if e, exists := p.log[m.Slot]; exists {
-			if !e.commit && m.Ballot > e.ballot {
+			if !e.Matches([]paxi.Command{m.Command}) {
+				// witnesses only keep hashes of commands every node executed
+				p.logLck.Unlock()
+				log.Errorf("Witness %s rejects %v, slot %d committed other commands", p.ID(), m, m.Slot)
+				return
+			}
+			if !e.Commit && m.Ballot > e.Ballot {
 				// different command and request is not nil
-				if !e.command.Equal(m.Command) && e.request != nil {
-					p.Forward(m.Ballot.ID(), *e.request)
-					// p.Retry(*e.request)
-					log.Debugf("Received different command (%v!=%v) for slot %d, resetting the request", m.Command, e.command, m.Slot)
-					e.request = nil
+				if !e.Command().Equal(m.Command) && e.Request() != nil {
+					p.Forward(m.Ballot.ID(), *e.Request())
+					// p.Retry(*e.Request())
+					log.Debugf("Received different command (%v!=%v) for slot %d, resetting the request", m.Command, e.Command(), m.Slot)
+					e.Requests = nil
 				}
-				e.command = m.Command
-				e.ballot = m.Ballot
-			} else if e.commit && e.ballot == 0 {
+				e.Commands = []paxi.Command{m.Command}
+				e.Ballot = m.Ballot
+			} else if e.Commit && e.Ballot == 0 {
 				// we can have commit slot with no ballot when we received P3 before P2a
-				e.command = m.Command
-				e.ballot = m.Ballot
+				e.Commands = []paxi.Command{m.Command}
+				e.Ballot = m.Ballot
 			}
 		} else {
-			p.log[m.Slot] = &entry{
-				ballot:  m.Ballot,
-				command: m.Command,
-				commit:  false,
+			p.log[m.Slot] = &paxi.Entry{
+				Ballot:   m.Ballot,
+				Commands: []paxi.Command{m.Command},
+				Commit:   false,
 			}
 		}
 		p.logLck.Unlock()
+		// accepted value must be durable before P2b leaves this node
+		if !paxi.PersistAccept(p.WAL(), p.ID(), m.Slot, m.Ballot, m.Command) {
+			return
+		}
 	}
 
 	p.Send(m.Ballot.ID(), P2b{
@@ -393,12 +562,13 @@ func (p *Paxos) HandleP2a(m P2a) {
 
 // HandleP2b handles P2b message
 func (p *Paxos) HandleP2b(m P2b) {
+	p.handover.Heard(m.ID)
 	// old message
 
 	p.logLck.RLock()
 	entry, exist := p.log[m.Slot]
 	p.logLck.RUnlock()
-	if !exist || m.Ballot < entry.ballot || entry.commit {
+	if !exist || m.Ballot < entry.Ballot || entry.Commit {
 		return
 	}
 
@@ -423,10 +593,11 @@ func (p *Paxos) HandleP2b(m P2b) {
 	// ack message
 	// the current slot might still be committed with q2
 	// if no q2 can be formed, this slot will be retried when received p2a or p3
-	if m.Ballot.ID() == p.ID() && m.Ballot == entry.ballot {
-		entry.quorum.ACK(m.ID)
-		if p.Q2(entry.quorum) {
-			entry.commit = true
+	if m.Ballot.ID() == p.ID() && m.Ballot == entry.Ballot {
+		p.latency.Add(m.ID, time.Since(entry.Timestamp))
+		entry.Quorum.ACK(m.ID)
+		if p.Q2(entry.Quorum) {
+			entry.Commit = true
 
 			p.p3Lock.Lock()
 			log.Debugf("Adding slot %d to P3Pending (%v)", m.Slot, p.p3pendingSlots)
@@ -434,7 +605,7 @@ func (p *Paxos) HandleP2b(m P2b) {
 			p.p3Lock.Unlock()
 
 			if p.ReplyWhenCommit {
-				r := entry.request
+				r := entry.Request()
 				r.Reply(paxi.Reply{
 					Command:   r.Command,
 					Timestamp: r.Timestamp,
@@ -454,12 +625,12 @@ func (p *Paxos) HandleP3(m P3) {
 		p.logLck.Lock()
 		e, exist := p.log[slot]
 		if exist {
-			if e.ballot == m.Ballot {
-				e.commit = true
-			} else if e.request != nil {
-				// p.Retry(*e.request)
-				p.Forward(m.Ballot.ID(), *e.request)
-				e.request = nil
+			if e.Ballot == m.Ballot {
+				e.Commit = true
+			} else if e.Request() != nil {
+				// p.Retry(*e.Request())
+				p.Forward(m.Ballot.ID(), *e.Request())
+				e.Requests = nil
 				// ask to recover the slot
 				log.Debugf("Replica %s needs to recover slot %d on ballot %v", p.ID(), slot, m.Ballot)
 				recoverSlots := []int{slot}
@@ -468,16 +639,16 @@ func (p *Paxos) HandleP3(m P3) {
 
 		} else {
 			// we mark slot as committed, but set ballot to 0 to designate that we have not received P2a for the slot and may need to recover later
-			e = &entry{commit: true, ballot: 0}
+			e = &paxi.Entry{Commit: true, Ballot: 0}
 			p.log[slot] = e
 		}
 		p.logLck.Unlock()
 
 		if p.ReplyWhenCommit {
-			if e.request != nil {
-				e.request.Reply(paxi.Reply{
-					Command:   e.request.Command,
-					Timestamp: e.request.Timestamp,
+			if r := e.Request(); r != nil {
+				r.Reply(paxi.Reply{
+					Command:   r.Command,
+					Timestamp: r.Timestamp,
 				})
 			}
 		}
@@ -494,24 +665,24 @@ func (p *Paxos) HandleP3(m P3) {
 
 	e, exist := p.log[m.Slot]
 	if exist {
-		if !e.command.Equal(m.Command) && e.request != nil {
-			// p.Retry(*e.request)
-			p.Forward(m.Ballot.ID(), *e.request)
-			e.request = nil
+		if !e.Command().Equal(m.Command) && e.Request() != nil {
+			// p.Retry(*e.Request())
+			p.Forward(m.Ballot.ID(), *e.Request())
+			e.Requests = nil
 		}
 	} else {
-		p.log[m.Slot] = &entry{}
+		p.log[m.Slot] = &paxi.Entry{}
 		e = p.log[m.Slot]
 	}
 
-	e.command = m.Command
-	e.commit = true
+	e.Commands = []paxi.Command{m.Command}
+	e.Commit = true
 
 	if p.ReplyWhenCommit {
-		if e.request != nil {
-			e.request.Reply(paxi.Reply{
-				Command:   e.request.Command,
-				Timestamp: e.request.Timestamp,
+		if r := e.Request(); r != nil {
+			r.Reply(paxi.Reply{
+				Command:   r.Command,
+				Timestamp: r.Timestamp,
 			})
 		}
 	} else {
@@ -532,20 +703,35 @@ func (p *Paxos) HandleP3RecoverRequest(m P3RecoverRequest) {
 	log.Debugf("Replica %s ===[%v]===>>> Replica %s\n", m.NodeId, m, p.ID())
 	p.logLck.Lock()
 
+	var snapshot *paxi.Snapshot
 	slotsToRecover := make([]int, 0, len(m.Slots))
 	cmdsToRecover := make([]paxi.Command, 0, len(m.Slots))
 	for _, slot := range m.Slots {
+		if slot < p.lastCleanupMarker {
+			// slot is compacted, node has to catch up from a snapshot
+			if snapshot == nil {
+				snapshot = p.snapshotFor(m.NodeId)
+			}
+			continue
+		}
 		e, exist := p.log[slot]
-		if exist && e.commit {
+		if exist && e.Commit {
 			log.Debugf("Entry on slot %d for recover: %v", slot, e)
 			slotsToRecover = append(slotsToRecover, slot)
-			cmdsToRecover = append(cmdsToRecover, e.command)
+			cmdsToRecover = append(cmdsToRecover, e.Command())
 		} else {
 			log.Debugf("Entry for recovery on slot %d does not exist or uncommitted", slot)
 		}
 	}
 	p.logLck.Unlock()
 
+	if snapshot != nil {
+		log.Infof("Replica %s sends %v to node %v", p.ID(), snapshot, m.NodeId)
+		for _, chunk := range snapshot.Chunks(p.ID(), paxi.GetConfig().SnapshotChunkSize) {
+			p.Send(m.NodeId, chunk)
+		}
+	}
+
 	// ok to recover
 	log.Debugf("Node %v sends recovery on slots %d to node %v", p.ID(), slotsToRecover, m.NodeId)
 	p.Send(m.NodeId, P3RecoverReply{
@@ -564,14 +750,19 @@ func (p *Paxos) HandleP3RecoverReply(m P3RecoverReply) {
 
 	for i, slot := range m.Slots {
 		p.slot = paxi.Max(p.slot, slot)
+		if e, exists := p.log[slot]; slot < p.execute || exists && e.Chosen() {
+			// committed or executed already, a late reply must not overwrite it
+			continue
+		}
 
 		// overwrite the slot with one we recovered, as it is guaranteed to have been majority committed
-		p.log[slot] = &entry{
-			ballot:    m.Ballot,
-			command:   m.Commands[i],
-			commit:    true,
-			timestamp: time.Now(),
+		p.log[slot] = &paxi.Entry{
+			Ballot:    m.Ballot,
+			Commands:  []paxi.Command{m.Commands[i]},
+			Commit:    true,
+			Timestamp: time.Now(),
 		}
+		paxi.PersistAccept(p.WAL(), p.ID(), slot, m.Ballot, m.Commands[i])
 	}
 
 	p.logLck.Unlock()
@@ -580,32 +771,83 @@ func (p *Paxos) HandleP3RecoverReply(m P3RecoverReply) {
 	log.Debugf("Leaving HandleP3RecoverReply")
 }
 
+// HandleInstallSnapshot installs a snapshot sent by the leader when this node fell behind its log compaction point
+func (p *Paxos) HandleInstallSnapshot(m paxi.InstallSnapshot) {
+	log.Debugf("Replica %s ===[%v]===>>> Replica %s\n", m.From, m, p.ID())
+	p.logLck.Lock()
+	s, done := p.assembler.Add(m)
+	if !done || s.Slot < p.execute {
+		p.logLck.Unlock()
+		return
+	}
+	if p.witness {
+		// witnesses keep no state machine, the snapshot only moves their log forward
+		s = &paxi.Snapshot{Slot: s.Slot, Ballot: s.Ballot}
+	} else {
+		if err := p.Node.Restore(s.Data); err != nil {
+			p.logLck.Unlock()
+			log.Errorf("Replica %s cannot restore %v: %v", p.ID(), s, err)
+			return
+		}
+		// keep only a local checkpoint of the installed state instead of the full image in the write-ahead log
+		if data, err := p.Node.Snapshot(); err == nil {
+			s = &paxi.Snapshot{Slot: s.Slot, Ballot: s.Ballot, Data: data}
+		}
+	}
+	for i := p.lastCleanupMarker; i <= s.Slot; i++ {
+		delete(p.log, i)
+	}
+	p.slot = paxi.Max(p.slot, s.Slot)
+	p.execute = s.Slot + 1
+	p.lastCleanupMarker = s.Slot + 1
+	p.snapshot = s
+	err := p.WAL().SaveSnapshot(*s, paxi.WALRecords(p.ballot, p.log, s.Slot+1, p.slot)...)
+	p.logLck.Unlock()
+	if err != nil {
+		log.Errorf("Replica %s cannot persist %v: %v", p.ID(), s, err)
+	}
+	log.Infof("Replica %s installed %v", p.ID(), s)
+
+	p.exec()
+}
+
 func (p *Paxos) exec() {
 	p.logLck.Lock()
 	defer p.logLck.Unlock()
 	for {
 		e, exists := p.log[p.execute]
 
-		if !exists || !e.commit {
+		if !exists || !e.Commit {
 			break
 		}
-		log.Debugf("Replica %s execute [s=%d, cmd=%v]", p.ID(), p.execute, e.command)
-		value := p.Execute(e.command)
-		if e.request != nil {
+		log.Debugf("Replica %s execute [s=%d, cmd=%v]", p.ID(), p.execute, e.Command())
+		if !p.recovering {
+			p.WAL().Commit(p.execute)
+		}
+		var value paxi.Value
+		if !p.witness {
+			value = p.Execute(e.Command())
+		}
+		if e.Request() != nil {
 			reply := paxi.Reply{
-				Command:    e.command,
+				Command:    e.Command(),
 				Value:      value,
 				Properties: make(map[string]string),
 			}
 			reply.Properties[HTTPHeaderSlot] = strconv.Itoa(p.execute)
-			reply.Properties[HTTPHeaderBallot] = e.ballot.String()
+			reply.Properties[HTTPHeaderBallot] = e.Ballot.String()
 			reply.Properties[HTTPHeaderExecute] = strconv.Itoa(p.execute)
-			e.request.Reply(reply)
-			e.request = nil
+			e.Request().Reply(reply)
+			e.Requests = nil
 		}
 		// TODO clean up the log periodically
 		// delete(p.log, p.execute)
 		p.execute++
+		if interval := paxi.GetConfig().SnapshotInterval; interval > 0 && !p.recovering && !p.witness && p.execute%interval == 0 {
+			if _, err := p.takeSnapshot(); err != nil {
+				log.Errorf("Replica %s cannot take snapshot: %v", p.ID(), err)
+			}
+		}
 	}
 	log.Debugf("Leaving exec")
 }
@@ -1,6 +1,9 @@
 package paxos
 
 import (
+	"flag"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"pigpaxos"
@@ -9,3 +12,47 @@ import (
 func TestPaxos(t *testing.T) {
 	paxi.Simulation()
 }
+
+// newFollower loads a configuration of three nodes and returns node 1.2
+func newFollower(t *testing.T) *Paxos {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+	err := os.WriteFile(file, []byte(`{
+		"address": {"1.1": "chan://127.0.0.1:1781", "1.2": "chan://127.0.0.1:1782", "1.3": "chan://127.0.0.1:1783"},
+		"http_address": {"1.1": "http://127.0.0.1:8781", "1.2": "http://127.0.0.1:8782", "1.3": "http://127.0.0.1:8783"}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flag.Set("config", file)
+	flag.Set("log_dir", dir)
+	paxi.Init()
+
+	return NewPaxos(paxi.NewNode(paxi.NewID(1, 2), paxi.WithStateMachine(new(countingStateMachine))))
+}
+
+func TestRecoverReplyKeepsCommittedSlots(t *testing.T) {
+	p := newFollower(t)
+
+	var b paxi.Ballot
+	b.Next(paxi.NewID(1, 1))
+	committed := paxi.Command{Key: "k", Value: paxi.Value("committed")}
+	p.log[0] = &paxi.Entry{Ballot: b, Commands: []paxi.Command{committed}, Commit: true}
+	// slot 1 heard only of its commit and needs to be recovered
+	p.log[1] = &paxi.Entry{Commit: true}
+	p.slot = 1
+
+	b.Next(paxi.NewID(1, 3))
+	late := paxi.Command{Key: "k", Value: paxi.Value("late")}
+	p.HandleP3RecoverReply(P3RecoverReply{Ballot: b, Slots: []int{0, 1}, Commands: []paxi.Command{late, late}})
+
+	if !p.log[0].Command().Equal(committed) {
+		t.Errorf("expect committed slot 0 to keep %v, got %v", committed, p.log[0].Command())
+	}
+	if !p.log[1].Command().Equal(late) || p.log[1].Ballot != b {
+		t.Errorf("expect slot 1 to be recovered with %v, got %v", late, p.log[1])
+	}
+	if p.execute != 2 {
+		t.Errorf("expect both slots to be executed, next execute slot is %d", p.execute)
+	}
+}
@@ -27,9 +27,9 @@ type Replica struct {
 }
 
 // NewReplica generates new Paxos replica
-func NewReplica(id paxi.ID) *Replica {
+func NewReplica(id paxi.ID, options ...paxi.NodeOption) *Replica {
 	r := new(Replica)
-	r.Node = paxi.NewNode(id)
+	r.Node = paxi.NewNode(id, options...)
 	r.Paxos = NewPaxos(r)
 	r.cleanupMultiplier = 3
 	r.Register(paxi.Request{}, r.handleRequest)
@@ -40,6 +40,9 @@ func NewReplica(id paxi.ID) *Replica {
 	r.Register(P3{}, r.HandleP3)
 	r.Register(P3RecoverRequest{}, r.HandleP3RecoverRequest)
 	r.Register(P3RecoverReply{}, r.HandleP3RecoverReply)
+	r.Register(paxi.InstallSnapshot{}, r.HandleInstallSnapshot)
+	r.Register(paxi.LeaderTransfer{}, r.HandleLeaderTransfer)
+	r.Register(Transfer{}, r.HandleTransfer)
 
 	go r.startTicker()
 
@@ -58,6 +61,9 @@ func (r *Replica) startTicker() {
 			r.CleanupLog()
 		}
 
+		r.CheckTransfer(now)
+		r.CheckPlacement(now, func(id paxi.ID) bool { return paxi.IsConnected(r, id) })
+
 		if r.IsLeader() {
 			r.P3Sync(now.UnixNano() / int64(time.Millisecond))
 		} else {
@@ -71,7 +77,8 @@ func (r *Replica) startTicker() {
 func (r *Replica) handleRequest(m paxi.Request) {
 	log.Debugf("Replica %s received %v\n", r.ID(), m)
 
-	if m.Command.IsRead() && *read != "" {
+	// witnesses have no database to read from
+	if m.Command.Operation() == paxi.Get && *read != "" && !r.Paxos.witness {
 		v, inProgress := r.readInProgress(m)
 		reply := paxi.Reply{
 			Command:    m.Command,
@@ -87,7 +94,7 @@ func (r *Replica) handleRequest(m paxi.Request) {
 		return
 	}
 
-	if *ephemeralLeader || r.Paxos.IsLeader() || r.Paxos.Ballot() == 0 {
+	if (*ephemeralLeader && !r.Paxos.witness) || r.Paxos.IsLeader() || r.Paxos.Ballot() == 0 {
 		r.Paxos.HandleRequest(m)
 	} else {
 		go r.Forward(r.Paxos.Leader(), m)
@@ -103,8 +110,12 @@ func (r *Replica) readInProgress(m paxi.Request) (paxi.Value, bool) {
 	// is in progress
 	for i := r.Paxos.slot; i >= r.Paxos.execute; i-- {
 		entry, exist := r.Paxos.log[i]
-		if exist && entry.command.Key == m.Command.Key {
-			return entry.command.Value, true
+		if exist && entry.Command().Key == m.Command.Key {
+			if entry.Command().Operation() != paxi.Put {
+				// value after reads, deletes, CAS and increments is not known before execution
+				return nil, true
+			}
+			return entry.Command().Value, true
 		}
 	}
 
@@ -0,0 +1,104 @@
+package paxos
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"pigpaxos"
+)
+
+// countingStateMachine counts commands it executes
+type countingStateMachine struct {
+	executed int
+}
+
+func (sm *countingStateMachine) Execute(paxi.Command) paxi.Value { sm.executed++; return nil }
+func (sm *countingStateMachine) Snapshot() ([]byte, error)       { return nil, nil }
+func (sm *countingStateMachine) Restore([]byte) error            { return nil }
+func (sm *countingStateMachine) Hash() uint64                    { return 0 }
+
+// newWitness loads a configuration of three nodes where 1.3 is a witness that snapshots every two slots
+func newWitness(t *testing.T, sm paxi.StateMachine) *Paxos {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+	err := os.WriteFile(file, []byte(`{
+		"address": {"1.1": "chan://127.0.0.1:1791", "1.2": "chan://127.0.0.1:1792", "1.3": "chan://127.0.0.1:1793"},
+		"http_address": {"1.1": "http://127.0.0.1:8791", "1.2": "http://127.0.0.1:8792", "1.3": "http://127.0.0.1:8793"},
+		"witnesses": ["1.3"],
+		"snapshot_interval": 2
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flag.Set("config", file)
+	flag.Set("log_dir", dir)
+	paxi.Init()
+
+	p := NewPaxos(paxi.NewNode(paxi.NewID(1, 3), paxi.WithStateMachine(sm)))
+	if !p.witness {
+		t.Fatal("expect 1.3 to be a witness")
+	}
+	return p
+}
+
+func TestWitness(t *testing.T) {
+	sm := new(countingStateMachine)
+	p := newWitness(t, sm)
+
+	var b paxi.Ballot
+	b.Next(paxi.NewID(1, 1))
+	cmds := make([]paxi.Command, 4)
+	for s := range cmds {
+		cmds[s] = paxi.Command{Key: paxi.Key(strconv.Itoa(s)), Value: paxi.Value("v")}
+		p.log[s] = &paxi.Entry{Ballot: b, Commands: []paxi.Command{cmds[s]}, Commit: true}
+	}
+	p.slot = len(cmds) - 1
+
+	// witnesses execute slots without a state machine
+	p.exec()
+	if p.execute != len(cmds) || sm.executed != 0 {
+		t.Fatalf("expect witness to execute %d slots without state machine, executed %d with %d commands", len(cmds), p.execute, sm.executed)
+	}
+
+	// slots not every node executed are handed off to a new leader
+	l := make(map[int]CommandBallot)
+	p.handOff(l)
+	if len(l) != len(cmds) {
+		t.Fatalf("expect %d slots to be handed off, got %v", len(cmds), l)
+	}
+
+	// slots 0 and 1 were executed by every node, they reach the snapshot interval
+	p.compact(2)
+	if p.snapshot == nil || p.snapshot.Slot != 1 {
+		t.Fatalf("expect snapshot at slot 1, got %v", p.snapshot)
+	}
+	if _, exists := p.log[0]; exists {
+		t.Error("expect snapshot to drop slot 0")
+	}
+	l = make(map[int]CommandBallot)
+	p.handOff(l)
+	if len(l) != 2 || !l[2].Command.Equal(cmds[2]) || !l[3].Command.Equal(cmds[3]) {
+		t.Errorf("expect slots 2 and 3 to be handed off, got %v", l)
+	}
+
+	// slot 2 keeps only the hash of its commands until the next snapshot
+	p.compact(3)
+	if p.snapshot.Slot != 1 {
+		t.Errorf("expect no snapshot before the interval, got %v", p.snapshot)
+	}
+	e := p.log[2]
+	if !e.Compacted() || e.Commands != nil {
+		t.Fatalf("expect slot 2 to keep only its hash, got %v", e)
+	}
+	if !e.Matches([]paxi.Command{cmds[2]}) || e.Matches([]paxi.Command{cmds[3]}) {
+		t.Error("expect hash of slot 2 to match only its commands")
+	}
+	l = make(map[int]CommandBallot)
+	p.handOff(l)
+	if _, exists := l[2]; exists || len(l) != 1 {
+		t.Errorf("expect only slot 3 to be handed off, got %v", l)
+	}
+}
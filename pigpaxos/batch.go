@@ -0,0 +1,59 @@
+package pigpaxos
+
+import (
+	"time"
+
+	"pigpaxos"
+)
+
+// propose adds request r to the batch of the next slot. The batch is proposed once it has BatchSize
+// commands or, from the ticker, once its first request waited for BatchDelay.
+// Membership changes are always proposed alone in their slot
+func (p *PigPaxos) propose(r *paxi.Request) {
+	p.batchLock.Lock()
+	defer p.batchLock.Unlock()
+	if r.Command.IsReconfig() {
+		if len(p.batch) > 0 {
+			p.P2a(p.takeBatch())
+		}
+		p.P2a([]*paxi.Request{r})
+		return
+	}
+	if len(p.batch) == 0 {
+		p.batchStart = time.Now()
+	}
+	p.batch = append(p.batch, r)
+	if len(p.batch) >= p.BatchSize {
+		p.P2a(p.takeBatch())
+	}
+}
+
+// FlushBatch proposes the pending batch if it was started before cutoff
+func (p *PigPaxos) FlushBatch(cutoff time.Time) {
+	p.batchLock.Lock()
+	defer p.batchLock.Unlock()
+	if !p.active || len(p.batch) == 0 || p.batchStart.After(cutoff) {
+		return
+	}
+	p.P2a(p.takeBatch())
+}
+
+// takeBatch removes and returns requests of the pending batch. Should be called with batchLock held
+func (p *PigPaxos) takeBatch() []*paxi.Request {
+	batch := p.batch
+	p.batch = make([]*paxi.Request, 0, p.BatchSize)
+	return batch
+}
+
+// sameCommands returns true if both batches have equal commands in the same order
+func sameCommands(a, b []paxi.Command) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+package pigpaxos
+
+import (
+	"encoding/json"
+
+	"pigpaxos"
+)
+
+// binary codec ids of PigPaxos messages on the hot path
+const (
+	p2aCodecID uint64 = iota + 100
+	p2bCodecID
+	p2bAggregatedCodecID
+	p3CodecID
+	routedMsgCodecID
+)
+
+func init() {
+	paxi.RegisterBinary(P2a{}, p2aCodecID, encodeP2a, decodeP2a)
+	paxi.RegisterBinary(P2b{}, p2bCodecID, encodeP2b, decodeP2b)
+	paxi.RegisterBinary(P2bAggregated{}, p2bAggregatedCodecID, encodeP2bAggregated, decodeP2bAggregated)
+	paxi.RegisterBinary(P3{}, p3CodecID, encodeP3, decodeP3)
+	paxi.RegisterBinary(RoutedMsg{}, routedMsgCodecID, encodeRoutedMsg, decodeRoutedMsg)
+}
+
+func encodeP3(w *paxi.BinaryWriter, m interface{}) {
+	p3 := m.(P3)
+	w.Ballot(p3.Ballot)
+	w.Ints(p3.Slot)
+	w.Bool(p3.Release)
+}
+
+func decodeP3(r *paxi.BinaryReader) interface{} {
+	return P3{
+		Ballot:  r.Ballot(),
+		Slot:    r.Ints(),
+		Release: r.Bool(),
+	}
+}
+
+func encodeP2a(w *paxi.BinaryWriter, m interface{}) {
+	p2a := m.(P2a)
+	w.Ballot(p2a.Ballot)
+	w.Int(p2a.Slot)
+	w.Int(p2a.GlobalExecute)
+	w.Commands(p2a.Commands)
+	encodeP3(w, p2a.P3msg)
+}
+
+func decodeP2a(r *paxi.BinaryReader) interface{} {
+	return P2a{
+		Ballot:        r.Ballot(),
+		Slot:          r.Int(),
+		GlobalExecute: r.Int(),
+		Commands:      r.Commands(),
+		P3msg:         decodeP3(r).(P3),
+	}
+}
+
+func encodeP2b(w *paxi.BinaryWriter, m interface{}) {
+	p2b := m.(P2b)
+	w.IDs(p2b.ID)
+	w.Ballot(p2b.Ballot)
+	w.Int(p2b.Slot)
+}
+
+func decodeP2b(r *paxi.BinaryReader) interface{} {
+	return P2b{
+		ID:     r.IDs(),
+		Ballot: r.Ballot(),
+		Slot:   r.Int(),
+	}
+}
+
+func encodeP2bAggregated(w *paxi.BinaryWriter, m interface{}) {
+	p2b := m.(P2bAggregated)
+	w.IDs(p2b.MissingIDs)
+	w.ID(p2b.RelayID)
+	w.Int(p2b.RelayLastExecute)
+	w.Ballot(p2b.Ballot)
+	w.Int(p2b.Slot)
+	w.Int(p2b.Layout)
+	w.Uvarint(uint64(len(p2b.Delays)))
+	for id, d := range p2b.Delays {
+		w.ID(id)
+		w.Varint(d)
+	}
+}
+
+func decodeP2bAggregated(r *paxi.BinaryReader) interface{} {
+	m := P2bAggregated{
+		MissingIDs:       r.IDs(),
+		RelayID:          r.ID(),
+		RelayLastExecute: r.Int(),
+		Ballot:           r.Ballot(),
+		Slot:             r.Int(),
+		Layout:           r.Int(),
+	}
+	if n := r.Count(); n > 0 {
+		m.Delays = make(map[paxi.ID]int64, n)
+		for i := 0; i < n && r.Err() == nil; i++ {
+			m.Delays[r.ID()] = r.Varint()
+		}
+	}
+	return m
+}
+
+func encodeRoutedMsg(w *paxi.BinaryWriter, m interface{}) {
+	routed := m.(RoutedMsg)
+	w.IDs(routed.Hops)
+	w.Bool(routed.IsForward)
+	w.Uvarint(uint64(routed.Progress))
+	w.Int(routed.Layout)
+	w.IDs(routed.Group)
+	w.Message(routed.Payload)
+}
+
+func decodeRoutedMsg(r *paxi.BinaryReader) interface{} {
+	return RoutedMsg{
+		Hops:      r.IDs(),
+		IsForward: r.Bool(),
+		Progress:  uint8(r.Uvarint()),
+		Layout:    r.Int(),
+		Group:     r.IDs(),
+		Payload:   r.Message(),
+	}
+}
+
+// routedMsgJSON is RoutedMsg with its payload encoded together with the payload type
+type routedMsgJSON struct {
+	Hops      []paxi.ID
+	IsForward bool
+	Progress  uint8
+	Layout    int
+	Group     []paxi.ID
+	Payload   json.RawMessage
+}
+
+func (m RoutedMsg) MarshalJSON() ([]byte, error) {
+	payload, err := paxi.EncodeJSONMessage(m.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(routedMsgJSON{m.Hops, m.IsForward, m.Progress, m.Layout, m.Group, payload})
+}
+
+func (m *RoutedMsg) UnmarshalJSON(b []byte) error {
+	var v routedMsgJSON
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+	m.Hops = v.Hops
+	m.IsForward = v.IsForward
+	m.Progress = v.Progress
+	m.Layout = v.Layout
+	m.Group = v.Group
+	m.Payload, err = paxi.DecodeJSONMessage(v.Payload)
+	return err
+}
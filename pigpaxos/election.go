@@ -0,0 +1,154 @@
+package pigpaxos
+
+import (
+	"math/rand"
+	"time"
+
+	"pigpaxos"
+	"pigpaxos/log"
+)
+
+// FailoverStats reports elections this node won after it detected a failed leader
+type FailoverStats struct {
+	Elections int     `json:"elections"`
+	Last      float64 `json:"last_ms"` // ms from the last message of the failed leader until this node became leader
+	Mean      float64 `json:"mean_ms"`
+}
+
+// resetElection draws a new randomized election deadline between one and two election timeouts from now,
+// so followers that lost the same leader rarely start competing elections
+func (p *PigPaxos) resetElection(now time.Time) {
+	p.electionDeadline = now.Add(p.ElectionTimeout + time.Duration(rand.Int63n(int64(p.ElectionTimeout)+1)))
+}
+
+// heardLeader records that the leader of ballot b is alive
+func (p *PigPaxos) heardLeader(b paxi.Ballot) {
+	if p.HeartbeatInterval == 0 || b < p.ballot {
+		return
+	}
+	p.electionLock.Lock()
+	defer p.electionLock.Unlock()
+	now := time.Now()
+	p.heard = now
+	p.electing = time.Time{}
+	p.preVoteBallot = 0
+	p.resetElection(now)
+}
+
+// SendHeartbeat sends a heartbeat through the relay tree every heartbeat interval while this node is the leader
+func (p *PigPaxos) SendHeartbeat(now time.Time) {
+	if p.HeartbeatInterval == 0 || !p.active {
+		return
+	}
+	p.electionLock.Lock()
+	due := now.Sub(p.lastHeartbeat) >= p.HeartbeatInterval
+	if due {
+		p.lastHeartbeat = now
+	}
+	p.electionLock.Unlock()
+	if !due {
+		return
+	}
+	p.logLck.RLock()
+	m := Heartbeat{Ballot: p.ballot, Committed: p.committed}
+	p.logLck.RUnlock()
+	p.Broadcast(m)
+	p.heartbeatLearners(m)
+}
+
+// HandleHeartbeat handles heartbeat of the leader
+func (p *PigPaxos) HandleHeartbeat(m Heartbeat) {
+	log.Debugf("Replica %s ===[%v]===>>> Replica %s\n", m.Ballot.ID(), m, p.ID())
+	p.heardLeader(m.Ballot)
+	p.heardCommitted(m.Committed)
+}
+
+// CheckElection starts a pre-vote once this follower has not heard from the leader before its election deadline.
+// A pre-vote does not change the ballot of any node, so a partitioned node that keeps timing out
+// does not force a healthy leader to step down when it comes back
+func (p *PigPaxos) CheckElection(now time.Time) {
+	if p.HeartbeatInterval == 0 || p.active || p.learner || p.witness {
+		return
+	}
+	p.electionLock.Lock()
+	defer p.electionLock.Unlock()
+	if p.electionDeadline.IsZero() {
+		p.resetElection(now)
+		return
+	}
+	if now.Before(p.electionDeadline) || p.leaseGranted(p.ID()) {
+		return
+	}
+	p.resetElection(now)
+	if p.electing.IsZero() {
+		p.electing = p.heard
+	}
+	p.preVoteBallot = p.ballot
+	p.preVoteBallot.Next(p.ID())
+	p.preVotes = paxi.NewQuorum()
+	p.preVotes.ACK(p.ID())
+	log.Infof("Replica %s has not heard from leader of %v since %v, starting pre-vote for %v", p.ID(), p.ballot, p.heard, p.preVoteBallot)
+	for _, id := range paxi.GetConfig().Voters() {
+		if id != p.ID() {
+			p.Send(id, PreVote{Ballot: p.preVoteBallot})
+		}
+	}
+}
+
+// HandlePreVote grants the pre-vote if this node would promise its ballot and has not heard from a leader
+// within the election timeout itself
+func (p *PigPaxos) HandlePreVote(m PreVote) {
+	log.Debugf("Replica %s ===[%v]===>>> Replica %s\n", m.Ballot.ID(), m, p.ID())
+	p.electionLock.Lock()
+	granted := m.Ballot > p.ballot && !p.active && time.Since(p.heard) >= p.ElectionTimeout && !p.leaseGranted(m.Ballot.ID())
+	p.electionLock.Unlock()
+	p.Send(m.Ballot.ID(), PreVoteReply{
+		Ballot:  m.Ballot,
+		ID:      p.ID(),
+		Granted: granted,
+	})
+}
+
+// HandlePreVoteReply starts phase 1 once a phase-1 quorum granted the pre-vote
+func (p *PigPaxos) HandlePreVoteReply(m PreVoteReply) {
+	log.Debugf("Replica %s ===[%v]===>>> Replica %s\n", m.ID, m, p.ID())
+	p.electionLock.Lock()
+	if !m.Granted || m.Ballot != p.preVoteBallot || p.active {
+		p.electionLock.Unlock()
+		return
+	}
+	p.preVotes.ACK(m.ID)
+	won := p.Q1(p.preVotes)
+	if won {
+		p.preVoteBallot = 0
+	}
+	p.electionLock.Unlock()
+	if won {
+		log.Infof("Replica %s won pre-vote, starting phase 1", p.ID())
+		p.P1a()
+	}
+}
+
+// electedLeader records failover time if this node became leader after it detected a failed leader
+func (p *PigPaxos) electedLeader() {
+	p.electionLock.Lock()
+	defer p.electionLock.Unlock()
+	p.lastHeartbeat = time.Time{}
+	p.preVoteBallot = 0
+	if p.electing.IsZero() {
+		return
+	}
+	d := float64(time.Since(p.electing)) / float64(time.Millisecond)
+	p.failover.Elections++
+	p.failover.Last = d
+	p.failover.Mean += (d - p.failover.Mean) / float64(p.failover.Elections)
+	p.electing = time.Time{}
+	log.Infof("Replica %s became leader of %v %.1f ms after the last message of the previous leader", p.ID(), p.ballot, d)
+}
+
+// Failover returns statistics of elections this node won after a leader failure
+func (p *PigPaxos) Failover() FailoverStats {
+	p.electionLock.Lock()
+	defer p.electionLock.Unlock()
+	return p.failover
+}
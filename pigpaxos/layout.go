@@ -0,0 +1,195 @@
+package pigpaxos
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"pigpaxos"
+	"pigpaxos/log"
+)
+
+// maxLayouts is how many relay layouts are kept to interpret replies relayed with older layouts
+const maxLayouts = 4
+
+// relayLayout is an assignment of nodes to relay groups used from slot onward.
+// Every routed message carries the slot of the layout it was relayed with, so the leader
+// reconstructs voters of an aggregated P2b with exactly the groups the relay used
+type relayLayout struct {
+	slot           int // first slot using this layout
+	groups         []*PeerGroup
+	nodeIdsToGroup map[paxi.ID]int
+	myGroup        int
+	fixedRelays    []paxi.ID
+}
+
+func (l relayLayout) String() string {
+	return fmt.Sprintf("RelayLayout {s=%d groups=%v}", l.slot, l.groups)
+}
+
+// newLayout indexes relay groups for this replica
+func (r *Replica) newLayout(slot int, groups []*PeerGroup) *relayLayout {
+	l := &relayLayout{
+		slot:           slot,
+		groups:         groups,
+		nodeIdsToGroup: make(map[paxi.ID]int),
+		fixedRelays:    make([]paxi.ID, len(groups)),
+	}
+	for i, pg := range groups {
+		for _, id := range pg.nodes {
+			l.nodeIdsToGroup[id] = i
+		}
+		if *fixedrelay {
+			l.fixedRelays[i] = pg.GetRandomNodeId(r.ID(), r.reachable)
+		}
+	}
+	l.myGroup = l.nodeIdsToGroup[r.ID()]
+	return l
+}
+
+// installLayout starts using layout l from its slot, it replaces a layout that starts at the same slot
+func (r *Replica) installLayout(l *relayLayout) {
+	r.layoutLock.Lock()
+	defer r.layoutLock.Unlock()
+	layouts := make([]*relayLayout, 0, len(r.layouts)+1)
+	for _, old := range r.layouts {
+		if old.slot != l.slot {
+			layouts = append(layouts, old)
+		}
+	}
+	layouts = append(layouts, l)
+	sort.Slice(layouts, func(i, j int) bool { return layouts[i].slot < layouts[j].slot })
+	if len(layouts) > maxLayouts {
+		layouts = layouts[len(layouts)-maxLayouts:]
+	}
+	r.layouts = layouts
+	log.Infof("Node %v installed %v", r.ID(), l)
+}
+
+// layout returns the newest known layout that is used for slot
+func (r *Replica) layout(slot int) *relayLayout {
+	r.layoutLock.RLock()
+	defer r.layoutLock.RUnlock()
+	for i := len(r.layouts) - 1; i > 0; i-- {
+		if r.layouts[i].slot <= slot {
+			return r.layouts[i]
+		}
+	}
+	return r.layouts[0]
+}
+
+// latestLayout returns layout used for new slots
+func (r *Replica) latestLayout() *relayLayout {
+	return r.layout(math.MaxInt)
+}
+
+// sampleLatency records latencies of a relay and its group from a sampled aggregated P2b.
+// The relay only answers after it collected its group, so its own latency is the round trip less that wait
+func (r *Replica) sampleLatency(m P2bAggregated) {
+	r.logLck.RLock()
+	e, exists := r.log[m.Slot]
+	r.logLck.RUnlock()
+	if !exists || e.Timestamp.IsZero() {
+		return
+	}
+	var wait int64
+	for _, d := range m.Delays {
+		if d > wait {
+			wait = d
+		}
+	}
+	base := time.Since(e.Timestamp) - time.Duration(wait)*time.Microsecond
+	r.latency.Add(m.RelayID, base)
+	for id, d := range m.Delays {
+		r.latency.Add(id, base+time.Duration(d)*time.Microsecond)
+	}
+}
+
+// rebalance rebuilds relay groups on the leader so that nodes with similar latency share a group
+// and slow nodes do not hold back relays of fast ones. The new layout is used from the next slot
+func (r *Replica) rebalance() {
+	if !r.active || r.reconfigSlot >= 0 {
+		return
+	}
+	ids := paxi.GetConfig().Voters()
+	latency := make(map[paxi.ID]float64, len(ids))
+	for _, id := range ids {
+		l, exists := r.latency.Get(id)
+		if !exists {
+			l = math.Inf(1)
+		}
+		latency[id] = l
+	}
+	latency[r.ID()] = 0
+	sort.Slice(ids, func(i, j int) bool {
+		if latency[ids[i]] != latency[ids[j]] {
+			return latency[ids[i]] < latency[ids[j]]
+		}
+		return ids[i].Zone() < ids[j].Zone() || (ids[i].Zone() == ids[j].Zone() && ids[i].Node() < ids[j].Node())
+	})
+
+	current := r.latestLayout()
+	groups := r.peersToGroups(len(current.groups), ids)
+	if sameGroups(groups, current.groups) {
+		// updates are not persisted, followers that missed one get the current layout again
+		if current.slot > 0 {
+			r.Node.Broadcast(r.layoutUpdate(current))
+		}
+		return
+	}
+
+	r.logLck.RLock()
+	slot := r.slot + 1
+	r.logLck.RUnlock()
+	l := r.newLayout(slot, groups)
+	r.installLayout(l)
+	r.Node.Broadcast(r.layoutUpdate(l))
+}
+
+// layoutUpdate returns the message that installs layout l on followers
+func (r *Replica) layoutUpdate(l *relayLayout) RelayGroupUpdate {
+	m := RelayGroupUpdate{
+		Ballot: r.ballot,
+		Slot:   l.slot,
+		Groups: make([][]paxi.ID, len(l.groups)),
+	}
+	for i, pg := range l.groups {
+		m.Groups[i] = pg.nodes
+	}
+	return m
+}
+
+func (r *Replica) handleRelayGroupUpdate(m RelayGroupUpdate) {
+	log.Debugf("Node %v received %v", r.ID(), m)
+	if m.Ballot < r.Ballot() {
+		return
+	}
+	groups := make([]*PeerGroup, len(m.Groups))
+	for i, nodes := range m.Groups {
+		groups[i] = &PeerGroup{nodes: nodes}
+	}
+	r.installLayout(r.newLayout(m.Slot, groups))
+}
+
+// sameGroups returns true if both layouts put every node into the same group
+func sameGroups(a, b []*PeerGroup) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == nil || b[i] == nil || len(a[i].nodes) != len(b[i].nodes) {
+			return false
+		}
+		nodes := make(map[paxi.ID]bool, len(a[i].nodes))
+		for _, id := range a[i].nodes {
+			nodes[id] = true
+		}
+		for _, id := range b[i].nodes {
+			if !nodes[id] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package pigpaxos
+
+import (
+	"strconv"
+
+	"pigpaxos"
+	"pigpaxos/log"
+)
+
+// HTTPHeaderLag is the reply property with the number of committed slots a learner has not executed when it served a read
+const HTTPHeaderLag = "Lag"
+
+// learn streams committed slot of entry e to every learner. Learners are not part of relay groups,
+// so the leader sends them the commands directly instead of a P3 through the relay tree
+func (p *PigPaxos) learn(slot int, e *paxi.Entry) {
+	p.logLck.Lock()
+	p.committed = paxi.Max(p.committed, slot)
+	committed := p.committed
+	p.logLck.Unlock()
+	learners := paxi.GetConfig().LearnerIDs()
+	if len(learners) == 0 {
+		return
+	}
+	m := Commit{
+		Ballot:    e.Ballot,
+		Slot:      slot,
+		Commands:  e.Commands,
+		Committed: committed,
+	}
+	for _, id := range learners {
+		go p.Send(id, m)
+	}
+}
+
+// heartbeatLearners sends heartbeat m of the leader to every learner, so learners that missed
+// commits still know how far behind they are
+func (p *PigPaxos) heartbeatLearners(m Heartbeat) {
+	for _, id := range paxi.GetConfig().LearnerIDs() {
+		go p.Send(id, m)
+	}
+}
+
+// heardCommitted records that the leader committed slots up to slot
+func (p *PigPaxos) heardCommitted(slot int) {
+	p.logLck.Lock()
+	p.committed = paxi.Max(p.committed, slot)
+	p.logLck.Unlock()
+}
+
+// HandleCommit executes a slot the leader streamed to this learner. Missing slots are recovered from the leader
+// once the learner falls behind, or replaced by a snapshot if the leader already compacted them
+func (p *PigPaxos) HandleCommit(m Commit) {
+	log.Debugf("Replica %s ===[%v]===>>> Replica %s\n", m.Ballot.ID(), m, p.ID())
+	if m.Ballot > p.ballot {
+		p.ballot = m.Ballot
+		// writes sent to this learner before it knew the leader
+		p.forward()
+	}
+	p.logLck.Lock()
+	p.committed = paxi.Max(p.committed, m.Committed)
+	if m.Slot < p.execute {
+		p.logLck.Unlock()
+		return
+	}
+	p.slot = paxi.Max(p.slot, m.Slot)
+	e, exists := p.log[m.Slot]
+	if exists && e.Commit && e.Ballot != 0 {
+		p.logLck.Unlock()
+		return
+	}
+	p.log[m.Slot] = &paxi.Entry{
+		Ballot:   m.Ballot,
+		Commands: m.Commands,
+		Commit:   true,
+	}
+	p.logLck.Unlock()
+	if !paxi.PersistAccept(p.WAL(), p.ID(), m.Slot, m.Ballot, m.Commands...) {
+		return
+	}
+	p.exec()
+}
+
+// Lag returns how many slots the leader committed that this node has not executed yet, as far as this node knows.
+// Learners hear the highest committed slot with every commit and heartbeat of the leader
+func (p *PigPaxos) Lag() int {
+	p.logLck.RLock()
+	defer p.logLck.RUnlock()
+	return paxi.Max(paxi.Max(p.committed, p.slot)-p.execute+1, 0)
+}
+
+// LearnerRead answers read request r from the local database if this node is a learner.
+// The value may be stale, the reply reports by how many slots
+func (p *PigPaxos) LearnerRead(r paxi.Request) bool {
+	if !r.Command.IsRead() || !p.learner {
+		return false
+	}
+	lag := p.Lag()
+	log.Debugf("Replica %s serves %v as learner %d slots behind", p.ID(), r.Command, lag)
+	value := p.Execute(r.Command)
+	r.Reply(paxi.Reply{
+		Command:    r.Command,
+		Value:      value,
+		Properties: map[string]string{HTTPHeaderLag: strconv.Itoa(lag)},
+	})
+	return true
+}
@@ -0,0 +1,88 @@
+package pigpaxos
+
+import (
+	"time"
+
+	"pigpaxos"
+	"pigpaxos/log"
+)
+
+// leaseClockDrift is the fraction of the lease the leader gives up to tolerate clock rate differences between nodes
+const leaseClockDrift = 0.1
+
+// grantLease promises the leader of ballot b that no other leader is elected by this node for LeaseDuration.
+// Every acceptor grants the lease when it accepts a P2a, so the P2b acks relayed back through the tree
+// carry the grants of the whole group
+func (p *PigPaxos) grantLease(b paxi.Ballot) {
+	if p.LeaseDuration == 0 {
+		return
+	}
+	p.leaseLock.Lock()
+	defer p.leaseLock.Unlock()
+	p.grantBallot = b
+	p.grant = time.Now().Add(p.LeaseDuration)
+}
+
+// leaseGranted returns true if this node granted a lease that is still valid to a leader other than id
+func (p *PigPaxos) leaseGranted(id paxi.ID) bool {
+	p.leaseLock.RLock()
+	defer p.leaseLock.RUnlock()
+	return p.grantBallot != 0 && p.grantBallot.ID() != id && time.Now().Before(p.grant)
+}
+
+// releaseLease drops the lease granted to the leader of ballot b after it gave up leadership
+func (p *PigPaxos) releaseLease(b paxi.Ballot) {
+	p.leaseLock.Lock()
+	defer p.leaseLock.Unlock()
+	if p.grantBallot == b {
+		p.grantBallot = 0
+	}
+}
+
+// extendLease renews the lease of this leader once slot of entry e is committed with a Q2 quorum of grants.
+// Acceptors granted the lease after the P2a was sent, so the lease is counted from the time of the proposal
+func (p *PigPaxos) extendLease(e *paxi.Entry) {
+	if p.LeaseDuration == 0 || e.Timestamp.IsZero() || e.Ballot != p.ballot {
+		return
+	}
+	expiry := e.Timestamp.Add(time.Duration(float64(p.LeaseDuration) * (1 - leaseClockDrift)))
+	p.leaseLock.Lock()
+	defer p.leaseLock.Unlock()
+	if p.leaseBallot != e.Ballot || expiry.After(p.lease) {
+		p.leaseBallot = e.Ballot
+		p.lease = expiry
+	}
+}
+
+// HasLease returns true if this node is the leader with a valid lease and has executed every slot
+// that may have been committed by previous leaders, so its local database is up to date
+func (p *PigPaxos) HasLease() bool {
+	if p.LeaseDuration == 0 || !p.active || p.ReplyWhenCommit {
+		return false
+	}
+	p.leaseLock.RLock()
+	valid := p.leaseBallot == p.ballot && time.Now().Before(p.lease)
+	p.leaseLock.RUnlock()
+	if !valid {
+		return false
+	}
+	p.logLck.RLock()
+	defer p.logLck.RUnlock()
+	return p.execute > p.leaseSlot
+}
+
+// LocalRead answers read request r from the local database if this node holds the leader lease.
+// It returns false if the request has to go through the log
+func (p *PigPaxos) LocalRead(r paxi.Request) bool {
+	if !r.Command.IsRead() || !p.HasLease() {
+		return false
+	}
+	log.Debugf("Replica %s serves %v under lease", p.ID(), r.Command)
+	value := p.Execute(r.Command)
+	r.Reply(paxi.Reply{
+		Command:    r.Command,
+		Value:      value,
+		Properties: make(map[string]string),
+	})
+	return true
+}
@@ -1,40 +1,47 @@
 package pigpaxos
 
 import (
-	"encoding/gob"
 	"fmt"
 	"pigpaxos"
 	"sync"
 )
 
 func init() {
-	gob.Register(P1b{})
-	gob.Register(P2b{})
-	gob.Register(P2bAggregated{})
-	gob.Register([]P1b{})
-	gob.Register([]P2b{})
-	gob.Register(P1a{})
-	gob.Register(P2a{})
-	gob.Register(P3{})
-	gob.Register(P3RecoverRequest{})
-	gob.Register(P3RecoverReply{})
-	gob.Register(RoutedMsg{})
+	paxi.RegisterMessage(P1b{})
+	paxi.RegisterMessage(P2b{})
+	paxi.RegisterMessage(P2bAggregated{})
+	paxi.RegisterMessage([]P1b{})
+	paxi.RegisterMessage([]P2b{})
+	paxi.RegisterMessage(P1a{})
+	paxi.RegisterMessage(P2a{})
+	paxi.RegisterMessage(P3{})
+	paxi.RegisterMessage(P3RecoverRequest{})
+	paxi.RegisterMessage(P3RecoverReply{})
+	paxi.RegisterMessage(RoutedMsg{})
+	paxi.RegisterMessage(RelayGroupUpdate{})
+	paxi.RegisterMessage(Heartbeat{})
+	paxi.RegisterMessage(PreVote{})
+	paxi.RegisterMessage(PreVoteReply{})
+	paxi.RegisterMessage(Transfer{})
+	paxi.RegisterMessage(Commit{})
 }
 
 // CommandBallot combines each command with its ballot number
 type CommandBallot struct {
-	Command paxi.Command
-	Ballot  paxi.Ballot
+	Commands []paxi.Command
+	Ballot   paxi.Ballot
 }
 
 func (cb CommandBallot) String() string {
-	return fmt.Sprintf("cmd=%v b=%v", cb.Command, cb.Ballot)
+	return fmt.Sprintf("cmds=%v b=%v", cb.Commands, cb.Ballot)
 }
 
 type RoutedMsg struct {
 	Hops      []paxi.ID
 	IsForward bool
 	Progress  uint8
+	Layout    int       // first slot of the relay layout used to route this message
+	Group     []paxi.ID // nodes served by the receiving relay below the first level of the tree
 	Payload   interface{}
 	lock      sync.Mutex
 }
@@ -48,7 +55,7 @@ func (m *RoutedMsg) GetPreviousProgressHop() paxi.ID {
 }
 
 func (m RoutedMsg) String() string {
-	return fmt.Sprintf("RoutedMsg {Hops=%v IsForward=%v Progress=%v, Payload=%v}", m.Hops, m.IsForward, m.Progress, m.Payload)
+	return fmt.Sprintf("RoutedMsg {Hops=%v IsForward=%v Progress=%v Layout=%d Group=%v, Payload=%v}", m.Hops, m.IsForward, m.Progress, m.Layout, m.Group, m.Payload)
 }
 
 // P1b promise message
@@ -80,12 +87,67 @@ type P2bAggregated struct {
 	RelayLastExecute int
 	Ballot           paxi.Ballot
 	Slot             int
+	Layout           int               // first slot of the relay layout that defines the relay group
+	Delays           map[paxi.ID]int64 // P2b latency of group members in microseconds, only on sampled slots
 }
 
 func (m P2bAggregated) String() string {
 	return fmt.Sprintf("P2b {b=%v RelayId=%s RelayLastExecute=%d s=%d, missingIDs=%v}", m.Ballot, m.RelayID, m.RelayLastExecute, m.Slot, m.MissingIDs)
 }
 
+// RelayGroupUpdate is a new relay group assignment that the leader uses from Slot onward
+type RelayGroupUpdate struct {
+	Ballot paxi.Ballot
+	Slot   int
+	Groups [][]paxi.ID
+}
+
+func (m RelayGroupUpdate) String() string {
+	return fmt.Sprintf("RelayGroupUpdate {b=%v s=%d groups=%v}", m.Ballot, m.Slot, m.Groups)
+}
+
+// Heartbeat is sent by the leader through the relay tree, so followers notice when it fails.
+// Learners get it directly and measure their lag against the highest slot the leader committed
+type Heartbeat struct {
+	Ballot    paxi.Ballot
+	Committed int
+}
+
+func (m Heartbeat) String() string {
+	return fmt.Sprintf("Heartbeat {b=%v committed=%d}", m.Ballot, m.Committed)
+}
+
+// PreVote asks a node whether it would promise Ballot without changing the ballot of the node
+type PreVote struct {
+	Ballot paxi.Ballot
+}
+
+func (m PreVote) String() string {
+	return fmt.Sprintf("PreVote {b=%v}", m.Ballot)
+}
+
+// PreVoteReply grants or rejects the pre-vote of Ballot
+type PreVoteReply struct {
+	Ballot  paxi.Ballot
+	ID      paxi.ID
+	Granted bool
+}
+
+func (m PreVoteReply) String() string {
+	return fmt.Sprintf("PreVoteReply {b=%v id=%s granted=%v}", m.Ballot, m.ID, m.Granted)
+}
+
+// Transfer hands leadership of Ballot over to the receiver together with the slots the leader has not committed
+type Transfer struct {
+	Ballot paxi.Ballot
+	Log    map[int]CommandBallot
+	Zone   int // zone the new leader leads from, 0 if none
+}
+
+func (m Transfer) String() string {
+	return fmt.Sprintf("Transfer {b=%v zone=%d log=%v}", m.Ballot, m.Zone, m.Log)
+}
+
 // P1a prepare message
 type P1a struct {
 	Ballot paxi.Ballot
@@ -100,23 +162,24 @@ type P2a struct {
 	Ballot        paxi.Ballot
 	Slot          int
 	GlobalExecute int
-	Command       paxi.Command
+	Commands      []paxi.Command // batch of commands proposed in the slot
 	P3msg         P3
 }
 
 func (m P2a) String() string {
-	return fmt.Sprintf("P2a {b=%v s=%d cmd=%v, p3Msg=%v}", m.Ballot, m.Slot, m.Command, m.P3msg)
+	return fmt.Sprintf("P2a {b=%v s=%d cmds=%v, p3Msg=%v}", m.Ballot, m.Slot, m.Commands, m.P3msg)
 }
 
 // P3 commit message
 type P3 struct {
-	Ballot paxi.Ballot
-	Slot   []int
+	Ballot  paxi.Ballot
+	Slot    []int
+	Release bool // the leader of Ballot handed leadership over, so leases granted to it are dropped
 	//Command paxi.Command
 }
 
 func (m P3) String() string {
-	return fmt.Sprintf("P3 {b=%v slots=%d}", m.Ballot, m.Slot)
+	return fmt.Sprintf("P3 {b=%v slots=%d release=%v}", m.Ballot, m.Slot, m.Release)
 }
 
 type P3RecoverRequest struct {
@@ -130,11 +193,23 @@ func (m P3RecoverRequest) String() string {
 }
 
 type P3RecoverReply struct {
-	Ballot  paxi.Ballot
-	Slot    int
-	Command paxi.Command
+	Ballot   paxi.Ballot
+	Slot     int
+	Commands []paxi.Command
 }
 
 func (m P3RecoverReply) String() string {
-	return fmt.Sprintf("P3RecoverReply {b=%v slots=%d, cmd=%v}", m.Ballot, m.Slot, m.Command)
+	return fmt.Sprintf("P3RecoverReply {b=%v slots=%d, cmds=%v}", m.Ballot, m.Slot, m.Commands)
+}
+
+// Commit streams the commands of a committed slot from the leader to learners
+type Commit struct {
+	Ballot    paxi.Ballot
+	Slot      int
+	Commands  []paxi.Command
+	Committed int // highest slot the leader committed
+}
+
+func (m Commit) String() string {
+	return fmt.Sprintf("Commit {b=%v s=%d committed=%d cmds=%v}", m.Ballot, m.Slot, m.Committed, m.Commands)
 }
@@ -10,24 +10,14 @@ import (
 	"sync"
 )
 
-// entry in log
-type entry struct {
-	ballot    paxi.Ballot
-	command   paxi.Command
-	commit    bool
-	request   *paxi.Request
-	quorum    *paxi.Quorum
-	timestamp time.Time
-}
-
 // Paxos instance
 type PigPaxos struct {
 	paxi.Node
 
 	// log management variables
-	log               map[int]*entry // log ordered by slot
-	slot              int            // highest slot number
-	execute           int            // next execute slot number
+	log               map[int]*paxi.Entry // log ordered by slot
+	slot              int                 // highest slot number
+	execute           int                 // next execute slot number
 	lastCleanupMarker int
 	globalExecute     int             // executed by all nodes. Need for log cleanup
 	executeByNode     map[paxi.ID]int // leader's knowledge of other nodes execute counter. Need for log cleanup
@@ -39,44 +29,137 @@ type PigPaxos struct {
 	quorum   *paxi.Quorum    // phase 1 quorum
 	requests []*paxi.Request // phase 1 pending requests
 
+	// batching
+	BatchSize  int           // maximum number of commands proposed in one slot
+	BatchDelay time.Duration // maximum time a request waits for its batch to fill up
+	batch      []*paxi.Request
+	batchStart time.Time // time the first request of the batch arrived
+
 	p3PendingBallot paxi.Ballot
 	p3pendingSlots  []int
 	lastP3Time      int64
 
+	recovering bool // replaying write-ahead log, committed slots are already durable
+	learner    bool // learners do not vote and only execute slots the leader streams to them
+	committed  int  // highest slot the leader committed, as last heard from the leader on learners
+	witness    bool // witnesses vote but keep no state machine, only ballots and hashes of executed slots
+
+	// membership changes
+	reconfigSlot int                 // slot of the membership change in progress, -1 if none
+	OnReconfig   func(paxi.Reconfig) // called after a membership change is applied
+
+	SendThrifty func(P2a) // sends P2a to a phase-2 quorum only in thrifty mode, to every node by default
+
+	// snapshots
+	snapshot     *paxi.Snapshot         // last snapshot taken or installed
+	snapshotSent map[paxi.ID]time.Time  // last time a snapshot was sent to a lagging node
+	assembler    paxi.SnapshotAssembler // snapshot being received from the leader
+
+	// leader leases
+	LeaseDuration time.Duration // 0 disables leases and local reads
+	lease         time.Time     // lease this node holds as the leader of leaseBallot
+	leaseBallot   paxi.Ballot
+	leaseSlot     int       // last slot that may be committed by previous leaders
+	grant         time.Time // lease this node granted to the leader of grantBallot
+	grantBallot   paxi.Ballot
+
+	// failure detection
+	HeartbeatInterval time.Duration // 0 disables heartbeats, elections then start on client requests only
+	ElectionTimeout   time.Duration // followers start an election after one to two timeouts without the leader
+	heard             time.Time     // last message from the leader
+	electionDeadline  time.Time
+	electing          time.Time // last message of the failed leader while this node runs an election
+	lastHeartbeat     time.Time
+	preVoteBallot     paxi.Ballot // ballot of the pre-vote in progress, 0 if none
+	preVotes          *paxi.Quorum
+	failover          FailoverStats
+	handover          *paxi.Handover // leadership transfer and placement
+
 	// Quorums
 	Q1              func(*paxi.Quorum) bool
 	Q2              func(*paxi.Quorum) bool
 	ReplyWhenCommit bool
 
 	// Locks
-	logLck     sync.RWMutex
-	p3Lock     sync.RWMutex
-	markerLock sync.RWMutex
+	logLck       sync.RWMutex
+	p3Lock       sync.RWMutex
+	markerLock   sync.RWMutex
+	leaseLock    sync.RWMutex
+	batchLock    sync.Mutex
+	electionLock sync.Mutex
 }
 
 // NewPaxos creates new paxos instance
 func NewPigPaxos(n paxi.Node, options ...func(*PigPaxos)) *PigPaxos {
 	p := &PigPaxos{
 		Node:            n,
-		log:             make(map[int]*entry, paxi.GetConfig().BufferSize),
+		log:             make(map[int]*paxi.Entry, paxi.GetConfig().BufferSize),
 		slot:            -1,
+		committed:       -1,
 		quorum:          paxi.NewQuorum(),
 		requests:        make([]*paxi.Request, 0),
 		p3pendingSlots:  make([]int, 0, 100),
 		executeByNode:   make(map[paxi.ID]int, 0),
+		snapshotSent:    make(map[paxi.ID]time.Time),
+		BatchSize:       1,
+		batch:           make([]*paxi.Request, 0),
+		reconfigSlot:    -1,
+		learner:         paxi.GetConfig().IsLearner(n.ID()),
+		witness:         paxi.GetConfig().IsWitness(n.ID()),
+		OnReconfig:      func(paxi.Reconfig) {},
 		lastP3Time:      0,
-		Q1:              func(q *paxi.Quorum) bool { return q.Majority() },
-		Q2:              func(q *paxi.Quorum) bool { return q.Majority() },
+		Q1:              func(q *paxi.Quorum) bool { return q.Q1() },
+		Q2:              func(q *paxi.Quorum) bool { return q.Q2() },
 		ReplyWhenCommit: false,
 	}
 
+	p.SendThrifty = func(m P2a) { p.Broadcast(m) }
+
+	p.handover = paxi.NewHandover(n.ID())
+
 	for _, opt := range options {
 		opt(p)
 	}
 
+	p.recover()
+
 	return p
 }
 
+// recover restores the last snapshot, rebuilds promised ballot and accepted log from the
+// write-ahead log and re-executes all committed slots after the snapshot against the state machine
+func (p *PigPaxos) recover() {
+	p.recovering = true
+	defer func() { p.recovering = false }()
+	p.logLck.Lock()
+	s, ballot, slot, err := paxi.ReplayWAL(p.WAL(), p.log)
+	if err != nil {
+		log.Fatalf("Replica %s cannot replay write-ahead log: %v", p.ID(), err)
+	}
+	p.ballot = ballot
+	p.slot = slot
+	// snapshots of witnesses have no state machine
+	if s != nil && !p.witness {
+		if err := p.Node.Restore(s.Data); err != nil {
+			// slots of the snapshot are compacted, the leader sends its snapshot when this node asks to recover them
+			log.Errorf("Replica %s cannot restore %v, waits for a snapshot from the leader: %v", p.ID(), s, err)
+			s = nil
+		}
+	}
+	if s != nil {
+		p.snapshot = s
+		p.execute = s.Slot + 1
+		p.lastCleanupMarker = s.Slot + 1
+	}
+	p.logLck.Unlock()
+	if p.ballot != 0 {
+		// we may have granted a lease before restart, assume it is still valid
+		p.grantLease(p.ballot)
+	}
+	log.Infof("Replica %s recovered ballot %v and log up to slot %d", p.ID(), p.ballot, p.slot)
+	p.exec()
+}
+
 // IsLeader indicates if this node is current leader
 func (p *PigPaxos) IsLeader() bool {
 	return p.active || p.ballot.ID() == p.ID()
@@ -87,12 +170,15 @@ func (p *PigPaxos) CheckTimeout(timeout int64) {
 	defer p.logLck.RUnlock()
 	execslot := p.execute
 	if p.active && execslot <= p.slot {
-		if e, ok := p.log[execslot]; ok && !e.commit {
-			if e.timestamp.UnixNano() < timeout {
-				log.Debugf("Retrying p2. entry_time = %d, retry time = %d", e.timestamp, timeout)
+		if e, ok := p.log[execslot]; ok && !e.Commit {
+			if e.Timestamp.UnixNano() < timeout {
+				log.Debugf("Retrying p2. entry_time = %d, retry time = %d", e.Timestamp, timeout)
 				p.RetryP2a(execslot, e)
 			}
 		}
+	} else if !p.active && p.handover.Pending() {
+		// this node handed leadership over and leads again if the target does not take over
+		p.CheckTransfer(time.Now())
 	} else if !p.active && p.p1aTime < timeout {
 		log.Debugf("Retrying p1. p1time = %d, retry time = %d", p.p1aTime, timeout)
 		p.RetryP1a()
@@ -153,13 +239,73 @@ func (p *PigPaxos) CleanupLog() {
 	marker := p.GetSafeLogCleanupMarker()
 	//log.Debugf("Replica %v log cleanup. lastCleanupMarker: %d, safeCleanUpMarker: %d", p.ID(), p.lastCleanupMarker, marker)
 	p.markerLock.Unlock()
+	if p.active {
+		// sent to followers with P2a, so witnesses know which commands no node needs anymore
+		p.globalExecute = marker
+	}
 
 	p.logLck.Lock()
 	defer p.logLck.Unlock()
+	if p.witness {
+		if p.globalExecute < marker {
+			marker = p.globalExecute
+		}
+		p.compact(marker)
+		return
+	}
+	// slots covered by a snapshot can go even if some node is behind, it will install the snapshot
+	if p.snapshot != nil && p.snapshot.Slot+1 > marker {
+		marker = p.snapshot.Slot + 1
+	}
 	for i := p.lastCleanupMarker; i < marker; i++ {
 		delete(p.log, i)
 	}
-	p.lastCleanupMarker = marker
+	p.lastCleanupMarker = paxi.Max(p.lastCleanupMarker, marker)
+}
+
+// takeSnapshot snapshots the state machine at the last executed slot and compacts the write-ahead log.
+// Should be called with logLck held
+func (p *PigPaxos) takeSnapshot() (*paxi.Snapshot, error) {
+	data, err := p.Node.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	s := &paxi.Snapshot{
+		Slot:   p.execute - 1,
+		Ballot: p.ballot,
+		Data:   data,
+	}
+	err = p.WAL().SaveSnapshot(*s, paxi.WALRecords(p.ballot, p.log, s.Slot+1, p.slot)...)
+	if err != nil {
+		return nil, err
+	}
+	p.snapshot = s
+	log.Debugf("Node %v took %v", p.ID(), s)
+	return s, nil
+}
+
+// snapshotFor returns a snapshot of the executed state for node that asked to recover compacted slots,
+// or nil if one was sent to it recently. Local snapshots may only refer to a checkpoint on the local disk,
+// so the state is exported in full. Should be called with logLck held
+func (p *PigPaxos) snapshotFor(id paxi.ID) *paxi.Snapshot {
+	if t, sent := p.snapshotSent[id]; sent && time.Since(t) < paxi.SnapshotResendInterval {
+		return nil
+	}
+	if p.witness {
+		// witnesses have no state machine to export
+		return nil
+	}
+	data, err := p.Node.Export()
+	if err != nil {
+		log.Errorf("Node %v cannot export snapshot: %v", p.ID(), err)
+		return nil
+	}
+	p.snapshotSent[id] = time.Now()
+	return &paxi.Snapshot{
+		Slot:   p.execute - 1,
+		Ballot: p.ballot,
+		Data:   data,
+	}
 }
 
 // HandleRequest handles request and start phase 1 or phase 2
@@ -171,18 +317,35 @@ func (p *PigPaxos) HandleRequest(r paxi.Request) {
 		if p.ballot.ID() != p.ID() {
 			p.P1a()
 		}
+	} else if p.reconfigSlot >= 0 {
+		// new proposals wait until the membership change in progress is applied
+		p.requests = append(p.requests, &r)
 	} else {
-		p.P2a(&r)
+		p.handover.Hit(r.NodeID)
+		p.propose(&r)
 	}
 }
 
 // P1a starts phase 1 prepare
 func (p *PigPaxos) P1a() {
 	log.Debugf("Node %v PigPaxos P1a", p.ID())
-	if p.active {
+	if p.active || p.learner || p.witness {
+		// learners and witnesses never lead
 		return
 	}
-	p.ballot.Next(p.ID())
+	if p.leaseGranted(p.ID()) {
+		// our own promise counts towards the lease of the current leader
+		log.Debugf("Node %v does not start phase 1, lease of %v has not expired", p.ID(), p.ballot)
+		return
+	}
+	p.handover.Stop()
+	// the next ballot is used only once it is durable
+	b := p.ballot
+	b.Next(p.ID())
+	if !paxi.PersistPromise(p.WAL(), p.ID(), b) {
+		return
+	}
+	p.ballot = b
 	p.quorum.Reset()
 	p.quorum.ACK(p.ID())
 	p.p1aTime = time.Now().UnixNano()
@@ -201,26 +364,37 @@ func (p *PigPaxos) RetryP1a() {
 	p.Broadcast(P1a{Ballot: p.ballot})
 }
 
-// P2a starts phase 2 accept
-func (p *PigPaxos) P2a(r *paxi.Request) {
+// P2a starts phase 2 accept of a batch of requests in the next slot
+func (p *PigPaxos) P2a(rs []*paxi.Request) {
 	log.Debugf("Node %v etering P2a with slot %d", p.ID(), p.slot)
+	cmds := make([]paxi.Command, len(rs))
+	for i, r := range rs {
+		cmds[i] = r.Command
+	}
 	p.logLck.Lock()
 	p.slot++
-	p.log[p.slot] = &entry{
-		ballot:    p.ballot,
-		command:   r.Command,
-		request:   r,
-		quorum:    paxi.NewQuorum(),
-		timestamp: time.Now(),
-	}
-	p.log[p.slot].quorum.ACK(p.ID())
+	if len(cmds) == 1 && cmds[0].IsReconfig() {
+		p.reconfigSlot = p.slot
+	}
+	p.log[p.slot] = &paxi.Entry{
+		Ballot:    p.ballot,
+		Commands:  cmds,
+		Requests:  rs,
+		Quorum:    paxi.NewQuorum(),
+		Timestamp: time.Now(),
+	}
+	p.log[p.slot].Quorum.ACK(p.ID())
+	p.grantLease(p.ballot)
 	m := P2a{
 		Ballot:        p.ballot,
 		Slot:          p.slot,
-		Command:       r.Command,
+		Commands:      cmds,
 		GlobalExecute: p.globalExecute,
 	}
 	p.logLck.Unlock()
+	if !paxi.PersistAccept(p.WAL(), p.ID(), m.Slot, m.Ballot, m.Commands...) {
+		return
+	}
 	p.p3Lock.Lock()
 	if p.p3PendingBallot > 0 {
 		m.P3msg = P3{Ballot: p.p3PendingBallot, Slot: p.p3pendingSlots}
@@ -230,26 +404,23 @@ func (p *PigPaxos) P2a(r *paxi.Request) {
 	p.p3Lock.Unlock()
 
 	if paxi.GetConfig().Thrifty {
-		go p.Broadcast(m) // TODO: implement thrifty
+		go p.SendThrifty(m)
 	} else {
 		go p.Broadcast(m)
 	}
 	log.Debugf("Leaving P2a with slot %d", p.slot)
 }
 
-func (p *PigPaxos) RetryP2a(slot int, e *entry) {
+func (p *PigPaxos) RetryP2a(slot int, e *paxi.Entry) {
 	log.Debugf("Entering RetryP2a with slot %d", slot)
 	m := P2a{
 		Ballot:        p.ballot,
 		Slot:          slot,
-		Command:       e.command,
+		Commands:      e.Commands,
 		GlobalExecute: p.globalExecute,
 	}
-	if paxi.GetConfig().Thrifty {
-		p.Broadcast(m) // TODO: implement thrifty
-	} else {
-		p.Broadcast(m)
-	}
+	// the retried slot was not committed in time, so it goes to every node even in thrifty mode
+	p.Broadcast(m)
 	log.Debugf("Leaving RetryP2a with slot %d", p.slot)
 }
 
@@ -257,8 +428,23 @@ func (p *PigPaxos) RetryP2a(slot int, e *entry) {
 func (p *PigPaxos) HandleP1a(m P1a, reply paxi.ID) {
 	log.Debugf("Replica %s ===[%v]===>>> Replica %s\n", m.Ballot.ID(), m, p.ID())
 
+	// a leader with a lease may serve reads locally until it expires, so do not elect another one before that
+	if m.Ballot > p.ballot && p.leaseGranted(m.Ballot.ID()) {
+		log.Debugf("Replica %s rejects %v, lease of %v has not expired", p.ID(), m, p.ballot)
+		p.Send(reply, P1b{
+			Ballot: p.ballot,
+			ID:     p.ID(),
+			Log:    make(map[int]CommandBallot),
+		})
+		return
+	}
+
 	// new leader
 	if m.Ballot > p.ballot {
+		// the ballot is promised only once it is durable, so a retried P1a does not get a P1b on a lost promise
+		if !paxi.PersistPromise(p.WAL(), p.ID(), m.Ballot) {
+			return
+		}
 		p.ballot = m.Ballot
 		p.active = false
 		p.forward()
@@ -267,10 +453,13 @@ func (p *PigPaxos) HandleP1a(m P1a, reply paxi.ID) {
 	l := make(map[int]CommandBallot)
 	p.logLck.RLock()
 	for s := p.execute; s <= p.slot; s++ {
-		if p.log[s] == nil || p.log[s].commit {
+		if p.log[s] == nil || p.log[s].Commit {
 			continue
 		}
-		l[s] = CommandBallot{p.log[s].command, p.log[s].ballot}
+		l[s] = CommandBallot{p.log[s].Commands, p.log[s].Ballot}
+	}
+	if p.witness {
+		p.handOff(l)
 	}
 	p.logLck.RUnlock()
 
@@ -287,16 +476,21 @@ func (p *PigPaxos) update(scb map[int]CommandBallot) {
 	defer p.logLck.Unlock()
 	for s, cb := range scb {
 		p.slot = paxi.Max(p.slot, s)
+		if s < p.execute {
+			// executed already, witnesses hand over slots that other nodes may have missed
+			continue
+		}
 		if e, exists := p.log[s]; exists {
-			if !e.commit && cb.Ballot > e.ballot {
-				e.ballot = cb.Ballot
-				e.command = cb.Command
+			// a slot committed with no ballot is missing its P2a
+			if (!e.Commit || e.Ballot == 0) && cb.Ballot > e.Ballot {
+				e.Ballot = cb.Ballot
+				e.Commands = cb.Commands
 			}
 		} else {
-			p.log[s] = &entry{
-				ballot:  cb.Ballot,
-				command: cb.Command,
-				commit:  false,
+			p.log[s] = &paxi.Entry{
+				Ballot:   cb.Ballot,
+				Commands: cb.Commands,
+				Commit:   false,
 			}
 		}
 	}
@@ -304,6 +498,7 @@ func (p *PigPaxos) update(scb map[int]CommandBallot) {
 
 // HandleP1b handles P1b message
 func (p *PigPaxos) HandleP1b(m P1b) {
+	p.handover.Heard(m.ID)
 	// old message
 	if m.Ballot < p.ballot || p.active {
 		return
@@ -325,30 +520,39 @@ func (p *PigPaxos) HandleP1b(m P1b) {
 		p.quorum.ACK(m.ID)
 		if p.Q1(p.quorum) {
 			p.active = true
+			p.electedLeader()
 			p.p3PendingBallot = p.ballot
 			// propose any uncommitted entries
 			p.logLck.Lock()
+			p.leaseSlot = p.slot
 			for i := p.execute; i <= p.slot; i++ {
 				// TODO nil gap?
-				if p.log[i] == nil || p.log[i].commit {
+				if p.log[i] == nil || p.log[i].Commit {
+					continue
+				}
+				if len(p.log[i].Commands) == 1 && p.log[i].Commands[0].IsReconfig() {
+					p.reconfigSlot = i
+				}
+				p.log[i].Ballot = p.ballot
+				p.log[i].Quorum = paxi.NewQuorum()
+				p.log[i].Quorum.ACK(p.ID())
+				if !paxi.PersistAccept(p.WAL(), p.ID(), i, p.ballot, p.log[i].Commands...) {
 					continue
 				}
-				p.log[i].ballot = p.ballot
-				p.log[i].quorum = paxi.NewQuorum()
-				p.log[i].quorum.ACK(p.ID())
 				p.Broadcast(P2a{
 					Ballot:        p.ballot,
 					Slot:          i,
-					Command:       p.log[i].command,
+					Commands:      p.log[i].Commands,
 					GlobalExecute: p.globalExecute,
 				})
 			}
 			p.logLck.Unlock()
 			// propose new commands
-			for _, req := range p.requests {
-				p.P2a(req)
-			}
+			requests := p.requests
 			p.requests = make([]*paxi.Request, 0)
+			for _, req := range requests {
+				p.HandleRequest(*req)
+			}
 		}
 	}
 }
@@ -366,28 +570,42 @@ func (p *PigPaxos) HandleP2a(m P2a, reply paxi.ID) {
 		p.slot = paxi.Max(p.slot, m.Slot)
 		// update entry
 		if e, exists := p.log[m.Slot]; exists {
-			if !e.commit && m.Ballot > e.ballot {
-				// different command and request is not nil
-				if !e.command.Equal(m.Command) && e.request != nil {
-					p.Forward(m.Ballot.ID(), *e.request)
+			if !e.Matches(m.Commands) {
+				// witnesses only keep hashes of commands every node executed
+				p.logLck.Unlock()
+				log.Errorf("Witness %v rejects %v, slot %d committed other commands", p.ID(), m, m.Slot)
+				return
+			}
+			if !e.Commit && m.Ballot > e.Ballot {
+				// different commands and requests are not nil
+				if !sameCommands(e.Commands, m.Commands) && e.Requests != nil {
+					for _, r := range e.Requests {
+						p.Forward(m.Ballot.ID(), *r)
+					}
 					// p.Retry(*e.request)
-					e.request = nil
+					e.Requests = nil
 				}
-				e.command = m.Command
-				e.ballot = m.Ballot
-			} else if e.commit && e.ballot == 0 {
+				e.Commands = m.Commands
+				e.Ballot = m.Ballot
+			} else if e.Commit && e.Ballot == 0 {
 				// we can have commit slot with no ballot when we received P3 before P2a
-				e.command = m.Command
-				e.ballot = m.Ballot
+				e.Commands = m.Commands
+				e.Ballot = m.Ballot
 			}
 		} else {
-			p.log[m.Slot] = &entry{
-				ballot:  m.Ballot,
-				command: m.Command,
-				commit:  false,
+			p.log[m.Slot] = &paxi.Entry{
+				Ballot:   m.Ballot,
+				Commands: m.Commands,
+				Commit:   false,
 			}
 		}
 		p.logLck.Unlock()
+		// accepted value must be durable before P2b leaves this node
+		if !paxi.PersistAccept(p.WAL(), p.ID(), m.Slot, m.Ballot, m.Commands...) {
+			return
+		}
+		p.grantLease(m.Ballot)
+		p.heardLeader(m.Ballot)
 	}
 
 	idList := make([]paxi.ID, 1, 1)
@@ -409,11 +627,12 @@ func (p *PigPaxos) HandleP2a(m P2a, reply paxi.ID) {
 // HandleP2b handles P2b message
 func (p *PigPaxos) HandleP2b(msgSlot int, msgBallot paxi.Ballot, votedIds []paxi.ID) {
 	log.Debugf("Entering HandleP2b: ===[bal: %v, slot: %d, votes: %v]===>>> %s", msgBallot, msgSlot, votedIds, p.ID())
+	p.handover.Heard(votedIds...)
 	// old message
 	p.logLck.RLock()
 	entry, exist := p.log[msgSlot]
 	p.logLck.RUnlock()
-	if !exist || msgBallot < entry.ballot || entry.commit {
+	if !exist || msgBallot < entry.Ballot || entry.Commit {
 		return
 	}
 	// reject message
@@ -436,15 +655,17 @@ func (p *PigPaxos) HandleP2b(msgSlot int, msgBallot paxi.Ballot, votedIds []paxi
 	// ack message
 	// the current slot might still be committed with q2
 	// if no q2 can be formed, this slot will be retried when received p2a or p3
-	if msgBallot.ID() == p.ID() && msgBallot == entry.ballot {
+	if msgBallot.ID() == p.ID() && msgBallot == entry.Ballot {
 		for _, id := range votedIds {
-			entry.quorum.ACK(id)
+			entry.Quorum.ACK(id)
 		}
 
-		if p.Q2(entry.quorum) {
-			entry.commit = true
+		if p.Q2(entry.Quorum) {
+			entry.Commit = true
+			p.extendLease(entry)
+			p.learn(msgSlot, entry)
 			if paxi.GetConfig().UseRetroLog {
-				slotStruct := retro_log.NewRqlStruct(nil).AddVarInt32("slot", msgSlot).AddVarStr("hash", entry.command.Hash())
+				slotStruct := retro_log.NewRqlStruct(nil).AddVarInt32("slot", msgSlot).AddVarStr("hash", paxi.HashCommands(entry.Commands))
 				paxi.Retrolog.StartTx().AppendSetStruct("committed", slotStruct).AppendSetInt32("committed_slots", msgSlot).Commit()
 			}
 
@@ -454,11 +675,12 @@ func (p *PigPaxos) HandleP2b(msgSlot int, msgBallot paxi.Ballot, votedIds []paxi
 			p.p3Lock.Unlock()
 
 			if p.ReplyWhenCommit {
-				r := entry.request
-				r.Reply(paxi.Reply{
-					Command:   r.Command,
-					Timestamp: r.Timestamp,
-				})
+				for _, r := range entry.Requests {
+					r.Reply(paxi.Reply{
+						Command:   r.Command,
+						Timestamp: r.Timestamp,
+					})
+				}
 			} else {
 				p.exec()
 			}
@@ -470,37 +692,42 @@ func (p *PigPaxos) HandleP2b(msgSlot int, msgBallot paxi.Ballot, votedIds []paxi
 // HandleP3 handles phase 3 commit message
 func (p *PigPaxos) HandleP3(m P3) {
 	log.Debugf("Replica %s ===[%v]===>>> Replica %s\n", m.Ballot.ID(), m, p.ID())
+	if m.Release {
+		p.releaseLease(m.Ballot)
+	}
 	for _, slot := range m.Slot {
 		p.logLck.Lock()
 		p.slot = paxi.Max(p.slot, slot)
 		e, exist := p.log[slot]
 		if exist {
-			if e.ballot == m.Ballot {
-				e.commit = true
-			} else if e.request != nil {
+			if e.Ballot == m.Ballot {
+				e.Commit = true
+			} else if e.Requests != nil {
 				// p.Retry(*e.request)
-				p.Forward(m.Ballot.ID(), *e.request)
-				e.request = nil
+				for _, r := range e.Requests {
+					p.Forward(m.Ballot.ID(), *r)
+				}
+				e.Requests = nil
 				// ask to recover the slot
-				log.Debugf("Replica %s needs to recover slot %d on ballot %v (we have cmd %v)", p.ID(), slot, m.Ballot, e.command)
+				log.Debugf("Replica %s needs to recover slot %d on ballot %v (we have cmds %v)", p.ID(), slot, m.Ballot, e.Commands)
 				p.sendRecoverRequest(m.Ballot, slot)
 			}
 
 		} else {
-			e = &entry{commit: true, ballot: 0}
+			e = &paxi.Entry{Commit: true, Ballot: 0}
 			p.log[slot] = e
 		}
 		p.logLck.Unlock()
 
 		if paxi.GetConfig().UseRetroLog {
-			slotStruct := retro_log.NewRqlStruct(nil).AddVarInt32("slot", slot).AddVarStr("hash", e.command.Hash())
+			slotStruct := retro_log.NewRqlStruct(nil).AddVarInt32("slot", slot).AddVarStr("hash", paxi.HashCommands(e.Commands))
 			paxi.Retrolog.StartTx().AppendSetStruct("committed", slotStruct).AppendSetInt32("committed_slots", slot).Commit()
 		}
 		if p.ReplyWhenCommit {
-			if e.request != nil {
-				e.request.Reply(paxi.Reply{
-					Command:   e.request.Command,
-					Timestamp: e.request.Timestamp,
+			for _, r := range e.Requests {
+				r.Reply(paxi.Reply{
+					Command:   r.Command,
+					Timestamp: r.Timestamp,
 				})
 			}
 		}
@@ -521,14 +748,26 @@ func (p *PigPaxos) sendRecoverRequest(ballot paxi.Ballot, slot int) {
 func (p *PigPaxos) HandleP3RecoverRequest(m P3RecoverRequest) {
 	log.Debugf("Replica %s ===[%v]===>>> Replica %s\n", m.NodeId, m, p.ID())
 	p.logLck.Lock()
+	if m.Slot < p.lastCleanupMarker {
+		// slot is compacted, node has to catch up from a snapshot
+		snapshot := p.snapshotFor(m.NodeId)
+		p.logLck.Unlock()
+		if snapshot != nil {
+			log.Infof("Node %v sends %v to node %v", p.ID(), snapshot, m.NodeId)
+			for _, chunk := range snapshot.Chunks(p.ID(), paxi.GetConfig().SnapshotChunkSize) {
+				p.Send(m.NodeId, chunk)
+			}
+		}
+		return
+	}
 	e, exist := p.log[m.Slot]
 	p.logLck.Unlock()
-	if exist && e.commit {
+	if exist && e.Commit {
 		// ok to recover
 		p.Send(m.NodeId, P3RecoverReply{
-			Ballot:  e.ballot,
-			Slot:    m.Slot,
-			Command: e.command,
+			Ballot:   e.Ballot,
+			Slot:     m.Slot,
+			Commands: e.Commands,
 		})
 	}
 
@@ -542,49 +781,157 @@ func (p *PigPaxos) HandleP3RecoverReply(m P3RecoverReply) {
 	p.logLck.Lock()
 	p.slot = paxi.Max(p.slot, m.Slot)
 	e, exist := p.log[m.Slot]
+	if !exist && m.Slot >= p.execute {
+		// learners do not hear of slots they missed in the commit stream
+		e = &paxi.Entry{}
+		p.log[m.Slot] = e
+		exist = true
+	}
+	if exist && (m.Slot < p.execute || e.Chosen()) {
+		// committed or executed already, a late reply must not overwrite it
+		exist = false
+	}
 	if exist {
-		e.command = m.Command
-		e.ballot = m.Ballot
-		e.commit = true
+		e.Commands = m.Commands
+		e.Ballot = m.Ballot
+		e.Commit = true
 	}
 	p.logLck.Unlock()
+	if exist {
+		paxi.PersistAccept(p.WAL(), p.ID(), m.Slot, m.Ballot, m.Commands...)
+	}
 
 	p.exec()
 	log.Debugf("Leaving HandleP3RecoverReply")
 }
 
+// HandleInstallSnapshot installs a snapshot sent by the leader when this node fell behind its log compaction point
+func (p *PigPaxos) HandleInstallSnapshot(m paxi.InstallSnapshot) {
+	log.Debugf("Replica %s ===[%v]===>>> Replica %s\n", m.From, m, p.ID())
+	p.logLck.Lock()
+	s, done := p.assembler.Add(m)
+	if !done || s.Slot < p.execute {
+		p.logLck.Unlock()
+		return
+	}
+	if p.witness {
+		// witnesses keep no state machine, the snapshot only moves their log forward
+		s = &paxi.Snapshot{Slot: s.Slot, Ballot: s.Ballot}
+	} else {
+		if err := p.Node.Restore(s.Data); err != nil {
+			p.logLck.Unlock()
+			log.Errorf("Replica %s cannot restore %v: %v", p.ID(), s, err)
+			return
+		}
+		// keep only a local checkpoint of the installed state instead of the full image in the write-ahead log
+		if data, err := p.Node.Snapshot(); err == nil {
+			s = &paxi.Snapshot{Slot: s.Slot, Ballot: s.Ballot, Data: data}
+		}
+	}
+	for i := p.lastCleanupMarker; i <= s.Slot; i++ {
+		delete(p.log, i)
+	}
+	p.slot = paxi.Max(p.slot, s.Slot)
+	p.execute = s.Slot + 1
+	p.lastCleanupMarker = s.Slot + 1
+	p.snapshot = s
+	err := p.WAL().SaveSnapshot(*s, paxi.WALRecords(p.ballot, p.log, s.Slot+1, p.slot)...)
+	p.logLck.Unlock()
+	if err != nil {
+		log.Errorf("Replica %s cannot persist %v: %v", p.ID(), s, err)
+	}
+	log.Infof("Replica %s installed %v", p.ID(), s)
+
+	p.exec()
+}
+
+// reconfigure applies committed membership change. Should be called with logLck held
+func (p *PigPaxos) reconfigure(cmd paxi.Command) {
+	if p.execute >= p.reconfigSlot {
+		p.reconfigSlot = -1
+	}
+	r, err := cmd.Reconfig()
+	if err != nil {
+		log.Errorf("Node %v cannot decode membership change in slot %d: %v", p.ID(), p.execute, err)
+		return
+	}
+	if err := p.Reconfigure(r); err != nil {
+		log.Errorf("Node %v cannot apply %v: %v", p.ID(), r, err)
+		return
+	}
+	if r.Op == paxi.RemoveNode {
+		p.markerLock.Lock()
+		delete(p.executeByNode, r.ID)
+		p.markerLock.Unlock()
+		if r.ID == p.ID() {
+			log.Infof("Node %v is removed from the cluster", p.ID())
+			p.active = false
+		}
+	}
+	p.OnReconfig(r)
+}
+
 func (p *PigPaxos) exec() {
 	log.Debugf("Entering exec. exec slot=%d", p.execute)
 	p.logLck.Lock()
-	defer p.logLck.Unlock()
+	reconfigured := false
 	for {
 		e, ok := p.log[p.execute]
-		if ok && p.execute+10 < p.slot && e.commit && e.ballot == 0 {
-			// ask to recover the slot
+		if p.execute+10 < p.slot && (!ok || e.Commit && e.Ballot == 0) && p.Ballot().ID() != p.ID() {
+			// ask to recover the slot, the leader sends a snapshot instead if the slot is already compacted
 			log.Debugf("Replica %s tries to recover slot %d on ballot %v", p.ID(), p.execute, p.Ballot())
 			p.sendRecoverRequest(p.Ballot(), p.execute)
 		}
 
-		if !ok || !e.commit || (e.commit && e.ballot == 0) {
+		if !ok || !e.Commit || (e.Commit && e.Ballot == 0) {
 			break
 		}
-		log.Debugf("Replica %s execute [s=%d, cmd=%v]", p.ID(), p.execute, e.command)
-		value := p.Execute(e.command)
-		if e.request != nil {
-			reply := paxi.Reply{
-				Command:    e.command,
-				Value:      value,
-				Properties: make(map[string]string),
+		log.Debugf("Replica %s execute [s=%d, cmds=%v]", p.ID(), p.execute, e.Commands)
+		if !p.recovering {
+			p.WAL().Commit(p.execute)
+		}
+		for i, cmd := range e.Commands {
+			var value paxi.Value
+			if cmd.IsReconfig() {
+				p.reconfigure(cmd)
+				reconfigured = true
+			} else if !p.witness {
+				value = p.Execute(cmd)
+			}
+			if i < len(e.Requests) && e.Requests[i] != nil {
+				reply := paxi.Reply{
+					Command:    cmd,
+					Value:      value,
+					Properties: make(map[string]string),
+				}
+				go e.Requests[i].Reply(reply)
 			}
-			go e.request.Reply(reply)
-			e.request = nil
 		}
+		e.Requests = nil
 		p.execute++
+		if interval := paxi.GetConfig().SnapshotInterval; interval > 0 && !p.recovering && !p.witness && p.execute%interval == 0 {
+			if _, err := p.takeSnapshot(); err != nil {
+				log.Errorf("Node %v cannot take snapshot: %v", p.ID(), err)
+			}
+		}
+	}
+	p.logLck.Unlock()
+
+	if reconfigured && p.active && p.reconfigSlot < 0 {
+		// propose requests held back by the membership change
+		requests := p.requests
+		p.requests = make([]*paxi.Request, 0)
+		for _, req := range requests {
+			p.HandleRequest(*req)
+		}
 	}
 	log.Debugf("Leaving exec")
 }
 
 func (p *PigPaxos) forward() {
+	p.batchLock.Lock()
+	p.requests = append(p.requests, p.takeBatch()...)
+	p.batchLock.Unlock()
 	for _, m := range p.requests {
 		p.Forward(p.ballot.ID(), *m)
 	}
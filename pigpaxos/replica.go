@@ -11,8 +11,8 @@ import (
 	"time"
 )
 
-const GrayTimeoutMultiplier = 1000
 const TickerDuration = 10
+const DefaultFanout = 2
 
 var stableLeader = flag.Bool("ephemeral", true, "stable leader, if true paxos forward request to current leader")
 var pg = flag.Int("pg", 1, "Number of peer-groups. Default is 2")
@@ -21,6 +21,15 @@ var useSmallP2b = flag.Bool("smallp2b", true, "use small p2b aggregated message
 var stdPigTimeout = flag.Int("stdpigtimeout", 50, "Standard timeout after which all non-collected responses are treated as failures")
 var rgSlack = flag.Int("rgslack", 0, "Slack for Relay group waiting. Ignoring this many slowest nodes")
 var fixedrelay = flag.Bool("fr", false, "Use static relay nodes that do not randomly change")
+var regroupInterval = flag.Int("regroup", 0, "Interval in ms between rebuilding relay groups from measured latency, 0 keeps static groups")
+var regroupSample = flag.Int("regroupsample", 100, "Relays report per-node P2b latency every this many slots")
+var depth = flag.Int("depth", 2, "Depth of relay tree. 2 is leader, one level of relays and their peer groups")
+var lease = flag.Int("lease", 0, "Leader lease in ms that lets the leader serve reads locally, 0 disables leases")
+var batchSize = flag.Int("batch", 1, "Maximum number of commands the leader proposes in one slot")
+var batchDelay = flag.Int("batchdelay", TickerDuration, "Maximum time in ms a request waits for its batch to fill up")
+var heartbeat = flag.Int("heartbeat", 0, "Interval in ms between leader heartbeats, 0 disables failure detection and elections start on client requests only")
+var electionTimeout = flag.Int("election", 0, "Minimum time in ms without the leader before a follower starts an election. Defaults to 10 heartbeats")
+var fanout = flag.String("fanout", "", "Comma separated number of child relays of a relay at each level for trees deeper than 2. Defaults to 2")
 
 type BalSlot struct {
 	paxi.Ballot
@@ -36,12 +45,18 @@ type PeerGroup struct {
 	nodes []paxi.ID
 }
 
-func (pg *PeerGroup) GetRandomNodeId(excludeId paxi.ID, gray map[paxi.ID]time.Time) paxi.ID {
-	randId := pg.nodes[rand.Intn(len(pg.nodes))]
-	_, isgray := gray[randId]
-	for randId == excludeId || isgray {
-		randId = pg.nodes[rand.Intn(len(pg.nodes))]
-		_, isgray = gray[randId]
+// GetRandomNodeId returns random reachable node of the group other than excludeId.
+// If no such node is reachable it returns any node other than excludeId
+func (pg *PeerGroup) GetRandomNodeId(excludeId paxi.ID, reachable func(paxi.ID) bool) paxi.ID {
+	randId := excludeId
+	for _, i := range rand.Perm(len(pg.nodes)) {
+		if pg.nodes[i] == excludeId {
+			continue
+		}
+		randId = pg.nodes[i]
+		if reachable(randId) {
+			break
+		}
 	}
 	return randId
 }
@@ -54,34 +69,52 @@ func (pg PeerGroup) String() string {
 type Replica struct {
 	paxi.Node
 	*PigPaxos
-	relayGroups       []*PeerGroup
-	fixedRelays       []paxi.ID
-	myRelayGroup      int
-	NodeIdsToGroup    map[paxi.ID]int
-	numRelayGroups    int
+	layouts           []*relayLayout // relay groups ordered by first slot they are used for
+	latency           *paxi.LatencyTracker
+	roundTrip         *paxi.LatencyTracker // round trip of P2a through relays, used to choose thrifty groups
+	thrifty           paxi.Thrifty
 	maxDepth          uint8
+	fanout            []int // child relays per relay at each level of the tree
 	relaySlack        int
 	cleanupMultiplier int
 
-	GrayNodes map[paxi.ID]time.Time
-
 	p1bRelayRoutedMsg *RoutedMsg
 	pendingP1bRelay   int64
 	p1bRelayDepth     uint8
 
 	p2bRelaysMapByBalSlot     map[int]*RoutedMsg
 	p2bRelaysTimeMapByBalSlot map[int]int64
+	p2bDelaysBySlot           map[int]map[paxi.ID]int64     // P2b latency of group members on sampled slots
+	p2bChildGroups            map[int]map[paxi.ID][]paxi.ID // groups served by child relays of each relayed slot
 
 	sync.RWMutex
-	GrayLock sync.RWMutex
+	layoutLock sync.RWMutex
 }
 
 // NewReplica generates new Paxos replica
-func NewReplica(id paxi.ID) *Replica {
+func NewReplica(id paxi.ID, options ...paxi.NodeOption) *Replica {
 	log.Debugf("PigPaxos Starting replica %v", id)
+	r := newReplica(paxi.NewNode(id, options...))
+	go r.startTicker()
+	return r
+}
+
+// newReplica creates replica on node n without starting its timers
+func newReplica(n paxi.Node) *Replica {
 	r := new(Replica)
-	r.Node = paxi.NewNode(id)
-	r.PigPaxos = NewPigPaxos(r)
+	r.Node = n
+	r.PigPaxos = NewPigPaxos(r, func(p *PigPaxos) {
+		p.OnReconfig = func(paxi.Reconfig) { r.regroup(p.execute + 1) }
+		p.LeaseDuration = time.Duration(*lease) * time.Millisecond
+		p.BatchSize = *batchSize
+		p.BatchDelay = time.Duration(*batchDelay) * time.Millisecond
+		p.SendThrifty = r.sendThrifty
+		p.HeartbeatInterval = time.Duration(*heartbeat) * time.Millisecond
+		p.ElectionTimeout = time.Duration(*electionTimeout) * time.Millisecond
+		if p.ElectionTimeout == 0 {
+			p.ElectionTimeout = 10 * p.HeartbeatInterval
+		}
+	})
 	r.Register(paxi.Request{}, r.handleRequest)
 	r.Register(P1b{}, r.handleP1b)
 	r.Register([]P1b{}, r.handleP1bLeader)
@@ -92,7 +125,15 @@ func NewReplica(id paxi.ID) *Replica {
 	//r.Register(P2a{}, r.handleP2a)
 	r.Register(P3RecoverRequest{}, r.HandleP3RecoverRequest)
 	r.Register(P3RecoverReply{}, r.HandleP3RecoverReply)
+	r.Register(paxi.InstallSnapshot{}, r.HandleInstallSnapshot)
 	r.Register(RoutedMsg{}, r.handleRoutedMsg)
+	r.Register(RelayGroupUpdate{}, r.handleRelayGroupUpdate)
+	r.Register(PreVote{}, r.HandlePreVote)
+	r.Register(PreVoteReply{}, r.HandlePreVoteReply)
+	r.Register(paxi.LeaderTransfer{}, r.HandleLeaderTransfer)
+	r.Register(Transfer{}, r.HandleTransfer)
+	r.Register(Commit{}, r.HandleCommit)
+	r.Register(Heartbeat{}, r.HandleHeartbeat)
 
 	r.pendingP1bRelay = 0
 	r.p1bRelayDepth = 0
@@ -100,13 +141,29 @@ func NewReplica(id paxi.ID) *Replica {
 	r.cleanupMultiplier = 3
 	r.p2bRelaysMapByBalSlot = make(map[int]*RoutedMsg)
 	r.p2bRelaysTimeMapByBalSlot = make(map[int]int64)
-	r.NodeIdsToGroup = make(map[paxi.ID]int)
-	r.GrayNodes = make(map[paxi.ID]time.Time)
-
-	knownIDs := make([]paxi.ID, 0, len(paxi.GetConfig().Addrs))
-	for id := range paxi.GetConfig().Addrs {
-		knownIDs = append(knownIDs, id)
+	r.p2bDelaysBySlot = make(map[int]map[paxi.ID]int64)
+	r.p2bChildGroups = make(map[int]map[paxi.ID][]paxi.ID)
+	r.latency = paxi.NewLatencyTracker()
+	r.roundTrip = paxi.NewLatencyTracker()
+	r.RegisterStat("thrifty", func() interface{} { return r.thrifty.Stats() })
+	r.RegisterStat("failover", func() interface{} { return r.Failover() })
+	if *depth < 2 {
+		log.Fatalf("PigPaxos relay tree depth must be at least 2, got %d", *depth)
+	}
+	r.maxDepth = uint8(*depth)
+	r.fanout = parseFanout(*fanout)
+	if len(r.layouts) == 0 {
+		// membership changes replayed from the log may have already computed groups
+		r.regroup(0)
 	}
+	return r
+}
+
+// regroup computes relay peer groups from the current configuration and uses them from slot onward.
+// It is called on start and every time a membership change is applied
+func (r *Replica) regroup(slot int) {
+	// learners are not in relay groups, so relays never wait for them
+	knownIDs := paxi.GetConfig().Voters()
 
 	sort.Slice(knownIDs, func(i, j int) bool {
 		return knownIDs[i].Zone() < knownIDs[j].Zone() ||
@@ -115,53 +172,43 @@ func NewReplica(id paxi.ID) *Replica {
 
 	log.Debugf("Known IDs : %v", knownIDs)
 
-	r.maxDepth = 2
+	var relayGroups []*PeerGroup
 	if !*regionPeerGroups {
-		r.numRelayGroups = *pg
-		r.relayGroups = r.peersToGroups(*pg, knownIDs)
-		log.Infof("PigPaxos computed PeerGroups: {%v}", r.relayGroups)
+		relayGroups = r.peersToGroups(*pg, knownIDs)
+		log.Infof("PigPaxos computed PeerGroups: {%v}", relayGroups)
 	} else {
-		r.numRelayGroups = paxi.GetConfig().Z()
-		r.relayGroups = make([]*PeerGroup, r.numRelayGroups)
-		r.myRelayGroup = r.ID().Zone() - 1
+		// zones may be sparse after membership changes, so map them to consecutive groups
+		zoneToGroup := make(map[int]int)
 		for _, id := range knownIDs {
-			pgNum := id.Zone() - 1
-			if r.relayGroups[pgNum] == nil {
-				r.relayGroups[pgNum] = &PeerGroup{nodes: make([]paxi.ID, 0)}
+			pgNum, exists := zoneToGroup[id.Zone()]
+			if !exists {
+				pgNum = len(relayGroups)
+				zoneToGroup[id.Zone()] = pgNum
+				relayGroups = append(relayGroups, &PeerGroup{nodes: make([]paxi.ID, 0)})
 			}
-			r.relayGroups[pgNum].nodes = append(r.relayGroups[pgNum].nodes, id)
+			relayGroups[pgNum].nodes = append(relayGroups[pgNum].nodes, id)
 		}
 
-		log.Infof("PigPaxos region computed PeerGroups: {%v}", r.relayGroups)
+		log.Infof("PigPaxos region computed PeerGroups: {%v}", relayGroups)
 	}
 
-	r.fixedRelays = make([]paxi.ID, r.numRelayGroups)
-
-	for i, pg := range r.relayGroups {
-		for _, id := range pg.nodes {
-			r.NodeIdsToGroup[id] = i
-		}
-		if *fixedrelay {
-			r.fixedRelays[i] = r.relayGroups[i].GetRandomNodeId(r.ID(), r.GrayNodes)
-		}
-	}
-
-	log.Infof("PigPaxos region NodeIdsToPeerGroups: {%v}", r.NodeIdsToGroup)
-
-	go r.startTicker()
-
-	return r
+	r.installLayout(r.newLayout(slot, relayGroups))
 }
 
+// peersToGroups splits nodeList into numGroups groups of consecutive nodes. There are never more groups than nodes,
+// so no group is left empty after membership changes removed nodes
 func (r *Replica) peersToGroups(numGroups int, nodeList []paxi.ID) []*PeerGroup {
+	if numGroups > len(nodeList) {
+		numGroups = len(nodeList)
+	}
+	if numGroups == 0 {
+		return nil
+	}
 	peerGroups := make([]*PeerGroup, numGroups)
 	pgNum := 0
 	nodesAddToPg := 0
 	nodesPerGroup := len(nodeList) / numGroups
 	for _, id := range nodeList {
-		if id == r.ID() {
-			r.myRelayGroup = pgNum
-		}
 		if peerGroups[pgNum] == nil {
 			peerGroups[pgNum] = &PeerGroup{nodes: make([]paxi.ID, 0)}
 		}
@@ -188,17 +235,19 @@ func (r *Replica) startTicker() {
 			r.CleanupLog()
 		}
 
-		if ticks%uint64(GrayTimeoutMultiplier) == 0 {
-			log.Debugf("Ticker gray check on tick %d", ticks)
-			r.GrayLock.Lock()
-			for grayId, t := range r.GrayNodes {
-				if t.Add(time.Duration(TickerDuration*GrayTimeoutMultiplier) * time.Millisecond).Before(now) {
-					log.Infof("Removing node %v from gray list on timeout", grayId)
-					delete(r.GrayNodes, grayId)
-				}
-			}
-			r.GrayLock.Unlock()
-			log.Debugf("Ticker gray check done on tick %d", ticks)
+		if *batchSize > 1 && r.IsLeader() {
+			r.FlushBatch(now.Add(-r.BatchDelay))
+		}
+
+		if r.active {
+			r.SendHeartbeat(now)
+			r.CheckPlacement(now, func(id paxi.ID) bool { return paxi.IsConnected(r, id) })
+		} else {
+			r.CheckElection(now)
+		}
+
+		if *regroupInterval > 0 && ticks%uint64(*regroupInterval/TickerDuration+1) == 0 && r.IsLeader() {
+			r.rebalance()
 		}
 
 		// handling timeouts
@@ -211,43 +260,25 @@ func (r *Replica) startTicker() {
 			r.Lock()
 			if r.p1bRelayRoutedMsg != nil {
 				p1bs := r.p1bRelayRoutedMsg.Payload.([]P1b)
-				if r.pendingP1bRelay > 0 && r.pendingP1bRelay < timeoutCutoffTime && len(p1bs) > 0 {
+				relayCutoffTime := now.Add(-r.relayTimeout(int(r.p1bRelayRoutedMsg.Progress) + 1)).UnixNano()
+				if r.pendingP1bRelay > 0 && r.pendingP1bRelay < relayCutoffTime && len(p1bs) > 0 {
 					// we have timeout on P1b
 					log.Debugf("Timeout on P1b. Relaying p1bs {%v}", r.p1bRelayRoutedMsg.Payload)
-
-					if r.p1bRelayRoutedMsg.Progress == 0 {
-						r.Send(r.p1bRelayRoutedMsg.GetLastProgressHop(), p1bs)
-					} else {
-						r.Send(r.p1bRelayRoutedMsg.GetLastProgressHop(), r.p1bRelayRoutedMsg)
-					}
+					r.Send(r.p1bRelayRoutedMsg.GetLastProgressHop(), p1bs)
 					r.p1bRelayRoutedMsg = nil
 					r.pendingP1bRelay = 0
 				}
 			}
 			// check for p2b timeouts
 			for slot, routedP2b := range r.p2bRelaysMapByBalSlot {
-				if r.p2bRelaysTimeMapByBalSlot[slot] < timeoutCutoffTime {
-					routedP2b.IsForward = false
+				relayCutoffTime := now.Add(-r.relayTimeout(int(routedP2b.Progress) + 1)).UnixNano()
+				if r.p2bRelaysTimeMapByBalSlot[slot] < relayCutoffTime {
 					log.Debugf("Timeout on P2b. Relaying p2bs {%v}", r.p2bRelaysMapByBalSlot[slot])
-					if routedP2b.Progress == 0 {
-						p2b := routedP2b.Payload.(P2b)
-						if *useSmallP2b {
-							p2bSmall := P2bAggregated{
-								Ballot:           p2b.Ballot,
-								Slot:             p2b.Slot,
-								RelayLastExecute: r.execute - 1,
-								RelayID:          r.ID(),
-								MissingIDs:       r.computeMissingIDsForP2b(p2b),
-							}
-							r.Send(routedP2b.GetLastProgressHop(), p2bSmall)
-						} else {
-							r.Send(routedP2b.GetLastProgressHop(), routedP2b.Payload)
-						}
-					} else {
-						r.Send(routedP2b.GetLastProgressHop(), routedP2b)
-					}
+					r.Send(routedP2b.GetLastProgressHop(), r.p2bRelayReply(routedP2b))
 					delete(r.p2bRelaysMapByBalSlot, slot)
 					delete(r.p2bRelaysTimeMapByBalSlot, slot)
+					delete(r.p2bDelaysBySlot, slot)
+					delete(r.p2bChildGroups, slot)
 				}
 			}
 			r.Unlock()
@@ -262,6 +293,21 @@ func (r *Replica) startTicker() {
 // Overrides Broadcast in node
 func (r *Replica) Broadcast(m interface{}) {
 	log.Debugf("PigPaxos Broadcast Msg: {%v}", m)
+	var layout *relayLayout
+	if p2a, ok := m.(P2a); ok {
+		layout = r.layout(p2a.Slot)
+	} else {
+		layout = r.latestLayout()
+	}
+	groups := make([]int, len(layout.groups))
+	for i := range groups {
+		groups[i] = i
+	}
+	r.relay(m, layout, groups)
+}
+
+// relay sends m through a relay of every group of layout with index in groups
+func (r *Replica) relay(m interface{}, layout *relayLayout, groups []int) {
 	routedMsg := RoutedMsg{
 		Hops:      make([]paxi.ID, 1),
 		IsForward: true,
@@ -269,15 +315,15 @@ func (r *Replica) Broadcast(m interface{}) {
 		Payload:   m,
 	}
 	routedMsg.Hops[0] = r.ID()
-	for i := 0; i < r.numRelayGroups; i++ {
+	routedMsg.Layout = layout.slot
+	for _, i := range groups {
+		pg := layout.groups[i]
 		var relayId paxi.ID
 		if *fixedrelay {
-			relayId = r.fixedRelays[i]
+			relayId = layout.fixedRelays[i]
 		} else {
-			r.GrayLock.RLock()
-			relayId = r.relayGroups[i].GetRandomNodeId(r.ID(), r.GrayNodes)
-			r.GrayLock.RUnlock()
-			log.Debugf("Generated Random Relay for RG #%d {%v}: %v", i, r.relayGroups[i], relayId)
+			relayId = pg.GetRandomNodeId(r.ID(), r.reachable)
+			log.Debugf("Generated Random Relay for RG #%d {%v}: %v", i, pg, relayId)
 		}
 		r.Send(relayId, routedMsg)
 	}
@@ -288,10 +334,7 @@ func (r *Replica) BroadcastToPeerGroup(pg *PeerGroup, originalSourceToExclude pa
 	log.Debugf("PigPaxos Broadcast to PeerGroup %v: {%v}", pg, m)
 	log.Debugf("node %v,PeerGroup: %v ,exclude %v", r.ID(), pg, originalSourceToExclude)
 	for _, id := range pg.nodes {
-		r.GrayLock.RLock()
-		_, gray := r.GrayNodes[id]
-		r.GrayLock.RUnlock()
-		if id != r.ID() && id != originalSourceToExclude && !gray {
+		if id != r.ID() && id != originalSourceToExclude && r.reachable(id) {
 			go r.Send(id, m)
 		}
 	}
@@ -303,18 +346,24 @@ func (r *Replica) Send(to paxi.ID, m interface{}) error {
 		r.HandleMsg(m) // loopback for self
 	} else {
 		err := r.Node.Send(to, m)
-		if err != nil {
-			// add node to gray list
-			r.GrayLock.Lock()
-			log.Infof("Adding node %v to gray list", to)
-			r.GrayNodes[to] = time.Now()
-			r.GrayLock.Unlock()
+		if err == paxi.ErrSendQueueFull {
+			// lost phase 2 messages are retried on timeout and lost commits are recovered by followers
+			log.Warningf("PigPaxos dropped %T to %v: %v", m, to, err)
+		} else if err != nil {
+			log.Debugf("PigPaxos cannot send to %v: %v", to, err)
 		}
+		return err
 	}
 
 	return nil
 }
 
+// reachable returns false for nodes whose connection is down, so they are not picked as relays
+// and not waited for. Nodes that were not dialed yet are reachable
+func (r *Replica) reachable(id paxi.ID) bool {
+	return paxi.Reachable(r.Node, id)
+}
+
 //*********************************************************************************************************************
 // Routing
 //*********************************************************************************************************************
@@ -322,6 +371,8 @@ func (r *Replica) Send(to paxi.ID, m interface{}) error {
 func (r *Replica) handleRoutedMsg(m RoutedMsg) {
 	log.Debugf("Node %v handling RoutedMsg {%v}", r.ID(), m)
 	if m.IsForward {
+		// relay with the layout the sender used, or the closest one we know if it is not here yet
+		m.Layout = r.layout(m.Layout).slot
 		// handle the payload ourselves
 		needToPropagate := false
 		switch msg := m.Payload.(type) {
@@ -336,16 +387,27 @@ func (r *Replica) handleRoutedMsg(m RoutedMsg) {
 			log.Debugf("Node %v handling msg {%v}", r.ID(), msg)
 			needToPropagate = true
 			r.HandleP3(msg)
+		case Heartbeat:
+			needToPropagate = true
+			r.HandleHeartbeat(msg)
 		}
 
 		// forward propagation if needed
 		if m.Progress+1 < r.maxDepth && needToPropagate {
 			// still not done going to the leaf nodes
+			level := int(m.Progress) + 1
+			pgToBroadcast := &PeerGroup{nodes: r.relayGroup(&m)}
+			children := r.childGroups(&m, level)
 			m.Progress += 1
-			pgToBroadcast := r.relayGroups[r.myRelayGroup]
 			m.Hops = append(m.Hops, r.ID())
 			log.Debugf("Node %v forward propagating msg %v at depth %d and max depth %d", r.ID(), m, m.Progress, r.maxDepth)
-			r.BroadcastToPeerGroup(pgToBroadcast, m.GetPreviousProgressHop(), m)
+			if m.Progress+1 < r.maxDepth {
+				// next level is relays too, each serving a part of our group
+				r.forwardToChildren(m, children)
+			} else {
+				m.Group = nil
+				r.BroadcastToPeerGroup(pgToBroadcast, m.GetPreviousProgressHop(), m)
+			}
 		}
 	} else {
 		// backward propagation
@@ -382,7 +444,7 @@ func (r *Replica) handleP1aRelay(m P1a, routedMsg RoutedMsg) bool {
 				r.Send(oldBallot.ID(), m)
 			}
 			r.pendingP1bRelay = time.Now().UnixNano()
-			r.p1bRelayRoutedMsg = &RoutedMsg{Progress: routedMsg.Progress, Hops: routedMsg.Hops, Payload: make([]P1b, 0)}
+			r.p1bRelayRoutedMsg = &RoutedMsg{Progress: routedMsg.Progress, Hops: routedMsg.Hops, Layout: routedMsg.Layout, Group: routedMsg.Group, Payload: make([]P1b, 0)}
 			needToPropagate = true
 			r.Unlock()
 		} else {
@@ -441,11 +503,19 @@ func (r *Replica) newP2bRelay(m P2a, routedMsg RoutedMsg) {
 		Hops:      routedMsg.Hops,
 		IsForward: false,
 		Progress:  routedMsg.Progress,
+		Layout:    routedMsg.Layout,
+		Group:     routedMsg.Group,
 		Payload:   P2b{Ballot: m.Ballot, Slot: m.Slot, ID: make([]paxi.ID, 0)},
 	}
+	r.p2bChildGroups[m.Slot] = make(map[paxi.ID][]paxi.ID)
 
 	r.p2bRelaysMapByBalSlot[m.Slot] = &routedP2b
 	r.p2bRelaysTimeMapByBalSlot[m.Slot] = time.Now().UnixNano()
+	if *regroupInterval > 0 && m.Slot%*regroupSample == 0 {
+		r.p2bDelaysBySlot[m.Slot] = make(map[paxi.ID]int64)
+	} else {
+		delete(r.p2bDelaysBySlot, m.Slot)
+	}
 }
 
 func (r *Replica) handleP3(m P3) bool {
@@ -464,7 +534,8 @@ func (r *Replica) handleP3(m P3) bool {
 func (r *Replica) handleP1bLeader(p1bs []P1b) {
 	log.Debugf("Node %v received aggregated P1b {%v}", r.ID(), p1bs)
 	for _, p1b := range p1bs {
-		r.HandleP1b(p1b)
+		// intermediate relays of deeper trees aggregate P1bs of their child relays
+		r.handleP1b(p1b)
 	}
 }
 
@@ -487,12 +558,8 @@ func (r *Replica) handleP1bRelay(m P1b) {
 	if r.readyToRelayP1b(m.Ballot, r.p1bRelayDepth) {
 
 		log.Debugf("Relaying p1bs {%v} to %v", r.p1bRelayRoutedMsg.Payload, m.Ballot.ID())
-		// relay RoutedMsg downstream unless relaying back to root, in which case just sand []P1b to ease processing at leader
-		if r.p1bRelayRoutedMsg.Progress == 0 {
-			r.Send(r.p1bRelayRoutedMsg.GetLastProgressHop(), r.p1bRelayRoutedMsg.Payload)
-		} else {
-			r.Send(r.p1bRelayRoutedMsg.GetLastProgressHop(), r.p1bRelayRoutedMsg)
-		}
+		// send plain []P1b to the parent, both the leader and intermediate relays aggregate them
+		r.Send(r.p1bRelayRoutedMsg.GetLastProgressHop(), r.p1bRelayRoutedMsg.Payload)
 		r.pendingP1bRelay = 0
 		r.p1bRelayDepth = 0
 		r.p1bRelayRoutedMsg = nil
@@ -500,20 +567,10 @@ func (r *Replica) handleP1bRelay(m P1b) {
 }
 
 func (r *Replica) readyToRelayP1b(ballot paxi.Ballot, depth uint8) bool {
-	pgToRelay := r.relayGroups[r.myRelayGroup]
+	expected := r.expectedReplies(r.p1bRelayRoutedMsg)
 	p1bs := r.p1bRelayRoutedMsg.Payload.([]P1b)
-	log.Debugf("Now have %d messages to relay for p1b Ballot %v. PeerGroup to relay is %d nodes at depth %d", len(p1bs), ballot, len(pgToRelay.nodes), depth)
-	if len(p1bs) == len(pgToRelay.nodes) {
-		return true
-	}
-	if len(p1bs) == len(pgToRelay.nodes)-1 {
-		for _, id := range pgToRelay.nodes {
-			if id == ballot.ID() {
-				return true
-			}
-		}
-	}
-	return false
+	log.Debugf("Now have %d messages to relay for p1b Ballot %v. Expecting %d replies at depth %d", len(p1bs), ballot, expected, depth)
+	return len(p1bs) >= expected
 }
 
 //***************
@@ -523,6 +580,9 @@ func (r *Replica) readyToRelayP1b(ballot paxi.Ballot, depth uint8) bool {
 func (r *Replica) handleP2b(m P2b) {
 	if r.IsLeader() {
 		// we received p2b aggregated reply, so just handle it at the pigpaxos level
+		if paxi.GetConfig().Thrifty {
+			r.sampleRoundTrip(m.Slot, m.ID)
+		}
 		r.HandleP2b(m.Slot, m.Ballot, m.ID)
 	} else {
 		// here we handle the P2b coming from the leaf node
@@ -536,28 +596,53 @@ func (r *Replica) handleP2bAggregated(m P2bAggregated) {
 	log.Debugf("Handling P2bAggregated: %v", m)
 	if r.IsLeader() {
 		r.UpdateLastExecuteByNode(m.RelayID, m.RelayLastExecute)
-		// we received p2b aggregated reply, so just handle it at the pigpaxos level
+		if len(m.Delays) > 0 {
+			r.sampleLatency(m)
+		}
+		if latest := r.latestLayout(); m.Layout < latest.slot && m.Slot >= latest.slot {
+			// the relay routed a slot of the latest layout with older groups, it missed the update
+			r.Send(m.RelayID, r.layoutUpdate(latest))
+		}
+		layout := r.layout(m.Layout)
+		if layout.slot != m.Layout {
+			log.Errorf("Node %v no longer has relay layout %d used for %v", r.ID(), m.Layout, m)
+			return
+		}
+		g, exists := layout.nodeIdsToGroup[m.RelayID]
+		if !exists {
+			log.Errorf("Node %v has no relay %v in layout %d used for %v", r.ID(), m.RelayID, m.Layout, m)
+			return
+		}
+		group := layout.groups[g]
+		// we received p2b aggregated reply, so just handle it at the pigpaxos level.
+		// The compact reply is turned back into the ids of voters, so the quorum adds up the weight of every
+		// voter and a group with a heavy node that did not vote is not counted by its size
 		if m.MissingIDs != nil && len(m.MissingIDs) > 0 {
-			ids := make([]paxi.ID, len(r.relayGroups[r.NodeIdsToGroup[m.RelayID]].nodes))
-			copy(ids, r.relayGroups[r.NodeIdsToGroup[m.RelayID]].nodes)
-			for _, missingId := range m.MissingIDs {
-				for i, id := range ids {
-					if id == missingId {
-						ids[i] = ids[len(ids)-1]
-						ids[len(ids)-1] = 0
-						ids = ids[:len(ids)-1]
-						break
-					}
+			missing := make(map[paxi.ID]bool, len(m.MissingIDs))
+			for _, id := range m.MissingIDs {
+				missing[id] = true
+			}
+			ids := make([]paxi.ID, 0, len(group.nodes))
+			for _, id := range group.nodes {
+				if !missing[id] {
+					ids = append(ids, id)
 				}
 			}
 			log.Debugf("Calling HandleP2b with ids: %v", ids)
+			if paxi.GetConfig().Thrifty {
+				r.sampleRoundTrip(m.Slot, ids)
+			}
 			r.HandleP2b(m.Slot, m.Ballot, ids)
 		} else {
-			log.Debugf("Calling HandleP2b with ids: %v", r.relayGroups[r.NodeIdsToGroup[m.RelayID]].nodes)
-			r.HandleP2b(m.Slot, m.Ballot, r.relayGroups[r.NodeIdsToGroup[m.RelayID]].nodes)
+			log.Debugf("Calling HandleP2b with ids: %v", group.nodes)
+			if paxi.GetConfig().Thrifty {
+				r.sampleRoundTrip(m.Slot, group.nodes)
+			}
+			r.HandleP2b(m.Slot, m.Ballot, group.nodes)
 		}
 	} else {
-		log.Errorf("Can process this type of messages only on leader node: %v", m)
+		// reply of a child relay in a tree deeper than 2
+		r.handleP2bAggregatedRelay(m)
 	}
 }
 
@@ -575,35 +660,26 @@ func (r *Replica) handleP2bRelay(m P2b) {
 			p2b.ID = append(p2b.ID, m.ID...)
 			r.Lock()
 			p2bForRelay.Payload = p2b
+			if delays, sampled := r.p2bDelaysBySlot[m.Slot]; sampled {
+				delay := (time.Now().UnixNano() - r.p2bRelaysTimeMapByBalSlot[m.Slot]) / int64(time.Microsecond)
+				for _, id := range m.ID {
+					delays[id] = delay
+				}
+			}
 			r.Unlock()
 			log.Debugf("Now have %d messages to relay for p2b Slot %d Ballot %v", len(p2b.ID), m.Slot, m.Ballot)
 			if r.readyToRelayP2b(m.Slot) {
-				var missingIds []paxi.ID
-				if r.relaySlack > 0 {
-					missingIds = r.computeMissingIDsForP2b(p2b)
-				} else {
-					missingIds = make([]paxi.ID, 0)
-				}
 				log.Debugf("Relaying p2bs {%v} to %v", p2bForRelay, m.Ballot.ID())
-				// relay RoutedMsg downstream unless relaying back to root
-				if p2bForRelay.Progress == 0 {
-					if *useSmallP2b {
-						p2bSmall := P2bAggregated{
-							Ballot:           m.Ballot,
-							Slot:             m.Slot,
-							RelayLastExecute: r.execute - 1,
-							MissingIDs:       missingIds,
-							RelayID:          r.ID()}
-						r.Send(p2bForRelay.GetLastProgressHop(), p2bSmall)
-					} else {
-						r.Send(p2bForRelay.GetLastProgressHop(), p2bForRelay.Payload)
-					}
-				} else {
-					r.Send(p2bForRelay.GetLastProgressHop(), p2bForRelay)
-				}
+				// compact P2bAggregated goes one level up the tree, whether it is the leader or a relay
+				r.RLock()
+				reply := r.p2bRelayReply(p2bForRelay)
+				r.RUnlock()
+				r.Send(p2bForRelay.GetLastProgressHop(), reply)
 				r.Lock()
 				delete(r.p2bRelaysMapByBalSlot, m.Slot)
 				delete(r.p2bRelaysTimeMapByBalSlot, m.Slot)
+				delete(r.p2bDelaysBySlot, m.Slot)
+				delete(r.p2bChildGroups, m.Slot)
 				r.Unlock()
 			}
 		} else {
@@ -617,9 +693,9 @@ func (r *Replica) handleP2bRelay(m P2b) {
 	}
 }
 
-func (r *Replica) computeMissingIDsForP2b(p2b P2b) []paxi.ID {
-	missingIds := make([]paxi.ID, len(r.relayGroups[r.myRelayGroup].nodes))
-	copy(missingIds, r.relayGroups[r.myRelayGroup].nodes)
+func (r *Replica) computeMissingIDsForP2b(p2b P2b, group []paxi.ID) []paxi.ID {
+	missingIds := make([]paxi.ID, len(group))
+	copy(missingIds, group)
 	for _, id := range p2b.ID {
 		for i, missingId := range missingIds {
 			if id == missingId {
@@ -639,17 +715,8 @@ func (r *Replica) readyToRelayP2b(m int) bool {
 	if r.p2bRelaysMapByBalSlot[m] == nil {
 		return false
 	}
-	pgToRelay := r.relayGroups[r.myRelayGroup]
 	p2b := r.p2bRelaysMapByBalSlot[m].Payload.(P2b)
-	if len(p2b.ID) == len(pgToRelay.nodes)-r.relaySlack {
-		return true
-	}
-	if len(p2b.ID) == len(pgToRelay.nodes)-1-r.relaySlack {
-		if r.NodeIdsToGroup[p2b.Ballot.ID()] == r.myRelayGroup {
-			return true
-		}
-	}
-	return false
+	return len(p2b.ID) >= r.expectedReplies(r.p2bRelaysMapByBalSlot[m])-r.relaySlack
 }
 
 //*********************************************************************************************************************
@@ -659,6 +726,10 @@ func (r *Replica) readyToRelayP2b(m int) bool {
 func (r *Replica) handleRequest(m paxi.Request) {
 	log.Debugf("Replica %s received %v\n", r.ID(), m)
 
+	if r.PigPaxos.LocalRead(m) || r.PigPaxos.LearnerRead(m) {
+		return
+	}
+
 	if !*stableLeader || r.PigPaxos.IsLeader() || r.PigPaxos.Ballot() == 0 {
 		r.PigPaxos.HandleRequest(m)
 	} else {
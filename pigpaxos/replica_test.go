@@ -1,53 +1,719 @@
 package pigpaxos
 
 import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"pigpaxos"
 )
 
-var replica *Replica
+// testNode records messages of a replica instead of sending them
+type testNode struct {
+	paxi.Node
+	sync.Mutex
+	sent []testMsg
+	down map[paxi.ID]bool // nodes whose connection is down
+	idle map[paxi.ID]bool // nodes that were not dialed yet
+	wal  paxi.WAL         // replaces the write-ahead log of the node if set
+}
+
+func (n *testNode) WAL() paxi.WAL {
+	if n.wal != nil {
+		return n.wal
+	}
+	return n.Node.WAL()
+}
+
+// failingWAL cannot persist promises
+type failingWAL struct {
+	paxi.WAL
+}
+
+func (failingWAL) Promise(paxi.Ballot) error {
+	return errors.New("disk full")
+}
+
+// testMsg is a message sent to node to, 0 for a broadcast
+type testMsg struct {
+	to paxi.ID
+	m  interface{}
+}
+
+func (n *testNode) Send(to paxi.ID, m interface{}) error {
+	n.Lock()
+	defer n.Unlock()
+	n.sent = append(n.sent, testMsg{to, m})
+	return nil
+}
+
+func (n *testNode) Broadcast(m interface{}) {
+	n.Send(0, m)
+}
+
+func (n *testNode) Forward(id paxi.ID, r paxi.Request) {
+	n.Send(id, r)
+}
+
+// Enqueue records m as a message the node sends to itself
+func (n *testNode) Enqueue(m interface{}) {
+	n.Send(n.ID(), m)
+}
+
+func (n *testNode) PeerState(id paxi.ID) paxi.ConnState {
+	n.Lock()
+	defer n.Unlock()
+	if n.down[id] {
+		return paxi.Disconnected
+	}
+	if n.idle[id] {
+		return paxi.Idle
+	}
+	return paxi.Connected
+}
+
+// take removes and returns messages sent so far
+func (n *testNode) take() []testMsg {
+	n.Lock()
+	defer n.Unlock()
+	sent := n.sent
+	n.sent = nil
+	return sent
+}
+
+// payloads returns messages of sent, routed messages are replaced by their payload
+func payloads(sent []testMsg) []interface{} {
+	ms := make([]interface{}, len(sent))
+	for i, s := range sent {
+		ms[i] = s.m
+		if routed, ok := s.m.(RoutedMsg); ok {
+			ms[i] = routed.Payload
+		}
+	}
+	return ms
+}
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "pigpaxos")
+	if err != nil {
+		panic(err)
+	}
+	// six nodes in zone 1, 1.1 should lead
+	file := filepath.Join(dir, "config.json")
+	err = os.WriteFile(file, []byte(`{
+		"address": {"1.1": "chan://127.0.0.1:1761", "1.2": "chan://127.0.0.1:1762", "1.3": "chan://127.0.0.1:1763",
+			"1.4": "chan://127.0.0.1:1764", "1.5": "chan://127.0.0.1:1765", "1.6": "chan://127.0.0.1:1766"},
+		"http_address": {"1.1": "http://127.0.0.1:8761", "1.2": "http://127.0.0.1:8762", "1.3": "http://127.0.0.1:8763",
+			"1.4": "http://127.0.0.1:8764", "1.5": "http://127.0.0.1:8765", "1.6": "http://127.0.0.1:8766"},
+		"leader_preference": ["1.1"]
+	}`), 0644)
+	if err != nil {
+		panic(err)
+	}
+	flag.Set("config", file)
+	flag.Set("log_dir", dir)
+	paxi.Init()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
 
-func testSetup() *Replica {
-	replica := NewReplica("1.2")
-	return replica
+// newTestReplica returns replica id on a node that records its messages, its timers are not started
+func newTestReplica(id paxi.ID) (*Replica, *testNode) {
+	n := &testNode{Node: paxi.NewNode(id), down: make(map[paxi.ID]bool), idle: make(map[paxi.ID]bool)}
+	return newReplica(n), n
+}
+
+// testBallot returns ballot n of node id
+func testBallot(n int, id paxi.ID) paxi.Ballot {
+	return paxi.NewBallot(n, id)
+}
+
+// lead makes replica the active leader of ballot b
+func lead(r *Replica, b paxi.Ballot) {
+	r.ballot = b
+	r.active = true
+}
+
+func TestRegroupOnFailure(t *testing.T) {
+	*pg = 2
+	defer func() { *pg = 1 }()
+	r, n := newTestReplica(paxi.NewID(1, 1))
+	lead(r, testBallot(1, r.ID()))
+	if l := r.latestLayout(); !sameGroups(l.groups, []*PeerGroup{
+		{nodes: []paxi.ID{paxi.NewID(1, 1), paxi.NewID(1, 2), paxi.NewID(1, 3)}},
+		{nodes: []paxi.ID{paxi.NewID(1, 4), paxi.NewID(1, 5), paxi.NewID(1, 6)}},
+	}) {
+		t.Fatalf("expect static groups of three, got %v", l)
+	}
+
+	// 1.4 and 1.6 failed and report no latency, 1.3 is slow
+	r.latency.Add(paxi.NewID(1, 2), time.Millisecond)
+	r.latency.Add(paxi.NewID(1, 5), time.Millisecond)
+	r.latency.Add(paxi.NewID(1, 3), 50*time.Millisecond)
+	r.slot = 9
+	r.rebalance()
+
+	l := r.latestLayout()
+	if l.slot != 10 {
+		t.Errorf("expect new layout from the next slot 10, got %d", l.slot)
+	}
+	if !sameGroups(l.groups, []*PeerGroup{
+		{nodes: []paxi.ID{paxi.NewID(1, 1), paxi.NewID(1, 2), paxi.NewID(1, 5)}},
+		{nodes: []paxi.ID{paxi.NewID(1, 3), paxi.NewID(1, 4), paxi.NewID(1, 6)}},
+	}) {
+		t.Errorf("expect fast nodes to share a group apart from failed ones, got %v", l)
+	}
+	if r.layout(9).slot != 0 {
+		t.Error("expect slots before the update to keep the old layout")
+	}
+	var update *RelayGroupUpdate
+	for _, m := range payloads(n.take()) {
+		if u, ok := m.(RelayGroupUpdate); ok {
+			update = &u
+		}
+	}
+	if update == nil || update.Slot != 10 || update.Ballot != r.ballot {
+		t.Errorf("expect followers to be sent the new groups, got %v", update)
+	}
+
+	// relays are picked among nodes that are not down
+	n.down[paxi.NewID(1, 4)] = true
+	n.down[paxi.NewID(1, 6)] = true
+	for i := 0; i < 10; i++ {
+		if id := l.groups[1].GetRandomNodeId(r.ID(), r.reachable); id != paxi.NewID(1, 3) {
+			t.Fatalf("expect reachable relay 1.3, got %v", id)
+		}
+	}
+
+	// nothing changed, the layout stays
+	r.rebalance()
+	if r.latestLayout() != l {
+		t.Error("expect unchanged latency to keep the layout")
+	}
 }
 
 func BenchmarkMissingIDAllMissing(b *testing.B) {
-	paxi.GetConfig().Addrs["1.1"] = "127.0.0.1:1735"
-	paxi.GetConfig().Addrs["1.2"] = "127.0.0.1:1736"
-	paxi.GetConfig().Addrs["1.3"] = "127.0.0.1:1737"
-	paxi.GetConfig().Addrs["1.4"] = "127.0.0.1:1738"
-	paxi.GetConfig().Addrs["1.5"] = "127.0.0.1:1739"
-	paxi.GetConfig().Addrs["1.6"] = "127.0.0.1:1740"
-	paxi.GetConfig().Addrs["1.7"] = "127.0.0.1:1741"
-	paxi.GetConfig().Addrs["1.8"] = "127.0.0.1:1742"
-	if replica == nil {
-		replica = testSetup()
-	}
-	bal := paxi.NewBallot(0, "1.1")
-	p2b := P2b{ID: make([]paxi.ID, 0), Ballot: bal, Slot: 42}
+	r, _ := newTestReplica(paxi.NewID(1, 2))
+	group := paxi.GetConfig().Voters()
+	p2b := P2b{ID: make([]paxi.ID, 0), Ballot: testBallot(0, paxi.NewID(1, 1)), Slot: 42}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		replica.computeMissingIDsForP2b(p2b)
+		r.computeMissingIDsForP2b(p2b, group)
 	}
 }
 
 func BenchmarkMissingIDOneMissing(b *testing.B) {
-	paxi.GetConfig().Addrs["1.1"] = "127.0.0.1:1735"
-	paxi.GetConfig().Addrs["1.2"] = "127.0.0.1:1736"
-	paxi.GetConfig().Addrs["1.3"] = "127.0.0.1:1737"
-	paxi.GetConfig().Addrs["1.4"] = "127.0.0.1:1738"
-	paxi.GetConfig().Addrs["1.5"] = "127.0.0.1:1739"
-	paxi.GetConfig().Addrs["1.6"] = "127.0.0.1:1740"
-	paxi.GetConfig().Addrs["1.7"] = "127.0.0.1:1741"
-	paxi.GetConfig().Addrs["1.8"] = "127.0.0.1:1742"
-	if replica == nil {
-		replica = testSetup()
-	}
-	bal := paxi.NewBallot(0, "1.1")
-	pgIds := []paxi.ID{paxi.ID("1.1"), paxi.ID("1.2"), paxi.ID("1.3")}
-	p2b := P2b{ID: pgIds, Ballot: bal, Slot: 42}
+	r, _ := newTestReplica(paxi.NewID(1, 2))
+	group := paxi.GetConfig().Voters()
+	pgIds := []paxi.ID{paxi.NewID(1, 1), paxi.NewID(1, 2), paxi.NewID(1, 3)}
+	p2b := P2b{ID: pgIds, Ballot: testBallot(0, paxi.NewID(1, 1)), Slot: 42}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		replica.computeMissingIDsForP2b(p2b)
+		r.computeMissingIDsForP2b(p2b, group)
+	}
+}
+
+func TestFollowerMissesLayoutUpdate(t *testing.T) {
+	*pg = 2
+	defer func() { *pg = 1 }()
+	leader, ln := newTestReplica(paxi.NewID(1, 1))
+	follower, _ := newTestReplica(paxi.NewID(1, 4))
+	b := testBallot(1, leader.ID())
+	lead(leader, b)
+	follower.ballot = b
+
+	// the broadcast of the new groups does not reach the follower
+	leader.latency.Add(paxi.NewID(1, 2), time.Millisecond)
+	leader.latency.Add(paxi.NewID(1, 5), time.Millisecond)
+	leader.latency.Add(paxi.NewID(1, 3), 50*time.Millisecond)
+	leader.slot = 9
+	leader.rebalance()
+	ln.take()
+	for i := 0; i < maxLayouts; i++ {
+		leader.installLayout(leader.newLayout(20+i, leader.latestLayout().groups))
+	}
+	latest := leader.latestLayout()
+
+	// the follower relays a slot of the latest layout with the groups it knows
+	leader.HandleMsg(P2bAggregated{
+		RelayID: follower.ID(),
+		Ballot:  b,
+		Slot:    latest.slot,
+		Layout:  follower.layout(latest.slot).slot,
+	})
+	var update *RelayGroupUpdate
+	for _, s := range ln.take() {
+		if u, ok := s.m.(RelayGroupUpdate); ok && s.to == follower.ID() {
+			update = &u
+		}
+	}
+	if update == nil {
+		t.Fatal("expect the stale relay to be sent the current layout")
+	}
+	follower.HandleMsg(*update)
+	if l := follower.layout(latest.slot); l.slot != latest.slot || !sameGroups(l.groups, latest.groups) {
+		t.Errorf("expect follower to relay with %v, got %v", latest, l)
+	}
+
+	// periodic rebalancing resends an unchanged layout to everyone
+	leader.rebalance()
+	resent := false
+	for _, s := range ln.take() {
+		if u, ok := s.m.(RelayGroupUpdate); ok && s.to == 0 && u.Slot == latest.slot {
+			resent = true
+		}
+	}
+	if !resent {
+		t.Error("expect unchanged layout to be broadcast again")
+	}
+}
+
+func TestRelayTree(t *testing.T) {
+	*depth = 3
+	defer func() { *depth = 2 }()
+	relay, n := newTestReplica(paxi.NewID(1, 2))
+	relay.relaySlack = 1
+	leader := paxi.NewID(1, 1)
+	b := testBallot(1, leader)
+
+	if relay.relayTimeout(2) >= relay.relayTimeout(1) {
+		t.Errorf("expect deeper relays to time out first, got %v at level 1 and %v at level 2", relay.relayTimeout(1), relay.relayTimeout(2))
+	}
+
+	relay.HandleMsg(RoutedMsg{
+		Hops:      []paxi.ID{leader},
+		IsForward: true,
+		Payload:   P2a{Ballot: b, Slot: 1, Commands: []paxi.Command{{Key: "k", Value: []byte("v")}}},
+	})
+
+	// the rest of the group is split between two child relays
+	children := make(map[paxi.ID][]paxi.ID)
+	for _, s := range n.take() {
+		m, ok := s.m.(RoutedMsg)
+		if !ok {
+			continue
+		}
+		if m.Progress != 1 || len(m.Hops) != 2 || m.Hops[1] != relay.ID() {
+			t.Errorf("expect child relay %v to get message of level 1 from the relay, got %v", s.to, m)
+		}
+		children[s.to] = m.Group
+	}
+	if len(children) != 2 {
+		t.Fatalf("expect two child relays, got %v", children)
+	}
+	served := make(map[paxi.ID]bool)
+	for child, group := range children {
+		if !onPath(child, group) || len(group) != 2 {
+			t.Errorf("expect child relay %v to serve a group of two with itself, got %v", child, group)
+		}
+		for _, id := range group {
+			served[id] = true
+		}
+	}
+	if len(served) != 4 || served[leader] || served[relay.ID()] {
+		t.Errorf("expect children to serve all nodes but the leader and the relay, got %v", served)
+	}
+
+	// one child relay lost a node, its compact reply still counts the rest of its group
+	var missing paxi.ID
+	for child, group := range children {
+		m := P2bAggregated{RelayID: child, Ballot: b, Slot: 1}
+		if missing == 0 {
+			for _, id := range group {
+				if id != child {
+					missing = id
+				}
+			}
+			m.MissingIDs = []paxi.ID{missing}
+		}
+		relay.HandleMsg(m)
+	}
+	var reply *P2bAggregated
+	for _, s := range n.take() {
+		if m, ok := s.m.(P2bAggregated); ok && s.to == leader {
+			reply = &m
+		}
+	}
+	if reply == nil {
+		t.Fatal("expect relay to reply to the leader once its slack is left")
+	}
+	if reply.RelayID != relay.ID() || len(reply.MissingIDs) != 2 || !onPath(missing, reply.MissingIDs) || !onPath(leader, reply.MissingIDs) {
+		t.Errorf("expect the leader and %v missing from the votes of the relay, got %v", missing, reply)
+	}
+}
+
+// p1bs returns P1b replies sent to node to
+func p1bs(sent []testMsg, to paxi.ID) []P1b {
+	replies := make([]P1b, 0)
+	for _, s := range sent {
+		if m, ok := s.m.(P1b); ok && s.to == to {
+			replies = append(replies, m)
+		}
+	}
+	return replies
+}
+
+func TestLeaseBlocksP1a(t *testing.T) {
+	r, n := newTestReplica(paxi.NewID(1, 2))
+	r.LeaseDuration = time.Second
+	leader, candidate := paxi.NewID(1, 1), paxi.NewID(1, 3)
+	b := testBallot(1, leader)
+	r.HandleP2a(P2a{Ballot: b, Slot: 0, Commands: []paxi.Command{{Key: "k", Value: []byte("v")}}}, leader)
+	n.take()
+
+	// the lease granted with the accept keeps the candidate from being elected
+	r.HandleP1a(P1a{Ballot: testBallot(2, candidate)}, candidate)
+	if replies := p1bs(n.take(), candidate); len(replies) != 1 || replies[0].Ballot != b {
+		t.Errorf("expect candidate to be rejected with ballot %v, got %v", b, replies)
+	}
+	if r.Ballot() != b {
+		t.Errorf("expect ballot %v to stay, got %v", b, r.Ballot())
+	}
+
+	// the leader itself may run phase 1 again
+	r.HandleP1a(P1a{Ballot: testBallot(2, leader)}, leader)
+	if replies := p1bs(n.take(), leader); len(replies) != 1 || replies[0].Ballot != testBallot(2, leader) {
+		t.Errorf("expect leader to be promised its new ballot, got %v", replies)
+	}
+
+	// once the lease expires the candidate is promised
+	r.grant = time.Now().Add(-time.Millisecond)
+	r.HandleP1a(P1a{Ballot: testBallot(3, candidate)}, candidate)
+	if replies := p1bs(n.take(), candidate); len(replies) != 1 || replies[0].Ballot != testBallot(3, candidate) {
+		t.Errorf("expect candidate to be promised after the lease expired, got %v", replies)
+	}
+}
+
+func TestLeaseAllowsLocalReads(t *testing.T) {
+	r, _ := newTestReplica(paxi.NewID(1, 1))
+	r.LeaseDuration = time.Second
+	b := testBallot(1, r.ID())
+	lead(r, b)
+	read := paxi.Request{Command: paxi.Command{Key: "k"}}
+
+	if r.HasLease() || r.LocalRead(read) {
+		t.Fatal("expect no local reads before a slot is committed with the lease")
+	}
+
+	// a quorum granted the lease with the P2a of slot 0, which is executed
+	r.extendLease(&paxi.Entry{Ballot: b, Timestamp: time.Now(), Commit: true})
+	r.execute = 1
+	if !r.HasLease() {
+		t.Error("expect leader to hold the lease")
+	}
+	if r.LocalRead(paxi.Request{Command: paxi.Command{Key: "k", Value: []byte("v")}}) {
+		t.Error("expect writes to go through the log under lease")
+	}
+
+	// slots of a previous leader not executed yet may hide newer values
+	r.leaseSlot = 1
+	if r.HasLease() {
+		t.Error("expect no local reads before slots of previous leaders are executed")
+	}
+	r.leaseSlot = 0
+
+	// a lease of an old ballot is not valid for the new one
+	r.ballot = testBallot(2, r.ID())
+	if r.HasLease() {
+		t.Error("expect lease to belong to the ballot it was granted for")
+	}
+}
+
+// proposed returns commands proposed in slots after slot
+func proposed(r *Replica, slot int) [][]paxi.Command {
+	r.logLck.RLock()
+	defer r.logLck.RUnlock()
+	batches := make([][]paxi.Command, 0)
+	for s := slot + 1; s <= r.slot; s++ {
+		batches = append(batches, r.log[s].Commands)
+	}
+	return batches
+}
+
+func TestBatch(t *testing.T) {
+	r, _ := newTestReplica(paxi.NewID(1, 1))
+	r.BatchSize = 3
+	lead(r, testBallot(1, r.ID()))
+	slot := r.slot
+	request := func(k paxi.Key) {
+		r.HandleRequest(paxi.Request{Command: paxi.Command{Key: k, Value: []byte("v")}})
+	}
+
+	// the batch is proposed in one slot once it is full
+	request("a")
+	request("b")
+	if batches := proposed(r, slot); len(batches) != 0 {
+		t.Fatalf("expect requests to wait for the batch to fill up, got %v", batches)
+	}
+	request("c")
+	batches := proposed(r, slot)
+	if len(batches) != 1 || len(batches[0]) != 3 || batches[0][0].Key != "a" || batches[0][2].Key != "c" {
+		t.Fatalf("expect one slot with a batch of three, got %v", batches)
+	}
+	slot = r.slot
+
+	// a partial batch is proposed from the ticker once its first request waited long enough
+	request("d")
+	r.FlushBatch(time.Now().Add(-time.Second))
+	if batches := proposed(r, slot); len(batches) != 0 {
+		t.Fatalf("expect a recent batch to wait, got %v", batches)
+	}
+	r.FlushBatch(time.Now())
+	if batches := proposed(r, slot); len(batches) != 1 || len(batches[0]) != 1 || batches[0][0].Key != "d" {
+		t.Fatalf("expect the waiting request to be proposed alone, got %v", batches)
+	}
+	r.FlushBatch(time.Now())
+	if r.slot != slot+1 {
+		t.Error("expect no slot for an empty batch")
+	}
+}
+
+func TestPreVoteKeepsBallotOfPartitionedNode(t *testing.T) {
+	r, n := newTestReplica(paxi.NewID(1, 3))
+	r.HeartbeatInterval = 10 * time.Millisecond
+	r.ElectionTimeout = 100 * time.Millisecond
+	leader := paxi.NewID(1, 1)
+	b := testBallot(1, leader)
+	r.HandleHeartbeat(Heartbeat{Ballot: b})
+	r.ballot = b
+
+	// the partitioned node keeps timing out, but its pre-votes are never answered
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		r.CheckElection(now)
+	}
+	preVotes := 0
+	for _, s := range n.take() {
+		switch m := s.m.(type) {
+		case PreVote:
+			preVotes++
+		case RoutedMsg:
+			t.Errorf("expect no phase 1 without a pre-vote quorum, got %v", m)
+		}
+	}
+	if preVotes != 5*(len(paxi.GetConfig().Voters())-1) {
+		t.Errorf("expect a pre-vote to every other voter on each timeout, got %d", preVotes)
+	}
+	if r.Ballot() != b {
+		t.Fatalf("expect ballot %v to stay on the partitioned node, got %v", b, r.Ballot())
+	}
+
+	// a follower that hears from the leader does not grant the pre-vote and keeps its ballot
+	f, fn := newTestReplica(paxi.NewID(1, 2))
+	f.HeartbeatInterval = r.HeartbeatInterval
+	f.ElectionTimeout = r.ElectionTimeout
+	f.HandleHeartbeat(Heartbeat{Ballot: b})
+	f.ballot = b
+	f.HandlePreVote(PreVote{Ballot: r.preVoteBallot})
+	for _, s := range fn.take() {
+		if m, ok := s.m.(PreVoteReply); !ok || m.Granted {
+			t.Errorf("expect pre-vote to be refused while the leader is alive, got %v", s.m)
+		}
+	}
+	if f.Ballot() != b {
+		t.Errorf("expect ballot %v to stay on the follower, got %v", b, f.Ballot())
+	}
+
+	// phase 1 with a new ballot starts only once a quorum granted the pre-vote
+	for _, id := range []paxi.ID{paxi.NewID(1, 4), paxi.NewID(1, 5), paxi.NewID(1, 6)} {
+		r.HandlePreVoteReply(PreVoteReply{Ballot: r.preVoteBallot, ID: id, Granted: true})
+	}
+	if r.Ballot() <= b || r.Ballot().ID() != r.ID() {
+		t.Errorf("expect phase 1 with a ballot of %v after the pre-vote, got %v", r.ID(), r.Ballot())
+	}
+}
+
+func TestLeaderTransferWithLease(t *testing.T) {
+	leader, ln := newTestReplica(paxi.NewID(1, 1))
+	follower, fn := newTestReplica(paxi.NewID(1, 2))
+	target, tn := newTestReplica(paxi.NewID(1, 3))
+	b := testBallot(1, leader.ID())
+	lead(leader, b)
+	for _, r := range []*Replica{leader, follower, target} {
+		r.LeaseDuration = time.Second
+	}
+	// every node granted the lease with the accept of slot 0
+	leader.P2a([]*paxi.Request{{Command: paxi.Command{Key: "k", Value: []byte("v")}}})
+	p2a := P2a{Ballot: b, Slot: leader.slot, Commands: leader.log[leader.slot].Commands}
+	follower.HandleP2a(p2a, leader.ID())
+	target.HandleP2a(p2a, leader.ID())
+	fn.take()
+	tn.take()
+
+	leader.HandleLeaderTransfer(paxi.LeaderTransfer{To: target.ID()})
+	if leader.active || leader.HasLease() {
+		t.Fatal("expect leader to stop proposing and serving reads")
+	}
+	if leader.leaseGranted(target.ID()) {
+		t.Error("expect leader to release the lease it granted itself")
+	}
+	var release *RoutedMsg
+	var transfer *Transfer
+	for _, s := range ln.take() {
+		switch m := s.m.(type) {
+		case RoutedMsg:
+			if p3, ok := m.Payload.(P3); ok && p3.Release && p3.Ballot == b {
+				release = &m
+			}
+		case Transfer:
+			if s.to == target.ID() {
+				transfer = &m
+			}
+		}
+	}
+	if release == nil || transfer == nil {
+		t.Fatalf("expect followers to be told to release the lease and slots handed over to the target, got %v %v", release, transfer)
+	}
+
+	// the follower still holds its grant until it hears of the release
+	candidate := testBallot(2, target.ID())
+	follower.HandleP1a(P1a{Ballot: candidate}, target.ID())
+	if replies := p1bs(fn.take(), target.ID()); len(replies) != 1 || replies[0].Ballot != b {
+		t.Errorf("expect target to be rejected before the release, got %v", replies)
+	}
+	follower.HandleMsg(*release)
+	fn.take()
+
+	// the target runs phase 1 and every node promises it before the grants expire
+	target.HandleMsg(*transfer)
+	if target.Ballot() <= b || target.Ballot().ID() != target.ID() {
+		t.Fatalf("expect target to run phase 1 with its ballot, got %v", target.Ballot())
+	}
+	for _, r := range []*Replica{leader, follower} {
+		n := r.Node.(*testNode)
+		r.HandleP1a(P1a{Ballot: target.Ballot()}, target.ID())
+		if replies := p1bs(n.take(), target.ID()); len(replies) != 1 || replies[0].Ballot != target.Ballot() {
+			t.Errorf("expect %v to promise %v after the transfer, got %v", r.ID(), target.Ballot(), replies)
+		}
+	}
+}
+
+func TestPlacementSkipsDeadPreferredNode(t *testing.T) {
+	r, n := newTestReplica(paxi.NewID(1, 2))
+	preferred := paxi.NewID(1, 1)
+	b := testBallot(1, r.ID())
+	lead(r, b)
+	healthy := func(id paxi.ID) bool { return paxi.IsConnected(r, id) }
+	now := time.Now()
+	check := func() []paxi.LeaderTransfer {
+		now = now.Add(paxi.LeaderPlacementInterval)
+		r.CheckPlacement(now, healthy)
+		transfers := make([]paxi.LeaderTransfer, 0)
+		for _, s := range n.take() {
+			if m, ok := s.m.(paxi.LeaderTransfer); ok {
+				transfers = append(transfers, m)
+			}
+		}
+		return transfers
+	}
+
+	// the preferred node was never dialed and never replied, it may be down
+	n.idle[preferred] = true
+	if transfers := check(); len(transfers) != 0 {
+		t.Fatalf("expect no transfer to a node that was never connected, got %v", transfers)
+	}
+	delete(n.idle, preferred)
+	if transfers := check(); len(transfers) != 0 {
+		t.Fatalf("expect no transfer to a node that never replied, got %v", transfers)
+	}
+
+	// the preferred node votes, leadership moves to it from the handler of the leader
+	r.logLck.Lock()
+	r.log[0] = &paxi.Entry{Ballot: b, Quorum: paxi.NewQuorum()}
+	r.logLck.Unlock()
+	r.HandleP2b(0, b, []paxi.ID{preferred})
+	transfers := check()
+	if len(transfers) != 1 || transfers[0].To != preferred {
+		t.Fatalf("expect transfer to %v, got %v", preferred, transfers)
+	}
+	if !r.active {
+		t.Fatal("expect transfer not to be handled on the ticker")
+	}
+	r.HandleMsg(transfers[0])
+	if r.active {
+		t.Error("expect leader to hand leadership over")
+	}
+
+	// a preferred node that stopped replying is not picked again
+	lead(r, b)
+	r.handover.Stop()
+	now = now.Add(paxi.LeaderPlacementLiveness)
+	if transfers := check(); len(transfers) != 0 {
+		t.Errorf("expect no transfer to a node that stopped replying, got %v", transfers)
+	}
+}
+
+func TestPromiseNotDurable(t *testing.T) {
+	r, n := newTestReplica(paxi.NewID(1, 2))
+	wal := r.WAL()
+	n.wal = failingWAL{wal}
+	candidate := paxi.NewID(1, 3)
+	b := testBallot(1, candidate)
+
+	// neither the first P1a nor its retry is promised while the ballot cannot be persisted
+	for i := 0; i < 2; i++ {
+		r.HandleP1a(P1a{Ballot: b}, candidate)
+		if replies := p1bs(n.take(), candidate); len(replies) != 0 {
+			t.Fatalf("expect no P1b on a promise that is not durable, got %v", replies)
+		}
+		if r.Ballot() != 0 {
+			t.Fatalf("expect ballot not to change, got %v", r.Ballot())
+		}
+	}
+
+	n.wal = nil
+	r.HandleP1a(P1a{Ballot: b}, candidate)
+	if replies := p1bs(n.take(), candidate); len(replies) != 1 || replies[0].Ballot != b || r.Ballot() != b {
+		t.Errorf("expect %v to be promised once it is durable, got %v", b, replies)
+	}
+}
+
+func TestRegroupWithFewerVotersThanGroups(t *testing.T) {
+	*pg = 4
+	defer func() { *pg = 1 }()
+	r, n := newTestReplica(paxi.NewID(1, 1))
+	lead(r, testBallot(1, r.ID()))
+	removed := []paxi.ID{paxi.NewID(1, 4), paxi.NewID(1, 5), paxi.NewID(1, 6)}
+	for _, id := range removed {
+		c := paxi.GetConfig()
+		addr, http := c.Addrs[id], c.HTTPAddrs[id]
+		if err := paxi.Reconfigure(paxi.Reconfig{Op: paxi.RemoveNode, ID: id}); err != nil {
+			t.Fatal(err)
+		}
+		defer paxi.Reconfigure(paxi.Reconfig{Op: paxi.AddNode, ID: id, Addr: addr, HTTPAddr: http})
+		r.regroup(r.execute + 1)
+	}
+
+	// three voters are left for four groups, every group has a node
+	l := r.latestLayout()
+	if len(l.groups) != 3 {
+		t.Fatalf("expect a group for each of three voters, got %v", l)
+	}
+	for _, g := range l.groups {
+		if g == nil || len(g.nodes) != 1 {
+			t.Fatalf("expect groups of one node, got %v", l)
+		}
+	}
+	r.Broadcast(Heartbeat{Ballot: r.ballot})
+	if sent := n.take(); len(sent) != 2 {
+		t.Errorf("expect heartbeat to the two other voters, got %v", sent)
+	}
+	if groups := r.peersToGroups(2, nil); len(groups) != 0 {
+		t.Errorf("expect no groups without nodes, got %v", groups)
+	}
+
+	// replies of a relay that is not in the layout are not credited to any group
+	r.logLck.Lock()
+	r.log[1] = &paxi.Entry{Ballot: r.ballot, Quorum: paxi.NewQuorum()}
+	r.logLck.Unlock()
+	r.handleP2bAggregated(P2bAggregated{RelayID: removed[0], Ballot: r.ballot, Slot: 1, Layout: l.slot})
+	if r.log[1].Quorum.Size() != 0 {
+		t.Errorf("expect no votes from relay %v outside the layout", removed[0])
 	}
 }
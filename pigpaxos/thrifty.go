@@ -0,0 +1,83 @@
+package pigpaxos
+
+import (
+	"sort"
+	"time"
+
+	"pigpaxos"
+	"pigpaxos/log"
+)
+
+// fastestGroups returns indexes of the relay groups of layout with the shortest round trip that together with
+// the leader make a phase-2 quorum. A group is as fast as its slowest node, groups never measured come first
+func (r *Replica) fastestGroups(layout *relayLayout) []int {
+	latency := make([]float64, len(layout.groups))
+	groups := make([]int, len(layout.groups))
+	for i, pg := range layout.groups {
+		groups[i] = i
+		for _, id := range pg.nodes {
+			if l, _ := r.roundTrip.Get(id); id != r.ID() && l > latency[i] {
+				latency[i] = l
+			}
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return latency[groups[i]] < latency[groups[j]] })
+
+	quorum := paxi.NewQuorum()
+	quorum.ACK(r.ID())
+	for i, g := range groups {
+		if r.Q2(quorum) {
+			return groups[:i]
+		}
+		for _, id := range layout.groups[g].nodes {
+			quorum.ACK(id)
+		}
+	}
+	return groups
+}
+
+// sendThrifty routes P2a only through the fastest relay groups that make a phase-2 quorum.
+// If the slot is not committed within the thrifty timeout, P2a is sent to every group and
+// nodes of the chosen groups that did not answer are penalized, so the next groups avoid them
+func (r *Replica) sendThrifty(m P2a) {
+	layout := r.layout(m.Slot)
+	groups := r.fastestGroups(layout)
+	if len(groups) == len(layout.groups) {
+		r.Broadcast(m)
+		return
+	}
+	r.thrifty.Sent()
+	r.relay(m, layout, groups)
+	ids := make([]paxi.ID, 0)
+	for _, g := range groups {
+		ids = append(ids, layout.groups[g].nodes...)
+	}
+	sent := time.Now()
+	time.AfterFunc(paxi.ThriftyTimeout(), func() {
+		r.logLck.RLock()
+		e, exists := r.log[m.Slot]
+		done := !exists || e.Commit || e.Ballot != m.Ballot
+		r.logLck.RUnlock()
+		if done {
+			return
+		}
+		log.Debugf("Node %v sends P2a of slot %d to every group after thrifty groups %v timed out", r.ID(), m.Slot, groups)
+		r.thrifty.Fallback()
+		r.roundTrip.Penalize(ids, sent, paxi.ThriftyTimeout())
+		r.Broadcast(m)
+	})
+}
+
+// sampleRoundTrip records how long voters of slot took to answer P2a through their relays
+func (r *Replica) sampleRoundTrip(slot int, ids []paxi.ID) {
+	r.logLck.RLock()
+	e, exists := r.log[slot]
+	r.logLck.RUnlock()
+	if !exists || e.Timestamp.IsZero() {
+		return
+	}
+	d := time.Since(e.Timestamp)
+	for _, id := range ids {
+		r.roundTrip.Add(id, d)
+	}
+}
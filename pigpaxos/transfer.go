@@ -0,0 +1,69 @@
+package pigpaxos
+
+import (
+	"time"
+
+	"pigpaxos"
+	"pigpaxos/log"
+)
+
+// HandleLeaderTransfer makes the leader stop proposing and hand its uncommitted slots over to m.To.
+// The leader no longer serves reads, so it drops its lease and tells followers to release their grants,
+// otherwise they reject phase 1 of the target until the grants expire. Other nodes pass the request on
+// to the leader they know
+func (p *PigPaxos) HandleLeaderTransfer(m paxi.LeaderTransfer) {
+	switch p.handover.Decide(m, p.ballot, p.active) {
+	case paxi.HandoverForward:
+		p.Send(p.ballot.ID(), m)
+	case paxi.HandoverElect:
+		p.P1a()
+	case paxi.HandoverStart:
+		p.active = false
+		// requests of the pending batch wait with other requests for the new leader
+		p.batchLock.Lock()
+		p.requests = append(p.requests, p.takeBatch()...)
+		p.batchLock.Unlock()
+		l := make(map[int]CommandBallot)
+		p.logLck.RLock()
+		for s := p.execute; s <= p.slot; s++ {
+			if p.log[s] == nil || p.log[s].Commit {
+				continue
+			}
+			l[s] = CommandBallot{p.log[s].Commands, p.log[s].Ballot}
+		}
+		p.logLck.RUnlock()
+		p.releaseLease(p.ballot)
+		p.Broadcast(P3{Ballot: p.ballot, Release: true})
+		log.Debugf("Node %v hands %d slots over to %v", p.ID(), len(l), m.To)
+		p.Send(m.To, Transfer{Ballot: p.ballot, Log: l, Zone: m.Zone})
+	}
+}
+
+// HandleTransfer takes over slots of the leader that gave up leadership and starts phase 1 with a higher ballot.
+// The leader no longer serves reads, so the lease this node granted to it is released. Followers release
+// theirs on the P3 of the leader, the ones it did not reach yet reject the new ballot and phase 1 is retried on timeout
+func (p *PigPaxos) HandleTransfer(m Transfer) {
+	log.Debugf("Replica %s ===[%v]===>>> Replica %s\n", m.Ballot.ID(), m, p.ID())
+	if m.Ballot < p.ballot || p.active {
+		return
+	}
+	p.update(m.Log)
+	p.handover.TakeOver(m.Zone)
+	p.releaseLease(m.Ballot)
+	p.P1a()
+}
+
+// CheckTransfer runs phase 1 again if the target of a leadership transfer did not take over in time
+func (p *PigPaxos) CheckTransfer(now time.Time) {
+	if p.handover.Expired(p.ballot, p.active, now) {
+		p.P1a()
+	}
+}
+
+// CheckPlacement hands leadership over to a healthy node that should lead instead of this leader.
+// It runs on the ticker, so the transfer is handled with other messages of this node
+func (p *PigPaxos) CheckPlacement(now time.Time, healthy func(paxi.ID) bool) {
+	if m := p.handover.Next(p.active, now, healthy); m.To != 0 {
+		p.Enqueue(m)
+	}
+}
@@ -0,0 +1,170 @@
+package pigpaxos
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"pigpaxos"
+	"pigpaxos/log"
+)
+
+// parseFanout reads per-level relay fan-out from a comma separated list
+func parseFanout(s string) []int {
+	fanout := make([]int, 0)
+	if s == "" {
+		return fanout
+	}
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n < 1 {
+			log.Fatalf("invalid relay fan-out %q", s)
+		}
+		fanout = append(fanout, n)
+	}
+	return fanout
+}
+
+// fanoutAt returns number of child relays of a relay at the given level of the tree.
+// Relays at level 1 are the ones picked by the leader
+func (r *Replica) fanoutAt(level int) int {
+	if level-1 < len(r.fanout) {
+		return r.fanout[level-1]
+	}
+	return DefaultFanout
+}
+
+// relayTimeout is how long relay at the given level waits for replies before relaying what it has.
+// Deeper relays time out earlier, so partial replies reach their parents before the parents time out
+func (r *Replica) relayTimeout(level int) time.Duration {
+	timeout := time.Duration(*stdPigTimeout) * time.Millisecond
+	return timeout * time.Duration(int(r.maxDepth)-level) / time.Duration(r.maxDepth-1)
+}
+
+// relayGroup returns nodes relay of m collects replies from, including the relay itself.
+// Relays at level 1 serve their group in the relay layout, deeper relays serve the group their parent assigned
+func (r *Replica) relayGroup(m *RoutedMsg) []paxi.ID {
+	if len(m.Group) > 0 {
+		return m.Group
+	}
+	layout := r.layout(m.Layout)
+	return layout.groups[layout.myGroup].nodes
+}
+
+// expectedReplies is the number of replies relay of m waits for: every node of its group except the ones
+// on the path from the leader, as they do not get the message from this relay
+func (r *Replica) expectedReplies(m *RoutedMsg) int {
+	n := 0
+	for _, id := range r.relayGroup(m) {
+		if !onPath(id, m.Hops) {
+			n++
+		}
+	}
+	return n
+}
+
+func onPath(id paxi.ID, hops []paxi.ID) bool {
+	for _, hop := range hops {
+		if hop == id {
+			return true
+		}
+	}
+	return false
+}
+
+// childGroups splits the group of relay at the given level into subgroups served by relays of the next level
+func (r *Replica) childGroups(m *RoutedMsg, level int) []*PeerGroup {
+	nodes := make([]paxi.ID, 0)
+	for _, id := range r.relayGroup(m) {
+		if id != r.ID() && !onPath(id, m.Hops) {
+			nodes = append(nodes, id)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	n := r.fanoutAt(level)
+	if n > len(nodes) {
+		n = len(nodes)
+	}
+	return r.peersToGroups(n, nodes)
+}
+
+// pickRelay returns random node of the group that is not known to be down
+func (r *Replica) pickRelay(pg *PeerGroup) paxi.ID {
+	for _, i := range rand.Perm(len(pg.nodes)) {
+		if r.reachable(pg.nodes[i]) {
+			return pg.nodes[i]
+		}
+	}
+	return pg.nodes[rand.Intn(len(pg.nodes))]
+}
+
+// forwardToChildren relays m to one node of every child group, recording which group each child relay serves
+func (r *Replica) forwardToChildren(m RoutedMsg, children []*PeerGroup) {
+	p2a, isP2a := m.Payload.(P2a)
+	for _, pg := range children {
+		child := r.pickRelay(pg)
+		if isP2a {
+			r.Lock()
+			if groups, exists := r.p2bChildGroups[p2a.Slot]; exists {
+				groups[child] = pg.nodes
+			}
+			r.Unlock()
+		}
+		m.Group = pg.nodes
+		log.Debugf("Node %v forwards msg %v to child relay %v of group %v", r.ID(), m, child, pg)
+		r.Send(child, m)
+	}
+}
+
+// p2bRelayReply builds reply with votes collected for a relayed P2a, which is sent one level up the tree.
+// Should be called with r locked
+func (r *Replica) p2bRelayReply(routedP2b *RoutedMsg) interface{} {
+	p2b := routedP2b.Payload.(P2b)
+	if !*useSmallP2b {
+		if routedP2b.Progress == 0 {
+			return p2b
+		}
+		routedP2b.IsForward = false
+		return routedP2b
+	}
+	var missingIds []paxi.ID
+	if r.relaySlack > 0 || len(p2b.ID) < r.expectedReplies(routedP2b) {
+		missingIds = r.computeMissingIDsForP2b(p2b, r.relayGroup(routedP2b))
+	} else {
+		missingIds = make([]paxi.ID, 0)
+	}
+	return P2bAggregated{
+		Ballot:           p2b.Ballot,
+		Slot:             p2b.Slot,
+		RelayLastExecute: r.execute - 1,
+		MissingIDs:       missingIds,
+		RelayID:          r.ID(),
+		Layout:           routedP2b.Layout,
+		Delays:           r.p2bDelaysBySlot[p2b.Slot],
+	}
+}
+
+// handleP2bAggregatedRelay turns compact reply of a child relay back into votes of its group
+func (r *Replica) handleP2bAggregatedRelay(m P2bAggregated) {
+	r.RLock()
+	group, exists := r.p2bChildGroups[m.Slot][m.RelayID]
+	r.RUnlock()
+	if !exists {
+		log.Debugf("Node %v has no child relay %v for slot %d. It may have already been replied", r.ID(), m.RelayID, m.Slot)
+		return
+	}
+	missing := make(map[paxi.ID]bool, len(m.MissingIDs))
+	for _, id := range m.MissingIDs {
+		missing[id] = true
+	}
+	ids := make([]paxi.ID, 0, len(group))
+	for _, id := range group {
+		if !missing[id] {
+			ids = append(ids, id)
+		}
+	}
+	r.handleP2bRelay(P2b{Ballot: m.Ballot, Slot: m.Slot, ID: ids})
+}
@@ -0,0 +1,35 @@
+package pigpaxos
+
+import (
+	"pigpaxos"
+	"pigpaxos/log"
+)
+
+// handOff adds committed slots to promise log l that this witness still holds commands of, because some node
+// may not have executed them yet. A new leader proposes them again, so a data replica that missed them
+// recovers them from the leader even if the witness is the only other node that accepted them.
+// Should be called with logLck held
+func (p *PigPaxos) handOff(l map[int]CommandBallot) {
+	for s := p.lastCleanupMarker; s < p.execute; s++ {
+		if e, exists := p.log[s]; exists && e.Ballot != 0 && !e.Compacted() {
+			l[s] = CommandBallot{e.Commands, e.Ballot}
+		}
+	}
+}
+
+// compact drops commands of slots below marker that every node executed, so the witness keeps only their
+// ballots and hashes. The hashes are dropped too once a snapshot without state machine covers them.
+// Should be called with logLck held
+func (p *PigPaxos) compact(marker int) {
+	marker = paxi.Max(p.lastCleanupMarker, marker)
+	s, err := paxi.CompactWitnessLog(p.WAL(), p.ballot, p.log, p.snapshot, p.lastCleanupMarker, marker, p.slot)
+	p.lastCleanupMarker = marker
+	if err != nil {
+		log.Errorf("Witness %v cannot compact write-ahead log: %v", p.ID(), err)
+		return
+	}
+	if s != nil {
+		p.snapshot = s
+		log.Debugf("Witness %v dropped hashes up to slot %d", p.ID(), s.Slot)
+	}
+}
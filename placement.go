@@ -0,0 +1,115 @@
+package paxi
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// LeaderPlacementInterval is how often the leader checks whether another node should lead
+const LeaderPlacementInterval = time.Second
+
+// LeaderPlacementLiveness is how recently a node must have replied to the leader to take leadership over
+const LeaderPlacementLiveness = 3 * LeaderPlacementInterval
+
+// LeaderPlacement decides whether the leader should hand leadership over to another node.
+// With Config.LeaderAffinity, Policy picks the zone that issues most requests and a node of that zone should lead,
+// the first healthy one of Config.LeaderPreference in the zone if any. Without a zone the first healthy node
+// of Config.LeaderPreference should lead
+type LeaderPlacement struct {
+	sync.Mutex
+	self   ID
+	policy Policy
+	zone   int // zone chosen by policy, 0 if none
+}
+
+// NewLeaderPlacement creates leader placement of node id
+func NewLeaderPlacement(id ID) *LeaderPlacement {
+	l := &LeaderPlacement{self: id}
+	if config.LeaderAffinity {
+		l.policy = NewPolicy()
+	}
+	return l
+}
+
+// Hit records a request that a client sent to node id
+func (l *LeaderPlacement) Hit(id ID) {
+	if l.policy == nil || id == 0 {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if to := l.policy.Hit(id); to != 0 {
+		l.zone = to.Zone()
+	}
+}
+
+// Zone returns the zone chosen by policy, 0 if none
+func (l *LeaderPlacement) Zone() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.zone
+}
+
+// Follow makes this node lead from zone the previous leader chose, so it keeps leadership in that zone
+// until its own requests pick another one
+func (l *LeaderPlacement) Follow(zone int) {
+	l.Lock()
+	defer l.Unlock()
+	l.zone = zone
+}
+
+// Next returns the node this leader should hand leadership over to, or 0 if it should keep leading
+func (l *LeaderPlacement) Next(healthy func(ID) bool) ID {
+	return l.next(l.Zone(), healthy)
+}
+
+// next returns the node that should lead from zone instead of this node, or 0 if it should keep leading
+func (l *LeaderPlacement) next(zone int, healthy func(ID) bool) ID {
+	for _, id := range leaderOrder(zone) {
+		if id == l.self {
+			return 0
+		}
+		if healthy(id) {
+			return id
+		}
+	}
+	return 0
+}
+
+// leaderOrder returns nodes in the order they should lead. If zone is not 0 only nodes of the zone are
+// returned, those without preference follow the preferred ones ordered by id. Learners and witnesses never lead
+func leaderOrder(zone int) []ID {
+	c := GetConfig()
+	ids := make([]ID, 0, len(c.lp))
+	listed := make(map[ID]bool)
+	for _, id := range c.lp {
+		if listed[id] || (zone != 0 && id.Zone() != zone) {
+			continue
+		}
+		listed[id] = true
+		ids = append(ids, id)
+	}
+	if zone == 0 {
+		return ids
+	}
+	rest := make([]ID, 0)
+	for _, id := range c.Voters() {
+		if id.Zone() == zone && !listed[id] && !c.wn[id] {
+			rest = append(rest, id)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i] < rest[j] })
+	return append(ids, rest...)
+}
+
+// Reachable returns false if the connection of socket s to node id is down. Nodes that were not dialed yet are reachable
+func Reachable(s Socket, id ID) bool {
+	state := s.PeerState(id)
+	return state != Disconnected && state != Closed
+}
+
+// IsConnected returns true only if socket s has an established connection to node id
+func IsConnected(s Socket, id ID) bool {
+	return s.PeerState(id) == Connected
+}
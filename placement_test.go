@@ -0,0 +1,49 @@
+package paxi
+
+import "testing"
+
+func TestLeaderPlacement(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = MakeDefaultConfig()
+	for z := 1; z <= 2; z++ {
+		for i := 1; i <= 3; i++ {
+			config.Addrs[NewID(z, i)] = "tcp://127.0.0.1:1735"
+		}
+	}
+	config.LeaderPreference = []string{"2.2", "1.3", "9.9"}
+	config.count()
+
+	down := map[ID]bool{}
+	healthy := func(id ID) bool { return !down[id] }
+	l := NewLeaderPlacement(NewID(1, 1))
+	if to := l.Next(healthy); to != NewID(2, 2) {
+		t.Errorf("expect leadership to move to 2.2, got %v", to)
+	}
+	down[NewID(2, 2)] = true
+	if to := l.Next(healthy); to != NewID(1, 3) {
+		t.Errorf("expect leadership to move to 1.3 while 2.2 is down, got %v", to)
+	}
+	if to := NewLeaderPlacement(NewID(1, 3)).Next(healthy); to != 0 {
+		t.Errorf("expect 1.3 to keep leading while 2.2 is down, got %v", to)
+	}
+
+	// three consecutive requests from zone 1 move leadership to the preferred node of zone 1
+	config.LeaderAffinity = true
+	config.Policy = "consecutive"
+	config.Threshold = 3
+	down = map[ID]bool{}
+	l = NewLeaderPlacement(NewID(2, 2))
+	for i := 0; i < 3; i++ {
+		if to := l.Next(healthy); to != 0 {
+			t.Fatalf("expect preferred 2.2 to keep leading, got %v", to)
+		}
+		l.Hit(NewID(1, 2))
+	}
+	if to := l.Next(healthy); to != NewID(1, 3) {
+		t.Errorf("expect leadership to move to zone 1, got %v", to)
+	}
+	if to := NewLeaderPlacement(NewID(1, 1)).Next(healthy); to != NewID(2, 2) {
+		t.Errorf("expect new placement without requests to prefer 2.2, got %v", to)
+	}
+}
@@ -1,11 +1,22 @@
 package paxi
 
+import (
+	"fmt"
+
+	"pigpaxos/log"
+)
+
 // Quorum records each acknowledgement and check for different types of quorum satisfied
 type Quorum struct {
-	size  int
-	acks  map[ID]bool
-	zones map[int]int
-	nacks map[ID]bool
+	size   int
+	weight int // total weight of acks
+	acks   map[ID]bool
+	zones  map[int]int
+	nacks  map[ID]bool
+
+	// membership acks are counted against, fixed until Reset so a concurrent reconfiguration
+	// cannot change quorum sizes in the middle of a phase
+	config *Config
 }
 
 // NewQuorum returns a new Quorum
@@ -15,14 +26,20 @@ func NewQuorum() *Quorum {
 		acks:  make(map[ID]bool),
 		zones: make(map[int]int),
 	}
+	q.config = currentConfig()
 	return q
 }
 
-// ACK adds id to quorum ack records
+// ACK adds id to quorum ack records. Acks of learners are ignored, they do not vote, and so are acks
+// of nodes that are not members of the configuration, like a removed node that replies late
 func (q *Quorum) ACK(id ID) {
+	if _, member := q.config.Addrs[id]; !member || q.config.ln[id] {
+		return
+	}
 	if !q.acks[id] {
 		q.acks[id] = true
 		q.size++
+		q.weight += q.config.wpn[id]
 		q.zones[id.Zone()]++
 	}
 }
@@ -34,9 +51,10 @@ func (q *Quorum) NACK(id ID) {
 	}
 }
 
-// ADD increase ack size by one
+// ADD increase ack size and weight by one
 func (q *Quorum) ADD() {
 	q.size++
+	q.weight++
 }
 
 // Size returns current ack size
@@ -44,41 +62,70 @@ func (q *Quorum) Size() int {
 	return q.size
 }
 
+// Weight returns current ack weight
+func (q *Quorum) Weight() int {
+	return q.weight
+}
+
 // Reset resets the quorum to empty
 func (q *Quorum) Reset() {
 	q.size = 0
+	q.weight = 0
 	q.acks = make(map[ID]bool)
 	q.zones = make(map[int]int)
 	q.nacks = make(map[ID]bool)
+	q.config = currentConfig()
+}
+
+// currentConfig returns a copy of the global configuration. Reconfigure rebuilds the membership maps
+// instead of changing them, so the copy is not affected by later membership changes
+func currentConfig() *Config {
+	c := GetConfig()
+	return &c
 }
 
 func (q *Quorum) All() bool {
-	return q.size == config.n
+	return q.size == q.config.n
 }
 
 // Majority quorum satisfied
 func (q *Quorum) Majority() bool {
-	return q.size > config.n/2
+	return q.size > q.config.n/2
+}
+
+// WeightedMajority returns true if acks hold more than half of the total weight
+func (q *Quorum) WeightedMajority() bool {
+	return q.weight*2 > q.config.w
+}
+
+// WeightedQ1 is flexible weighted quorum for phase 1 with weight at least w
+func (q *Quorum) WeightedQ1(w int) bool {
+	return q.weight >= w
+}
+
+// WeightedQ2 is flexible weighted quorum for phase 2 with weight at least w
+func (q *Quorum) WeightedQ2(w int) bool {
+	return q.weight >= w
 }
 
 func (q *Quorum) LayerMajority() bool {
-	return q.size > config.n/4
+	return q.size > q.config.n/4
 }
 
 // FastQuorum from fast paxos
 func (q *Quorum) FastQuorum() bool {
-	return q.size >= config.n*3/4
+	return q.size >= q.config.n*3/4
 }
 
 // AllZones returns true if there is at one ack from each zone
 func (q *Quorum) AllZones() bool {
-	return len(q.zones) == config.z
+	return len(q.zones) == q.config.z
 }
 
 // ZoneMajority returns true if majority quorum satisfied in any zone
 func (q *Quorum) ZoneMajority() bool {
 	for z, n := range q.zones {
-		if n > config.npz[z]/2 {
+		if n > q.config.npz[z]/2 {
 			return true
 		}
 	}
@@ -93,7 +140,7 @@ func (q *Quorum) GridRow() bool {
 // GridColumn == all nodes in one zone
 func (q *Quorum) GridColumn() bool {
 	for z, n := range q.zones {
-		if n == config.npz[z] {
+		if n == q.config.npz[z] {
 			return true
 		}
 	}
@@ -104,60 +151,126 @@ func (q *Quorum) GridColumn() bool {
 func (q *Quorum) FGridQ1(Fz int) bool {
 	zone := 0
 	for z, n := range q.zones {
-		if n > config.npz[z]/2 {
+		if n > q.config.npz[z]/2 {
 			zone++
 		}
 	}
-	return zone >= config.z-Fz
+	return zone >= q.config.z-Fz
 }
 
 // FGridQ2 is flexible grid quorum for phase 2
 func (q *Quorum) FGridQ2(Fz int) bool {
 	zone := 0
 	for z, n := range q.zones {
-		if n > config.npz[z]/2 {
+		if n > q.config.npz[z]/2 {
 			zone++
 		}
 	}
 	return zone >= Fz+1
 }
 
-/*
-// Q1 returns true if config.Quorum type is satisfied
+// Q1 returns true if phase-1 quorum of config.Quorum type is satisfied
 func (q *Quorum) Q1() bool {
-	switch config.Quorum {
-	case "majority":
+	switch q.config.Quorum.Type {
+	case "", "majority":
 		return q.Majority()
 	case "grid":
 		return q.GridRow()
 	case "fgrid":
-		return q.FGridQ1()
+		return q.FGridQ1(q.config.Quorum.Fz)
 	case "group":
 		return q.ZoneMajority()
 	case "count":
-		return q.size >= config.n-config.F
+		return q.size >= q.config.n-q.config.Quorum.F
+	case "size":
+		return q.size >= q.config.Quorum.Q1
+	case "weighted":
+		return q.WeightedMajority()
+	case "fweighted":
+		return q.WeightedQ1(q.config.Quorum.Q1)
 	default:
 		log.Error("Unknown quorum type")
 		return false
 	}
 }
 
-// Q2 returns true if config.Quorum type is satisfied
+// Q2 returns true if phase-2 quorum of config.Quorum type is satisfied
 func (q *Quorum) Q2() bool {
-	switch config.Quorum {
-	case "majority":
+	switch q.config.Quorum.Type {
+	case "", "majority":
 		return q.Majority()
 	case "grid":
 		return q.GridColumn()
 	case "fgrid":
-		return q.FGridQ2()
+		return q.FGridQ2(q.config.Quorum.Fz)
 	case "group":
 		return q.ZoneMajority()
 	case "count":
-		return q.size > config.F
+		return q.size > q.config.Quorum.F
+	case "size":
+		return q.size >= q.config.Quorum.Q2
+	case "weighted":
+		return q.WeightedMajority()
+	case "fweighted":
+		return q.WeightedQ2(q.config.Quorum.Q2)
 	default:
 		log.Error("Unknown quorum type")
 		return false
 	}
 }
-*/
+
+// QuorumConfig selects phase-1 and phase-2 quorums of the protocols
+type QuorumConfig struct {
+	Type string `json:"type"` // majority, grid, fgrid, group, count, size, weighted or fweighted
+	Fz   int    `json:"fz"`   // zone failures tolerated by phase 2 of fgrid quorums
+	F    int    `json:"f"`    // node failures tolerated by phase 2 of count quorums
+	Q1   int    `json:"q1"`   // phase-1 quorum size of size quorums, or weight of fweighted quorums
+	Q2   int    `json:"q2"`   // phase-2 quorum size of size quorums, or weight of fweighted quorums
+}
+
+// validateQuorum returns an error if some phase-1 quorum of c does not intersect with some phase-2 quorum
+func (c Config) validateQuorum() error {
+	q := c.Quorum
+	for id, w := range c.wpn {
+		if w < 0 {
+			return fmt.Errorf("node %v has negative weight %d", id, w)
+		}
+	}
+	switch q.Type {
+	case "", "majority", "grid":
+		return nil
+	case "fgrid":
+		if q.Fz < 0 || q.Fz >= c.z {
+			return fmt.Errorf("fgrid quorum needs 0 <= fz < %d zones, got fz=%d", c.z, q.Fz)
+		}
+	case "group":
+		if c.z > 1 {
+			return fmt.Errorf("group quorums in different zones of %d zones do not intersect", c.z)
+		}
+	case "count":
+		if q.F < 0 || q.F >= c.n {
+			return fmt.Errorf("count quorum needs 0 <= f < %d nodes, got f=%d", c.n, q.F)
+		}
+	case "size":
+		if q.Q1 < 1 || q.Q2 < 1 || q.Q1 > c.n || q.Q2 > c.n {
+			return fmt.Errorf("size quorums q1=%d q2=%d must be between 1 and %d nodes", q.Q1, q.Q2, c.n)
+		}
+		if q.Q1+q.Q2 <= c.n {
+			return fmt.Errorf("size quorums q1=%d q2=%d of %d nodes do not intersect", q.Q1, q.Q2, c.n)
+		}
+	case "weighted":
+		if c.w <= 0 {
+			return fmt.Errorf("weighted quorum needs positive total weight, got %d", c.w)
+		}
+	case "fweighted":
+		if q.Q1 < 1 || q.Q2 < 1 || q.Q1 > c.w || q.Q2 > c.w {
+			return fmt.Errorf("weighted quorums q1=%d q2=%d must be between 1 and total weight %d", q.Q1, q.Q2, c.w)
+		}
+		if q.Q1+q.Q2 <= c.w {
+			return fmt.Errorf("weighted quorums q1=%d q2=%d of total weight %d do not intersect", q.Q1, q.Q2, c.w)
+		}
+	default:
+		return fmt.Errorf("unknown quorum type %q", q.Type)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package paxi
+
+import "testing"
+
+func TestValidateQuorum(t *testing.T) {
+	c := MakeDefaultConfig()
+	for z := 1; z <= 3; z++ {
+		for i := 1; i <= 3; i++ {
+			c.Addrs[NewID(z, i)] = "tcp://127.0.0.1:1735"
+		}
+	}
+	c.count()
+
+	for _, test := range []struct {
+		quorum QuorumConfig
+		valid  bool
+	}{
+		{QuorumConfig{}, true},
+		{QuorumConfig{Type: "grid"}, true},
+		{QuorumConfig{Type: "fgrid", Fz: 1}, true},
+		{QuorumConfig{Type: "fgrid", Fz: 3}, false},
+		{QuorumConfig{Type: "group"}, false},
+		{QuorumConfig{Type: "count", F: 4}, true},
+		{QuorumConfig{Type: "count", F: 9}, false},
+		{QuorumConfig{Type: "size", Q1: 7, Q2: 3}, true},
+		{QuorumConfig{Type: "size", Q1: 6, Q2: 3}, false},
+		{QuorumConfig{Type: "unknown"}, false},
+	} {
+		c.Quorum = test.quorum
+		if err := c.validateQuorum(); (err == nil) != test.valid {
+			t.Errorf("quorum %+v should be valid=%v, got %v", test.quorum, test.valid, err)
+		}
+	}
+
+	// adding a node breaks intersection of size quorums q1=5 q2=5 of 9 nodes
+	c.Quorum = QuorumConfig{Type: "size", Q1: 5, Q2: 5}
+	if err := c.apply(Reconfig{Op: AddNode, ID: NewID(1, 4)}); err == nil || c.n != 9 {
+		t.Errorf("expect new node to be rejected, got %v with %d nodes", err, c.n)
+	}
+}
+
+func TestQuorumSize(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = MakeDefaultConfig()
+	for i := 1; i <= 5; i++ {
+		config.Addrs[NewID(1, i)] = "tcp://127.0.0.1:1735"
+	}
+	config.count()
+	config.Quorum = QuorumConfig{Type: "size", Q1: 4, Q2: 2}
+
+	q := NewQuorum()
+	q.ACK(NewID(1, 1))
+	q.ACK(NewID(1, 2))
+	if q.Q1() || !q.Q2() {
+		t.Error("expect 2 acks to satisfy phase 2 only")
+	}
+	q.ACK(NewID(1, 3))
+	q.ACK(NewID(1, 4))
+	if !q.Q1() {
+		t.Error("expect 4 acks to satisfy phase 1")
+	}
+}
+
+func TestWeightedQuorum(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = MakeDefaultConfig()
+	for i := 1; i <= 5; i++ {
+		config.Addrs[NewID(1, i)] = "tcp://127.0.0.1:1735"
+	}
+	config.Weights = map[string]int{"1.1": 3, "1.2": 2}
+	config.count()
+	if config.TotalWeight() != 8 {
+		t.Fatalf("expect total weight 8, got %d", config.TotalWeight())
+	}
+
+	config.Quorum = QuorumConfig{Type: "weighted"}
+	q := NewQuorum()
+	q.ACK(NewID(1, 3))
+	q.ACK(NewID(1, 4))
+	q.ACK(NewID(1, 5))
+	if q.Q2() {
+		t.Error("expect three light nodes not to be a weighted majority")
+	}
+	q.ACK(NewID(1, 2))
+	if !q.Q2() || q.Weight() != 5 {
+		t.Errorf("expect weight 5 to be a weighted majority, got %d", q.Weight())
+	}
+
+	config.Quorum = QuorumConfig{Type: "fweighted", Q1: 6, Q2: 3}
+	if err := config.validateQuorum(); err != nil {
+		t.Error(err)
+	}
+	q.Reset()
+	q.ACK(NewID(1, 1))
+	if q.Q1() || !q.Q2() {
+		t.Error("expect heavy node alone to satisfy phase 2 only")
+	}
+	config.Quorum.Q1 = 5
+	if err := config.validateQuorum(); err == nil {
+		t.Error("expect weighted quorums q1=5 q2=3 of weight 8 not to intersect")
+	}
+}
+
+func TestLearnerQuorum(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = MakeDefaultConfig()
+	for i := 1; i <= 3; i++ {
+		config.Addrs[NewID(1, i)] = "tcp://127.0.0.1:1735"
+		config.Addrs[NewID(2, i)] = "tcp://127.0.0.1:1735"
+	}
+	config.Learners = []string{"2.1", "2.2", "2.3"}
+	config.count()
+	if config.N() != 3 || config.Z() != 1 || len(config.Voters()) != 3 || !config.IsLearner(NewID(2, 1)) {
+		t.Fatalf("expect 3 voters in 1 zone, got %d in %d zones", config.N(), config.Z())
+	}
+
+	q := NewQuorum()
+	q.ACK(NewID(1, 1))
+	q.ACK(NewID(2, 1))
+	q.ACK(NewID(2, 2))
+	if q.Majority() || q.Size() != 1 {
+		t.Errorf("expect acks of learners not to count, got size %d", q.Size())
+	}
+	q.ACK(NewID(1, 2))
+	if !q.Majority() {
+		t.Error("expect 2 of 3 voters to be a majority")
+	}
+}
+
+func TestWitnessQuorum(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = MakeDefaultConfig()
+	for i := 1; i <= 3; i++ {
+		config.Addrs[NewID(1, i)] = "tcp://127.0.0.1:1735"
+	}
+	config.Witnesses = []string{"1.3"}
+	config.LeaderPreference = []string{"1.3", "1.2"}
+	config.count()
+	if config.N() != 3 || !config.IsWitness(NewID(1, 3)) {
+		t.Fatalf("expect witness to be one of 3 voters, got %d", config.N())
+	}
+
+	q := NewQuorum()
+	q.ACK(NewID(1, 1))
+	q.ACK(NewID(1, 3))
+	if !q.Majority() {
+		t.Error("expect ack of witness to count in majority")
+	}
+	if order := leaderOrder(1); len(order) != 2 || order[0] != NewID(1, 2) {
+		t.Errorf("expect witness never to lead, got leader order %v", order)
+	}
+}
+
+func TestQuorumReconfigure(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = MakeDefaultConfig()
+	for i := 1; i <= 3; i++ {
+		config.Addrs[NewID(1, i)] = "tcp://127.0.0.1:1735"
+	}
+	config.count()
+
+	q := NewQuorum()
+	for i := 4; i <= 5; i++ {
+		if err := Reconfigure(Reconfig{Op: AddNode, ID: NewID(1, i), Addr: "tcp://127.0.0.1:1735"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.ACK(NewID(1, 1))
+	q.ACK(NewID(1, 2))
+	if !q.Majority() {
+		t.Error("expect quorum to count against the 3 nodes it started with")
+	}
+	q.Reset()
+	q.ACK(NewID(1, 1))
+	q.ACK(NewID(1, 2))
+	if q.Majority() {
+		t.Error("expect 2 acks not to be a majority of 5 nodes after reset")
+	}
+
+	// a removed node that replies late does not count towards the new configuration
+	for i := 3; i <= 5; i++ {
+		if err := Reconfigure(Reconfig{Op: RemoveNode, ID: NewID(1, i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Reset()
+	q.ACK(NewID(1, 1))
+	q.ACK(NewID(1, 3))
+	q.ACK(NewID(9, 9))
+	if q.Size() != 1 || q.Majority() {
+		t.Errorf("expect only the ack of member 1.1 to count, got %d acks", q.Size())
+	}
+}
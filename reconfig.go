@@ -0,0 +1,120 @@
+package paxi
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"pigpaxos/log"
+)
+
+// ReconfigKey is the reserved key of membership change commands
+const ReconfigKey Key = "\x00reconfig"
+
+// ReconfigOp is the kind of membership change
+type ReconfigOp uint8
+
+const (
+	AddNode    ReconfigOp = iota + 1 // add new replica
+	RemoveNode                       // remove existing replica
+)
+
+// Reconfig is a membership change committed through the log as a command on ReconfigKey.
+// Replicas apply it when the command executes, so every replica switches to the new
+// configuration at the same slot. Protocols keep at most one change in flight (alpha = 1)
+type Reconfig struct {
+	Op       ReconfigOp
+	ID       ID
+	Addr     string // node address, only used by AddNode
+	HTTPAddr string // http address, only used by AddNode
+}
+
+func (r Reconfig) String() string {
+	if r.Op == AddNode {
+		return fmt.Sprintf("Reconfig {add id=%v addr=%s http=%s}", r.ID, r.Addr, r.HTTPAddr)
+	}
+	return fmt.Sprintf("Reconfig {remove id=%v}", r.ID)
+}
+
+// Command encodes membership change as a command that can be proposed like any other write
+func (r Reconfig) Command() Command {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&r)
+	if err != nil {
+		log.Error(err)
+	}
+	return Command{Key: ReconfigKey, Value: buf.Bytes()}
+}
+
+// IsReconfig returns true if command is a membership change
+func (c Command) IsReconfig() bool {
+	return c.Key == ReconfigKey && c.Value != nil
+}
+
+// Reconfig decodes membership change from the command
+func (c Command) Reconfig() (Reconfig, error) {
+	var r Reconfig
+	if !c.IsReconfig() {
+		return r, errors.New("not a reconfiguration command")
+	}
+	err := gob.NewDecoder(bytes.NewReader(c.Value)).Decode(&r)
+	return r, err
+}
+
+// apply changes the node set of the configuration and recomputes its quorum sizes.
+// Address maps are copied, so readers holding the old maps are not affected.
+// Changes that break the intersection of configured quorums are rejected
+func (c *Config) apply(r Reconfig) error {
+	_, exists := c.Addrs[r.ID]
+	switch r.Op {
+	case AddNode:
+		if exists {
+			return fmt.Errorf("node %v is already a member", r.ID)
+		}
+	case RemoveNode:
+		if !exists {
+			return fmt.Errorf("node %v is not a member", r.ID)
+		}
+		if len(c.Addrs) == 1 {
+			return errors.New("cannot remove the last node")
+		}
+	default:
+		return fmt.Errorf("unknown reconfiguration %d", r.Op)
+	}
+
+	addrs := make(map[ID]string, len(c.Addrs)+1)
+	for id, addr := range c.Addrs {
+		addrs[id] = addr
+	}
+	httpAddrs := make(map[ID]string, len(c.HTTPAddrs)+1)
+	for id, addr := range c.HTTPAddrs {
+		httpAddrs[id] = addr
+	}
+	if r.Op == AddNode {
+		addrs[r.ID] = r.Addr
+		httpAddrs[r.ID] = r.HTTPAddr
+	} else {
+		delete(addrs, r.ID)
+		delete(httpAddrs, r.ID)
+	}
+	next := *c
+	next.Addrs = addrs
+	next.HTTPAddrs = httpAddrs
+	next.count()
+	if err := next.validateQuorum(); err != nil {
+		return fmt.Errorf("%v rejected: %v", r, err)
+	}
+	// only membership changes, so readers of other settings do not race with the reconfiguration
+	c.Addrs, c.HTTPAddrs = next.Addrs, next.HTTPAddrs
+	c.n, c.z, c.w = next.n, next.z, next.w
+	c.npz, c.wpn, c.ln, c.wn, c.lp = next.npz, next.wpn, next.ln, next.wn, next.lp
+	return nil
+}
+
+// Reconfigure applies membership change to the global configuration
+func Reconfigure(r Reconfig) error {
+	configLock.Lock()
+	defer configLock.Unlock()
+	return config.apply(r)
+}
@@ -0,0 +1,52 @@
+package paxi
+
+import "testing"
+
+func TestReconfigCommand(t *testing.T) {
+	r := Reconfig{Op: AddNode, ID: NewID(2, 1), Addr: "tcp://127.0.0.1:1740", HTTPAddr: "http://127.0.0.1:8090"}
+	cmd := r.Command()
+	if !cmd.IsReconfig() || cmd.IsRead() {
+		t.Fatalf("%v is not a reconfiguration write", cmd)
+	}
+	decoded, err := cmd.Reconfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != r {
+		t.Errorf("expected %v, decoded %v", r, decoded)
+	}
+	if _, err := (Command{Key: "1", Value: []byte("v")}).Reconfig(); err == nil {
+		t.Error("decoded reconfiguration from a regular command")
+	}
+}
+
+func TestConfigApplyReconfig(t *testing.T) {
+	c := MakeDefaultConfig()
+	for i := 1; i <= 3; i++ {
+		c.apply(Reconfig{Op: AddNode, ID: NewID(1, i), Addr: "tcp://127.0.0.1:1735", HTTPAddr: "http://127.0.0.1:8080"})
+	}
+	addrs := c.Addrs
+
+	if err := c.apply(Reconfig{Op: AddNode, ID: NewID(2, 1), Addr: "tcp://127.0.0.1:1740", HTTPAddr: "http://127.0.0.1:8090"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.n != 4 || c.z != 2 || c.npz[2] != 1 {
+		t.Errorf("unexpected quorum sizes n=%d z=%d npz=%v", c.n, c.z, c.npz)
+	}
+	if len(addrs) != 3 {
+		t.Error("apply modified the old address map")
+	}
+
+	if err := c.apply(Reconfig{Op: AddNode, ID: NewID(2, 1)}); err == nil {
+		t.Error("added the same node twice")
+	}
+	if err := c.apply(Reconfig{Op: RemoveNode, ID: NewID(1, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := c.HTTPAddrs[NewID(1, 1)]; exists || c.n != 3 {
+		t.Errorf("node 1.1 is still a member of %v", c.Addrs)
+	}
+	if err := c.apply(Reconfig{Op: RemoveNode, ID: NewID(1, 1)}); err == nil {
+		t.Error("removed a node that is not a member")
+	}
+}
@@ -0,0 +1,59 @@
+package paxi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+
+	"pigpaxos/log"
+)
+
+// ScanCommand returns command that reads up to limit keys in [start, end) in key order.
+// An empty end has no upper bound and limit 0 has no limit. Scans go through the log like other reads,
+// so they are linearizable
+func ScanCommand(start, end Key, limit int) Command {
+	if limit < 0 {
+		limit = 0
+	}
+	value := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(end))
+	value = append(value[:binary.PutUvarint(value, uint64(limit))], end...)
+	return Command{Key: start, Value: value, Op: Scan}
+}
+
+// ScanRange returns range of scan command
+func (c Command) ScanRange() (start, end Key, limit int) {
+	n, size := binary.Uvarint(c.Value)
+	if size <= 0 {
+		return c.Key, "", 0
+	}
+	return c.Key, Key(c.Value[size:]), int(n)
+}
+
+// inRange returns true if key k is in the range of scan command c
+func inRange(k Key, c *Command) bool {
+	start, end, _ := c.ScanRange()
+	return k >= start && (end == "" || k < end)
+}
+
+func encodeKeyValues(kvs []KeyValue) Value {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(kvs)
+	if err != nil {
+		log.Error(err)
+	}
+	return buf.Bytes()
+}
+
+// KeyValues decodes keys and values returned by scan command
+func (r Reply) KeyValues() ([]KeyValue, error) {
+	if r.Command.Operation() != Scan {
+		return nil, errors.New("not a scan reply")
+	}
+	kvs := make([]KeyValue, 0)
+	if r.Value == nil {
+		return kvs, errors.New("scan reply has no result")
+	}
+	err := gob.NewDecoder(bytes.NewReader(r.Value)).Decode(&kvs)
+	return kvs, err
+}
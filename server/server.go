@@ -26,6 +26,11 @@ func replica(id paxi.ID) {
 
 	log.Infof("node %v starting with algorithm %s", id, *algorithm)
 
+	// only pigpaxos streams committed slots to learners, other algorithms would treat them as acceptors
+	if len(paxi.GetConfig().Learners) > 0 && *algorithm != "pigpaxos" {
+		log.Fatalf("algorithm %s does not support learners", *algorithm)
+	}
+
 	switch *algorithm {
 
 	case "paxos":
@@ -0,0 +1,262 @@
+package paxi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"pigpaxos/log"
+)
+
+// sessionWindow is the number of recent command results kept for every client session
+const sessionWindow = 1024
+
+// ErrSessionInUse is returned when the session id of a new client is already registered by another client
+var ErrSessionInUse = errors.New("session id in use")
+
+// session keeps results of recent write commands of one client
+type session struct {
+	First    uint64        // fingerprint of the first command that registered the session
+	LastSeen int64         // timestamp of the latest command of the client
+	Low      int           // results of command ids up to Low are dropped
+	Replies  map[int]Value // results of recent commands by command id
+}
+
+// sessionTable is the replicated table of client sessions keyed by session id.
+// It is only changed by write commands in log order, so every replica holds the same sessions.
+// Sessions are leases renewed by every command of the client and expire after timeout without one,
+// where time is the timestamp carried by commands in the log instead of the local clock.
+// A command moves the clock forward by at most maxClockStep, so one node with a skewed clock cannot expire all sessions at once
+type sessionTable struct {
+	sync.Mutex
+	timeout  time.Duration // 0 never expires sessions
+	clock    int64         // latest command timestamp in the log
+	swept    int64         // clock of the last sweep of expired sessions
+	sessions map[uint64]*session
+}
+
+// maxClockStep is how far one command may move the clock of the session table forward, only the first command sets it freely
+const maxClockStep = int64(time.Second)
+
+// tracked returns true if duplicates of command c are detected
+func tracked(c Command) bool {
+	return c.Session != 0 && c.CommandID != 0 && !c.IsRead()
+}
+
+// fingerprint identifies command c, so a retry of the first command of a session is told apart from another client
+func fingerprint(c Command) uint64 {
+	h := fnv.New64a()
+	b := make([]byte, binary.MaxVarintLen64)
+	h.Write(b[:binary.PutUvarint(b, uint64(c.Operation()))])
+	for _, f := range [][]byte{[]byte(c.Key), c.Value, c.Expect} {
+		h.Write(b[:binary.PutUvarint(b, uint64(len(f)))])
+		h.Write(f)
+	}
+	return h.Sum64() | 1
+}
+
+// clash returns true if c registers a session that another client already registered
+func (t *sessionTable) clash(c Command) bool {
+	if !tracked(c) || c.CommandID != 1 {
+		return false
+	}
+	t.Lock()
+	defer t.Unlock()
+	s, exists := t.sessions[c.Session]
+	return exists && t.alive(s) && s.First != 0 && s.First != fingerprint(c)
+}
+
+// alive returns true if the lease of session s did not run out
+func (t *sessionTable) alive(s *session) bool {
+	return t.timeout <= 0 || t.clock-s.LastSeen <= int64(t.timeout)
+}
+
+// lookup advances the clock of the table with command c and returns the cached result if c was already executed.
+// A command that clashes with the session of another client is reported as executed, so it is never applied
+func (t *sessionTable) lookup(c Command) (Value, bool) {
+	if !tracked(c) {
+		return nil, false
+	}
+	t.Lock()
+	defer t.Unlock()
+	if c.Timestamp > t.clock {
+		step := c.Timestamp - t.clock
+		if step > maxClockStep && t.clock != 0 {
+			step = maxClockStep
+		}
+		t.clock += step
+		t.expire()
+	}
+	s, exists := t.sessions[c.Session]
+	if exists && !t.alive(s) {
+		log.Debugf("client session %x expired", c.Session)
+		delete(t.sessions, c.Session)
+		exists = false
+	}
+	if !exists {
+		return nil, false
+	}
+	if c.CommandID == 1 && s.First != 0 && s.First != fingerprint(c) {
+		log.Errorf("command %v clashes with session %x of another client", c, c.Session)
+		return nil, true
+	}
+	s.LastSeen = t.clock
+	if c.CommandID <= s.Low {
+		// executed long ago, the result is gone but the command must not be applied again
+		return nil, true
+	}
+	v, exists := s.Replies[c.CommandID]
+	return v, exists
+}
+
+// record caches result v of executed command c
+func (t *sessionTable) record(c Command, v Value) {
+	if !tracked(c) {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.sessions == nil {
+		t.sessions = make(map[uint64]*session)
+	}
+	s, exists := t.sessions[c.Session]
+	if !exists {
+		s = &session{}
+		t.sessions[c.Session] = s
+	}
+	if c.CommandID == 1 {
+		s.First = fingerprint(c)
+	}
+	if s.Replies == nil {
+		s.Replies = make(map[int]Value)
+	}
+	s.LastSeen = t.clock
+	s.Replies[c.CommandID] = v
+	if len(s.Replies) > 2*sessionWindow {
+		s.Low = c.CommandID - sessionWindow
+		for id := range s.Replies {
+			if id <= s.Low {
+				delete(s.Replies, id)
+			}
+		}
+	}
+}
+
+// expire removes sessions whose lease ran out.
+// Lookup drops an expired session itself, so the table is only swept once per timeout to free the others
+func (t *sessionTable) expire() {
+	if t.timeout <= 0 || t.clock-t.swept < int64(t.timeout) {
+		return
+	}
+	t.swept = t.clock
+	for id, s := range t.sessions {
+		if !t.alive(s) {
+			log.Debugf("client session %x expired", id)
+			delete(t.sessions, id)
+		}
+	}
+}
+
+// Execute applies command c to the state machine.
+// A write command that was already executed for its client is not applied again, its cached result is returned
+func (n *node) Execute(c Command) Value {
+	if v, duplicate := n.sessions.lookup(c); duplicate {
+		log.Debugf("node %v skips duplicate command %v", n.id, c)
+		return v
+	}
+	v := n.execute(c)
+	n.sessions.record(c, v)
+	return v
+}
+
+// nodeSnapshot is the snapshot of node state, the state machine together with the client sessions
+type nodeSnapshot struct {
+	State    []byte
+	Clock    int64
+	Sessions map[uint64]*session
+}
+
+// Snapshot returns snapshot of the state machine and the session table
+func (n *node) Snapshot() ([]byte, error) {
+	state, err := n.StateMachine.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return n.snapshot(state)
+}
+
+// Export returns snapshot of the whole state machine and the session table that another replica can restore.
+// It differs from Snapshot only for state machines that implement Exporter
+func (n *node) Export() ([]byte, error) {
+	e, ok := n.StateMachine.(Exporter)
+	if !ok {
+		return n.Snapshot()
+	}
+	state, err := e.Export()
+	if err != nil {
+		return nil, err
+	}
+	return n.snapshot(state)
+}
+
+// snapshot encodes state of the state machine together with the session table
+func (n *node) snapshot(state []byte) ([]byte, error) {
+	n.sessions.Lock()
+	defer n.sessions.Unlock()
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(nodeSnapshot{State: state, Clock: n.sessions.clock, Sessions: n.sessions.sessions})
+	return buf.Bytes(), err
+}
+
+// Restore replaces the state machine and the session table with snapshot b
+func (n *node) Restore(b []byte) error {
+	var s nodeSnapshot
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&s)
+	if err != nil {
+		return err
+	}
+	err = n.StateMachine.Restore(s.State)
+	if err != nil {
+		return err
+	}
+	n.sessions.Lock()
+	defer n.sessions.Unlock()
+	n.sessions.clock = s.Clock
+	n.sessions.sessions = s.Sessions
+	return nil
+}
+
+// release tells the state machine that snapshot b of the node is durable
+func (n *node) release(b []byte) {
+	sm, ok := n.StateMachine.(Checkpointer)
+	if !ok || b == nil {
+		return
+	}
+	var s nodeSnapshot
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&s)
+	if err == nil {
+		err = sm.Release(s.State)
+	}
+	if err != nil {
+		log.Errorf("node %v cannot release snapshot: %v", n.id, err)
+	}
+}
+
+// snapshotWAL releases snapshots of the node once they are stored in the write-ahead log,
+// so the state machine keeps the checkpoint of the previous snapshot until then
+type snapshotWAL struct {
+	WAL
+	n *node
+}
+
+func (w snapshotWAL) SaveSnapshot(s Snapshot, keep ...WALRecord) error {
+	err := w.WAL.SaveSnapshot(s, keep...)
+	if err == nil {
+		w.n.release(s.Data)
+	}
+	return err
+}
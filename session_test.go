@@ -0,0 +1,119 @@
+package paxi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionDuplicate(t *testing.T) {
+	n := &node{StateMachine: NewDatabase()}
+	db := n.StateMachine.(Database)
+
+	put := Command{Key: "a", Value: []byte("1"), Session: 1, CommandID: 1}
+	inc := Command{Key: "a", Value: []byte("1"), Op: Increment, Session: 1, CommandID: 2}
+	n.Execute(put)
+	if v := n.Execute(inc); !v.Equals([]byte("1")) {
+		t.Errorf("expect increment to return 1, got %q", v)
+	}
+	n.Execute(Command{Key: "a", Value: []byte("5"), Session: 2, CommandID: 1})
+
+	// retried commands return the cached results and are not applied again
+	n.Execute(put)
+	if v := n.Execute(inc); !v.Equals([]byte("1")) {
+		t.Errorf("expect retried increment to return cached 1, got %q", v)
+	}
+	if v := db.Get("a"); !v.Equals([]byte("5")) {
+		t.Errorf("expect duplicates not to change a, got %q", v)
+	}
+
+	// commands without session are always applied
+	anonymous := Command{Key: "b", Value: []byte("1"), Op: Increment}
+	n.Execute(anonymous)
+	n.Execute(anonymous)
+	if v := db.Get("b"); !v.Equals([]byte("2")) {
+		t.Errorf("expect b to be 2, got %q", v)
+	}
+}
+
+func TestSessionExpire(t *testing.T) {
+	n := &node{StateMachine: NewDatabase()}
+	n.sessions.timeout = time.Second
+	db := n.StateMachine.(Database)
+
+	inc := Command{Key: "a", Value: []byte("1"), Op: Increment, Session: 1, CommandID: 1, Timestamp: int64(time.Second)}
+	n.Execute(inc)
+
+	// the lease of client 1 is renewed by its own commands only
+	for i := 1; i <= 2; i++ {
+		n.Execute(Command{Key: "b", Value: []byte("1"), Session: 2, CommandID: i, Timestamp: int64(3 * time.Second)})
+	}
+	if _, exists := n.sessions.sessions[1]; exists {
+		t.Fatal("expect session of client 1 to expire")
+	}
+	n.Execute(inc)
+	if v := db.Get("a"); !v.Equals([]byte("2")) {
+		t.Errorf("expect command of expired session to be applied again, got %q", v)
+	}
+}
+
+func TestSessionClockSkew(t *testing.T) {
+	n := &node{StateMachine: NewDatabase()}
+	n.sessions.timeout = time.Minute
+	db := n.StateMachine.(Database)
+
+	inc := Command{Key: "a", Value: []byte("1"), Op: Increment, Session: 1, CommandID: 1, Timestamp: int64(time.Hour)}
+	n.Execute(inc)
+
+	// a node whose clock is a day ahead moves the session clock by one step only
+	n.Execute(Command{Key: "b", Value: []byte("1"), Session: 2, CommandID: 1, Timestamp: int64(25 * time.Hour)})
+	if n.sessions.clock != int64(time.Hour)+maxClockStep {
+		t.Errorf("expect clock to move by %v, got %v", time.Duration(maxClockStep), time.Duration(n.sessions.clock))
+	}
+	n.Execute(inc)
+	if v := db.Get("a"); !v.Equals([]byte("1")) {
+		t.Errorf("expect retry of client 1 to be a duplicate, got a=%q", v)
+	}
+}
+
+func TestSessionClash(t *testing.T) {
+	n := &node{StateMachine: NewDatabase()}
+	db := n.StateMachine.(Database)
+
+	first := Command{Key: "a", Value: []byte("1"), Session: 7, CommandID: 1}
+	n.Execute(first)
+	if n.sessions.clash(first) {
+		t.Error("expect retry of the first command not to clash")
+	}
+
+	// another client that picked the same session id is refused
+	other := Command{Key: "b", Value: []byte("2"), Session: 7, CommandID: 1}
+	if !n.sessions.clash(other) {
+		t.Fatal("expect registration of a used session to clash")
+	}
+	n.Execute(other)
+	if v := db.Get("b"); v != nil {
+		t.Errorf("expect clashing command not to be applied, got b=%q", v)
+	}
+	if n.sessions.clash(Command{Key: "b", Value: []byte("2"), Session: 8, CommandID: 1}) {
+		t.Error("expect new session not to clash")
+	}
+}
+
+func TestSessionSnapshot(t *testing.T) {
+	n := &node{StateMachine: NewDatabase()}
+	inc := Command{Key: "a", Value: []byte("1"), Op: Increment, Session: 1, CommandID: 1}
+	n.Execute(inc)
+	b, err := n.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &node{StateMachine: NewDatabase()}
+	if err := restored.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	restored.Execute(inc)
+	if v := restored.StateMachine.(Database).Get("a"); !v.Equals([]byte("1")) {
+		t.Errorf("expect restored sessions to detect duplicate, got a=%q", v)
+	}
+}
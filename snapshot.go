@@ -0,0 +1,95 @@
+package paxi
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// SnapshotResendInterval is the minimum time between two snapshots sent to the same lagging node
+const SnapshotResendInterval = time.Second
+
+// Snapshot is a state machine image that includes effects of every slot up to and including Slot
+type Snapshot struct {
+	Slot   int    // last executed slot
+	Ballot Ballot // ballot of the replica when the snapshot was taken
+	Data   []byte // serialized state machine
+}
+
+func (s Snapshot) String() string {
+	return fmt.Sprintf("Snapshot {s=%d b=%v size=%d}", s.Slot, s.Ballot, len(s.Data))
+}
+
+// Chunks splits snapshot into InstallSnapshot messages of at most size bytes of data each
+func (s Snapshot) Chunks(from ID, size int) []InstallSnapshot {
+	if size <= 0 {
+		size = len(s.Data)
+	}
+	chunks := make([]InstallSnapshot, 0, len(s.Data)/size+1)
+	offset := 0
+	for {
+		end := offset + size
+		if end > len(s.Data) {
+			end = len(s.Data)
+		}
+		chunks = append(chunks, InstallSnapshot{
+			From:   from,
+			Slot:   s.Slot,
+			Ballot: s.Ballot,
+			Offset: offset,
+			Data:   s.Data[offset:end],
+			Done:   end == len(s.Data),
+		})
+		if end == len(s.Data) {
+			return chunks
+		}
+		offset = end
+	}
+}
+
+// InstallSnapshot carries one chunk of a snapshot to a replica that fell behind the compaction point
+type InstallSnapshot struct {
+	From   ID
+	Slot   int
+	Ballot Ballot
+	Offset int
+	Data   []byte
+	Done   bool // last chunk
+}
+
+func (m InstallSnapshot) String() string {
+	return fmt.Sprintf("InstallSnapshot {from=%v s=%d b=%v offset=%d size=%d done=%v}", m.From, m.Slot, m.Ballot, m.Offset, len(m.Data), m.Done)
+}
+
+// SnapshotAssembler collects InstallSnapshot chunks into a complete Snapshot.
+// Chunks are expected in order; a chunk of a different snapshot or an unexpected offset restarts assembly
+type SnapshotAssembler struct {
+	slot   int
+	ballot Ballot
+	buf    bytes.Buffer
+}
+
+// Add appends chunk m and returns the snapshot once its last chunk is received
+func (a *SnapshotAssembler) Add(m InstallSnapshot) (*Snapshot, bool) {
+	if m.Offset == 0 || m.Slot != a.slot || m.Ballot != a.ballot {
+		a.slot = m.Slot
+		a.ballot = m.Ballot
+		a.buf.Reset()
+	}
+	if m.Offset != a.buf.Len() {
+		// we lost a chunk, wait for the snapshot to be resent
+		return nil, false
+	}
+	a.buf.Write(m.Data)
+	if !m.Done {
+		return nil, false
+	}
+	s := &Snapshot{
+		Slot:   a.slot,
+		Ballot: a.ballot,
+		Data:   make([]byte, a.buf.Len()),
+	}
+	copy(s.Data, a.buf.Bytes())
+	a.buf.Reset()
+	return s, true
+}
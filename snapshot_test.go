@@ -0,0 +1,82 @@
+package paxi
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSnapshotChunks(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	s := Snapshot{Slot: 42, Ballot: NewBallot(1, NewID(1, 1)), Data: data}
+
+	chunks := s.Chunks(NewID(1, 1), 300)
+	if len(chunks) != 4 {
+		t.Fatalf("expected 4 chunks, got %d", len(chunks))
+	}
+
+	var a SnapshotAssembler
+	for i, c := range chunks {
+		got, done := a.Add(c)
+		if done != (i == len(chunks)-1) {
+			t.Fatalf("chunk %d: unexpected done=%v", i, done)
+		}
+		if done && (got.Slot != s.Slot || got.Ballot != s.Ballot || !bytes.Equal(got.Data, data)) {
+			t.Errorf("assembled %v does not match %v", got, s)
+		}
+	}
+
+	// a missing chunk must not produce a snapshot
+	a.Add(chunks[0])
+	if _, done := a.Add(chunks[3]); done {
+		t.Error("snapshot assembled with missing chunks")
+	}
+}
+
+func TestDatabaseSnapshot(t *testing.T) {
+	db := NewDatabase()
+	db.Put("1", []byte("a"))
+	db.Put("2", []byte("b"))
+	b, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewDatabase()
+	restored.Put("3", []byte("c"))
+	if err := restored.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Get("1").Equals([]byte("a")) || !restored.Get("2").Equals([]byte("b")) || restored.Get("3") != nil {
+		t.Errorf("restored database %v does not match snapshot", restored)
+	}
+}
+
+func TestDatabaseHash(t *testing.T) {
+	a := NewDatabase()
+	b := NewDatabase()
+	a.Execute(Command{Key: "x", Value: []byte("1")})
+	a.Execute(Command{Key: "y", Value: []byte("2")})
+	b.Execute(Command{Key: "y", Value: []byte("2")})
+	if a.Hash() == b.Hash() {
+		t.Error("databases with different states have the same hash")
+	}
+	b.Execute(Command{Key: "x", Value: []byte("1")})
+	if a.Hash() != b.Hash() {
+		t.Error("databases with the same state have different hashes")
+	}
+
+	data, err := a.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewDatabase()
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Hash() != a.Hash() {
+		t.Error("restored database has a different hash")
+	}
+}
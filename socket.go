@@ -1,6 +1,7 @@
 package paxi
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -30,6 +31,15 @@ type Socket interface {
 	// Recv receives a message
 	Recv() interface{}
 
+	// SetAddress changes address of node id, an empty address removes the node
+	SetAddress(id ID, addr string)
+
+	// PeerState returns state of the connection to node id
+	PeerState(id ID) ConnState
+
+	// Dropped returns how many messages to each node were dropped because its send queue stayed full
+	Dropped() map[ID]int
+
 	Close()
 
 	// Fault injection
@@ -43,6 +53,7 @@ type socket struct {
 	id        ID
 	addresses map[ID]string
 	nodes     map[ID]Transport
+	tls       *tls.Config
 
 	crash bool
 	drop  map[ID]bool
@@ -53,6 +64,7 @@ type socket struct {
 
 	sync.RWMutex
 	sentCount int
+	dropped   map[ID]int // messages dropped on a full send queue
 }
 
 // NewSocket return Socket interface instance given self ID, node list, transport and codec name
@@ -68,9 +80,18 @@ func NewSocket(id ID, addrs map[ID]string) Socket {
 		flaky:     make(map[ID]float64),
 		msgid:     initMsgId,
 		sentCount: 0,
+		dropped:   make(map[ID]int),
 	}
 
-	socket.nodes[id] = NewTransport(addrs[id])
+	if tlsConfig := GetConfig().TLS; tlsConfig.Enabled() {
+		c, err := tlsConfig.NodeConfig(id)
+		if err != nil {
+			log.Fatalf("node %s cannot load TLS config: %v", id, err)
+		}
+		socket.tls = c
+	}
+
+	socket.nodes[id] = NewTLSTransport(addrs[id], socket.tls)
 	socket.nodes[id].Listen()
 
 	return socket
@@ -119,23 +140,31 @@ func (s *socket) send(to ID, m interface{}) error {
 
 	s.RLock()
 	t, exists := s.nodes[to]
+	address, ok := s.addresses[to]
 	s.RUnlock()
 	if !exists {
-		address, ok := s.addresses[to]
 		if !ok {
 			log.Errorf("socket does not have address of node %s", to)
 			return errors.New(fmt.Sprintf("socket does not have address of node %s", to))
 		}
-		t = NewTransport(address)
+		t = NewTLSTransport(address, s.tls)
 		log.Debugf("Dialing %v", to)
 		err := Retry(t.Dial, 2, time.Duration(3)*time.Millisecond)
-		if err == nil {
+		if err == nil || t.State() == Disconnected {
+			// a transport that failed to connect keeps redialing in background
 			s.Lock()
-			log.Debugf("Adding %v to nodes", to)
-			s.nodes[to] = t
-			log.Debugf("Added %v to nodes", to)
+			if existing, exists := s.nodes[to]; exists {
+				// another sender connected first
+				t.Close()
+				t = existing
+				err = nil
+			} else {
+				log.Debugf("Adding %v to nodes", to)
+				s.nodes[to] = t
+			}
 			s.Unlock()
-		} else {
+		}
+		if err != nil {
 			//panic(err)
 			log.Debugf("Error connecting with %v: %v", to, err)
 			return err
@@ -146,13 +175,49 @@ func (s *socket) send(to ID, m interface{}) error {
 		timer := time.NewTimer(time.Duration(delay) * time.Millisecond)
 		go func() {
 			<-timer.C
-			t.Send(m)
+			s.count(to, t.Send(m))
 		}()
 		return nil
 	}
 
-	t.Send(m)
-	return nil
+	return s.count(to, t.Send(m))
+}
+
+// count records message to node id that was dropped on a full send queue and returns err
+func (s *socket) count(id ID, err error) error {
+	if err == ErrSendQueueFull {
+		s.Lock()
+		s.dropped[id]++
+		s.Unlock()
+	}
+	return err
+}
+
+func (s *socket) Dropped() map[ID]int {
+	s.RLock()
+	defer s.RUnlock()
+	dropped := make(map[ID]int, len(s.dropped))
+	for id, n := range s.dropped {
+		dropped[id] = n
+	}
+	return dropped
+}
+
+func (s *socket) PeerState(id ID) ConnState {
+	if id == s.id {
+		return Connected
+	}
+	s.RLock()
+	t, exists := s.nodes[id]
+	_, member := s.addresses[id]
+	s.RUnlock()
+	if exists {
+		return t.State()
+	}
+	if member {
+		return Idle
+	}
+	return Closed
 }
 
 func (s *socket) Recv() interface{} {
@@ -169,7 +234,7 @@ func (s *socket) Recv() interface{} {
 
 func (s *socket) MulticastZone(zone int, m interface{}) {
 	//log.Debugf("node %s broadcasting message %+v in zone %d", s.id, m, zone)
-	for id := range s.addresses {
+	for id := range s.peers() {
 		if id == s.id {
 			continue
 		}
@@ -182,7 +247,7 @@ func (s *socket) MulticastZone(zone int, m interface{}) {
 func (s *socket) MulticastQuorum(quorum int, m interface{}) {
 	//log.Debugf("node %s multicasting message %+v for %d nodes", s.id, m, quorum)
 	i := 0
-	for id := range s.addresses {
+	for id := range s.peers() {
 		if id == s.id {
 			continue
 		}
@@ -196,7 +261,7 @@ func (s *socket) MulticastQuorum(quorum int, m interface{}) {
 
 func (s *socket) Broadcast(m interface{}) {
 	//log.Debugf("node %s broadcasting message %+v", s.id, m)
-	for id := range s.addresses {
+	for id := range s.peers() {
 		if id == s.id {
 			continue
 		}
@@ -204,6 +269,34 @@ func (s *socket) Broadcast(m interface{}) {
 	}
 }
 
+// peers returns current address map, it is never modified in place
+func (s *socket) peers() map[ID]string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.addresses
+}
+
+func (s *socket) SetAddress(id ID, addr string) {
+	s.Lock()
+	defer s.Unlock()
+	addresses := make(map[ID]string, len(s.addresses)+1)
+	for i, a := range s.addresses {
+		addresses[i] = a
+	}
+	if addr == "" {
+		delete(addresses, id)
+	} else {
+		addresses[id] = addr
+	}
+	s.addresses = addresses
+
+	// drop connection to the old address
+	if t, exists := s.nodes[id]; exists && id != s.id {
+		t.Close()
+		delete(s.nodes, id)
+	}
+}
+
 func (s *socket) Close() {
 	for _, t := range s.nodes {
 		t.Close()
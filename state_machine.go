@@ -1,12 +1,43 @@
 package paxi
 
-// StateMachine defines a deterministic state machine
+// StateMachine defines a deterministic state machine replicated by the consensus protocols.
+// Replicas execute committed commands in log order, so replicas that executed the same
+// commands have the same state
 type StateMachine interface {
 	// Execute is the state-transition function
-	// returns current state value if state unchanged or previous state value
-	Execute(interface{}) interface{}
+	// returns the result of command, the previous value of the key for the key-value database
+	Execute(Command) Value
+
+	// Snapshot serializes the current state
+	Snapshot() ([]byte, error)
+
+	// Restore replaces the current state with a snapshot
+	Restore([]byte) error
+
+	State
+}
+
+// Exporter is implemented by state machines whose snapshots refer to state kept on the local disk.
+// Export serializes the whole current state, so a replica without that local state can restore it
+type Exporter interface {
+	Export() ([]byte, error)
 }
 
+// Checkpointer is implemented by state machines whose snapshots refer to a checkpoint on the local disk.
+// The checkpoint of the last durable snapshot is kept until Release is called with a newer durable snapshot,
+// so a replica that fails before its new snapshot is durable still restores the previous one
+type Checkpointer interface {
+	Release(snapshot []byte) error
+}
+
+// State identifies the current state of a state machine, so replicas can compare their states
 type State interface {
 	Hash() uint64
 }
+
+// Transactional is implemented by state machines that execute multi-key transactions
+type Transactional interface {
+	// ExecuteTransaction applies all commands or none of them if the condition of any command does not hold.
+	// returns the result of every command
+	ExecuteTransaction([]Command) ([]Value, error)
+}
@@ -0,0 +1,123 @@
+package paxi
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyTracker keeps smoothed response latency of every node observed by the leader
+type LatencyTracker struct {
+	sync.Mutex
+	latency map[ID]float64   // ms
+	updated map[ID]time.Time // time of the last sample
+}
+
+// latencySmoothing is the weight of a new sample in the moving average
+const latencySmoothing = 0.2
+
+// NewLatencyTracker creates a new LatencyTracker
+func NewLatencyTracker() *LatencyTracker {
+	return &LatencyTracker{latency: make(map[ID]float64), updated: make(map[ID]time.Time)}
+}
+
+// Add records latency sample d of node id
+func (t *LatencyTracker) Add(id ID, d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	t.add(id, d)
+	t.updated[id] = time.Now()
+}
+
+func (t *LatencyTracker) add(id ID, d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	if l, exists := t.latency[id]; exists {
+		t.latency[id] = l + latencySmoothing*(ms-l)
+	} else {
+		t.latency[id] = ms
+	}
+}
+
+// Get returns smoothed latency of node id in ms and whether it was ever measured
+func (t *LatencyTracker) Get(id ID) (float64, bool) {
+	t.Lock()
+	defer t.Unlock()
+	l, exists := t.latency[id]
+	return l, exists
+}
+
+// Penalize adds latency sample d to every node of ids that gave no sample after time since,
+// so nodes that did not answer are not preferred any more
+func (t *LatencyTracker) Penalize(ids []ID, since time.Time, d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	for _, id := range ids {
+		if t.updated[id].Before(since) {
+			t.add(id, d)
+		}
+	}
+}
+
+// Fastest returns the shortest prefix of ids ordered by latency that together with the node self satisfies quorum q.
+// Nodes that were never measured come first, so they get measured. It returns all ids if no prefix satisfies q
+func (t *LatencyTracker) Fastest(self ID, ids []ID, q func(*Quorum) bool) []ID {
+	sorted := make([]ID, len(ids))
+	copy(sorted, ids)
+	latency := make(map[ID]float64, len(ids))
+	for _, id := range ids {
+		latency[id], _ = t.Get(id)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if latency[sorted[i]] != latency[sorted[j]] {
+			return latency[sorted[i]] < latency[sorted[j]]
+		}
+		return sorted[i] < sorted[j]
+	})
+	quorum := NewQuorum()
+	quorum.ACK(self)
+	for i, id := range sorted {
+		if q(quorum) {
+			return sorted[:i]
+		}
+		quorum.ACK(id)
+	}
+	return sorted
+}
+
+// ThriftyStats counts messages sent to a quorum only and how often they had to be sent to every node after a timeout
+type ThriftyStats struct {
+	Sent      int64   `json:"sent"`
+	Fallbacks int64   `json:"fallbacks"`
+	Rate      float64 `json:"fallback_rate"`
+}
+
+// Thrifty keeps statistics of thrifty sends, it is safe for concurrent use
+type Thrifty struct {
+	sent      int64
+	fallbacks int64
+}
+
+// Sent counts a message sent to a quorum only
+func (t *Thrifty) Sent() {
+	atomic.AddInt64(&t.sent, 1)
+}
+
+// Fallback counts a message sent to every node after the quorum did not answer in time
+func (t *Thrifty) Fallback() {
+	atomic.AddInt64(&t.fallbacks, 1)
+}
+
+// Stats returns current statistics
+func (t *Thrifty) Stats() ThriftyStats {
+	s := ThriftyStats{Sent: atomic.LoadInt64(&t.sent), Fallbacks: atomic.LoadInt64(&t.fallbacks)}
+	if s.Sent > 0 {
+		s.Rate = float64(s.Fallbacks) / float64(s.Sent)
+	}
+	return s
+}
+
+// ThriftyTimeout returns how long a thrifty message waits for its quorum before it is sent to every node
+func ThriftyTimeout() time.Duration {
+	return time.Duration(GetConfig().ThriftyTimeout) * time.Millisecond
+}
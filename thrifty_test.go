@@ -0,0 +1,45 @@
+package paxi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyTrackerFastest(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = MakeDefaultConfig()
+	ids := make([]ID, 0)
+	for i := 1; i <= 5; i++ {
+		config.Addrs[NewID(1, i)] = "tcp://127.0.0.1:1735"
+		ids = append(ids, NewID(1, i))
+	}
+	config.count()
+
+	tracker := NewLatencyTracker()
+	tracker.Add(NewID(1, 2), 30*time.Millisecond)
+	tracker.Add(NewID(1, 3), 10*time.Millisecond)
+	tracker.Add(NewID(1, 4), 20*time.Millisecond)
+	tracker.Add(NewID(1, 5), 40*time.Millisecond)
+	q2 := func(q *Quorum) bool { return q.Q2() }
+	if f := tracker.Fastest(NewID(1, 1), ids[1:], q2); len(f) != 2 || f[0] != NewID(1, 3) || f[1] != NewID(1, 4) {
+		t.Errorf("expect 1.3 and 1.4 to be the fastest quorum, got %v", f)
+	}
+
+	// 1.4 did not answer in time
+	sent := time.Now()
+	tracker.Add(NewID(1, 3), 10*time.Millisecond)
+	tracker.Penalize([]ID{NewID(1, 3), NewID(1, 4)}, sent, time.Second)
+	if f := tracker.Fastest(NewID(1, 1), ids[1:], q2); len(f) != 2 || f[0] != NewID(1, 3) || f[1] != NewID(1, 2) {
+		t.Errorf("expect 1.3 and 1.2 to be the fastest quorum, got %v", f)
+	}
+
+	var thrifty Thrifty
+	for i := 0; i < 4; i++ {
+		thrifty.Sent()
+	}
+	thrifty.Fallback()
+	if s := thrifty.Stats(); s.Sent != 4 || s.Fallbacks != 1 || s.Rate != 0.25 {
+		t.Errorf("unexpected thrifty stats %+v", s)
+	}
+}
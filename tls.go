@@ -0,0 +1,126 @@
+package paxi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// TLSConfig locates PEM files for mutual TLS between nodes and HTTPS of the client REST API.
+// TLS is disabled if no certificate authority is given
+type TLSConfig struct {
+	CA         string            `json:"ca"`          // certificate authority that signs node and client certificates
+	Certs      map[string]string `json:"certs"`       // certificate of every node by node id, which names the node id as common name or DNS name
+	Keys       map[string]string `json:"keys"`        // private key of every node by node id
+	ClientCert string            `json:"client_cert"` // certificate presented by clients and admin tools
+	ClientKey  string            `json:"client_key"`  // private key of client certificate
+	Admins     []string          `json:"admins"`      // common names allowed to call admin endpoints, any verified client if empty
+}
+
+// Enabled returns true if nodes and clients have to use TLS
+func (c TLSConfig) Enabled() bool {
+	return c.CA != ""
+}
+
+// certPool loads the certificate authority
+func (c TLSConfig) certPool() (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(c.CA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", c.CA)
+	}
+	return pool, nil
+}
+
+// NodeConfig returns TLS configuration of node id. Peers on both ends of a connection
+// have to present a certificate signed by the certificate authority that names a node
+func (c TLSConfig) NodeConfig(id ID) (*tls.Config, error) {
+	pool, err := c.certPool()
+	if err != nil {
+		return nil, err
+	}
+	certFile, keyFile := c.Certs[id.String()], c.Keys[id.String()]
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("no certificate for node %s", id)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		RootCAs:               pool,
+		ClientCAs:             pool,
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		VerifyPeerCertificate: verifyNode,
+		MinVersion:            tls.VersionTLS12,
+	}, nil
+}
+
+// verifyNode accepts a verified certificate only if its common name or a DNS name is the id of a node
+// in the configuration. Client and admin certificates are signed by the same authority and must not
+// open peer connections
+func verifyNode(_ [][]byte, chains [][]*x509.Certificate) error {
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return errors.New("no verified node certificate")
+	}
+	leaf := chains[0][0]
+	addrs := GetConfig().Addrs
+	for _, name := range append([]string{leaf.Subject.CommonName}, leaf.DNSNames...) {
+		for id := range addrs {
+			if id.String() == name {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("certificate %s does not name a node", leaf.Subject.CommonName)
+}
+
+// ClientConfig returns TLS configuration of clients, which present the client certificate if there is one
+func (c TLSConfig) ClientConfig() (*tls.Config, error) {
+	pool, err := c.certPool()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// ErrUnauthorized is returned to admin requests without a verified client certificate
+var ErrUnauthorized = errors.New("client certificate required")
+
+// authorize checks that request r is sent by an admin client. Every request is allowed without TLS
+func (c TLSConfig) authorize(r *http.Request) error {
+	if !c.Enabled() {
+		return nil
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ErrUnauthorized
+	}
+	if len(c.Admins) == 0 {
+		return nil
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	for _, admin := range c.Admins {
+		if cn == admin {
+			return nil
+		}
+	}
+	return fmt.Errorf("client %s is not an admin", cn)
+}
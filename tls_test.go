@@ -0,0 +1,234 @@
+package paxi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs certificates written to files in dir
+type testCA struct {
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	ca := &testCA{dir: dir}
+	ca.cert, ca.key = ca.sign(t, "ca", nil, nil)
+	return ca
+}
+
+// sign issues certificate name signed by parent, self-signed CA if parent is nil, and writes name.pem and name.key
+func (ca *testCA) sign(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(ca.dir, name+".pem"), "CERTIFICATE", der)
+	writePEM(t, filepath.Join(ca.dir, name+".key"), "EC PRIVATE KEY", keyDER)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func (ca *testCA) issue(t *testing.T, name string) {
+	ca.sign(t, name, ca.cert, ca.key)
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testTLSConfig creates certificates of nodes 1.1 and 1.2, an admin client and a client
+func testTLSConfig(t *testing.T) TLSConfig {
+	ca := newTestCA(t, t.TempDir())
+	for _, name := range []string{"1.1", "1.2", "admin", "client"} {
+		ca.issue(t, name)
+	}
+	return TLSConfig{
+		CA:         ca.path("ca.pem"),
+		Certs:      map[string]string{"1.1": ca.path("1.1.pem"), "1.2": ca.path("1.2.pem")},
+		Keys:       map[string]string{"1.1": ca.path("1.1.key"), "1.2": ca.path("1.2.key")},
+		ClientCert: ca.path("admin.pem"),
+		ClientKey:  ca.path("admin.key"),
+		Admins:     []string{"admin"},
+	}
+}
+
+func TestTLSTransport(t *testing.T) {
+	gob.Register(A{})
+	saved := config
+	defer func() { config = saved }()
+	config = MakeDefaultConfig()
+	config.Addrs[NewIDFromString("1.1")] = "tcp://127.0.0.1:1739"
+	config.Addrs[NewIDFromString("1.2")] = "tcp://127.0.0.1:1740"
+	c := testTLSConfig(t)
+	serverConfig, err := c.NodeConfig(NewIDFromString("1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := c.NodeConfig(NewIDFromString("1.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewTLSTransport("tcp://127.0.0.1:1739", serverConfig)
+	server.Listen()
+	defer server.Close()
+
+	// peers without a node certificate cannot connect
+	plain := NewTransport("tcp://127.0.0.1:1739")
+	plain.Dial()
+	plain.Send(A{S: "plaintext"})
+	defer plain.Close()
+
+	client := NewTLSTransport("tcp://127.0.0.1:1739", clientConfig)
+	if err := client.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Send(A{I: 42, S: "hello tls"})
+
+	m := server.Recv()
+	if a, ok := m.(A); !ok || a.S != "hello tls" {
+		t.Errorf("expect message over TLS, got %+v", m)
+	}
+}
+
+func TestTLSClientCertificateIsNotNode(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = MakeDefaultConfig()
+	config.Addrs[NewIDFromString("1.1")] = "tcp://127.0.0.1:1741"
+	c := testTLSConfig(t)
+	serverConfig, err := c.NodeConfig(NewIDFromString("1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:1741", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// a peer that is accepted reads one byte
+			if conn.(*tls.Conn).Handshake() == nil {
+				conn.Write([]byte{1})
+			}
+			conn.Close()
+		}
+	}()
+
+	// the client certificate is signed by the same authority, but it does not name a node
+	clientConfig, err := c.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", "127.0.0.1:1741", clientConfig)
+	if err == nil {
+		// with TLS 1.3 the client learns that its certificate was refused on the first read
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Error("expect peer port to refuse the client certificate")
+	}
+	if err := verifyNode(nil, [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "1.1"}}}}); err != nil {
+		t.Errorf("expect certificate of node 1.1 to be accepted, got %v", err)
+	}
+}
+
+func TestTLSAdmin(t *testing.T) {
+	c := testTLSConfig(t)
+	defer func(tlsConfig TLSConfig) {
+		config.TLS = tlsConfig
+	}(config.TLS)
+	config.TLS = c
+
+	server := httptest.NewUnstartedServer(admin(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS, _ = c.NodeConfig(NewIDFromString("1.1"))
+	server.TLS.ClientAuth = tls.VerifyClientCertIfGiven
+	server.TLS.VerifyPeerCertificate = nil
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(cert, key string) int {
+		tc := c
+		tc.ClientCert, tc.ClientKey = cert, key
+		clientConfig, err := tc.ClientConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		r, err := client.Get(server.URL + "/crash?t=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r.StatusCode
+	}
+
+	if status := get("", ""); status != http.StatusForbidden {
+		t.Errorf("expect %d without client certificate, got %d", http.StatusForbidden, status)
+	}
+	dir := filepath.Dir(c.CA)
+	if status := get(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")); status != http.StatusForbidden {
+		t.Errorf("expect %d for non-admin client, got %d", http.StatusForbidden, status)
+	}
+	if status := get(c.ClientCert, c.ClientKey); status != http.StatusOK {
+		t.Errorf("expect %d for admin client, got %d", http.StatusOK, status)
+	}
+}
@@ -0,0 +1,150 @@
+package paxi
+
+import (
+	"sync"
+	"time"
+
+	"pigpaxos/log"
+)
+
+// HandoverAction is what a replica does with a leadership transfer request
+type HandoverAction int
+
+const (
+	HandoverIgnore  HandoverAction = iota // drop the request
+	HandoverForward                       // pass the request on to the leader of the current ballot
+	HandoverElect                         // there is no leader to hand over from, the target runs phase 1
+	HandoverStart                         // stop proposing and hand uncommitted slots over to the target
+)
+
+// Handover is the leadership transfer state of a replica shared by the protocols. It decides what to do with
+// transfer requests, when a transfer timed out and when leadership should move to another node.
+// Protocols only hand their uncommitted slots over to the target
+type Handover struct {
+	sync.Mutex
+	self      ID
+	placement *LeaderPlacement
+	started   time.Time        // time this leader handed leadership over, zero if no transfer is pending
+	checked   time.Time        // time of the last leader placement check
+	heard     map[ID]time.Time // last time this node got a phase 1 or phase 2 reply from each node
+}
+
+// NewHandover creates leadership transfer state of node id
+func NewHandover(id ID) *Handover {
+	return &Handover{
+		self:      id,
+		placement: NewLeaderPlacement(id),
+		heard:     make(map[ID]time.Time),
+	}
+}
+
+// Heard records that nodes ids replied to this node, so leadership may be moved to them
+func (h *Handover) Heard(ids ...ID) {
+	now := time.Now()
+	h.Lock()
+	defer h.Unlock()
+	for _, id := range ids {
+		h.heard[id] = now
+	}
+}
+
+// Hit records a request that a client sent to node id while this node leads
+func (h *Handover) Hit(id ID) {
+	h.placement.Hit(id)
+}
+
+// Decide returns what this node, leader of ballot b if active, does with transfer m.
+// HandoverStart starts the timer of the transfer
+func (h *Handover) Decide(m LeaderTransfer, b Ballot, active bool) HandoverAction {
+	if !active {
+		if b != 0 && b.ID() != h.self {
+			return HandoverForward
+		}
+		if m.To == h.self {
+			h.placement.Follow(m.Zone)
+			return HandoverElect
+		}
+		log.Errorf("Node %v cannot transfer leadership to %v, it is not the leader of %v", h.self, m.To, b)
+		return HandoverIgnore
+	}
+	if m.To == h.self {
+		return HandoverIgnore
+	}
+	c := GetConfig()
+	if _, exists := c.Addrs[m.To]; !exists || c.IsLearner(m.To) || c.IsWitness(m.To) {
+		log.Errorf("Node %v cannot transfer leadership to %v, it is not a node that can lead", h.self, m.To)
+		return HandoverIgnore
+	}
+	h.Lock()
+	h.started = time.Now()
+	h.Unlock()
+	log.Infof("Node %v hands leadership of %v over to %v", h.self, b, m.To)
+	return HandoverStart
+}
+
+// Pending returns true if this node handed leadership over and the transfer is not over yet
+func (h *Handover) Pending() bool {
+	h.Lock()
+	defer h.Unlock()
+	return !h.started.IsZero()
+}
+
+// Stop ends the pending transfer, this node runs phase 1 itself
+func (h *Handover) Stop() {
+	h.Lock()
+	defer h.Unlock()
+	h.started = time.Time{}
+}
+
+// Expired returns true if the target did not take over in time and this node should run phase 1 again.
+// The transfer is over once this node is active again or saw ballot b of another node
+func (h *Handover) Expired(b Ballot, active bool, now time.Time) bool {
+	if !h.Pending() {
+		return false
+	}
+	if active || b.ID() != h.self {
+		h.Stop()
+		return false
+	}
+	h.Lock()
+	started := h.started
+	h.Unlock()
+	if now.Sub(started) < LeaderTransferTimeout {
+		return false
+	}
+	h.Stop()
+	log.Warningf("Node %v leads again, leadership transfer of %v timed out", h.self, b)
+	return true
+}
+
+// TakeOver makes this node lead from zone after the previous leader handed leadership over to it
+func (h *Handover) TakeOver(zone int) {
+	h.placement.Follow(zone)
+}
+
+// Next returns transfer to a healthy node that should lead instead of this node, its To is 0 if this node keeps leading.
+// A node is only healthy if it also replied to this node within LeaderPlacementLiveness, so leadership is not
+// handed over to a node that is down but was never dialed. The leader checks every LeaderPlacementInterval
+// while no transfer is pending
+func (h *Handover) Next(active bool, now time.Time, healthy func(ID) bool) LeaderTransfer {
+	h.Lock()
+	if !active || !h.started.IsZero() || now.Sub(h.checked) < LeaderPlacementInterval {
+		h.Unlock()
+		return LeaderTransfer{}
+	}
+	h.checked = now
+	heard := make(map[ID]time.Time, len(h.heard))
+	for id, t := range h.heard {
+		heard[id] = t
+	}
+	h.Unlock()
+	alive := func(id ID) bool {
+		return now.Sub(heard[id]) < LeaderPlacementLiveness && healthy(id)
+	}
+	zone := h.placement.Zone()
+	m := LeaderTransfer{To: h.placement.next(zone, alive), Zone: zone}
+	if m.To != 0 {
+		log.Infof("Node %v moves leadership to preferred node %v of zone %d", h.self, m.To, m.Zone)
+	}
+	return m
+}
@@ -0,0 +1,101 @@
+package paxi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandover(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = MakeDefaultConfig()
+	for i := 1; i <= 4; i++ {
+		config.Addrs[NewID(1, i)] = "tcp://127.0.0.1:1735"
+	}
+	config.Witnesses = []string{"1.4"}
+	config.count()
+
+	self, other := NewID(1, 1), NewID(1, 2)
+	var own, higher Ballot
+	own.Next(self)
+	higher = own
+	higher.Next(other)
+
+	h := NewHandover(self)
+	for _, test := range []struct {
+		m      LeaderTransfer
+		b      Ballot
+		active bool
+		action HandoverAction
+	}{
+		{LeaderTransfer{To: self}, higher, false, HandoverForward},
+		{LeaderTransfer{To: self}, 0, false, HandoverElect},
+		{LeaderTransfer{To: other}, own, false, HandoverIgnore},
+		{LeaderTransfer{To: self}, own, true, HandoverIgnore},
+		{LeaderTransfer{To: NewID(1, 4)}, own, true, HandoverIgnore},
+		{LeaderTransfer{To: NewID(9, 9)}, own, true, HandoverIgnore},
+	} {
+		if action := h.Decide(test.m, test.b, test.active); action != test.action {
+			t.Errorf("expect %v with ballot %v active=%v to be %d, got %d", test.m, test.b, test.active, test.action, action)
+		}
+	}
+	if h.Pending() {
+		t.Fatal("expect no transfer to be pending")
+	}
+
+	if action := h.Decide(LeaderTransfer{To: other}, own, true); action != HandoverStart || !h.Pending() {
+		t.Fatalf("expect transfer to %v to start, got %d", other, action)
+	}
+	now := time.Now()
+	if h.Expired(own, false, now) || !h.Pending() {
+		t.Error("expect transfer not to expire before timeout")
+	}
+	if h.Expired(higher, false, now.Add(LeaderTransferTimeout)) || h.Pending() {
+		t.Error("expect transfer to be over once the target runs phase 1 with a higher ballot")
+	}
+
+	h.Decide(LeaderTransfer{To: other}, own, true)
+	if !h.Expired(own, false, time.Now().Add(LeaderTransferTimeout)) || h.Pending() {
+		t.Error("expect transfer to expire if the target did not take over")
+	}
+}
+
+func TestHandoverAffinity(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = MakeDefaultConfig()
+	for z := 1; z <= 2; z++ {
+		for i := 1; i <= 3; i++ {
+			config.Addrs[NewID(z, i)] = "tcp://127.0.0.1:1735"
+		}
+	}
+	config.LeaderPreference = []string{"2.2", "1.3"}
+	config.LeaderAffinity = true
+	config.Policy = "consecutive"
+	config.Threshold = 3
+	config.count()
+	healthy := func(ID) bool { return true }
+
+	// requests from zone 1 move leadership from preferred 2.2 to the preferred node of zone 1
+	leader := NewHandover(NewID(2, 2))
+	for i := 0; i < 3; i++ {
+		leader.Hit(NewID(1, 2))
+	}
+	now := time.Now()
+	if m := leader.Next(true, now, healthy); m.To != 0 {
+		t.Fatalf("expect no transfer to 1.3 before it replied, got %v", m)
+	}
+	leader.Heard(NewID(1, 3))
+	m := leader.Next(true, now.Add(LeaderPlacementInterval), healthy)
+	if m.To != NewID(1, 3) || m.Zone != 1 {
+		t.Fatalf("expect leadership to move to 1.3 in zone 1, got %v", m)
+	}
+
+	// the new leader stays in the zone instead of handing leadership back to 2.2
+	next := NewHandover(NewID(1, 3))
+	next.TakeOver(m.Zone)
+	next.Heard(NewID(2, 2))
+	if m := next.Next(true, time.Now(), healthy); m.To != 0 {
+		t.Errorf("expect 1.3 to keep leading zone 1, got %v", m)
+	}
+}
@@ -2,13 +2,16 @@ package paxi
 
 import (
 	"bytes"
-	"encoding/gob"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"flag"
+	"io"
 	"net"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"pigpaxos/log"
@@ -16,29 +19,81 @@ import (
 
 var scheme = flag.String("transport", "tcp", "transport scheme (tcp, udp, chan), default tcp")
 
+// ConnState is the state of the outbound connection of a transport
+type ConnState int32
+
+const (
+	Idle         ConnState = iota // not dialed yet
+	Connecting                    // dialing, messages are queued
+	Connected                     // messages are being sent
+	Disconnected                  // connection failed and is redialed with backoff, messages are rejected
+	Closed                        // transport is closed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Idle:
+		return "idle"
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	case Closed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int32(s))
+}
+
+// redial backoff of a failed connection
+const (
+	MinRedialBackoff = 10 * time.Millisecond
+	MaxRedialBackoff = time.Second
+	DialTimeout      = time.Second
+	// SendTimeout is how long Send waits for room in the queue of a connected transport before it gives up
+	SendTimeout = 100 * time.Millisecond
+)
+
+var (
+	ErrSendQueueFull = errors.New("transport send queue is full")
+	ErrDisconnected  = errors.New("transport is disconnected")
+	ErrClosed        = errors.New("transport is closed")
+)
+
 // Transport = transport + pipe + client + server
 type Transport interface {
 	// Scheme returns tranport scheme
 	Scheme() string
 
-	// Send sends message into t.send chan
-	Send(interface{})
+	// Send puts message into the bounded t.send queue. If the queue is full it waits up to SendTimeout
+	// while the connection is up. It fails if the queue stays full or the connection is down
+	Send(interface{}) error
 
 	// Recv waits for message from t.recv chan
 	Recv() interface{}
 
-	// Dial connects to remote server non-blocking once connected
+	// Dial connects to remote server non-blocking once connected.
+	// Transports that keep redialing after a failed dial report Disconnected, others stay Idle
 	Dial() error
 
 	// Listen waits for connections, non-blocking once listener starts
 	Listen()
 
-	// Close closes send channel and stops listener
+	// State returns state of the outbound connection
+	State() ConnState
+
+	// Close flushes queued messages if connected, closes send queue and stops listener
 	Close()
 }
 
 // NewTransport creates new transport object with url
 func NewTransport(addr string) Transport {
+	return NewTLSTransport(addr, nil)
+}
+
+// NewTLSTransport creates new transport object with url, which uses TLS config c for tcp connections if c is not nil
+func NewTLSTransport(addr string, c *tls.Config) Transport {
 	if !strings.Contains(addr, "://") {
 		addr = *scheme + "://" + addr
 	}
@@ -52,6 +107,7 @@ func NewTransport(addr string) Transport {
 		send:  make(chan interface{}, config.ChanBufferSize),
 		recv:  make(chan interface{}, config.ChanBufferSize),
 		close: make(chan struct{}),
+		tls:   c,
 	}
 
 	switch uri.Scheme {
@@ -73,50 +129,199 @@ func NewTransport(addr string) Transport {
 	return nil
 }
 
+// newCodec returns the configured codec for a connection
+func newCodec(rw io.ReadWriter) Codec {
+	codec := NewCodec(config.Codec, rw)
+	if codec == nil {
+		log.Fatalf("unknown codec %s", config.Codec)
+	}
+	return codec
+}
+
 type transport struct {
-	uri   *url.URL
-	send  chan interface{}
-	recv  chan interface{}
-	close chan struct{}
+	uri       *url.URL
+	send      chan interface{}
+	recv      chan interface{}
+	close     chan struct{}
+	closeOnce sync.Once
+	state     int32       // ConnState
+	tls       *tls.Config // TLS of tcp connections, plaintext if nil
 }
 
-func (t *transport) Send(m interface{}) {
-	t.send <- m
+func (t *transport) Send(m interface{}) error {
+	switch t.State() {
+	case Disconnected:
+		return ErrDisconnected
+	case Closed:
+		return ErrClosed
+	}
+	select {
+	case t.send <- m:
+		return nil
+	default:
+	}
+	if t.State() != Connected {
+		return ErrSendQueueFull
+	}
+	// the connection drains the queue, so wait a little instead of dropping a message of a burst
+	timer := time.NewTimer(SendTimeout)
+	defer timer.Stop()
+	select {
+	case t.send <- m:
+		return nil
+	case <-t.close:
+		return ErrClosed
+	case <-timer.C:
+		return ErrSendQueueFull
+	}
 }
 
 func (t *transport) Recv() interface{} {
 	return <-t.recv
 }
 
+func (t *transport) State() ConnState {
+	return ConnState(atomic.LoadInt32(&t.state))
+}
+
+func (t *transport) setState(s ConnState) {
+	old := ConnState(atomic.SwapInt32(&t.state, int32(s)))
+	if old != s && (old == Connected || s == Connected) {
+		log.Infof("connection to %s is %v", t.uri.Host, s)
+	}
+}
+
 func (t *transport) Close() {
-	close(t.send)
-	close(t.close)
+	t.closeOnce.Do(func() {
+		close(t.close)
+	})
 }
 
 func (t *transport) Scheme() string {
 	return t.uri.Scheme
 }
 
+// drain discards queued messages of a failed connection, protocols retransmit what they need
+func (t *transport) drain() {
+	n := 0
+	for {
+		select {
+		case <-t.send:
+			n++
+		default:
+			if n > 0 {
+				log.Debugf("dropped %d messages queued for %s", n, t.uri.Host)
+			}
+			return
+		}
+	}
+}
+
 func (t *transport) Dial() error {
-	conn, err := net.Dial(t.Scheme(), t.uri.Host)
+	if !atomic.CompareAndSwapInt32(&t.state, int32(Idle), int32(Connecting)) {
+		// already dialed, the send loop redials by itself
+		if t.State() == Connected {
+			return nil
+		}
+		return ErrDisconnected
+	}
+	conn, err := t.dial()
 	if err != nil {
-		return err
+		t.setState(Disconnected)
+	} else {
+		t.setState(Connected)
 	}
+	go t.sendLoop(conn)
+	return err
+}
 
-	go func(conn net.Conn) {
-		// w := bufio.NewWriter(conn)
-		// codec := NewCodec(config.Codec, conn)
-		encoder := gob.NewEncoder(conn)
-		defer conn.Close()
-		for m := range t.send {
-			err := encoder.Encode(&m)
+// dial connects to the remote address, with a TLS handshake if the transport has TLS config
+func (t *transport) dial() (net.Conn, error) {
+	if t.tls == nil {
+		return net.DialTimeout(t.Scheme(), t.uri.Host, DialTimeout)
+	}
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	return tls.DialWithDialer(dialer, t.Scheme(), t.uri.Host, t.tls)
+}
+
+// connWriter remembers the first write error, so failed connections are told apart from messages that cannot be encoded
+type connWriter struct {
+	net.Conn
+	err error
+}
+
+func (w *connWriter) Write(b []byte) (int, error) {
+	n, err := w.Conn.Write(b)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// sendLoop writes queued messages to conn. When the connection fails it drains the queue
+// and redials with exponential backoff until the transport is closed
+func (t *transport) sendLoop(conn net.Conn) {
+	backoff := MinRedialBackoff
+	for {
+		if conn == nil {
+			t.drain()
+			select {
+			case <-t.close:
+				t.setState(Closed)
+				return
+			case <-time.After(backoff):
+			}
+			t.setState(Connecting)
+			var err error
+			conn, err = t.dial()
 			if err != nil {
-				log.Error(err)
+				log.Debugf("redial %s failed: %v", t.uri.Host, err)
+				t.setState(Disconnected)
+				backoff *= 2
+				if backoff > MaxRedialBackoff {
+					backoff = MaxRedialBackoff
+				}
+				continue
 			}
+			backoff = MinRedialBackoff
+			t.setState(Connected)
 		}
-	}(conn)
 
-	return nil
+		// every connection starts a new codec stream
+		w := &connWriter{Conn: conn}
+		codec := newCodec(w)
+		for w.err == nil {
+			var m interface{}
+			select {
+			case <-t.close:
+				t.flush(codec, w)
+				conn.Close()
+				t.setState(Closed)
+				return
+			case m = <-t.send:
+			}
+			err := codec.Encode(&m)
+			if err != nil && w.err == nil {
+				log.Errorf("cannot encode message %v to %s: %v", m, t.uri.Host, err)
+			}
+		}
+		log.Errorf("connection to %s failed: %v", t.uri.Host, w.err)
+		conn.Close()
+		conn = nil
+		t.setState(Disconnected)
+	}
+}
+
+// flush sends messages queued before the transport was closed
+func (t *transport) flush(codec Codec, w *connWriter) {
+	for w.err == nil {
+		select {
+		case m := <-t.send:
+			codec.Encode(&m)
+		default:
+			return
+		}
+	}
 }
 
 /******************************
@@ -132,38 +337,46 @@ func (t *tcp) Listen() {
 	if err != nil {
 		log.Fatal("TCP Listener error: ", err)
 	}
+	if t.tls != nil {
+		listener = tls.NewListener(listener, t.tls)
+	}
+
+	go func() {
+		<-t.close
+		listener.Close()
+	}()
 
 	go func(listener net.Listener) {
 		defer listener.Close()
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
+				select {
+				case <-t.close:
+					return
+				default:
+				}
 				log.Error("TCP Accept error: ", err)
 				continue
 			}
 
 			go func(conn net.Conn) {
-				// codec := NewCodec(config.Codec, conn)
-				decoder := gob.NewDecoder(conn)
+				codec := newCodec(conn)
 				defer conn.Close()
 				//r := bufio.NewReader(conn)
-				numFail := 0
 				for {
 					select {
 					case <-t.close:
 						return
 					default:
 						var m interface{}
-						err := decoder.Decode(&m)
+						err := codec.Decode(&m)
 						if err != nil {
-							log.Error(err)
-							numFail++
-							time.Sleep(10 * time.Millisecond)
-							if numFail >= 20 {
-								log.Errorf("transport closing due to excess failures")
-								return
+							// the stream cannot be trusted after an error, the peer redials
+							if err != io.EOF {
+								log.Errorf("closing connection from %v: %v", conn.RemoteAddr(), err)
 							}
-							continue
+							return
 						}
 						t.recv <- m
 					}
@@ -190,14 +403,31 @@ func (u *udp) Dial() error {
 	if err != nil {
 		return err
 	}
+	u.setState(Connected)
 
 	go func(conn *net.UDPConn) {
 		// packet := make([]byte, 1500)
 		// w := bytes.NewBuffer(packet)
 		w := new(bytes.Buffer)
-		for m := range u.send {
-			gob.NewEncoder(w).Encode(&m)
-			_, err := conn.Write(w.Bytes())
+		defer conn.Close()
+		for {
+			var m interface{}
+			select {
+			case m = <-u.send:
+			case <-u.close:
+				select {
+				case m = <-u.send:
+					// flush messages queued before close
+				default:
+					u.setState(Closed)
+					return
+				}
+			}
+			err := newCodec(w).Encode(&m)
+			if err != nil {
+				log.Error(err)
+			}
+			_, err = conn.Write(w.Bytes())
 			if err != nil {
 				log.Error(err)
 			}
@@ -225,14 +455,17 @@ func (u *udp) Listen() {
 			case <-u.close:
 				return
 			default:
-				_, err := conn.Read(packet)
+				n, err := conn.Read(packet)
 				if err != nil {
 					log.Error(err)
 					continue
 				}
-				r := bytes.NewReader(packet)
 				var m interface{}
-				gob.NewDecoder(r).Decode(&m)
+				err = newCodec(bytes.NewBuffer(packet[:n])).Decode(&m)
+				if err != nil {
+					log.Error(err)
+					continue
+				}
 				u.recv <- m
 			}
 		}
@@ -261,9 +494,24 @@ func (c *channel) Dial() error {
 	if !ok {
 		return errors.New("server not ready")
 	}
+	c.setState(Connected)
 	go func(conn chan<- interface{}) {
-		for m := range c.send {
-			conn <- m
+		for {
+			select {
+			case m := <-c.send:
+				conn <- m
+			case <-c.close:
+				// flush messages queued before close
+				for {
+					select {
+					case m := <-c.send:
+						conn <- m
+					default:
+						c.setState(Closed)
+						return
+					}
+				}
+			}
 		}
 	}(conn)
 	return nil
@@ -2,7 +2,9 @@ package paxi
 
 import (
 	"encoding/gob"
+	"net/url"
 	"testing"
+	"time"
 )
 
 func TestTransport(t *testing.T) {
@@ -55,3 +57,73 @@ func TestTransport(t *testing.T) {
 		t.Error()
 	}
 }
+
+func TestTransportRedial(t *testing.T) {
+	gob.Register(B{})
+
+	client := NewTransport("tcp://127.0.0.1:1738")
+	if err := client.Dial(); err == nil {
+		t.Fatal("expect dial error without server")
+	}
+	if client.State() != Disconnected {
+		t.Errorf("expect state %v, got %v", Disconnected, client.State())
+	}
+	if err := client.Send(B{"lost"}); err != ErrDisconnected {
+		t.Errorf("expect %v sending while disconnected, got %v", ErrDisconnected, err)
+	}
+
+	server := NewTransport("tcp://127.0.0.1:1738")
+	server.Listen()
+	defer server.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.State() != Connected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.State() != Connected {
+		t.Fatalf("expect transport to redial, state %v", client.State())
+	}
+
+	if err := client.Send(B{"hello again"}); err != nil {
+		t.Fatal(err)
+	}
+	m := server.Recv()
+	if b, ok := m.(B); !ok || b.S != "hello again" {
+		t.Errorf("expect message after redial, got %v", m)
+	}
+
+	client.Close()
+	for client.State() != Closed && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := client.Send(B{"closed"}); err != ErrClosed {
+		t.Errorf("expect %v sending after close, got %v", ErrClosed, err)
+	}
+}
+
+func TestTransportSendQueueFull(t *testing.T) {
+	tr := &transport{
+		uri:   &url.URL{Scheme: "tcp", Host: "127.0.0.1:1738"},
+		send:  make(chan interface{}, 1),
+		close: make(chan struct{}),
+		state: int32(Connected),
+	}
+	tr.send <- B{"queued"}
+
+	go func() {
+		time.Sleep(SendTimeout / 4)
+		<-tr.send
+	}()
+	if err := tr.Send(B{"waits"}); err != nil {
+		t.Errorf("expect send to wait for the queue to drain, got %v", err)
+	}
+	if err := tr.Send(B{"dropped"}); err != ErrSendQueueFull {
+		t.Errorf("expect %v once the queue stays full, got %v", ErrSendQueueFull, err)
+	}
+
+	tr.setState(Connecting)
+	start := time.Now()
+	if err := tr.Send(B{"dropped"}); err != ErrSendQueueFull || time.Since(start) >= SendTimeout {
+		t.Errorf("expect %v without waiting while connecting, got %v", ErrSendQueueFull, err)
+	}
+}
@@ -0,0 +1,103 @@
+package paxi
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"pigpaxos/log"
+)
+
+// TxnKey is the reserved key of transaction commands
+const TxnKey Key = "\x00txn"
+
+// ErrTxnAborted is returned if a transaction is not applied as the condition of one of its commands does not hold
+var ErrTxnAborted = errors.New("transaction aborted")
+
+// transactionResult is the result of a transaction returned as value of its command
+type transactionResult struct {
+	Values []Value
+	Abort  string // reason of abort, empty if the transaction committed
+}
+
+// Command encodes transaction as a single command, so the whole transaction takes one slot of the log
+func (t Transaction) Command() Command {
+	// gob does not keep empty values apart from nil ones, so operations are made explicit
+	cmds := make([]Command, len(t.Commands))
+	for i, c := range t.Commands {
+		cmds[i] = c
+		cmds[i].Op = c.Operation()
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(cmds)
+	if err != nil {
+		log.Error(err)
+	}
+	return Command{Key: TxnKey, Value: buf.Bytes()}
+}
+
+// IsTransaction returns true if command is a multi-key transaction
+func (c Command) IsTransaction() bool {
+	return c.Key == TxnKey && c.Value != nil
+}
+
+// Transaction decodes multi-key transaction from the command
+func (c Command) Transaction() (Transaction, error) {
+	var t Transaction
+	if !c.IsTransaction() {
+		return t, errors.New("not a transaction command")
+	}
+	err := gob.NewDecoder(bytes.NewReader(c.Value)).Decode(&t.Commands)
+	return t, err
+}
+
+// execute applies command c to the state machine. Transactions are applied all-or-nothing
+func (n *node) execute(c Command) Value {
+	if !c.IsTransaction() {
+		return n.StateMachine.Execute(c)
+	}
+	var result transactionResult
+	t, err := c.Transaction()
+	if err == nil {
+		if sm, ok := n.StateMachine.(Transactional); ok {
+			result.Values, err = sm.ExecuteTransaction(t.Commands)
+		} else {
+			err = errors.New("state machine does not support transactions")
+		}
+	}
+	if err != nil {
+		log.Debugf("node %v aborts transaction %v: %v", n.id, t, err)
+		result = transactionResult{Abort: err.Error()}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&result); err != nil {
+		log.Error(err)
+	}
+	return buf.Bytes()
+}
+
+// TransactionReply decodes reply of executed transaction command
+func (r Reply) TransactionReply() (TransactionReply, error) {
+	reply := TransactionReply{Timestamp: r.Timestamp}
+	if r.Value == nil {
+		return reply, errors.New("transaction reply has no result")
+	}
+	t, err := r.Command.Transaction()
+	if err != nil {
+		return reply, err
+	}
+	reply.Commands = t.Commands
+	var result transactionResult
+	err = gob.NewDecoder(bytes.NewReader(r.Value)).Decode(&result)
+	if err != nil {
+		return reply, err
+	}
+	if result.Abort != "" {
+		reply.Err = fmt.Errorf("%w: %s", ErrTxnAborted, result.Abort)
+		return reply, nil
+	}
+	reply.OK = true
+	reply.Values = result.Values
+	return reply, nil
+}
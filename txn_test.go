@@ -0,0 +1,60 @@
+package paxi
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTransaction(t *testing.T) {
+	n := &node{StateMachine: NewDatabase()}
+	n.Execute(Command{Key: "a", Value: []byte("1")})
+
+	execute := func(cmds ...Command) TransactionReply {
+		cmd := Transaction{Commands: cmds}.Command()
+		reply, err := Reply{Command: cmd, Value: n.Execute(cmd)}.TransactionReply()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	reply := execute(
+		Command{Key: "a", Op: Increment},
+		Command{Key: "a", Op: Get},
+		Command{Key: "b", Op: CAS, Expect: nil, Value: []byte("x")},
+	)
+	if !reply.OK || !reply.Values[0].Equals([]byte("1")) || !reply.Values[1].Equals([]byte("2")) {
+		t.Errorf("unexpected transaction reply %+v", reply)
+	}
+	if v := n.StateMachine.(Database).Get("b"); !v.Equals([]byte("x")) {
+		t.Errorf("expect committed transaction to write b, got %q", v)
+	}
+
+	// failed CAS aborts every write of the transaction
+	reply = execute(
+		Command{Key: "a", Op: Delete},
+		Command{Key: "b", Op: CAS, Expect: []byte("y"), Value: []byte("z")},
+	)
+	if reply.OK || !errors.Is(reply.Err, ErrTxnAborted) {
+		t.Errorf("expect transaction to abort, got %+v", reply)
+	}
+	if v := n.StateMachine.(Database).Get("a"); !v.Equals([]byte("2")) {
+		t.Errorf("expect aborted transaction to keep a, got %q", v)
+	}
+}
+
+func TestTransactionConflict(t *testing.T) {
+	txn := Transaction{Commands: []Command{{Key: "a"}, {Key: "b", Value: []byte("v")}}}.Command()
+	read := Command{Key: "a"}
+	write := Command{Key: "b", Value: []byte("w")}
+	other := Command{Key: "c", Value: []byte("w")}
+	if Conflict(&txn, &read) {
+		t.Error("expect transaction reading a not to conflict with read of a")
+	}
+	if !Conflict(&txn, &write) || !Conflict(&write, &txn) {
+		t.Error("expect transaction writing b to conflict with write of b")
+	}
+	if Conflict(&txn, &other) {
+		t.Error("expect transaction not to conflict with command on other key")
+	}
+}
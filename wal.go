@@ -0,0 +1,416 @@
+package paxi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"pigpaxos/log"
+)
+
+// WALRecordType is the kind of acceptor state change stored in the write-ahead log
+type WALRecordType uint8
+
+const (
+	WALPromise WALRecordType = iota + 1 // promised ballot
+	WALAccept                           // accepted (slot, ballot, commands)
+	WALCommit                           // slot is known to be committed
+)
+
+const (
+	walSegmentSuffix = ".wal"
+	walSnapshotFile  = "snapshot"
+)
+
+// WALRecord is a single durable acceptor state change
+type WALRecord struct {
+	Type     WALRecordType
+	Slot     int
+	Ballot   Ballot
+	Commands []Command
+}
+
+func (r WALRecord) String() string {
+	return fmt.Sprintf("WALRecord {t=%d s=%d b=%v cmds=%v}", r.Type, r.Slot, r.Ballot, r.Commands)
+}
+
+// WAL is a write-ahead log for acceptor state.
+// Promise and Accept must return only after the record is durable,
+// so replies such as P1b and P2b can be sent right after them.
+type WAL interface {
+	// Promise persists the highest ballot this acceptor promised
+	Promise(b Ballot) error
+
+	// Accept persists commands accepted in slot with ballot b
+	Accept(slot int, b Ballot, cmds ...Command) error
+
+	// Commit records that slot is committed. It is never synced to disk,
+	// as a lost commit record is recovered with the usual P3/recover path
+	Commit(slot int) error
+
+	// Replay calls f for every record in the order it was written
+	Replay(f func(WALRecord)) error
+
+	// SaveSnapshot durably stores s and compacts the log. Records in keep are
+	// rewritten after the snapshot, every older record is discarded
+	SaveSnapshot(s Snapshot, keep ...WALRecord) error
+
+	// LoadSnapshot returns the last saved snapshot or nil if there is none
+	LoadSnapshot() (*Snapshot, error)
+
+	// Close flushes and closes the log
+	Close() error
+}
+
+// NewWAL returns the write-ahead log configured for node id.
+// Nodes without a configured WAL directory keep acceptor state in memory only
+func NewWAL(id ID) WAL {
+	if config.WALDir == "" {
+		return new(nullWAL)
+	}
+	w, err := OpenFileWAL(filepath.Join(config.WALDir, id.String()), config.WALSegmentSize, config.WALSync)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return w
+}
+
+// nullWAL is used when persistence is disabled, it only keeps the last snapshot in memory
+type nullWAL struct {
+	sync.RWMutex
+	snapshot *Snapshot
+}
+
+func (w *nullWAL) Promise(b Ballot) error                           { return nil }
+func (w *nullWAL) Accept(slot int, b Ballot, cmds ...Command) error { return nil }
+func (w *nullWAL) Commit(slot int) error                            { return nil }
+func (w *nullWAL) Replay(f func(WALRecord)) error                   { return nil }
+func (w *nullWAL) Close() error                                     { return nil }
+
+func (w *nullWAL) SaveSnapshot(s Snapshot, keep ...WALRecord) error {
+	w.Lock()
+	defer w.Unlock()
+	w.snapshot = &s
+	return nil
+}
+
+func (w *nullWAL) LoadSnapshot() (*Snapshot, error) {
+	w.RLock()
+	defer w.RUnlock()
+	return w.snapshot, nil
+}
+
+// fileWAL stores records in a directory of segment files.
+// Every record is framed as [length uint32][crc32 uint32][gob payload], so a torn
+// write at the tail of a segment is detected and skipped on replay
+type fileWAL struct {
+	sync.Mutex
+	dir         string
+	segmentSize int64
+	sync        bool
+
+	segment int // sequence number of the current segment
+	file    *os.File
+	w       *bufio.Writer
+	size    int64
+}
+
+// OpenFileWAL opens or creates segmented write-ahead log in dir.
+// New records always go into a fresh segment, older segments are only read by Replay
+func OpenFileWAL(dir string, segmentSize int64, sync bool) (WAL, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	w := &fileWAL{
+		dir:         dir,
+		segmentSize: segmentSize,
+		sync:        sync,
+	}
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		w.segment = segments[len(segments)-1]
+	}
+	err = w.roll()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *fileWAL) segmentPath(seq int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", seq, walSegmentSuffix))
+}
+
+// segments returns sequence numbers of all segment files in ascending order
+func (w *fileWAL) segments() ([]int, error) {
+	files, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]int, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(name, walSegmentSuffix))
+		if err != nil {
+			log.Errorf("skipping unknown file %s in wal directory %s", name, w.dir)
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// roll closes current segment and starts a new one
+func (w *fileWAL) roll() error {
+	if w.file != nil {
+		err := w.flush(true)
+		if err != nil {
+			return err
+		}
+		err = w.file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	w.segment++
+	file, err := os.OpenFile(w.segmentPath(w.segment), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.w = bufio.NewWriter(file)
+	w.size = 0
+	return nil
+}
+
+func (w *fileWAL) flush(sync bool) error {
+	err := w.w.Flush()
+	if err != nil {
+		return err
+	}
+	if sync {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+func (w *fileWAL) append(r WALRecord, sync bool) error {
+	w.Lock()
+	defer w.Unlock()
+	return w.write(r, sync)
+}
+
+// write appends one record to the current segment, should be called with the lock held
+func (w *fileWAL) write(r WALRecord, sync bool) error {
+	var payload bytes.Buffer
+	err := gob.NewEncoder(&payload).Encode(&r)
+	if err != nil {
+		return err
+	}
+
+	if w.file == nil {
+		return errors.New("wal is closed")
+	}
+	if w.segmentSize > 0 && w.size >= w.segmentSize {
+		err = w.roll()
+		if err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	_, err = w.w.Write(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(payload.Bytes())
+	if err != nil {
+		return err
+	}
+	w.size += int64(len(header) + payload.Len())
+	return w.flush(sync && w.sync)
+}
+
+func (w *fileWAL) Promise(b Ballot) error {
+	return w.append(WALRecord{Type: WALPromise, Ballot: b}, true)
+}
+
+func (w *fileWAL) Accept(slot int, b Ballot, cmds ...Command) error {
+	return w.append(WALRecord{Type: WALAccept, Slot: slot, Ballot: b, Commands: cmds}, true)
+}
+
+func (w *fileWAL) Commit(slot int) error {
+	return w.append(WALRecord{Type: WALCommit, Slot: slot}, false)
+}
+
+func (w *fileWAL) SaveSnapshot(s Snapshot, keep ...WALRecord) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.file == nil {
+		return errors.New("wal is closed")
+	}
+
+	// write snapshot to a temporary file and atomically replace the old one
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&s)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(w.dir, walSnapshotFile+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buf.Bytes())
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, filepath.Join(w.dir, walSnapshotFile))
+	if err != nil {
+		return err
+	}
+
+	// start a new segment with the records that are still needed and drop the rest
+	err = w.roll()
+	if err != nil {
+		return err
+	}
+	for _, r := range keep {
+		err = w.write(r, false)
+		if err != nil {
+			return err
+		}
+	}
+	err = w.flush(true)
+	if err != nil {
+		return err
+	}
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, seq := range segments {
+		if seq < w.segment {
+			err = os.Remove(w.segmentPath(seq))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *fileWAL) LoadSnapshot() (*Snapshot, error) {
+	w.Lock()
+	defer w.Unlock()
+	b, err := os.ReadFile(filepath.Join(w.dir, walSnapshotFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := new(Snapshot)
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (w *fileWAL) Replay(f func(WALRecord)) error {
+	w.Lock()
+	defer w.Unlock()
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, seq := range segments {
+		if seq == w.segment {
+			// current segment only has records written after opening
+			err = w.flush(false)
+			if err != nil {
+				return err
+			}
+		}
+		err = replaySegment(w.segmentPath(seq), f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySegment reads records from one segment file until its end or the first corrupted record
+func replaySegment(path string, f func(WALRecord)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	header := make([]byte, 8)
+	for {
+		_, err = io.ReadFull(r, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			log.Errorf("wal segment %s has a torn record header: %v", path, err)
+			return nil
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+		_, err = io.ReadFull(r, payload)
+		if err != nil || crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+			log.Errorf("wal segment %s has a corrupted record, ignoring rest of the segment", path)
+			return nil
+		}
+		var record WALRecord
+		err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&record)
+		if err != nil {
+			return err
+		}
+		f(record)
+	}
+}
+
+func (w *fileWAL) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.flush(true)
+	if err != nil {
+		return err
+	}
+	err = w.file.Close()
+	w.file = nil
+	return err
+}
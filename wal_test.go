@@ -0,0 +1,132 @@
+package paxi
+
+import (
+	"os"
+	"testing"
+)
+
+func TestFileWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenFileWAL(dir, 128, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBallot(1, NewID(1, 1))
+	cmd := Command{Key: "1", Value: []byte("v"), ClientID: NewID(1, 1), CommandID: 1}
+	for slot := 0; slot < 10; slot++ {
+		if err := w.Promise(b); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Accept(slot, b, cmd); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Commit(slot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// reopen and replay
+	w, err = OpenFileWAL(dir, 128, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	accepted := 0
+	committed := 0
+	err = w.Replay(func(r WALRecord) {
+		switch r.Type {
+		case WALAccept:
+			if r.Slot != accepted || r.Ballot != b || !r.Commands[0].Equal(cmd) {
+				t.Errorf("unexpected accept record %v", r)
+			}
+			accepted++
+		case WALCommit:
+			committed++
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted != 10 || committed != 10 {
+		t.Errorf("expected 10 accepted and 10 committed slots, got %d and %d", accepted, committed)
+	}
+}
+
+func TestFileWALTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenFileWAL(dir, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Promise(NewBallot(1, NewID(1, 1)))
+	w.Promise(NewBallot(2, NewID(1, 1)))
+	w.Close()
+
+	// chop off the tail of the last record
+	path := w.(*fileWAL).segmentPath(1)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = OpenFileWAL(dir, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var ballot Ballot
+	n := 0
+	w.Replay(func(r WALRecord) {
+		ballot = r.Ballot
+		n++
+	})
+	if n != 1 || ballot != NewBallot(1, NewID(1, 1)) {
+		t.Errorf("expected only first promise to survive, got %d records with ballot %v", n, ballot)
+	}
+}
+
+func TestFileWALSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenFileWAL(dir, 64, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBallot(1, NewID(1, 1))
+	cmd := Command{Key: "1", Value: []byte("v"), ClientID: NewID(1, 1), CommandID: 1}
+	for slot := 0; slot < 10; slot++ {
+		w.Accept(slot, b, cmd)
+	}
+	s := Snapshot{Slot: 8, Ballot: b, Data: []byte("state")}
+	err = w.SaveSnapshot(s, WALRecord{Type: WALPromise, Ballot: b}, WALRecord{Type: WALAccept, Slot: 9, Ballot: b, Commands: []Command{cmd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	w, err = OpenFileWAL(dir, 64, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	loaded, err := w.LoadSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded == nil || loaded.Slot != s.Slot || string(loaded.Data) != "state" {
+		t.Fatalf("expected %v, loaded %v", s, loaded)
+	}
+	var slots []int
+	w.Replay(func(r WALRecord) {
+		if r.Type == WALAccept {
+			slots = append(slots, r.Slot)
+		}
+	})
+	if len(slots) != 1 || slots[0] != 9 {
+		t.Errorf("expected only slot 9 after compaction, got %v", slots)
+	}
+}
@@ -0,0 +1,61 @@
+package paxi
+
+import "strings"
+
+// HashCommands returns hash of commands cmds in order
+func HashCommands(cmds []Command) string {
+	hashes := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		hashes[i] = cmd.Hash()
+	}
+	return strings.Join(hashes, ",")
+}
+
+// Compact drops commands of the slot and keeps only their hash. Witnesses compact slots every node executed
+func (e *Entry) Compact() {
+	if e.Hash != "" {
+		return
+	}
+	e.Hash = HashCommands(e.Commands)
+	e.Commands = nil
+}
+
+// Compacted returns true if the slot only keeps the hash of its commands
+func (e *Entry) Compacted() bool {
+	return e.Hash != ""
+}
+
+// Matches returns false if the slot only keeps the hash of its commands and cmds are different commands
+func (e *Entry) Matches(cmds []Command) bool {
+	return e.Hash == "" || e.Hash == HashCommands(cmds)
+}
+
+// CompactWitnessLog compacts committed slots of log in [from, to) of a witness. Once SnapshotInterval slots
+// after snapshot last are compacted, it saves a snapshot without state machine at slot to-1 with accepted slots
+// after it up to slot in w, removes hashes it covers from log and returns it. Otherwise it returns nil
+func CompactWitnessLog(w WAL, ballot Ballot, log map[int]*Entry, last *Snapshot, from, to, slot int) (*Snapshot, error) {
+	for s := from; s < to; s++ {
+		if e, exists := log[s]; exists && e.Commit {
+			e.Compact()
+		}
+	}
+	lastSlot := -1
+	if last != nil {
+		lastSlot = last.Slot
+	}
+	interval := GetConfig().SnapshotInterval
+	if interval == 0 || to-1-lastSlot < interval {
+		return nil, nil
+	}
+	s := &Snapshot{
+		Slot:   to - 1,
+		Ballot: ballot,
+	}
+	if err := w.SaveSnapshot(*s, WALRecords(ballot, log, s.Slot+1, slot)...); err != nil {
+		return nil, err
+	}
+	for i := lastSlot + 1; i <= s.Slot; i++ {
+		delete(log, i)
+	}
+	return s, nil
+}